@@ -0,0 +1,20 @@
+package cmd
+
+import "github.com/spf13/cobra"
+
+type certsCommand struct {
+	cmd *cobra.Command
+}
+
+func newCertsCommand() *certsCommand {
+	certsCommand := &certsCommand{}
+	certsCommand.cmd = &cobra.Command{
+		Use:   "certs",
+		Short: "Inspect TLS certificates",
+	}
+
+	certsCommand.cmd.AddCommand(newCertsCheckCommand().cmd)
+	certsCommand.cmd.AddCommand(newCertsStatusCommand().cmd)
+
+	return certsCommand
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"net/rpc"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type certsCheckCommand struct {
+	cmd  *cobra.Command
+	args server.CertsCheckArgs
+}
+
+func newCertsCheckCommand() *certsCheckCommand {
+	certsCheckCommand := &certsCheckCommand{}
+	certsCheckCommand.cmd = &cobra.Command{
+		Use:   "check",
+		Short: "Check for certificates that are close to expiry (exits non-zero if any are found)",
+		RunE:  certsCheckCommand.run,
+		Args:  cobra.NoArgs,
+	}
+
+	certsCheckCommand.cmd.Flags().DurationVar(&certsCheckCommand.args.Within, "within", server.DefaultCertExpiryWarning, "Report certificates that expire within this period")
+
+	return certsCheckCommand
+}
+
+func (c *certsCheckCommand) run(cmd *cobra.Command, args []string) error {
+	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
+		var response server.CertsCheckResponse
+
+		err := client.Call("kamal-proxy.CertsCheck", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		if len(response.Expiring) == 0 {
+			if jsonOutput {
+				c.displayResponse(response)
+			}
+			return nil
+		}
+
+		c.displayResponse(response)
+		return fmt.Errorf("%d certificate(s) expiring within %s", len(response.Expiring), c.args.Within)
+	})
+}
+
+func (c *certsCheckCommand) displayResponse(response server.CertsCheckResponse) {
+	if jsonOutput {
+		printJSON(response)
+		return
+	}
+
+	table := NewTable()
+	table.AddRow([]string{"Service", "Host", "Expires"})
+
+	for _, status := range response.Expiring {
+		table.AddRow([]string{status.Service, status.Host, status.NotAfter.Format(time.RFC3339)})
+	}
+
+	table.Print()
+}
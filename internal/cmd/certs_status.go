@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"net/rpc"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type certsStatusCommand struct {
+	cmd *cobra.Command
+}
+
+func newCertsStatusCommand() *certsStatusCommand {
+	certsStatusCommand := &certsStatusCommand{}
+	certsStatusCommand.cmd = &cobra.Command{
+		Use:   "status <service>",
+		Short: "Show the certificate state of each of a service's hosts",
+		RunE:  certsStatusCommand.run,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	return certsStatusCommand
+}
+
+func (c *certsStatusCommand) run(cmd *cobra.Command, args []string) error {
+	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
+		var response server.CertsStatusResponse
+
+		err := client.Call("kamal-proxy.CertsStatus", server.CertsStatusArgs{Service: args[0]}, &response)
+		if err != nil {
+			return err
+		}
+
+		c.displayResponse(response)
+		return nil
+	})
+}
+
+func (c *certsStatusCommand) displayResponse(response server.CertsStatusResponse) {
+	if jsonOutput {
+		printJSON(response)
+		return
+	}
+
+	table := NewTable()
+	table.AddRow([]string{"Host", "State", "Expires", "Error"})
+
+	for _, status := range response.Hosts {
+		expires := ""
+		if status.NotAfter != nil {
+			expires = status.NotAfter.Format(time.RFC3339)
+		}
+		table.AddRow([]string{status.Host, status.State, expires, status.LastError})
+	}
+
+	table.Print()
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"net/rpc"
+
+	"github.com/spf13/cobra"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type cloneCommand struct {
+	cmd  *cobra.Command
+	args server.CloneArgs
+}
+
+func newCloneCommand() *cloneCommand {
+	cloneCommand := &cloneCommand{}
+	cloneCommand.cmd = &cobra.Command{
+		Use:       "clone <service> <new-service>",
+		Short:     "Deploy a new service using the options of an existing one",
+		RunE:      cloneCommand.run,
+		Args:      cobra.ExactArgs(2),
+		ValidArgs: []string{"service", "new-service"},
+	}
+
+	cloneCommand.cmd.Flags().StringVar(&cloneCommand.args.TargetURL, "target", "", "Target host to deploy (defaults to the target of the existing service)")
+	cloneCommand.cmd.Flags().StringSliceVar(&cloneCommand.args.Hosts, "host", []string{}, "Host(s) to serve the new service on")
+	cloneCommand.cmd.Flags().DurationVar(&cloneCommand.args.DeployTimeout, "deploy-timeout", server.DefaultDeployTimeout, "Maximum time to wait for the new target to become healthy")
+	cloneCommand.cmd.Flags().DurationVar(&cloneCommand.args.DrainTimeout, "drain-timeout", server.DefaultDrainTimeout, "Maximum time to allow existing connections to drain before removing old target")
+
+	cloneCommand.cmd.MarkFlagRequired("host")
+
+	return cloneCommand
+}
+
+func (c *cloneCommand) run(cmd *cobra.Command, args []string) error {
+	c.args.Service = args[0]
+	c.args.NewService = args[1]
+
+	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
+		var response bool
+		err := client.Call("kamal-proxy.Clone", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("clone", c.args.NewService)
+		return nil
+	})
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"net/rpc"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -10,9 +11,16 @@ import (
 )
 
 type deployCommand struct {
-	cmd        *cobra.Command
-	args       server.DeployArgs
-	tlsStaging bool
+	cmd         *cobra.Command
+	args        server.DeployArgs
+	tlsStaging  bool
+	optionsFile string
+	dryRun      bool
+	dryRunProbe bool
+
+	operationRoutes      []string
+	domainRewrites       []string
+	autoStopErrorPercent float64
 }
 
 func newDeployCommand() *deployCommand {
@@ -26,37 +34,98 @@ func newDeployCommand() *deployCommand {
 		ValidArgs: []string{"service"},
 	}
 
-	deployCommand.cmd.Flags().StringVar(&deployCommand.args.TargetURL, "target", "", "Target host to deploy")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.TargetURL, "target", "", "Target host to deploy; a port on its own (:3000) keeps the current target's host, a container name without a port uses the port in its kamal-proxy.port label, and ;health=<path> or ;health-port=<port> suffixes change where this target's health is checked")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.StandbyTarget, "standby-target", "", "Standby target host to keep health checked, and send traffic to while the target is failing its health checks; takes the same ;health=<path> and ;health-port=<port> suffixes as --target")
 	deployCommand.cmd.Flags().StringSliceVar(&deployCommand.args.Hosts, "host", []string{}, "Host(s) to serve this target on (empty for wildcard)")
+	deployCommand.cmd.Flags().StringSliceVar(&deployCommand.args.ServiceOptions.AllowedHosts, "allowed-host", nil, "Reject requests whose Host header doesn't match one of these patterns, such as *.example.com (may be specified multiple times)")
+	deployCommand.cmd.Flags().StringSliceVar(&deployCommand.args.ServiceOptions.AllowedMethods, "allow-methods", nil, "Reject requests using other HTTP methods with 405 Method Not Allowed, such as GET,POST (default of empty means allow all)")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.ServiceOptions.DisableKeepAlive, "disable-keepalive", false, "Close HTTP/1 connections after each response, for clients that mishandle connection reuse")
+	deployCommand.cmd.Flags().Float64Var(&deployCommand.args.ServiceOptions.RateLimit, "rate-limit", 0, "Max requests per second from each client; requests over the limit get a 429 response (0 to disable)")
+	deployCommand.cmd.Flags().IntVar(&deployCommand.args.ServiceOptions.RateLimitBurst, "rate-limit-burst", 0, "Number of requests a client can make at once above the rate limit (default of 0 means the same as the rate)")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.RateLimitHeader, "rate-limit-header", "", "Tell clients apart for rate limiting by this request header, such as an API key header, rather than by IP address")
+	deployCommand.cmd.Flags().StringArrayVar(&deployCommand.args.ServiceOptions.Schedule, "schedule", nil, "Only serve requests during this window, such as \"Mon-Fri 09:00-17:00\", serving the stopped page outside of it (may be specified multiple times)")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.ScheduleTimezone, "schedule-timezone", "UTC", "Time zone for schedule windows, such as Europe/London")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.ScheduleMessage, "schedule-message", "", "Message to show on the stopped page outside of the schedule")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.ServiceOptions.AnswerOptions, "answer-options", false, "Respond to OPTIONS requests with the allowed methods, instead of passing them to the target (CORS preflight requests are still passed on; requires allow-methods)")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.ServiceOptions.MethodOverride, "method-override", false, "Send POST requests with an X-HTTP-Method-Override header of PUT, PATCH or DELETE to the target using that method instead")
 
 	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.ServiceOptions.TLSEnabled, "tls", false, "Configure TLS for this target (requires a non-empty host)")
 	deployCommand.cmd.Flags().BoolVar(&deployCommand.tlsStaging, "tls-staging", false, "Use Let's Encrypt staging environment for certificate provisioning")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.ACMEDirectory, "acme-directory", "", "ACME directory URL to provision certificates from (default Let's Encrypt)")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.ACMEEmail, "acme-email", "", "Contact email to register with the ACME provider")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.TLSDNSProvider, "tls-dns-provider", "", "Provision certificates with DNS challenges, which allow wildcard hosts, using this DNS provider: \"cloudflare\" or \"route53\" (credentials are read from the proxy's environment)")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.ServiceOptions.TLSInternalCA, "tls-internal-ca", false, "Issue certificates from the proxy's own CA, for internal hosts under .internal, .home.arpa, .local or .test that ACME can't verify (clients must be given the CA certificate to trust)")
 	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.TLSCertificatePath, "tls-certificate-path", "", "Configure custom TLS certificate path (PEM format)")
 	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.TLSPrivateKeyPath, "tls-private-key-path", "", "Configure custom TLS private key path (PEM format)")
 	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.ServiceOptions.TLSDisableRedirect, "tls-disable-redirect", false, "Don't redirect HTTP traffic to HTTPS")
+	deployCommand.cmd.Flags().StringSliceVar(&deployCommand.args.ServiceOptions.TLSRedirectExceptions, "tls-redirect-except", nil, "Host pattern (such as internal.example.com) or path (such as /healthz, or /.well-known/* for a prefix) to serve over plain HTTP instead of redirecting to HTTPS (may be specified multiple times)")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.ServiceOptions.TLSFingerprint, "tls-fingerprint", false, "Send the client's JA3 and JA4 TLS fingerprints to the target in X-JA3-Fingerprint and X-JA4-Fingerprint headers")
+
+	deployCommand.cmd.Flags().Float64Var(&deployCommand.autoStopErrorPercent, "auto-stop-error-rate", 0, "Stop the service when this percentage of its responses are server errors for the whole of auto-stop-window (0 to disable)")
+	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.ServiceOptions.AutoStopWindow, "auto-stop-window", server.DefaultAutoStopWindow, "How long the error rate must stay over auto-stop-error-rate before the service is stopped")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.AutoStopMessage, "auto-stop-message", "", "Message to show while the service is stopped for exceeding its error rate")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.AutoStopWebhook, "auto-stop-webhook", "", "URL to POST a JSON event to when the service is stopped for exceeding its error rate")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.ServiceOptions.FailHealthChecksWhilePaused, "fail-health-checks-while-paused", false, "Respond to health checks with 503 while the service is paused or stopped, so that an upstream load balancer moves traffic elsewhere")
 
 	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.DeployTimeout, "deploy-timeout", server.DefaultDeployTimeout, "Maximum time to wait for the new target to become healthy")
 	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.DrainTimeout, "drain-timeout", server.DefaultDrainTimeout, "Maximum time to allow existing connections to drain before removing old target")
+	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.UploadDrainTimeout, "upload-drain-timeout", 0, "Maximum time to allow requests that are still uploading their body to drain, when longer than drain-timeout (default of 0 means use drain-timeout)")
 	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.HealthCheckConfig.Interval, "health-check-interval", server.DefaultHealthCheckInterval, "Interval between health checks")
 	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.HealthCheckConfig.Timeout, "health-check-timeout", server.DefaultHealthCheckTimeout, "Time each health check must complete in")
 	deployCommand.cmd.Flags().StringVar(&deployCommand.args.TargetOptions.HealthCheckConfig.Path, "health-check-path", server.DefaultHealthCheckPath, "Path to check for health")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.TargetOptions.HealthCheckConfig.Host, "health-check-host", "", "Host header to send with health checks, when the target serves them on a different host to the service")
+	deployCommand.cmd.Flags().StringArrayVar(&deployCommand.args.TargetOptions.HealthCheckConfig.Headers, "health-check-header", nil, "Header to send with health checks, as \"Name: value\" (may be specified multiple times)")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.TargetOptions.HealthCheckConfig.ServerName, "health-check-server-name", "", "Server name to send as the SNI of health checks (requires target-tls)")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.HealthCheckConfig.LogChecks, "log-health-checks", false, "Log the result of every health check, and an hourly summary per target")
 
 	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.ResponseTimeout, "target-timeout", server.DefaultTargetTimeout, "Maximum time to wait for the target server to respond when serving requests")
+	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.MaxResponseTimeout, "max-target-timeout", 0, "Allow the target to extend target-timeout for a request, up to this long, by sending an interim response with an X-Kamal-Timeout header in seconds")
+	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.StreamIdleTimeout, "stream-idle-timeout", 0, "Maximum time a response body may go without sending data before it is closed (default of 0 means no limit)")
+	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.WebSocketHandshakeTimeout, "websocket-handshake-timeout", 0, "Maximum time to wait for the target to accept a WebSocket connection (default of 0 means use target-timeout)")
+	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.WebSocketIdleTimeout, "websocket-idle-timeout", 0, "Close WebSocket connections that have had no traffic in either direction for this long (default of 0 means no limit)")
+	deployCommand.cmd.Flags().IntVar(&deployCommand.args.TargetOptions.WebSocketDrainCloseCode, "websocket-drain-close-code", 0, "WebSocket close code to send clients when their connection is closed by a deploy, such as 1012 for Service Restart (default of 0 means close without one)")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.ForwardDeadline, "forward-deadline", false, "Send an X-Request-Deadline header to the target with the time at which the proxy will stop waiting for a response, before any extension allowed by max-target-timeout")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.ForwardConnectionInfo, "forward-connection-info", false, "Send the client's negotiated protocol and estimated round-trip time to the target in X-Kamal-Proto and X-Kamal-Client-RTT headers")
+	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.RefusedRetryDelay, "refused-retry-delay", 0, "If the target refuses a connection, wait this long and try once more (default of 0 means no retry)")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.TargetOptions.SigningKeyFile, "signing-key-file", "", "File on the proxy's host of HMAC keys, one per line, to sign requests to the target with in an X-Kamal-Signature header (list more than one to rotate keys)")
+	deployCommand.cmd.Flags().IntVar(&deployCommand.args.TargetOptions.WarmConnections, "warm-connections", 0, "Number of connections to open to the target once it is healthy, before sending it traffic")
+	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.UpstreamConnMaxLifetime, "upstream-conn-max-lifetime", 0, "Stop reusing connections to the target once they are this old (default of 0 means no limit)")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.TargetOptions.SourceAddress, "source-address", "", "Local IP address or interface name to connect to the target from")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.TargetTLS, "target-tls", false, "Connect to the target over HTTPS, including for health checks")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.TargetOptions.TargetTLSCA, "target-tls-ca", "", "Path to a PEM bundle of CA certificates to verify the target's certificate with, instead of the system roots (requires target-tls)")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.TargetTLSInsecure, "target-tls-insecure", false, "Don't verify the target's certificate, such as when it's self-signed (requires target-tls)")
 
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.DecompressResponses, "decompress-responses", false, "Decompress gzipped responses for clients that don't accept gzip")
 	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.BufferRequests, "buffer-requests", false, "Buffer requests before forwarding to target")
 	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.BufferResponses, "buffer-responses", false, "Buffer responses before forwarding to client")
+	deployCommand.cmd.Flags().StringVar(&deployCommand.args.TargetOptions.BufferingOverrideTokenFile, "buffering-override-token-file", "", "File on the proxy's host containing a token; requests with it in X-Kamal-Buffering-Token can disable response buffering by sending X-Kamal-Buffering: off")
+	deployCommand.cmd.Flags().StringSliceVar(&deployCommand.args.TargetOptions.BufferingOverrideNetworks, "buffering-override-from", nil, "Allow requests from these IP addresses or CIDR ranges to disable response buffering by sending X-Kamal-Buffering: off")
+	deployCommand.cmd.Flags().DurationVar(&deployCommand.args.TargetOptions.BufferFlushTimeout, "buffer-flush-timeout", 0, "Stream a buffered response instead if it's still incomplete this long after its headers arrive, or if the target ends it by closing the connection, as long-polling endpoints may (default of 0 means always buffer)")
 	deployCommand.cmd.Flags().Int64Var(&deployCommand.args.TargetOptions.MaxMemoryBufferSize, "buffer-memory", server.DefaultMaxMemoryBufferSize, "Max size of memory buffer")
 	deployCommand.cmd.Flags().Int64Var(&deployCommand.args.TargetOptions.MaxRequestBodySize, "max-request-body", server.DefaultMaxRequestBodySize, "Max size of request body when buffering (default of 0 means unlimited)")
 	deployCommand.cmd.Flags().Int64Var(&deployCommand.args.TargetOptions.MaxResponseBodySize, "max-response-body", server.DefaultMaxResponseBodySize, "Max size of response body when buffering (default of 0 means unlimited)")
 	deployCommand.cmd.Flags().StringVar(&deployCommand.args.ServiceOptions.ErrorPagePath, "error-pages", "", "Path to custom error pages")
+	deployCommand.cmd.Flags().StringSliceVar(&deployCommand.domainRewrites, "rewrite-domain", nil, "Rewrite a domain the target thinks it's served on, in cookie domains and redirect locations, as <domain>=<new domain> or just <domain> to use the request's host (may be specified multiple times)")
+	deployCommand.cmd.Flags().StringSliceVar(&deployCommand.operationRoutes, "route-operation", nil, "Route GraphQL operations matching a name pattern to another service, as <operation>=<service> (requires request buffering; may be specified multiple times)")
 
 	deployCommand.cmd.Flags().StringSliceVar(&deployCommand.args.TargetOptions.LogRequestHeaders, "log-request-header", nil, "Additional request header to log (may be specified multiple times)")
 	deployCommand.cmd.Flags().StringSliceVar(&deployCommand.args.TargetOptions.LogResponseHeaders, "log-response-header", nil, "Additional response header to log (may be specified multiple times)")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.StripServerHeaders, "strip-server-headers", false, "Remove headers that identify the target's software, such as Server, X-Powered-By and X-Runtime, from responses")
+	deployCommand.cmd.Flags().StringSliceVar(&deployCommand.args.TargetOptions.StripResponseHeaders, "strip-response-header", nil, "Response header to remove before sending responses to the client (may be specified multiple times)")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.ExposeUpstreamErrors, "expose-upstream-errors", false, "Add an X-Kamal-Upstream-Error header to error responses saying why the target couldn't be reached (not recommended in production)")
+	deployCommand.cmd.Flags().IntVar(&deployCommand.args.ServiceOptions.HostGroupLimit, "log-host-groups", 0, "Log the part of the host matched by a wildcard as host_group, for up to this many distinct values; the rest are logged as _other (default of 0 means disabled)")
 
 	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.TargetOptions.ForwardHeaders, "forward-headers", false, "Forward X-Forwarded headers to target (default false if TLS enabled; otherwise true)")
 
+	deployCommand.cmd.Flags().StringVar(&deployCommand.optionsFile, "options-file", "", "File to read default deploy options from (defaults to the service's file in the config directory, if present)")
+
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.args.Force, "force", false, "Deploy the target without waiting for it to pass a health check (for emergencies, when the health check is broken but the application works)")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.dryRun, "dry-run", false, "Validate the deployment and show what would change, without applying it")
+	deployCommand.cmd.Flags().BoolVar(&deployCommand.dryRunProbe, "dry-run-health-check", false, "Check the target's health once as part of a dry run")
+
 	deployCommand.cmd.MarkFlagRequired("target")
 	deployCommand.cmd.MarkFlagsRequiredTogether("tls-certificate-path", "tls-private-key-path")
+	deployCommand.cmd.MarkFlagsMutuallyExclusive("tls-staging", "acme-directory")
 
 	return deployCommand
 }
@@ -72,23 +141,47 @@ func (c *deployCommand) run(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	if c.dryRun {
+		return c.runDryRun()
+	}
+
 	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
 		var response bool
-		return client.Call("kamal-proxy.Deploy", c.args, &response)
+		err := client.Call("kamal-proxy.Deploy", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("deploy", c.args.Service)
+		return nil
 	})
 }
 
-func (c *deployCommand) preRun(cmd *cobra.Command, args []string) error {
-	if cmd.Flags().Changed("max-request-body") && !cmd.Flags().Changed("buffer-requests") {
-		return fmt.Errorf("max-request-body can only be set when request buffering is enabled")
-	}
+func (c *deployCommand) runDryRun() error {
+	args := server.PlanDeployArgs{DeployArgs: c.args, ProbeTarget: c.dryRunProbe}
+
+	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
+		var plan server.ChangePlan
+
+		err := client.Call("kamal-proxy.PlanDeploy", args, &plan)
+		if err != nil {
+			return err
+		}
+
+		printChangePlan(plan)
+		return nil
+	})
+}
 
-	if cmd.Flags().Changed("max-response-body") && !cmd.Flags().Changed("buffer-responses") {
-		return fmt.Errorf("max-response-body can only be set when response buffering is enabled")
+func (c *deployCommand) preRun(cmd *cobra.Command, args []string) error {
+	err := c.applyDefaultOptions(cmd, args[0])
+	if err != nil {
+		return err
 	}
 
-	if cmd.Flags().Changed("tls") && !cmd.Flags().Changed("host") {
-		return fmt.Errorf("host must be set when using TLS")
+	err = c.validate(cmd)
+	if err != nil {
+		return err
 	}
 
 	if !cmd.Flags().Changed("forward-headers") {
@@ -97,3 +190,170 @@ func (c *deployCommand) preRun(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+func (c *deployCommand) validate(cmd *cobra.Command) error {
+	var v validator
+	flags := cmd.Flags()
+	options := c.args.ServiceOptions
+	hasCustomCert := options.TLSCertificatePath != ""
+
+	v.checkHosts(c.args.Hosts)
+
+	baseHealthCheck := c.args.TargetOptions.HealthCheckConfig
+
+	target, healthCheck, err := server.ParseTargetHealthCheck(c.args.TargetURL, baseHealthCheck)
+	v.check(err == nil, exitCodeInvalidOption, "invalid target %q: %v", c.args.TargetURL, err)
+	c.args.TargetURL, c.args.TargetOptions.HealthCheckConfig = target, healthCheck
+
+	if options.StandbyTarget != "" {
+		standby, standbyHealthCheck, err := server.ParseTargetHealthCheck(options.StandbyTarget, baseHealthCheck)
+		v.check(err == nil, exitCodeInvalidOption, "invalid standby-target %q: %v", options.StandbyTarget, err)
+		c.args.ServiceOptions.StandbyTarget, c.args.ServiceOptions.StandbyHealthCheckConfig = standby, &standbyHealthCheck
+	}
+
+	v.check(!options.TLSEnabled || len(c.args.Hosts) > 0, exitCodeTLSRequiresHost,
+		"host must be set when using TLS")
+
+	if options.TLSEnabled && !hasCustomCert && options.TLSDNSProvider == "" && !options.TLSInternalCA {
+		for _, host := range c.args.Hosts {
+			v.check(!strings.HasPrefix(host, "*."), exitCodeTLSWildcard,
+				"automatic TLS does not support wildcard host %q (use a custom certificate, tls-dns-provider or tls-internal-ca instead)", host)
+		}
+	}
+
+	if options.TLSDNSProvider != "" {
+		_, err := server.NewDNSProvider(options.TLSDNSProvider)
+		v.check(err == nil, exitCodeInvalidOption, "invalid tls-dns-provider %q: %v", options.TLSDNSProvider, err)
+		v.check(options.TLSEnabled && !hasCustomCert, exitCodeInvalidOption,
+			"tls-dns-provider can only be set when using automatic TLS")
+	}
+
+	v.check(!options.TLSInternalCA || (options.TLSEnabled && !hasCustomCert && options.TLSDNSProvider == ""), exitCodeInvalidOption,
+		"tls-internal-ca can only be set when using automatic TLS, without tls-dns-provider")
+
+	v.check(!options.TLSFingerprint || options.TLSEnabled, exitCodeInvalidOption,
+		"tls-fingerprint can only be set when TLS is enabled")
+
+	v.check(!flags.Changed("max-request-body") || c.args.TargetOptions.BufferRequests, exitCodeConflictingBuffer,
+		"max-request-body can only be set when request buffering is enabled")
+	v.check(!flags.Changed("buffer-flush-timeout") || c.args.TargetOptions.BufferResponses, exitCodeConflictingBuffer,
+		"buffer-flush-timeout can only be set when response buffering is enabled")
+	v.check(!flags.Changed("max-response-body") || c.args.TargetOptions.BufferResponses, exitCodeConflictingBuffer,
+		"max-response-body can only be set when response buffering is enabled")
+
+	c.args.ServiceOptions.OperationRoutes = nil
+	for _, value := range c.operationRoutes {
+		route, err := server.ParseOperationRoute(value)
+		v.check(err == nil, exitCodeInvalidOption, "invalid operation route %q: %v", value, err)
+		if err == nil {
+			c.args.ServiceOptions.OperationRoutes = append(c.args.ServiceOptions.OperationRoutes, route)
+		}
+	}
+	v.check(len(c.operationRoutes) == 0 || c.args.TargetOptions.BufferRequests, exitCodeConflictingBuffer,
+		"route-operation can only be set when request buffering is enabled")
+
+	v.check(c.args.TargetOptions.MaxResponseTimeout == 0 || c.args.TargetOptions.MaxResponseTimeout > c.args.TargetOptions.ResponseTimeout, exitCodeInvalidOption,
+		"max-target-timeout must be longer than target-timeout")
+
+	v.check(c.args.TargetOptions.WarmConnections >= 0 && c.args.TargetOptions.WarmConnections <= server.MaxIdleConnsPerHost, exitCodeInvalidOption,
+		"warm-connections must be between 0 and %d", server.MaxIdleConnsPerHost)
+
+	for _, value := range c.args.TargetOptions.BufferingOverrideNetworks {
+		_, err := server.ParseTrustedNetwork(value)
+		v.check(err == nil, exitCodeInvalidOption, "invalid address %q in buffering-override-from: %v", value, err)
+	}
+	v.check((c.args.TargetOptions.BufferingOverrideTokenFile == "" && len(c.args.TargetOptions.BufferingOverrideNetworks) == 0) || c.args.TargetOptions.BufferResponses, exitCodeConflictingBuffer,
+		"buffering-override-token-file and buffering-override-from can only be set when response buffering is enabled")
+
+	for i, value := range c.args.ServiceOptions.TLSRedirectExceptions {
+		exception, err := server.ParseTLSRedirectException(value)
+		v.check(err == nil, exitCodeInvalidOption, "invalid exception %q in tls-redirect-except: %v", value, err)
+		c.args.ServiceOptions.TLSRedirectExceptions[i] = exception
+	}
+	v.check(len(c.args.ServiceOptions.TLSRedirectExceptions) == 0 || (c.args.ServiceOptions.TLSEnabled && !c.args.ServiceOptions.TLSDisableRedirect), exitCodeInvalidOption,
+		"tls-redirect-except can only be used with tls, and without tls-disable-redirect")
+
+	for i, value := range c.args.ServiceOptions.AllowedMethods {
+		method, err := server.ParseAllowedMethod(value)
+		v.check(err == nil, exitCodeInvalidOption, "invalid method %q in allow-methods", value)
+		c.args.ServiceOptions.AllowedMethods[i] = method
+	}
+	v.check(!c.args.ServiceOptions.AnswerOptions || len(c.args.ServiceOptions.AllowedMethods) > 0, exitCodeInvalidOption,
+		"answer-options can only be used with allow-methods")
+
+	v.check(c.autoStopErrorPercent >= 0 && c.autoStopErrorPercent <= 100, exitCodeInvalidOption,
+		"auto-stop-error-rate must be between 0 and 100")
+	v.check(c.autoStopErrorPercent > 0 || !(flags.Changed("auto-stop-window") || flags.Changed("auto-stop-message") || flags.Changed("auto-stop-webhook")), exitCodeInvalidOption,
+		"auto-stop-window, auto-stop-message and auto-stop-webhook can only be set with auto-stop-error-rate")
+	v.check(c.args.ServiceOptions.AutoStopWindow > 0, exitCodeInvalidOption,
+		"auto-stop-window must be positive")
+	c.args.ServiceOptions.AutoStopErrorRate = c.autoStopErrorPercent / 100
+
+	v.check(c.args.ServiceOptions.RateLimit >= 0, exitCodeInvalidOption,
+		"rate-limit must not be negative")
+	v.check(c.args.ServiceOptions.RateLimitBurst >= 0, exitCodeInvalidOption,
+		"rate-limit-burst must not be negative")
+	v.check(c.args.ServiceOptions.RateLimit > 0 || !(flags.Changed("rate-limit-burst") || flags.Changed("rate-limit-header")), exitCodeInvalidOption,
+		"rate-limit-burst and rate-limit-header can only be set with rate-limit")
+
+	if len(c.args.ServiceOptions.Schedule) > 0 {
+		_, err := server.ParseServiceSchedule(c.args.ServiceOptions.Schedule, c.args.ServiceOptions.ScheduleTimezone)
+		v.check(err == nil, exitCodeInvalidOption, "invalid schedule: %v", err)
+	}
+	v.check(len(c.args.ServiceOptions.Schedule) > 0 || !(flags.Changed("schedule-timezone") || flags.Changed("schedule-message")), exitCodeInvalidOption,
+		"schedule-timezone and schedule-message can only be set with schedule")
+
+	v.check(c.args.ServiceOptions.HostGroupLimit >= 0, exitCodeInvalidOption,
+		"log-host-groups must not be negative")
+
+	v.check(c.args.TargetOptions.TargetTLS || (c.args.TargetOptions.TargetTLSCA == "" && !c.args.TargetOptions.TargetTLSInsecure), exitCodeInvalidOption,
+		"target-tls-ca and target-tls-insecure can only be used with target-tls")
+	v.check(c.args.TargetOptions.TargetTLSCA == "" || !c.args.TargetOptions.TargetTLSInsecure, exitCodeInvalidOption,
+		"target-tls-ca and target-tls-insecure cannot be used together")
+
+	for _, value := range c.args.TargetOptions.HealthCheckConfig.Headers {
+		_, _, err := server.ParseHealthCheckHeader(value)
+		v.check(err == nil, exitCodeInvalidOption, "invalid header %q in health-check-header", value)
+	}
+	v.check(c.args.TargetOptions.HealthCheckConfig.ServerName == "" || c.args.TargetOptions.TargetTLS, exitCodeInvalidOption,
+		"health-check-server-name can only be used with target-tls")
+
+	v.check(c.args.TargetOptions.WebSocketDrainCloseCode == 0 || server.IsValidWebSocketDrainCloseCode(c.args.TargetOptions.WebSocketDrainCloseCode), exitCodeInvalidOption,
+		"websocket-drain-close-code must be a close code between 1000 and 4999 that can be sent to clients")
+
+	c.args.TargetOptions.DomainRewrites = nil
+	for _, value := range c.domainRewrites {
+		rewrite, err := server.ParseDomainRewrite(value)
+		v.check(err == nil, exitCodeInvalidOption, "invalid domain rewrite %q: %v", value, err)
+		if err == nil {
+			c.args.TargetOptions.DomainRewrites = append(c.args.TargetOptions.DomainRewrites, rewrite)
+		}
+	}
+
+	v.check(!c.dryRunProbe || c.dryRun, exitCodeInvalidOption,
+		"dry-run-health-check can only be used with dry-run")
+
+	return v.err()
+}
+
+// applyDefaultOptions fills in any flags that weren't given on the command
+// line, first from the service's options file and then from the
+// KAMAL_PROXY_DEPLOY_OPTS environment variable.
+func (c *deployCommand) applyDefaultOptions(cmd *cobra.Command, service string) error {
+	optionsFile := c.optionsFile
+	if optionsFile == "" {
+		optionsFile = globalConfig.DeployOptionsPath(service)
+	}
+
+	fileOptions, err := readOptionsFile(optionsFile, c.optionsFile != "")
+	if err != nil {
+		return fmt.Errorf("unable to read options file: %w", err)
+	}
+
+	envOptions, err := splitOptions(getEnvString("DEPLOY_OPTS", ""))
+	if err != nil {
+		return fmt.Errorf("unable to read deploy options from the environment: %w", err)
+	}
+
+	return applyFlagDefaults(cmd, fileOptions, envOptions)
+}
@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeployCommand_ScheduleWithDayList(t *testing.T) {
+	deploy := newDeployCommand()
+	require.NoError(t, deploy.cmd.ParseFlags([]string{
+		"--target", "localhost:3000",
+		"--schedule", "Sat,Sun 10:00-14:00",
+		"--schedule", "Mon-Fri 09:00-17:00",
+	}))
+
+	require.NoError(t, deploy.validate(deploy.cmd))
+	assert.Equal(t, []string{"Sat,Sun 10:00-14:00", "Mon-Fri 09:00-17:00"}, deploy.args.ServiceOptions.Schedule)
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"net/rpc"
+
+	"github.com/spf13/cobra"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type doctorCommand struct {
+	cmd *cobra.Command
+}
+
+func newDoctorCommand() *doctorCommand {
+	doctorCommand := &doctorCommand{}
+	doctorCommand.cmd = &cobra.Command{
+		Use:   "doctor",
+		Short: "Check a running proxy for common problems (exits non-zero if any errors are found)",
+		RunE:  doctorCommand.run,
+		Args:  cobra.NoArgs,
+	}
+
+	return doctorCommand
+}
+
+func (c *doctorCommand) run(cmd *cobra.Command, args []string) error {
+	var response server.DoctorResponse
+
+	err := withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
+		return client.Call("kamal-proxy.Doctor", true, &response)
+	})
+	if err != nil {
+		// Nothing else can be checked without the proxy, so this is the only
+		// problem there is to report.
+		response.Problems = []server.DoctorProblem{{
+			Severity: server.DoctorSeverityError,
+			Check:    "socket",
+			Message:  fmt.Sprintf("unable to reach the proxy at %s: %v", globalConfig.SocketPath(), err),
+		}}
+	}
+
+	c.displayResponse(response)
+
+	errors := 0
+	for _, problem := range response.Problems {
+		if problem.Severity == server.DoctorSeverityError {
+			errors++
+		}
+	}
+	if errors > 0 {
+		return fmt.Errorf("%d error(s) found", errors)
+	}
+
+	return nil
+}
+
+func (c *doctorCommand) displayResponse(response server.DoctorResponse) {
+	if jsonOutput {
+		printJSON(response)
+		return
+	}
+
+	if len(response.Problems) == 0 {
+		fmt.Println("No problems found")
+		return
+	}
+
+	table := NewTable()
+	table.AddRow([]string{"Severity", "Check", "Problem"})
+
+	for _, problem := range response.Problems {
+		table.AddRow([]string{problem.Severity.String(), problem.Check, problem.Message})
+	}
+
+	table.Print()
+}
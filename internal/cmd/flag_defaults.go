@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// applyFlagDefaults sets flags from each source of default options in turn.
+// Options use the same format as they would on the command line. Flags that
+// were set explicitly take precedence over any defaults, and earlier sources
+// take precedence over later ones.
+func applyFlagDefaults(cmd *cobra.Command, sources ...[]string) error {
+	alreadySet := map[string]bool{}
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		alreadySet[flag.Name] = true
+	})
+
+	for _, options := range sources {
+		applied, err := applyFlagOptions(cmd, options, alreadySet)
+		if err != nil {
+			return err
+		}
+		maps.Copy(alreadySet, applied)
+	}
+
+	return nil
+}
+
+func applyFlagOptions(cmd *cobra.Command, options []string, skip map[string]bool) (map[string]bool, error) {
+	applied := map[string]bool{}
+
+	for i := 0; i < len(options); i++ {
+		option := options[i]
+		if !strings.HasPrefix(option, "--") {
+			return nil, fmt.Errorf("invalid default option: %s", option)
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(option, "--"), "=")
+
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil {
+			return nil, fmt.Errorf("unknown default option: --%s", name)
+		}
+
+		if !hasValue {
+			if flag.NoOptDefVal != "" {
+				value = flag.NoOptDefVal
+			} else if i+1 < len(options) {
+				i++
+				value = options[i]
+			} else {
+				return nil, fmt.Errorf("default option --%s requires a value", name)
+			}
+		}
+
+		if skip[name] {
+			continue
+		}
+
+		err := cmd.Flags().Set(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default option --%s: %w", name, err)
+		}
+		applied[name] = true
+	}
+
+	return applied, nil
+}
+
+var errUnterminatedOption = errors.New("unterminated quote or escape")
+
+// readOptionsFile loads default options from a file. Options may be split
+// across lines, and lines starting with # are ignored.
+func readOptionsFile(path string, required bool) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !required && errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return splitOptions(string(data))
+}
+
+// splitOptions splits options the way a shell would split arguments. Values
+// containing spaces can be quoted with single or double quotes, and a
+// backslash escapes the character after it, except inside single quotes.
+// Inside double quotes, only quotes and backslashes can be escaped.
+func splitOptions(s string) ([]string, error) {
+	options := []string{}
+
+	var current strings.Builder
+	var quote rune
+	inOption := false
+	inComment := false
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case inComment:
+			if r == '\n' {
+				inComment = false
+			}
+		case escaped:
+			escaped = false
+			if quote == 0 && r == '\n' {
+				break // A line continuation
+			}
+			if quote == '"' && r != '"' && r != '\\' {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(r)
+			inOption = true
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inOption = true
+		case r == '#' && !inOption:
+			inComment = true
+		case unicode.IsSpace(r):
+			if inOption {
+				options = append(options, current.String())
+				current.Reset()
+				inOption = false
+			}
+		default:
+			current.WriteRune(r)
+			inOption = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, errUnterminatedOption
+	}
+	if inOption {
+		options = append(options, current.String())
+	}
+
+	return options, nil
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitOptions(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected []string
+	}{
+		"empty":                       {"", []string{}},
+		"whitespace only":             {" \n\t ", []string{}},
+		"flags and values":            {"--buffer-requests --target-timeout 60s", []string{"--buffer-requests", "--target-timeout", "60s"}},
+		"split across lines":          {"--target-timeout\n  60s\n--buffer-requests\n", []string{"--target-timeout", "60s", "--buffer-requests"}},
+		"double quotes":               {`--schedule "Mon-Fri 09:00-17:00"`, []string{"--schedule", "Mon-Fri 09:00-17:00"}},
+		"single quotes":               {`--schedule 'Mon-Fri 09:00-17:00'`, []string{"--schedule", "Mon-Fri 09:00-17:00"}},
+		"quotes within an option":     {`--schedule="Sat,Sun 10:00-14:00"`, []string{"--schedule=Sat,Sun 10:00-14:00"}},
+		"empty quotes":                {`--health-check-host ""`, []string{"--health-check-host", ""}},
+		"other quote inside quotes":   {`--stop-message "It's closed" 'say "hi"'`, []string{"--stop-message", "It's closed", `say "hi"`}},
+		"escaped space":               {`--error-pages /srv/error\ pages`, []string{"--error-pages", "/srv/error pages"}},
+		"escaped quote":               {`--message \"quoted\"`, []string{"--message", `"quoted"`}},
+		"escapes in double quotes":    {`"a \"b\" \\ \n"`, []string{`a "b" \ \n`}},
+		"no escapes in single quotes": {`'a\b'`, []string{`a\b`}},
+		"line continuation":           {"--target-timeout \\\n 60s", []string{"--target-timeout", "60s"}},
+		"comment lines":               {"# defaults\n--buffer-requests\n  # indented\n--forward-headers", []string{"--buffer-requests", "--forward-headers"}},
+		"comment after an option":     {"--buffer-requests # always\n--forward-headers", []string{"--buffer-requests", "--forward-headers"}},
+		"hash within an option":       {"--health-check-path /up#anchor", []string{"--health-check-path", "/up#anchor"}},
+		"hash within quotes":          {`--stop-message "# not a comment"`, []string{"--stop-message", "# not a comment"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			options, err := splitOptions(tc.input)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, options)
+		})
+	}
+}
+
+func TestSplitOptions_Unterminated(t *testing.T) {
+	for _, input := range []string{
+		`--schedule "Mon-Fri 09:00-17:00`,
+		`--schedule 'Mon-Fri`,
+		`--stop-message "closed\"`,
+		`--error-pages /srv/errors\`,
+	} {
+		_, err := splitOptions(input)
+		assert.ErrorIs(t, err, errUnterminatedOption, input)
+	}
+}
+
+func TestApplyDefaultOptions_Precedence(t *testing.T) {
+	optionsFile := filepath.Join(t.TempDir(), "app.opts")
+	require.NoError(t, os.WriteFile(optionsFile, []byte(`
+		--target-timeout 20s
+		--health-check-path /file
+		--drain-timeout 20s
+	`), 0o600))
+
+	t.Setenv("KAMAL_PROXY_DEPLOY_OPTS", "--target-timeout 30s --health-check-path /env --deploy-timeout 30s --buffer-requests")
+
+	deploy := newDeployCommand()
+	require.NoError(t, deploy.cmd.ParseFlags([]string{
+		"--target", "localhost:3000",
+		"--options-file", optionsFile,
+		"--target-timeout", "10s",
+	}))
+	require.NoError(t, deploy.applyDefaultOptions(deploy.cmd, "app"))
+
+	assert.Equal(t, 10*time.Second, deploy.args.TargetOptions.ResponseTimeout, "command line wins over the file and environment")
+	assert.Equal(t, "/file", deploy.args.TargetOptions.HealthCheckConfig.Path, "file wins over the environment")
+	assert.Equal(t, 20*time.Second, deploy.args.DrainTimeout, "file applies when not given on the command line")
+	assert.Equal(t, 30*time.Second, deploy.args.DeployTimeout, "environment applies when given nowhere else")
+	assert.True(t, deploy.args.TargetOptions.BufferRequests)
+}
+
+func TestApplyDefaultOptions_Errors(t *testing.T) {
+	dir := t.TempDir()
+
+	deploy := newDeployCommand()
+	require.NoError(t, deploy.cmd.ParseFlags([]string{"--target", "localhost:3000", "--options-file", filepath.Join(dir, "missing.opts")}))
+	assert.ErrorIs(t, deploy.applyDefaultOptions(deploy.cmd, "app"), os.ErrNotExist, "a named file must exist")
+
+	t.Setenv("KAMAL_PROXY_DEPLOY_OPTS", "--no-such-option")
+	deploy = newDeployCommand()
+	require.NoError(t, deploy.cmd.ParseFlags([]string{"--target", "localhost:3000", "--options-file", filepath.Join(dir, "empty.opts")}))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty.opts"), nil, 0o600))
+	assert.ErrorContains(t, deploy.applyDefaultOptions(deploy.cmd, "app"), "unknown default option: --no-such-option")
+
+	t.Setenv("KAMAL_PROXY_DEPLOY_OPTS", `--stop-message "unterminated`)
+	deploy = newDeployCommand()
+	require.NoError(t, deploy.cmd.ParseFlags([]string{"--target", "localhost:3000", "--options-file", filepath.Join(dir, "empty.opts")}))
+	assert.ErrorIs(t, deploy.applyDefaultOptions(deploy.cmd, "app"), errUnterminatedOption)
+}
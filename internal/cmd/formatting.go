@@ -1,8 +1,12 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
 )
 
 type Table struct {
@@ -40,6 +44,48 @@ func (t *Table) Print() {
 	}
 }
 
+// commandResult is printed in JSON mode by commands that have nothing else to
+// report, and by any command that fails.
+type commandResult struct {
+	Command  string `json:"command,omitempty"`
+	Service  string `json:"service,omitempty"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+}
+
+func printJSON(v any) {
+	json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// printCommandSucceeded reports that a command completed. Only JSON output
+// needs this; otherwise, succeeding quietly is enough.
+func printCommandSucceeded(command string, service string) {
+	if jsonOutput {
+		printJSON(commandResult{Command: command, Service: service, Success: true})
+	}
+}
+
+func printChangePlan(plan server.ChangePlan) {
+	if jsonOutput {
+		printJSON(plan)
+		return
+	}
+
+	fmt.Printf("Would %s service %s\n", plan.Action, bold.format(plan.Service))
+
+	if len(plan.Changes) == 0 {
+		fmt.Println("  (no changes)")
+	}
+	for _, change := range plan.Changes {
+		fmt.Printf("  %s\n", change)
+	}
+
+	if plan.HealthCheck != "" {
+		fmt.Printf("Health check: %s\n", plan.HealthCheck)
+	}
+}
+
 // Private
 
 type style string
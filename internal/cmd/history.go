@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"net/rpc"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type historyCommand struct {
+	cmd  *cobra.Command
+	args server.HistoryArgs
+}
+
+func newHistoryCommand() *historyCommand {
+	historyCommand := &historyCommand{}
+	historyCommand.cmd = &cobra.Command{
+		Use:       "history <service>",
+		Short:     "Show the configuration changes made to a service",
+		RunE:      historyCommand.run,
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"service"},
+	}
+
+	return historyCommand
+}
+
+func (c *historyCommand) run(cmd *cobra.Command, args []string) error {
+	c.args.Service = args[0]
+
+	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
+		var response server.HistoryResponse
+
+		err := client.Call("kamal-proxy.History", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		c.displayResponse(response)
+		return nil
+	})
+}
+
+func (c *historyCommand) displayResponse(response server.HistoryResponse) {
+	if jsonOutput {
+		printJSON(response)
+		return
+	}
+
+	table := NewTable()
+	table.AddRow([]string{"Time", "Command", "User", "PID", "Result", "Options"})
+
+	for _, entry := range response.Entries {
+		result := "ok"
+		if entry.Error != "" {
+			result = entry.Error
+		}
+
+		table.AddRow([]string{
+			entry.Time.Local().Format(time.DateTime),
+			entry.Command,
+			c.formatUser(entry.Caller),
+			strconv.Itoa(entry.Caller.PID),
+			result,
+			string(entry.Options),
+		})
+	}
+
+	table.Print()
+}
+
+func (c *historyCommand) formatUser(caller server.AuditCaller) string {
+	if caller.User != "" {
+		return caller.User
+	}
+	return strconv.Itoa(caller.UID)
+}
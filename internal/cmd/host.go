@@ -0,0 +1,20 @@
+package cmd
+
+import "github.com/spf13/cobra"
+
+type hostCommand struct {
+	cmd *cobra.Command
+}
+
+func newHostCommand() *hostCommand {
+	hostCommand := &hostCommand{}
+	hostCommand.cmd = &cobra.Command{
+		Use:   "host",
+		Short: "Add or remove a service's hosts without a deploy",
+	}
+
+	hostCommand.cmd.AddCommand(newHostAddCommand().cmd)
+	hostCommand.cmd.AddCommand(newHostRemoveCommand().cmd)
+
+	return hostCommand
+}
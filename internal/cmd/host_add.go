@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"net/rpc"
+
+	"github.com/spf13/cobra"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type hostAddCommand struct {
+	cmd  *cobra.Command
+	args server.HostsArgs
+}
+
+func newHostAddCommand() *hostAddCommand {
+	hostAddCommand := &hostAddCommand{}
+	hostAddCommand.cmd = &cobra.Command{
+		Use:     "add <service> <host>...",
+		Short:   "Add hosts to a service",
+		PreRunE: hostAddCommand.preRun,
+		RunE:    hostAddCommand.run,
+		Args:    cobra.MinimumNArgs(2),
+	}
+
+	return hostAddCommand
+}
+
+func (c *hostAddCommand) preRun(cmd *cobra.Command, args []string) error {
+	c.args.Service = args[0]
+	c.args.Hosts = args[1:]
+
+	var v validator
+	v.checkHosts(c.args.Hosts)
+	return v.err()
+}
+
+func (c *hostAddCommand) run(cmd *cobra.Command, args []string) error {
+	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
+		var response bool
+		err := client.Call("kamal-proxy.AddHosts", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("host add", c.args.Service)
+		return nil
+	})
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"net/rpc"
+
+	"github.com/spf13/cobra"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type hostRemoveCommand struct {
+	cmd  *cobra.Command
+	args server.HostsArgs
+}
+
+func newHostRemoveCommand() *hostRemoveCommand {
+	hostRemoveCommand := &hostRemoveCommand{}
+	hostRemoveCommand.cmd = &cobra.Command{
+		Use:     "remove <service> <host>...",
+		Short:   "Remove hosts from a service",
+		PreRunE: hostRemoveCommand.preRun,
+		RunE:    hostRemoveCommand.run,
+		Args:    cobra.MinimumNArgs(2),
+	}
+
+	return hostRemoveCommand
+}
+
+func (c *hostRemoveCommand) preRun(cmd *cobra.Command, args []string) error {
+	c.args.Service = args[0]
+	c.args.Hosts = args[1:]
+
+	var v validator
+	v.checkHosts(c.args.Hosts)
+	return v.err()
+}
+
+func (c *hostRemoveCommand) run(cmd *cobra.Command, args []string) error {
+	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
+		var response bool
+		err := client.Call("kamal-proxy.RemoveHosts", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("host remove", c.args.Service)
+		return nil
+	})
+}
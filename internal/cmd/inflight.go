@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"cmp"
+	"net/rpc"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type inflightCommand struct {
+	cmd  *cobra.Command
+	args server.InflightArgs
+}
+
+func newInflightCommand() *inflightCommand {
+	inflightCommand := &inflightCommand{}
+	inflightCommand.cmd = &cobra.Command{
+		Use:       "inflight <service>",
+		Short:     "List the requests currently in progress for a service",
+		RunE:      inflightCommand.run,
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"service"},
+	}
+
+	return inflightCommand
+}
+
+func (c *inflightCommand) run(cmd *cobra.Command, args []string) error {
+	c.args.Service = args[0]
+
+	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
+		var response server.InflightResponse
+
+		err := client.Call("kamal-proxy.Inflight", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		c.displayResponse(response)
+		return nil
+	})
+}
+
+func (c *inflightCommand) displayResponse(response server.InflightResponse) {
+	if jsonOutput {
+		printJSON(response)
+		return
+	}
+
+	table := NewTable()
+	table.AddRow([]string{"Method", "Host", "Path", "Target", "Elapsed", "Hijacked"})
+
+	// Longest-running first, since those are the ones holding up a drain.
+	requests := slices.SortedFunc(slices.Values(response.Requests), func(a, b server.InflightRequestDescription) int {
+		return cmp.Compare(b.Elapsed, a.Elapsed)
+	})
+
+	for _, req := range requests {
+		elapsed := req.Elapsed.Round(time.Millisecond).String()
+		table.AddRow([]string{req.Method, req.Host, req.Path, req.Target, elapsed, strconv.FormatBool(req.Hijacked)})
+	}
+
+	table.Print()
+}
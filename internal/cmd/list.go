@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"fmt"
 	"maps"
 	"net/rpc"
 	"slices"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -11,7 +13,8 @@ import (
 )
 
 type listCommand struct {
-	cmd *cobra.Command
+	cmd   *cobra.Command
+	stats bool
 }
 
 func newListCommand() *listCommand {
@@ -24,6 +27,8 @@ func newListCommand() *listCommand {
 		Aliases: []string{"ls"},
 	}
 
+	listCommand.cmd.Flags().BoolVar(&listCommand.stats, "stats", false, "Include the number of requests and errors served by each service, and the bytes received and sent")
+
 	return listCommand
 }
 
@@ -42,8 +47,17 @@ func (c *listCommand) run(cmd *cobra.Command, args []string) error {
 }
 
 func (c *listCommand) displayResponse(response server.ListResponse) {
+	if jsonOutput {
+		printJSON(response)
+		return
+	}
+
 	table := NewTable()
-	table.AddRow([]string{"Service", "Host", "Target", "State", "TLS"})
+	header := []string{"Service", "Host", "Target", "State", "TLS"}
+	if c.stats {
+		header = append(header, "Requests", "Errors", "In", "Out", "Since")
+	}
+	table.AddRow(header)
 
 	sortedKeys := slices.Sorted(maps.Keys(response.Targets))
 	for _, name := range sortedKeys {
@@ -53,8 +67,40 @@ func (c *listCommand) displayResponse(response server.ListResponse) {
 			tls = "yes"
 		}
 
-		table.AddRow([]string{name, service.Host, service.Target, service.State, tls})
+		target := service.Target
+		if service.FailedOver {
+			target = service.Standby + " (standby)"
+		}
+
+		row := []string{name, service.Host, target, service.State, tls}
+		if c.stats {
+			row = append(row, c.formatStats(service.Stats)...)
+		}
+		table.AddRow(row)
 	}
 
 	table.Print()
 }
+
+func (c *listCommand) formatStats(stats server.ServiceStats) []string {
+	errorCount := fmt.Sprintf("%d", stats.Errors)
+	if stats.Requests > 0 {
+		errorCount += fmt.Sprintf(" (%.1f%%)", float64(stats.Errors)*100/float64(stats.Requests))
+	}
+
+	return []string{fmt.Sprintf("%d", stats.Requests), errorCount, formatBytes(stats.BytesIn), formatBytes(stats.BytesOut), stats.Since.Format(time.DateTime)}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
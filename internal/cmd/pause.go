@@ -35,6 +35,12 @@ func (c *pauseCommand) run(cmd *cobra.Command, args []string) error {
 	c.args.Service = args[0]
 
 	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
-		return client.Call("kamal-proxy.Pause", c.args, &response)
+		err := client.Call("kamal-proxy.Pause", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("pause", c.args.Service)
+		return nil
 	})
 }
@@ -9,8 +9,9 @@ import (
 )
 
 type removeCommand struct {
-	cmd  *cobra.Command
-	args server.RemoveArgs
+	cmd    *cobra.Command
+	args   server.RemoveArgs
+	dryRun bool
 }
 
 func newRemoveCommand() *removeCommand {
@@ -24,6 +25,8 @@ func newRemoveCommand() *removeCommand {
 		Aliases:   []string{"rm"},
 	}
 
+	removeCommand.cmd.Flags().BoolVar(&removeCommand.dryRun, "dry-run", false, "Show what would be removed, without removing it")
+
 	return removeCommand
 }
 
@@ -33,6 +36,23 @@ func (c *removeCommand) run(cmd *cobra.Command, args []string) error {
 	c.args.Service = args[0]
 
 	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
-		return client.Call("kamal-proxy.Remove", c.args, &response)
+		if c.dryRun {
+			var plan server.ChangePlan
+			err := client.Call("kamal-proxy.PlanRemove", c.args, &plan)
+			if err != nil {
+				return err
+			}
+
+			printChangePlan(plan)
+			return nil
+		}
+
+		err := client.Call("kamal-proxy.Remove", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("remove", c.args.Service)
+		return nil
 	})
 }
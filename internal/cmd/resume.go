@@ -32,6 +32,12 @@ func (c *resumeCommand) run(cmd *cobra.Command, args []string) error {
 	c.args.Service = args[0]
 
 	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
-		return client.Call("kamal-proxy.Resume", c.args, &response)
+		err := client.Call("kamal-proxy.Resume", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("resume", c.args.Service)
+		return nil
 	})
 }
@@ -36,6 +36,12 @@ func (c *rolloutDeployCommand) run(cmd *cobra.Command, args []string) error {
 
 	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
 		var response bool
-		return client.Call("kamal-proxy.RolloutDeploy", c.args, &response)
+		err := client.Call("kamal-proxy.RolloutDeploy", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("rollout deploy", c.args.Service)
+		return nil
 	})
 }
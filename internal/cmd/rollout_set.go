@@ -25,6 +25,10 @@ func newRolloutSetCommand() *rolloutSetCommand {
 	rolloutSetCommand.cmd.Flags().IntVar(&rolloutSetCommand.args.Percentage, "percent", 0, "Percentage of traffic to send to the new target")
 	rolloutSetCommand.cmd.Flags().StringSliceVar(&rolloutSetCommand.args.Allowlist, "list", []string{}, "Rollout to specific values")
 
+	rolloutSetCommand.cmd.Flags().BoolVar(&rolloutSetCommand.args.Options.Sticky, "sticky", false, "Give clients without a rollout cookie a random one, so they stay in the same group")
+
+	rolloutSetCommand.cmd.Flags().BoolVar(&rolloutSetCommand.args.Options.ExposeVariant, "expose-variant", false, "Also include the X-Kamal-Variant header, that tells the target which group a request is in, in responses")
+
 	rolloutSetCommand.cmd.MarkFlagsOneRequired("percent", "list")
 
 	return rolloutSetCommand
@@ -35,6 +39,12 @@ func (c *rolloutSetCommand) run(cmd *cobra.Command, args []string) error {
 
 	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
 		var response bool
-		return client.Call("kamal-proxy.RolloutSet", c.args, &response)
+		err := client.Call("kamal-proxy.RolloutSet", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("rollout set", c.args.Service)
+		return nil
 	})
 }
@@ -30,6 +30,12 @@ func (c *rolloutStopCommand) run(cmd *cobra.Command, args []string) error {
 
 	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
 		var response bool
-		return client.Call("kamal-proxy.RolloutStop", c.args, &response)
+		err := client.Call("kamal-proxy.RolloutStop", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("rollout stop", c.args.Service)
+		return nil
 	})
 }
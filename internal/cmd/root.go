@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -10,27 +12,52 @@ import (
 
 var globalConfig server.Config
 
+// jsonOutput is set by the --json flag, to print results and errors as JSON
+// for scripts, rather than formatted for people.
+var jsonOutput bool
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:          "kamal-proxy",
-	Short:        "HTTP proxy for zero downtime deployments",
-	SilenceUsage: true,
+	Use:           "kamal-proxy",
+	Short:         "HTTP proxy for zero downtime deployments",
+	SilenceUsage:  true,
+	SilenceErrors: true,
 }
 
 func Execute() {
 	rootCmd.CompletionOptions.HiddenDefaultCmd = true
+	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "Print results and errors as JSON")
 
 	rootCmd.AddCommand(newRunCommand().cmd)
 	rootCmd.AddCommand(newDeployCommand().cmd)
+	rootCmd.AddCommand(newCloneCommand().cmd)
 	rootCmd.AddCommand(newRemoveCommand().cmd)
 	rootCmd.AddCommand(newPauseCommand().cmd)
 	rootCmd.AddCommand(newStopCommand().cmd)
 	rootCmd.AddCommand(newResumeCommand().cmd)
 	rootCmd.AddCommand(newListCommand().cmd)
+	rootCmd.AddCommand(newInflightCommand().cmd)
+	rootCmd.AddCommand(newHistoryCommand().cmd)
 	rootCmd.AddCommand(newRolloutCommand().cmd)
+	rootCmd.AddCommand(newHostCommand().cmd)
+	rootCmd.AddCommand(newTunnelCommand().cmd)
+	rootCmd.AddCommand(newTunnelTokenCommand().cmd)
+	rootCmd.AddCommand(newCertsCommand().cmd)
+	rootCmd.AddCommand(newDoctorCommand().cmd)
 
 	err := rootCmd.Execute()
 	if err != nil {
-		os.Exit(1)
+		exitCode := 1
+		var exitErr interface{ ExitCode() int }
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+
+		if jsonOutput {
+			printJSON(commandResult{Success: false, Error: err.Error(), ExitCode: exitCode})
+		} else {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		os.Exit(exitCode)
 	}
 }
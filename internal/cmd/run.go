@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/spf13/cobra"
@@ -11,9 +13,31 @@ import (
 	"github.com/basecamp/kamal-proxy/internal/server"
 )
 
+// exitCodePreflightFailed is distinct from the usual failure status, so that
+// restart policies can avoid restarting into an environment that isn't ready.
+const exitCodePreflightFailed = 20
+
+type PreflightError struct {
+	problems []server.PreflightProblem
+}
+
+func (e *PreflightError) Error() string {
+	lines := []string{"preflight checks failed:"}
+	for _, problem := range e.problems {
+		lines = append(lines, "  - "+problem.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *PreflightError) ExitCode() int {
+	return exitCodePreflightFailed
+}
+
 type runCommand struct {
 	cmd              *cobra.Command
 	debugLogsEnabled bool
+	preflight        bool
+	restoreOptions   server.RestoreOptions
 }
 
 func newRunCommand() *runCommand {
@@ -27,6 +51,30 @@ func newRunCommand() *runCommand {
 	runCommand.cmd.Flags().BoolVar(&runCommand.debugLogsEnabled, "debug", getEnvBool("DEBUG", false), "Include debugging logs")
 	runCommand.cmd.Flags().IntVar(&globalConfig.HttpPort, "http-port", getEnvInt("HTTP_PORT", server.DefaultHttpPort), "Port to serve HTTP traffic on")
 	runCommand.cmd.Flags().IntVar(&globalConfig.HttpsPort, "https-port", getEnvInt("HTTPS_PORT", server.DefaultHttpsPort), "Port to serve HTTPS traffic on")
+	runCommand.cmd.Flags().BoolVar(&runCommand.preflight, "preflight", getEnvBool("PREFLIGHT", false), "Check that the ports, directories, state and clock are usable before starting, and exit with status 20 if not")
+	runCommand.cmd.Flags().BoolVar(&runCommand.restoreOptions.ProbeTargets, "probe-on-restore", getEnvBool("PROBE_ON_RESTORE", false), "Check that restored targets are reachable, and hold traffic for those that aren't until they become healthy")
+	runCommand.cmd.Flags().BoolVar(&runCommand.restoreOptions.VerifyTargets, "verify-on-restore", getEnvBool("VERIFY_ON_RESTORE", false), "Hold traffic for all restored targets until they pass a health check")
+	runCommand.cmd.Flags().IntVar(&globalConfig.InternalHttpPort, "internal-http-port", getEnvInt("INTERNAL_HTTP_PORT", 0), "Port to serve internal HTTP traffic on, without HTTPS redirects or allowed host checks (0 to disable)")
+	runCommand.cmd.Flags().StringVar(&globalConfig.InternalBind, "internal-bind", getEnvString("INTERNAL_BIND", server.DefaultInternalBind), "Address to serve internal HTTP traffic on, such as that of a Docker network")
+	runCommand.cmd.Flags().StringSliceVar(&globalConfig.InternalAllowedNetworks, "internal-allow", getEnvStrings("INTERNAL_ALLOW", server.DefaultInternalAllowedNetworks), "IP addresses or CIDR ranges allowed to use the internal port")
+	runCommand.cmd.Flags().IntVar(&globalConfig.TunnelPort, "tunnel-port", getEnvInt("TUNNEL_PORT", 0), "Port to accept tunnel agent connections on (0 to disable)")
+	runCommand.cmd.Flags().DurationVar(&globalConfig.CertExpiryWarning, "cert-expiry-warning", getEnvDuration("CERT_EXPIRY_WARNING", server.DefaultCertExpiryWarning), "Log a warning when a certificate will expire within this period (0 to disable)")
+	runCommand.cmd.Flags().StringVar(&globalConfig.InternalPathPrefix, "internal-path-prefix", getEnvString("INTERNAL_PATH_PREFIX", server.DefaultInternalPathPrefix), "Path prefix reserved for the proxy's own endpoints on all hosts (empty to disable)")
+	runCommand.cmd.Flags().DurationVar(&globalConfig.ShutdownGracePeriod, "shutdown-grace-period", getEnvDuration("SHUTDOWN_GRACE_PERIOD", 0), "When stopping, keep serving for this long while asking clients to close their connections, before shutting down")
+	runCommand.cmd.Flags().StringVar(&globalConfig.StateStore, "state-store", getEnvString("STATE_STORE", ""), "Where to save routing state: a file path, an sqlite://<path> URL, or an s3://<bucket>/<key> URL (default is a file in the data directory)")
+	runCommand.cmd.Flags().BoolVar(&globalConfig.DisableSessionTickets, "disable-session-tickets", getEnvBool("DISABLE_SESSION_TICKETS", false), "Don't issue TLS session tickets, so clients must always perform a full handshake")
+	runCommand.cmd.Flags().StringVar(&globalConfig.SessionTicketKeyFile, "session-ticket-key-file", getEnvString("SESSION_TICKET_KEY_FILE", ""), "File of hex-encoded 32 byte keys to encrypt TLS session tickets with, one per line, newest first; re-read every minute so keys can be shared and rotated across proxies")
+	runCommand.cmd.Flags().IntVar(&globalConfig.HandshakeRatePerIP, "tls-handshake-rate-per-ip", getEnvInt("TLS_HANDSHAKE_RATE_PER_IP", 0), "Maximum new HTTPS connections per second from each IP address; connections over the limit are reset (default of 0 means unlimited)")
+	runCommand.cmd.Flags().IntVar(&globalConfig.HandshakeRate, "tls-handshake-rate", getEnvInt("TLS_HANDSHAKE_RATE", 0), "Maximum new HTTPS connections per second in total; connections over the limit are reset (default of 0 means unlimited)")
+	runCommand.cmd.Flags().IntVar(&globalConfig.HandshakeBurst, "tls-handshake-burst", getEnvInt("TLS_HANDSHAKE_BURST", 0), "Number of new HTTPS connections allowed at once above the handshake rates (default of 0 means the same as the rate)")
+	runCommand.cmd.Flags().DurationVar(&globalConfig.SessionTicketRotation, "session-ticket-rotation", getEnvDuration("SESSION_TICKET_ROTATION", 0), "How often to generate a new TLS session ticket key, when not using a key file (default of 0 means daily)")
+	runCommand.cmd.Flags().StringVar(&globalConfig.MissingHost, "missing-host", getEnvString("MISSING_HOST", server.MissingHostDefault), "What to do with requests that have no Host header: \"default\" routes them to the service without hosts, \"reject\" responds with 400, and a host name routes them to that host's service")
+	runCommand.cmd.Flags().BoolVar(&globalConfig.UnmapIPv4Addresses, "unmap-ipv4-addresses", getEnvBool("UNMAP_IPV4_ADDRESSES", false), "Report IPv4 clients that connect over a dual-stack socket by their IPv4 address, rather than as IPv4-mapped IPv6 addresses (::ffff:192.0.2.1), in logs and forwarded headers")
+	runCommand.cmd.Flags().DurationVar(&globalConfig.RequestSummaryInterval, "request-summary-interval", getEnvDuration("REQUEST_SUMMARY_INTERVAL", 0), "Log a summary of each service's request counts and response times this often (0 to disable)")
+	runCommand.cmd.Flags().StringVar(&globalConfig.MalformedRequestPages, "malformed-request-pages", getEnvString("MALFORMED_REQUEST_PAGES", ""), "Directory of error page templates, such as 400.html, for responses to requests that can't be parsed (default is the built-in pages)")
+	runCommand.cmd.Flags().Int64Var(&globalConfig.BufferMemoryBudget, "buffer-memory-budget", getEnvInt64("BUFFER_MEMORY_BUDGET", 0), "Max memory, in bytes, for all request and response buffers together (0 for unlimited)")
+	runCommand.cmd.Flags().StringVar(&globalConfig.BufferMemoryBudgetAction, "buffer-memory-budget-action", getEnvString("BUFFER_MEMORY_BUDGET_ACTION", server.BufferMemoryBudgetSpill), "What to do with buffers once the budget is used up: \"spill\" them to disk, or \"reject\" their requests with 503")
+	runCommand.cmd.Flags().StringVar(&globalConfig.TunnelToken, "tunnel-token", getEnvString("TUNNEL_TOKEN", ""), "Secret that each tunnel agent's token is derived from (required with --tunnel-port)")
 
 	return runCommand
 }
@@ -34,11 +82,46 @@ func newRunCommand() *runCommand {
 func (c *runCommand) run(cmd *cobra.Command, args []string) error {
 	c.setLogger()
 
-	router := server.NewRouter(globalConfig.StatePath())
-	router.RestoreLastSavedState()
+	missingHost, err := server.NormalizeMissingHostPolicy(globalConfig.MissingHost)
+	if err != nil {
+		return err
+	}
+	globalConfig.MissingHost = missingHost
+
+	bufferMemoryBudgetAction, err := server.NormalizeBufferMemoryBudgetAction(globalConfig.BufferMemoryBudgetAction)
+	if err != nil {
+		return err
+	}
+	globalConfig.BufferMemoryBudgetAction = bufferMemoryBudgetAction
+
+	if globalConfig.TunnelPort != 0 && globalConfig.TunnelToken == "" {
+		return server.ErrorTunnelTokenRequired
+	}
 
+	stateStore, err := server.NewStateStore(globalConfig.StateStore, globalConfig.StatePath())
+	if err != nil {
+		return err
+	}
+
+	if c.preflight {
+		problems := server.RunPreflightChecks(&globalConfig, stateStore)
+		if len(problems) > 0 {
+			return &PreflightError{problems: problems}
+		}
+	}
+
+	router := server.NewRouter(stateStore)
 	s := server.NewServer(&globalConfig, router)
-	err := s.Start()
+	// Starting without the saved state would overwrite it on the next save, so
+	// a store that can't be read, even for a moment, is a reason not to start.
+	// Services that can't be restored are skipped, rather than stopping the
+	// others from being served.
+	err = router.RestoreLastSavedState(c.restoreOptions)
+	if err != nil {
+		return fmt.Errorf("unable to restore saved state from %s: %w", stateStore, err)
+	}
+
+	err = s.Start()
 	if err != nil {
 		return err
 	}
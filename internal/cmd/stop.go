@@ -35,6 +35,12 @@ func (c *stopCommand) run(cmd *cobra.Command, args []string) error {
 	c.args.Service = args[0]
 
 	return withRPCClient(globalConfig.SocketPath(), func(client *rpc.Client) error {
-		return client.Call("kamal-proxy.Stop", c.args, &response)
+		err := client.Call("kamal-proxy.Stop", c.args, &response)
+		if err != nil {
+			return err
+		}
+
+		printCommandSucceeded("stop", c.args.Service)
+		return nil
 	})
 }
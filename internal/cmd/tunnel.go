@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type tunnelCommand struct {
+	cmd         *cobra.Command
+	proxyAddr   string
+	targetURL   string
+	token       string
+	connections int
+}
+
+func newTunnelCommand() *tunnelCommand {
+	tunnelCommand := &tunnelCommand{}
+	tunnelCommand.cmd = &cobra.Command{
+		Use:       "tunnel <name>",
+		Short:     "Connect a target to a remote proxy through a reverse tunnel",
+		RunE:      tunnelCommand.run,
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"name"},
+	}
+
+	tunnelCommand.cmd.Flags().StringVar(&tunnelCommand.proxyAddr, "proxy", "", "Address of the proxy's tunnel listener (host:port)")
+	tunnelCommand.cmd.Flags().StringVar(&tunnelCommand.targetURL, "target", "", "Local target host to forward traffic to")
+	tunnelCommand.cmd.Flags().StringVar(&tunnelCommand.token, "token", getEnvString("TUNNEL_TOKEN", ""), "Token to present when registering with the proxy, as printed by tunnel-token")
+	tunnelCommand.cmd.Flags().IntVar(&tunnelCommand.connections, "connections", server.DefaultTunnelConnections, "Number of connections to keep open to the proxy")
+
+	tunnelCommand.cmd.MarkFlagRequired("proxy")
+	tunnelCommand.cmd.MarkFlagRequired("target")
+
+	return tunnelCommand
+}
+
+func (c *tunnelCommand) run(cmd *cobra.Command, args []string) error {
+	agent, err := server.NewTunnelAgent(args[0], c.proxyAddr, c.token, c.targetURL, c.connections)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+		<-ch
+		agent.Close()
+	}()
+
+	return agent.Run()
+}
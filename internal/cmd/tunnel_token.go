@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type tunnelTokenCommand struct {
+	cmd    *cobra.Command
+	secret string
+}
+
+func newTunnelTokenCommand() *tunnelTokenCommand {
+	tunnelTokenCommand := &tunnelTokenCommand{}
+	tunnelTokenCommand.cmd = &cobra.Command{
+		Use:       "tunnel-token <name>",
+		Short:     "Print the token a tunnel agent must present to register as <name>",
+		RunE:      tunnelTokenCommand.run,
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"name"},
+	}
+
+	tunnelTokenCommand.cmd.Flags().StringVar(&tunnelTokenCommand.secret, "tunnel-token", getEnvString("TUNNEL_TOKEN", ""), "The proxy's tunnel token, that agent tokens are derived from")
+
+	return tunnelTokenCommand
+}
+
+func (c *tunnelTokenCommand) run(cmd *cobra.Command, args []string) error {
+	if c.secret == "" {
+		return server.ErrorTunnelTokenRequired
+	}
+
+	token := server.TunnelToken(c.secret, args[0])
+
+	if jsonOutput {
+		printJSON(map[string]string{"name": args[0], "token": token})
+	} else {
+		fmt.Println(token)
+	}
+	return nil
+}
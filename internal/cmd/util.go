@@ -4,6 +4,8 @@ import (
 	"net/rpc"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -33,6 +35,24 @@ func findEnv(key string) (string, bool) {
 	return "", false
 }
 
+func getEnvString(key string, defaultValue string) string {
+	value, ok := findEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	return value
+}
+
+func getEnvStrings(key string, defaultValue []string) []string {
+	value, ok := findEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	return strings.Split(value, ",")
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	value, ok := findEnv(key)
 	if !ok {
@@ -47,6 +67,34 @@ func getEnvInt(key string, defaultValue int) int {
 	return intValue
 }
 
+func getEnvInt64(key string, defaultValue int64) int64 {
+	value, ok := findEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	intValue, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return defaultValue
+	}
+
+	return intValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, ok := findEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	durationValue, err := time.ParseDuration(value)
+	if err != nil {
+		return defaultValue
+	}
+
+	return durationValue
+}
+
 func getEnvBool(key string, defaultValue bool) bool {
 	value, ok := findEnv(key)
 	if !ok {
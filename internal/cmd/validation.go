@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+// Exit codes for invalid options. When there are several problems, we exit
+// with the code of the first one.
+const (
+	exitCodeInvalidHost       = 10
+	exitCodeTLSRequiresHost   = 11
+	exitCodeTLSWildcard       = 12
+	exitCodeConflictingBuffer = 13
+	exitCodeInvalidOption     = 14
+)
+
+var validHostRegex = regexp.MustCompile(`^(\*\.)?[a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?$`)
+
+type validationProblem struct {
+	exitCode int
+	message  string
+}
+
+type ValidationError struct {
+	problems []validationProblem
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{"invalid options:"}
+	for _, problem := range e.problems {
+		lines = append(lines, "  - "+problem.message)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *ValidationError) ExitCode() int {
+	return e.problems[0].exitCode
+}
+
+// validator collects every problem with a command's options, so that they can
+// all be reported together rather than one at a time.
+type validator struct {
+	problems []validationProblem
+}
+
+func (v *validator) check(valid bool, exitCode int, format string, args ...any) {
+	if !valid {
+		v.problems = append(v.problems, validationProblem{exitCode: exitCode, message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// checkHosts validates hosts, normalizing them in place so that Unicode hosts
+// are given in their punycode form.
+func (v *validator) checkHosts(hosts []string) {
+	for i, host := range hosts {
+		normalized, err := server.NormalizeHost(host)
+		v.check(err == nil && validHostRegex.MatchString(normalized), exitCodeInvalidHost, "invalid host: %q", host)
+		if err == nil {
+			hosts[i] = normalized
+		}
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{problems: v.problems}
+}
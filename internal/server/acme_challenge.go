@@ -0,0 +1,41 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const acmeChallengePathPrefix = "/.well-known/acme-challenge/"
+
+// ACMEChallengesServed is the number of HTTP-01 challenge requests that have
+// been answered since the proxy started.
+func (r *Router) ACMEChallengesServed() int64 {
+	return r.acmeChallenges.Load()
+}
+
+// Private
+
+func isACMEChallenge(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, acmeChallengePathPrefix)
+}
+
+// serveACMEChallenge answers an HTTP-01 challenge for a service that gets its
+// certificates automatically. This happens before any of the service's own
+// handling, so that a challenge is never redirected to HTTPS, held by a pause,
+// or refused because the service is stopped; otherwise certificates can't be
+// provisioned during maintenance.
+func (s *Service) serveACMEChallenge(w http.ResponseWriter, req *http.Request) bool {
+	manager, ok := s.config().certManager.(*autocert.Manager)
+	if !ok {
+		return false
+	}
+
+	LoggingRequestContext(req).Service = s.name
+	slog.Debug("Serving ACME challenge", "service", s.name, "host", req.Host, "path", req.URL.Path)
+
+	manager.HTTPHandler(nil).ServeHTTP(w, req)
+	return true
+}
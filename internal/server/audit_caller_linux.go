@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func auditCallerForConn(conn net.Conn) AuditCaller {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return unknownAuditCaller
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return unknownAuditCaller
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return unknownAuditCaller
+	}
+
+	caller := AuditCaller{UID: int(cred.Uid), PID: int(cred.Pid)}
+	if u, err := user.LookupId(strconv.Itoa(caller.UID)); err == nil {
+		caller.User = u.Username
+	}
+
+	return caller
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+func auditCallerForConn(conn net.Conn) AuditCaller {
+	return unknownAuditCaller
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditCaller identifies who issued a command, from the credentials of their
+// connection to the command socket.
+type AuditCaller struct {
+	UID  int    `json:"uid"`
+	PID  int    `json:"pid"`
+	User string `json:"user"`
+}
+
+var unknownAuditCaller = AuditCaller{UID: -1, PID: -1}
+
+// auditLogMaxSize is how large the audit log may grow before it is rotated.
+// Only one rotated file is kept, so the history takes at most twice this much
+// disk space, and History never reads more than that.
+const auditLogMaxSize = 10 * MB
+
+type AuditEntry struct {
+	Time    time.Time       `json:"time"`
+	Service string          `json:"service"`
+	Command string          `json:"command"`
+	Caller  AuditCaller     `json:"caller"`
+	Options json.RawMessage `json:"options"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// AuditLog is an append-only record of the commands that changed each
+// service's configuration. Entries are stored one per line, as JSON.
+//
+// Once the file reaches its maximum size, it is renamed with a .1 suffix,
+// replacing the previous one, and a new file is started. The oldest entries
+// are dropped, rather than letting the log grow for as long as the proxy
+// runs.
+type AuditLog struct {
+	path    string
+	maxSize int64
+	lock    sync.Mutex
+}
+
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{
+		path:    path,
+		maxSize: auditLogMaxSize,
+	}
+}
+
+func (l *AuditLog) Record(service, command string, caller AuditCaller, options any, commandErr error) {
+	entry := AuditEntry{
+		Time:    time.Now().UTC(),
+		Service: service,
+		Command: command,
+		Caller:  caller,
+	}
+
+	entry.Options, _ = json.Marshal(options)
+	if commandErr != nil {
+		entry.Error = commandErr.Error()
+	}
+
+	err := l.append(entry)
+	if err != nil {
+		slog.Error("Failed to write audit log", "path", l.path, "error", err)
+	}
+}
+
+func (l *AuditLog) History(service string) ([]AuditEntry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entries := []AuditEntry{}
+
+	for _, path := range []string{l.rotatedPath(), l.path} {
+		var err error
+		entries, err = l.readEntries(path, service, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// Private
+
+func (l *AuditLog) rotatedPath() string {
+	return l.path + ".1"
+}
+
+func (l *AuditLog) readEntries(path string, service string, entries []AuditEntry) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		var entry AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			continue // Skip anything that was only partially written
+		}
+		if entry.Service == service {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func (l *AuditLog) rotateIfFull(size int) error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if info.Size() == 0 || info.Size()+int64(size) <= l.maxSize {
+		return nil
+	}
+
+	return os.Rename(l.path, l.rotatedPath())
+}
+
+func (l *AuditLog) append(entry AuditEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	err = l.rotateIfFull(len(line))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(line)
+	return err
+}
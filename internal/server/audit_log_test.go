@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog_RecordAndHistory(t *testing.T) {
+	auditLog := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	caller := AuditCaller{UID: 1000, PID: 42, User: "deploy"}
+
+	auditLog.Record("service1", "deploy", caller, DeployArgs{Service: "service1", TargetURL: "web:3000"}, nil)
+	auditLog.Record("service2", "pause", caller, PauseArgs{Service: "service2"}, nil)
+	auditLog.Record("service1", "stop", caller, StopArgs{Service: "service1"}, errors.New("service not found"))
+
+	entries, err := auditLog.History("service1")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	assert.Equal(t, "deploy", entries[0].Command)
+	assert.Equal(t, caller, entries[0].Caller)
+	assert.Contains(t, string(entries[0].Options), `"TargetURL":"web:3000"`)
+	assert.Empty(t, entries[0].Error)
+
+	assert.Equal(t, "stop", entries[1].Command)
+	assert.Equal(t, "service not found", entries[1].Error)
+}
+
+func TestAuditLog_HistoryWhenEmpty(t *testing.T) {
+	auditLog := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+
+	entries, err := auditLog.History("service1")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestAuditLog_RotatesWhenFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog := NewAuditLog(path)
+	auditLog.maxSize = 10 * KB
+
+	for i := range 50 {
+		auditLog.Record("service1", "deploy", unknownAuditCaller, DeployArgs{Service: "service1", TargetURL: fmt.Sprintf("web:%d", 3000+i)}, nil)
+	}
+
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), auditLog.maxSize)
+	}
+
+	entries, err := auditLog.History("service1")
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	assert.Less(t, len(entries), 50, "the oldest entries are dropped")
+
+	// The newest entries are kept, in order
+	for i, entry := range entries {
+		expected := fmt.Sprintf(`"TargetURL":"web:%d"`, 3000+50-len(entries)+i)
+		assert.Contains(t, string(entry.Options), expected)
+	}
+}
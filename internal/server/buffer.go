@@ -12,25 +12,30 @@ import (
 var (
 	ErrMaximumSizeExceeded = errors.New("maximum size exceeded")
 	ErrWriteAfterRead      = errors.New("write after read")
+
+	ErrBufferMemoryBudgetExceeded = errors.New("buffer memory budget exceeded")
 )
 
 type Buffer struct {
 	maxBytes    int64
 	maxMemBytes int64
+	budget      *BufferMemoryBudget
 
 	memoryBuffer     bytes.Buffer
 	memBytesWritten  int64
 	diskBuffer       *os.File
 	diskBytesWritten int64
 	overflowed       bool
+	budgetExceeded   bool
 	reader           io.Reader
 	closeOnce        sync.Once
 }
 
-func NewBufferedReadCloser(r io.ReadCloser, maxBytes, maxMemBytes int64) (io.ReadCloser, error) {
+func NewBufferedReadCloser(r io.ReadCloser, maxBytes, maxMemBytes int64, budget *BufferMemoryBudget) (io.ReadCloser, error) {
 	buf := &Buffer{
 		maxBytes:    maxBytes,
 		maxMemBytes: maxMemBytes,
+		budget:      budget,
 	}
 
 	_, err := io.Copy(buf, r)
@@ -42,10 +47,11 @@ func NewBufferedReadCloser(r io.ReadCloser, maxBytes, maxMemBytes int64) (io.Rea
 	return buf, nil
 }
 
-func NewBufferedWriteCloser(maxBytes, maxMemBytes int64) *Buffer {
+func NewBufferedWriteCloser(maxBytes, maxMemBytes int64, budget *BufferMemoryBudget) *Buffer {
 	return &Buffer{
 		maxBytes:    maxBytes,
 		maxMemBytes: maxMemBytes,
+		budget:      budget,
 	}
 }
 
@@ -66,17 +72,27 @@ func (b *Buffer) Write(p []byte) (int, error) {
 		return b.writeToDisk(p)
 	}
 
-	if b.memBytesWritten+length <= b.maxMemBytes {
+	memLength := min(length, b.maxMemBytes-b.memBytesWritten)
+	if !b.budget.reserve(memLength) {
+		if b.budget.exceeded() {
+			b.budgetExceeded = true
+			return 0, ErrBufferMemoryBudgetExceeded
+		}
+		memLength = 0
+	}
+
+	if memLength == length {
 		return b.writeToMemory(p)
 	}
 
 	// We're writing past the memory buffer, so we need to start the spill to disk
 	err := b.createSpill()
 	if err != nil {
+		b.budget.release(memLength)
 		return 0, err
 	}
 
-	memWritten, err := b.writeToMemory(p[:b.maxMemBytes-b.memBytesWritten])
+	memWritten, err := b.writeToMemory(p[:memLength])
 	if err != nil {
 		return memWritten, err
 	}
@@ -94,6 +110,12 @@ func (b *Buffer) Overflowed() bool {
 	return b.overflowed
 }
 
+// BudgetExceeded reports whether the buffer was refused because the buffer
+// memory budget was used up.
+func (b *Buffer) BudgetExceeded() bool {
+	return b.budgetExceeded
+}
+
 func (b *Buffer) Send(w io.Writer) error {
 	b.setReader()
 	_, err := io.Copy(w, b.reader)
@@ -103,6 +125,7 @@ func (b *Buffer) Send(w io.Writer) error {
 func (b *Buffer) Close() error {
 	b.closeOnce.Do(func() {
 		b.discardSpill()
+		b.budget.release(b.memBytesWritten)
 	})
 
 	return nil
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BufferMemoryBudgetSpill  = "spill"
+	BufferMemoryBudgetReject = "reject"
+
+	bufferMemoryWarningInterval = 10 * time.Second
+)
+
+var contextKeyBufferMemoryBudget = contextKey("buffer-memory-budget")
+
+var ErrorInvalidBufferMemoryBudgetAction = errors.New("buffer memory budget action must be \"spill\" or \"reject\"")
+
+// BufferMemoryBudget limits how much memory all of the request and response
+// buffers may use between them, so that a burst of large requests can't
+// exhaust the proxy's memory, even though each stays within its own limit.
+// Once the budget is used up, buffers either spill to disk, as they would
+// on reaching their own memory limit, or refuse to buffer any more.
+//
+// The budget belongs to the server, which makes it available to the buffers
+// through the context of each request. A nil budget is unlimited.
+type BufferMemoryBudget struct {
+	limit  int64
+	reject bool
+
+	inUse      atomic.Int64
+	peak       atomic.Int64
+	spills     atomic.Int64
+	rejections atomic.Int64
+
+	lastWarning      atomic.Int64
+	warnedRejections atomic.Int64
+}
+
+type BufferMemoryStats struct {
+	Limit      int64 `json:"limit"`
+	InUse      int64 `json:"in_use"`
+	Peak       int64 `json:"peak"`
+	Spills     int64 `json:"spills"`
+	Rejections int64 `json:"rejections"`
+}
+
+// NormalizeBufferMemoryBudgetAction checks what to do when the buffer memory
+// budget is used up, which is BufferMemoryBudgetSpill unless otherwise set.
+func NormalizeBufferMemoryBudgetAction(action string) (string, error) {
+	switch action {
+	case "", BufferMemoryBudgetSpill:
+		return BufferMemoryBudgetSpill, nil
+	case BufferMemoryBudgetReject:
+		return BufferMemoryBudgetReject, nil
+	}
+	return "", ErrorInvalidBufferMemoryBudgetAction
+}
+
+// NewBufferMemoryBudget creates a budget with a limit, where 0 means
+// unlimited, and the action to take when it's reached.
+func NewBufferMemoryBudget(limit int64, action string) *BufferMemoryBudget {
+	return &BufferMemoryBudget{
+		limit:  limit,
+		reject: action == BufferMemoryBudgetReject,
+	}
+}
+
+// WithBufferMemoryBudget returns a context whose requests' buffers will
+// share the budget.
+func WithBufferMemoryBudget(ctx context.Context, budget *BufferMemoryBudget) context.Context {
+	return context.WithValue(ctx, contextKeyBufferMemoryBudget, budget)
+}
+
+func (b *BufferMemoryBudget) Stats() BufferMemoryStats {
+	return BufferMemoryStats{
+		Limit:      b.limit,
+		InUse:      b.inUse.Load(),
+		Peak:       b.peak.Load(),
+		Spills:     b.spills.Load(),
+		Rejections: b.rejections.Load(),
+	}
+}
+
+// Private
+
+// bufferMemoryBudgetForRequest returns the budget that the request's buffers
+// share, if any.
+func bufferMemoryBudgetForRequest(r *http.Request) *BufferMemoryBudget {
+	budget, _ := r.Context().Value(contextKeyBufferMemoryBudget).(*BufferMemoryBudget)
+	return budget
+}
+
+// reserve claims n bytes of the budget, if they're available.
+func (b *BufferMemoryBudget) reserve(n int64) bool {
+	if b == nil || n == 0 {
+		return true
+	}
+
+	for {
+		inUse := b.inUse.Load()
+		if b.limit > 0 && inUse+n > b.limit {
+			return false
+		}
+		if b.inUse.CompareAndSwap(inUse, inUse+n) {
+			b.recordPeak(inUse + n)
+			return true
+		}
+	}
+}
+
+func (b *BufferMemoryBudget) release(n int64) {
+	if b != nil && n > 0 {
+		b.inUse.Add(-n)
+	}
+}
+
+// exceeded records that a buffer couldn't have the memory it wanted, and
+// reports whether it should be refused rather than spilled to disk.
+func (b *BufferMemoryBudget) exceeded() bool {
+	if b.reject {
+		b.warnRejections(b.rejections.Add(1))
+		return true
+	}
+
+	b.spills.Add(1)
+	slog.Debug("Buffer memory budget exceeded; spilling to disk", "limit", b.limit)
+	return false
+}
+
+// warnRejections logs the number of rejections since the last warning, at
+// most once per interval, so that a flood of rejected requests doesn't flood
+// the log as well.
+func (b *BufferMemoryBudget) warnRejections(total int64) {
+	now := time.Now().UnixNano()
+	last := b.lastWarning.Load()
+	if now-last < int64(bufferMemoryWarningInterval) || !b.lastWarning.CompareAndSwap(last, now) {
+		return
+	}
+
+	rejections := total - b.warnedRejections.Swap(total)
+	slog.Warn("Buffer memory budget exceeded; rejecting", "limit", b.limit, "rejections", rejections)
+}
+
+func (b *BufferMemoryBudget) recordPeak(inUse int64) {
+	for {
+		peak := b.peak.Load()
+		if inUse <= peak || b.peak.CompareAndSwap(peak, inUse) {
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferMemoryBudget_SpillsWhenUsedUp(t *testing.T) {
+	budget := NewBufferMemoryBudget(10, BufferMemoryBudgetSpill)
+
+	first := NewBufferedWriteCloser(0, 1024, budget)
+	_, err := first.Write([]byte("12345678"))
+	require.NoError(t, err)
+	assert.Nil(t, first.diskBuffer)
+
+	second := NewBufferedWriteCloser(0, 1024, budget)
+	_, err = second.Write([]byte("abcdefgh"))
+	require.NoError(t, err)
+	assert.NotNil(t, second.diskBuffer)
+
+	result, err := io.ReadAll(second)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefgh", string(result))
+
+	stats := budget.Stats()
+	assert.Equal(t, int64(8), stats.InUse)
+	assert.Equal(t, int64(8), stats.Peak)
+	assert.Equal(t, int64(1), stats.Spills)
+
+	first.Close()
+	second.Close()
+	assert.Equal(t, int64(0), budget.Stats().InUse)
+}
+
+func TestBufferMemoryBudget_RejectsWhenUsedUp(t *testing.T) {
+	budget := NewBufferMemoryBudget(10, BufferMemoryBudgetReject)
+
+	first := NewBufferedWriteCloser(0, 1024, budget)
+	defer first.Close()
+	_, err := first.Write([]byte("12345678"))
+	require.NoError(t, err)
+
+	second := NewBufferedWriteCloser(0, 1024, budget)
+	defer second.Close()
+	_, err = second.Write([]byte("abcdefgh"))
+	assert.Equal(t, ErrBufferMemoryBudgetExceeded, err)
+	assert.True(t, second.BudgetExceeded())
+
+	assert.Equal(t, int64(1), budget.Stats().Rejections)
+}
+
+func TestBufferMemoryBudget_RequestsRejectedWhenUsedUp(t *testing.T) {
+	budget := NewBufferMemoryBudget(4, BufferMemoryBudgetReject)
+
+	handler := WithRequestBufferMiddleware(1024, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("Hi"))
+	req = req.WithContext(WithBufferMemoryBudget(req.Context(), budget))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "Hi", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("Hello, World!"))
+	req = req.WithContext(WithBufferMemoryBudget(req.Context(), budget))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+
+	assert.Equal(t, int64(0), budget.Stats().InUse)
+}
+
+func TestBufferMemoryBudget_RejectionWarningsAreAggregated(t *testing.T) {
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	budget := NewBufferMemoryBudget(1, BufferMemoryBudgetReject)
+	for range 100 {
+		buffer := NewBufferedWriteCloser(0, 1024, budget)
+		_, err := buffer.Write([]byte("too much"))
+		assert.Equal(t, ErrBufferMemoryBudgetExceeded, err)
+		buffer.Close()
+	}
+
+	assert.Equal(t, int64(100), budget.Stats().Rejections)
+	assert.Equal(t, 1, strings.Count(logs.String(), "Buffer memory budget exceeded"))
+}
+
+func TestBufferMemoryBudget_SharedByServerRequests(t *testing.T) {
+	config := &Config{
+		Bind:                     "127.0.0.1",
+		AlternateConfigDir:       t.TempDir(),
+		BufferMemoryBudget:       4,
+		BufferMemoryBudgetAction: BufferMemoryBudgetReject,
+	}
+	server := NewServer(config, NewRouter(NewFileStateStore(config.StatePath())))
+	require.NoError(t, server.Start())
+	t.Cleanup(server.Stop)
+	addr := fmt.Sprintf("http://localhost:%d", server.HttpPort())
+
+	_, target := testBackendWithHandler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	targetOptions := defaultTargetOptions
+	targetOptions.BufferRequests = true
+	targetOptions.MaxMemoryBufferSize = 1024
+	require.NoError(t, server.router.SetServiceTarget("service1", defaultEmptyHosts, target, defaultServiceOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	resp, err := http.Post(addr, "text/plain", strings.NewReader("Hello, World!"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int64(1), server.bufferMemory.Stats().Rejections)
+}
+
+func TestNormalizeBufferMemoryBudgetAction(t *testing.T) {
+	action, err := NormalizeBufferMemoryBudgetAction("")
+	require.NoError(t, err)
+	assert.Equal(t, BufferMemoryBudgetSpill, action)
+
+	action, err = NormalizeBufferMemoryBudgetAction("reject")
+	require.NoError(t, err)
+	assert.Equal(t, BufferMemoryBudgetReject, action)
+
+	_, err = NormalizeBufferMemoryBudgetAction("drop")
+	assert.Equal(t, ErrorInvalidBufferMemoryBudgetAction, err)
+}
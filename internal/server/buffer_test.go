@@ -25,7 +25,7 @@ func TestBufferedReadCloser(t *testing.T) {
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
 			r := io.NopCloser(strings.NewReader("Hello, World!"))
-			brc, err := NewBufferedReadCloser(r, tc.maxBytes, tc.maxMemBytes)
+			brc, err := NewBufferedReadCloser(r, tc.maxBytes, tc.maxMemBytes, nil)
 
 			if tc.expectOverflow {
 				require.Equal(t, ErrMaximumSizeExceeded, err)
@@ -42,7 +42,7 @@ func TestBufferedReadCloser(t *testing.T) {
 
 func TestBufferedReadCloser_EmptyReader(t *testing.T) {
 	r := io.NopCloser(strings.NewReader(""))
-	brc, err := NewBufferedReadCloser(r, 2048, 1024)
+	brc, err := NewBufferedReadCloser(r, 2048, 1024, nil)
 
 	require.NoError(t, err)
 
@@ -66,7 +66,7 @@ func TestBufferedWriteCloser(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			bwc := NewBufferedWriteCloser(tc.maxBytes, tc.maxMemBytes)
+			bwc := NewBufferedWriteCloser(tc.maxBytes, tc.maxMemBytes, nil)
 			_, err := bwc.Write([]byte("Hello, World!"))
 
 			if tc.expectOverflow {
@@ -84,7 +84,7 @@ func TestBufferedWriteCloser(t *testing.T) {
 }
 
 func TestBufferedWriteCloser_NothingWritten(t *testing.T) {
-	bwc := NewBufferedWriteCloser(2048, 1024)
+	bwc := NewBufferedWriteCloser(2048, 1024, nil)
 
 	var result strings.Builder
 	require.NoError(t, bwc.Send(&result))
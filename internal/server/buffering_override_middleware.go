@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	BufferingOverrideHeader      = "X-Kamal-Buffering"
+	BufferingOverrideTokenHeader = "X-Kamal-Buffering-Token"
+)
+
+var (
+	ErrorInvalidTrustedNetwork               = errors.New("must be an IP address or CIDR range")
+	ErrorBufferingOverrideTokenFileEmpty     = errors.New("buffering override token file contains no token")
+	ErrorBufferingOverrideTokenFileAmbiguous = errors.New("buffering override token file must contain a single token")
+)
+
+// BufferingOverrideMiddleware lets trusted clients turn off response
+// buffering for a single request by sending `X-Kamal-Buffering: off`. That
+// makes it possible to debug streaming responses in production, without
+// redeploying the service.
+//
+// A client is trusted if its address is in one of the configured networks, or
+// if it sends the configured token in X-Kamal-Buffering-Token. The headers are
+// never passed on to the target.
+type BufferingOverrideMiddleware struct {
+	token      string
+	networks   []*net.IPNet
+	unbuffered http.Handler
+	next       http.Handler
+}
+
+func WithBufferingOverrideMiddleware(token string, networks []string, unbuffered http.Handler, next http.Handler) (http.Handler, error) {
+	parsed := []*net.IPNet{}
+	for _, network := range networks {
+		ipNet, err := ParseTrustedNetwork(network)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, ipNet)
+	}
+
+	return &BufferingOverrideMiddleware{
+		token:      token,
+		networks:   parsed,
+		unbuffered: unbuffered,
+		next:       next,
+	}, nil
+}
+
+// readBufferingOverrideToken reads the token from a file, which keeps it out
+// of the saved and displayed target options.
+func readBufferingOverrideToken(path string) (string, error) {
+	tokens, err := readSecretFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(tokens) {
+	case 0:
+		return "", ErrorBufferingOverrideTokenFileEmpty
+	case 1:
+		return tokens[0], nil
+	default:
+		return "", ErrorBufferingOverrideTokenFileAmbiguous
+	}
+}
+
+// ParseTrustedNetwork accepts an IP address or a CIDR range.
+func ParseTrustedNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, ErrorInvalidTrustedNetwork
+		}
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, ErrorInvalidTrustedNetwork
+	}
+	return ipNet, nil
+}
+
+func (h *BufferingOverrideMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	override := strings.EqualFold(r.Header.Get(BufferingOverrideHeader), "off")
+	token := r.Header.Get(BufferingOverrideTokenHeader)
+
+	r.Header.Del(BufferingOverrideHeader)
+	r.Header.Del(BufferingOverrideTokenHeader)
+
+	if override && h.isTrusted(r, token) {
+		slog.Info("Response buffering disabled by request header", "path", r.URL.Path)
+		h.unbuffered.ServeHTTP(w, r)
+		return
+	}
+
+	h.next.ServeHTTP(w, r)
+}
+
+// Private
+
+func (h *BufferingOverrideMiddleware) isTrusted(r *http.Request, token string) bool {
+	if h.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1 {
+		return true
+	}
+
+	ip, ok := clientIP(r.RemoteAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range h.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
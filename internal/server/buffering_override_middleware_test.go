@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferingOverrideMiddleware(t *testing.T) {
+	sendRequest := func(token string, networks []string, headers map[string]string) (int, http.Header) {
+		var received http.Header
+		unbuffered := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header
+			w.Write([]byte("this response body is much too large to buffer"))
+		})
+
+		middleware, err := WithBufferingOverrideMiddleware(token, networks, unbuffered, WithResponseBufferMiddleware(4, 8, 0, unbuffered))
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		middleware.ServeHTTP(w, req)
+
+		return w.Result().StatusCode, received
+	}
+
+	t.Run("buffered without the header", func(t *testing.T) {
+		status, _ := sendRequest("secret", []string{"192.0.2.0/24"}, nil)
+		assert.Equal(t, http.StatusInternalServerError, status)
+	})
+
+	t.Run("unbuffered with a valid token", func(t *testing.T) {
+		status, received := sendRequest("secret", nil, map[string]string{
+			BufferingOverrideHeader:      "off",
+			BufferingOverrideTokenHeader: "secret",
+		})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Empty(t, received.Get(BufferingOverrideHeader))
+		assert.Empty(t, received.Get(BufferingOverrideTokenHeader))
+	})
+
+	t.Run("buffered with an invalid token", func(t *testing.T) {
+		status, received := sendRequest("secret", nil, map[string]string{
+			BufferingOverrideHeader:      "off",
+			BufferingOverrideTokenHeader: "guess",
+		})
+		assert.Equal(t, http.StatusInternalServerError, status)
+		assert.Empty(t, received.Get(BufferingOverrideTokenHeader))
+	})
+
+	t.Run("unbuffered from a trusted network", func(t *testing.T) {
+		status, _ := sendRequest("", []string{"10.0.0.1", "192.0.2.0/24"}, map[string]string{BufferingOverrideHeader: "off"})
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("buffered from another network", func(t *testing.T) {
+		status, _ := sendRequest("", []string{"10.0.0.1"}, map[string]string{BufferingOverrideHeader: "off"})
+		assert.Equal(t, http.StatusInternalServerError, status)
+	})
+}
+
+func TestBufferingOverrideMiddleware_ParseTrustedNetwork(t *testing.T) {
+	network, err := ParseTrustedNetwork("10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1/32", network.String())
+
+	network, err = ParseTrustedNetwork("fd00::1")
+	require.NoError(t, err)
+	assert.Equal(t, "fd00::1/128", network.String())
+
+	network, err = ParseTrustedNetwork("10.0.0.0/8")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/8", network.String())
+
+	_, err = ParseTrustedNetwork("example.com")
+	assert.Equal(t, ErrorInvalidTrustedNetwork, err)
+}
+
+func TestBufferingOverrideTokenFile(t *testing.T) {
+	writeTokenFile := func(contents string) string {
+		path := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+		return path
+	}
+
+	token, err := readBufferingOverrideToken(writeTokenFile("# debugging token\nsecret\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "secret", token)
+
+	_, err = readBufferingOverrideToken(writeTokenFile("\n"))
+	assert.ErrorIs(t, err, ErrorBufferingOverrideTokenFileEmpty)
+
+	_, err = readBufferingOverrideToken(writeTokenFile("one\ntwo\n"))
+	assert.ErrorIs(t, err, ErrorBufferingOverrideTokenFileAmbiguous)
+
+	options := TargetOptions{BufferResponses: true, BufferingOverrideTokenFile: writeTokenFile("secret\n")}
+	data, err := json.Marshal(options)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret\"")
+}
@@ -1,13 +1,21 @@
 package server
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
+	"sync/atomic"
 )
 
-var ErrorUnableToLoadCertificate = errors.New("unable to load certificate")
+var (
+	ErrorUnableToLoadCertificate = errors.New("unable to load certificate")
+	ErrorCertificateHostMismatch = errors.New("certificate is not valid for host")
+)
 
 type CertManager interface {
 	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
@@ -16,25 +24,96 @@ type CertManager interface {
 
 // StaticCertManager is a certificate manager that loads certificates from disk.
 type StaticCertManager struct {
-	cert *tls.Certificate
+	cert atomic.Pointer[tls.Certificate]
 }
 
 func NewStaticCertManager(tlsCertificateFilePath, tlsPrivateKeyFilePath string) (*StaticCertManager, error) {
-	cert, err := tls.LoadX509KeyPair(tlsCertificateFilePath, tlsPrivateKeyFilePath)
+	cert, err := loadStaticCertificate(tlsCertificateFilePath, tlsPrivateKeyFilePath)
 	if err != nil {
-		slog.Error("Error loading TLS certificate", "error", err)
-		return nil, ErrorUnableToLoadCertificate
+		return nil, err
 	}
 
-	return &StaticCertManager{
-		cert: &cert,
-	}, nil
+	m := &StaticCertManager{}
+	m.cert.Store(cert)
+	return m, nil
 }
 
 func (m *StaticCertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-	return m.cert, nil
+	return m.cert.Load(), nil
 }
 
 func (m *StaticCertManager) HTTPHandler(handler http.Handler) http.Handler {
 	return handler
 }
+
+// Private
+
+// replace puts a certificate into use for new connections.
+func (m *StaticCertManager) replace(cert *tls.Certificate) {
+	current := m.cert.Swap(cert)
+	if !bytes.Equal(cert.Certificate[0], current.Certificate[0]) {
+		slog.Info("Replaced TLS certificate", "expires", cert.Leaf.NotAfter)
+	}
+}
+
+func loadStaticCertificate(tlsCertificateFilePath, tlsPrivateKeyFilePath string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(tlsCertificateFilePath, tlsPrivateKeyFilePath)
+	if err == nil && cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if err != nil {
+		slog.Error("Error loading TLS certificate", "error", err)
+		return nil, ErrorUnableToLoadCertificate
+	}
+
+	return &cert, nil
+}
+
+// loadStaticCertificateForHosts loads a certificate that must be valid for
+// each of the hosts, so that a mistaken path can't take a working service
+// offline.
+func loadStaticCertificateForHosts(tlsCertificateFilePath, tlsPrivateKeyFilePath string, hosts []string) (*tls.Certificate, error) {
+	cert, err := loadStaticCertificate(tlsCertificateFilePath, tlsPrivateKeyFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyCertificateHosts(cert.Leaf, hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+func verifyCertificateHosts(leaf *x509.Certificate, hosts []string) error {
+	for _, host := range hosts {
+		// A wildcard host needs a wildcard certificate, which will match any
+		// single label in its place.
+		name := strings.Replace(host, "*", "wildcard", 1)
+		if leaf.VerifyHostname(name) != nil {
+			return fmt.Errorf("%w: %s", ErrorCertificateHostMismatch, host)
+		}
+	}
+	return nil
+}
+
+// certHostFor returns the host, of those given, that covers the requested
+// name; a wildcard covers a single label in its place.
+func certHostFor(hosts []string, name string) string {
+	for _, host := range hosts {
+		if host == name {
+			return host
+		}
+	}
+
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		for _, host := range hosts {
+			if host == "*."+parent {
+				return host
+			}
+		}
+	}
+
+	return ""
+}
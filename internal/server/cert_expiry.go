@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	DefaultCertExpiryWarning = 14 * 24 * time.Hour
+
+	certExpiryCheckInterval = 12 * time.Hour
+)
+
+type CertificateStatus struct {
+	Service  string    `json:"service"`
+	Host     string    `json:"host"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+func (cs CertificateStatus) ExpiresWithin(period time.Duration) bool {
+	return time.Until(cs.NotAfter) < period
+}
+
+// CertExpiryChecker periodically looks for certificates that are close to
+// expiring. Automatic certificates are renewed well before they get this
+// close, so one that shows up here means renewal has been failing.
+type CertExpiryChecker struct {
+	router        *Router
+	warningPeriod time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewCertExpiryChecker(router *Router, warningPeriod time.Duration) *CertExpiryChecker {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &CertExpiryChecker{
+		router:        router,
+		warningPeriod: warningPeriod,
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (c *CertExpiryChecker) Start() {
+	go c.run()
+}
+
+func (c *CertExpiryChecker) Close() {
+	c.cancel()
+}
+
+// Private
+
+func (c *CertExpiryChecker) run() {
+	ticker := time.NewTicker(certExpiryCheckInterval)
+	defer ticker.Stop()
+
+	c.check()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.check()
+		}
+	}
+}
+
+func (c *CertExpiryChecker) check() {
+	expiring := []CertificateStatus{}
+	for _, status := range c.router.CertificateStatuses() {
+		if status.ExpiresWithin(c.warningPeriod) {
+			slog.Warn("Certificate is close to expiry", "service", status.Service, "host", status.Host, "expires", status.NotAfter, "remaining", time.Until(status.NotAfter).Round(time.Minute))
+			expiring = append(expiring, status)
+		}
+	}
+
+	c.router.certExpiry.record(expiring)
+}
+
+// certExpiryMetrics is what the expiry checks have found: the days left on
+// each certificate that was close to expiry at the last check, by host, and
+// how many warnings have been logged since the proxy started.
+type certExpiryMetrics struct {
+	lock          sync.Mutex
+	daysRemaining map[string]int
+	warnings      int64
+}
+
+func (m *certExpiryMetrics) record(expiring []CertificateStatus) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.daysRemaining = map[string]int{}
+	for _, status := range expiring {
+		m.daysRemaining[status.Host] = int(math.Floor(time.Until(status.NotAfter).Hours() / 24))
+	}
+	m.warnings += int64(len(expiring))
+}
+
+func (m *certExpiryMetrics) snapshot() (map[string]int, int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	days := make(map[string]int, len(m.daysRemaining))
+	for host, remaining := range m.daysRemaining {
+		days[host] = remaining
+	}
+	return days, m.warnings
+}
+
+func certificateExpiry(certManager CertManager, host string) (time.Time, bool) {
+	switch manager := certManager.(type) {
+	case *StaticCertManager:
+		cert := manager.cert.Load()
+		if cert.Leaf == nil {
+			return time.Time{}, false
+		}
+		return cert.Leaf.NotAfter, true
+
+	case *autocert.Manager:
+		return cachedCertificateExpiry(manager.Cache, host)
+
+	case *DNSCertManager:
+		return cachedCertificateExpiry(manager.cache, host)
+
+	case *InternalCertManager:
+		if cert, ok := manager.certificate(host); ok {
+			return cert.Leaf.NotAfter, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// cachedCertificateExpiry reports when the certificate cached for a host
+// expires. Caches that remember expiry times answer from memory.
+func cachedCertificateExpiry(cache autocert.Cache, host string) (time.Time, bool) {
+	if cache, ok := cache.(*certExpiryCache); ok {
+		return cache.expiry(host)
+	}
+	return readCertificateExpiry(cache, host)
+}
+
+// certExpiryCache remembers when each certificate in a cache expires, so that
+// reporting on them doesn't read the cache every time. Certificates are issued
+// and renewed by writing them through it, which keeps it up to date.
+type certExpiryCache struct {
+	autocert.Cache
+
+	lock     sync.Mutex
+	expiries map[string]certExpiry
+}
+
+type certExpiry struct {
+	notAfter time.Time
+	ok       bool
+}
+
+func newCertExpiryCache(cache autocert.Cache) *certExpiryCache {
+	return &certExpiryCache{Cache: cache, expiries: map[string]certExpiry{}}
+}
+
+func (c *certExpiryCache) Put(ctx context.Context, key string, data []byte) error {
+	err := c.Cache.Put(ctx, key, data)
+	if err != nil {
+		return err
+	}
+
+	notAfter, ok := parseCertificateExpiry(data)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.expiries[key] = certExpiry{notAfter: notAfter, ok: ok}
+
+	return nil
+}
+
+func (c *certExpiryCache) Delete(ctx context.Context, key string) error {
+	c.lock.Lock()
+	delete(c.expiries, key)
+	c.lock.Unlock()
+
+	return c.Cache.Delete(ctx, key)
+}
+
+func (c *certExpiryCache) expiry(host string) (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expiry, ok := c.expiries[host]
+	if !ok {
+		notAfter, found := readCertificateExpiry(c.Cache, host)
+		expiry = certExpiry{notAfter: notAfter, ok: found}
+		c.expiries[host] = expiry
+	}
+
+	return expiry.notAfter, expiry.ok
+}
+
+func readCertificateExpiry(cache autocert.Cache, host string) (time.Time, bool) {
+	if cache == nil {
+		return time.Time{}, false
+	}
+
+	data, err := cache.Get(context.Background(), host)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return parseCertificateExpiry(data)
+}
+
+// parseCertificateExpiry finds the expiry of a cache entry, which holds the
+// private key followed by the certificate chain, with the leaf certificate
+// first.
+func parseCertificateExpiry(data []byte) (time.Time, bool) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return time.Time{}, false
+		}
+
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return time.Time{}, false
+			}
+			return cert.NotAfter, true
+		}
+	}
+}
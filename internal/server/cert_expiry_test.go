@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestCertificateStatuses_StaticCertificate(t *testing.T) {
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "example.com", "www.example.com")
+
+	service := testCreateService(t, []string{"example.com", "www.example.com"}, ServiceOptions{
+		TLSEnabled:         true,
+		TLSCertificatePath: certPath,
+		TLSPrivateKeyPath:  keyPath,
+	}, defaultTargetOptions)
+
+	statuses := service.CertificateStatuses()
+	require.Len(t, statuses, 2)
+
+	assert.Equal(t, "example.com", statuses[0].Host)
+	assert.Equal(t, "www.example.com", statuses[1].Host)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), statuses[0].NotAfter, time.Minute)
+	assert.True(t, statuses[0].ExpiresWithin(DefaultCertExpiryWarning))
+}
+
+func TestCertExpiryChecker_RecordsDaysRemaining(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "example.com")
+
+	options := ServiceOptions{TLSEnabled: true, TLSCertificatePath: certPath, TLSPrivateKeyPath: keyPath}
+	require.NoError(t, router.SetServiceTarget("service1", []string{"example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	checker := NewCertExpiryChecker(router, DefaultCertExpiryWarning)
+	checker.check()
+	checker.check()
+
+	days, warnings := router.certExpiry.snapshot()
+	assert.Equal(t, map[string]int{"example.com": 0}, days)
+	assert.Equal(t, int64(2), warnings)
+
+	handler := WithInternalEndpointsMiddleware(DefaultInternalPathPrefix, router, nil, true, http.NotFoundHandler())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/.kamal/acme", nil))
+	assert.JSONEq(t, `{"certificates":1,"expiring_soon":1,"expiry_warnings":2,"challenges_served":0,"days_remaining":{"example.com":0}}`, w.Body.String())
+}
+
+func TestCertificateStatuses_NoTLS(t *testing.T) {
+	service := testCreateService(t, []string{"example.com"}, defaultServiceOptions, defaultTargetOptions)
+
+	assert.Empty(t, service.CertificateStatuses())
+}
+
+func TestCertificateStatuses_CachedAutomaticCertificate(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+	require.NoError(t, cache.Put(context.Background(), "example.com", []byte(keyPem+"\n"+certPem)))
+
+	notAfter, ok := cachedCertificateExpiry(cache, "example.com")
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2018, 10, 20, 19, 43, 6, 0, time.UTC), notAfter)
+
+	_, ok = cachedCertificateExpiry(cache, "other.example.com")
+	assert.False(t, ok)
+}
+
+func TestCertificateStatuses_ExpiryIsRememberedUntilRenewal(t *testing.T) {
+	dir := t.TempDir()
+	cache := newCertExpiryCache(autocert.DirCache(dir))
+
+	_, ok := cachedCertificateExpiry(cache, "example.com")
+	assert.False(t, ok)
+
+	require.NoError(t, cache.Put(context.Background(), "example.com", []byte(keyPem+"\n"+certPem)))
+
+	notAfter, ok := cachedCertificateExpiry(cache, "example.com")
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2018, 10, 20, 19, 43, 6, 0, time.UTC), notAfter)
+
+	// Answered from memory, without reading the cache again
+	require.NoError(t, os.Remove(filepath.Join(dir, "example.com")))
+	notAfter, ok = cachedCertificateExpiry(cache, "example.com")
+	require.True(t, ok)
+	assert.Equal(t, 2018, notAfter.Year())
+
+	certFile, keyFile := prepareTestCertificateFilesForHosts(t, "example.com")
+	certData, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	keyData, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	require.NoError(t, cache.Put(context.Background(), "example.com", append(keyData, certData...)))
+
+	notAfter, ok = cachedCertificateExpiry(cache, "example.com")
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), notAfter, time.Minute)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	CertificateIssued  = "issued"
+	CertificatePending = "pending"
+	CertificateFailed  = "failed"
+
+	certIssuanceMinBackoff = time.Minute
+	certIssuanceMaxBackoff = time.Hour
+)
+
+// HostCertificateStatus describes the state of the certificate for one of a
+// service's hosts.
+type HostCertificateStatus struct {
+	Host        string     `json:"host"`
+	State       string     `json:"state"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+}
+
+// HostCertificateStatuses reports the certificate state of each of the
+// service's hosts. Automatic certificates are pending until they have been
+// issued, which happens on the first TLS request for the host; if issuance
+// fails, the error from the most recent attempt is included.
+func (s *Service) HostCertificateStatuses() []HostCertificateStatus {
+	result := []HostCertificateStatus{}
+	config := s.config()
+	if config.certManager == nil {
+		return result
+	}
+
+	for _, host := range config.hosts {
+		status := HostCertificateStatus{Host: host, State: CertificatePending}
+
+		attempt, attempted := s.certIssuance.lookup(host)
+		if attempted {
+			status.LastAttempt = &attempt.at
+			if attempt.err != nil {
+				status.LastError = attempt.err.Error()
+			}
+		}
+
+		switch manager := config.certManager.(type) {
+		case *StaticCertManager:
+			leaf := manager.cert.Load().Leaf
+			status.State = CertificateIssued
+			status.NotAfter = &leaf.NotAfter
+			if err := verifyCertificateHosts(leaf, []string{host}); err != nil {
+				status.State = CertificateFailed
+				status.LastError = err.Error()
+			}
+
+		case *autocert.Manager:
+			if notAfter, ok := cachedCertificateExpiry(manager.Cache, host); ok {
+				status.State = CertificateIssued
+				status.NotAfter = &notAfter
+			} else if status.LastError != "" {
+				status.State = CertificateFailed
+			}
+
+		case *DNSCertManager:
+			if attempt, ok := manager.issuance.lookup(host); ok {
+				status.LastAttempt = &attempt.at
+				if attempt.err != nil {
+					status.LastError = attempt.err.Error()
+				}
+			}
+
+			if notAfter, ok := cachedCertificateExpiry(manager.cache, host); ok {
+				status.State = CertificateIssued
+				status.NotAfter = &notAfter
+			} else if status.LastError != "" {
+				status.State = CertificateFailed
+			}
+
+		case *InternalCertManager:
+			// Certificates are minted on the first handshake for each host,
+			// so until then they're pending, but can't fail.
+			if cert, ok := manager.certificate(host); ok {
+				status.State = CertificateIssued
+				status.NotAfter = &cert.Leaf.NotAfter
+			}
+		}
+
+		result = append(result, status)
+	}
+
+	return result
+}
+
+// Private
+
+type certIssuanceAttempt struct {
+	at       time.Time
+	err      error
+	failures int
+}
+
+// certIssuanceTracker remembers the outcome of the most recent attempt to get
+// a certificate for each host, since the ACME manager doesn't keep track of
+// its failures.
+type certIssuanceTracker struct {
+	lock     sync.Mutex
+	attempts map[string]certIssuanceAttempt
+}
+
+func newCertIssuanceTracker() *certIssuanceTracker {
+	return &certIssuanceTracker{attempts: map[string]certIssuanceAttempt{}}
+}
+
+func (t *certIssuanceTracker) record(host string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	failures := 0
+	if err != nil {
+		failures = t.attempts[host].failures + 1
+	}
+
+	t.attempts[host] = certIssuanceAttempt{at: time.Now(), err: err, failures: failures}
+}
+
+// backingOff is true while a host whose last attempt failed should be left
+// alone, so that handshakes for it don't each start a new order and run into
+// the ACME server's rate limits. The wait doubles with each failure in a row,
+// from a minute up to an hour.
+func (t *certIssuanceTracker) backingOff(host string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	attempt, ok := t.attempts[host]
+	if !ok || attempt.err == nil {
+		return false
+	}
+
+	backoff := certIssuanceMaxBackoff
+	if attempt.failures < 8 {
+		backoff = min(certIssuanceMinBackoff<<(attempt.failures-1), certIssuanceMaxBackoff)
+	}
+	return time.Since(attempt.at) < backoff
+}
+
+func (t *certIssuanceTracker) lookup(host string) (certIssuanceAttempt, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	attempt, ok := t.attempts[host]
+	return attempt, ok
+}
+
+func (s *Service) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	manager := s.config().certManager
+	if manager == nil {
+		return nil, ErrorUnknownServerName
+	}
+
+	cert, err := manager.GetCertificate(hello)
+
+	if _, ok := manager.(*autocert.Manager); ok {
+		s.certIssuance.record(normalizeRequestHost(hello.ServerName), err)
+	}
+
+	return cert, err
+}
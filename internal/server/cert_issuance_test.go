@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestHostCertificateStatuses_StaticCertificate(t *testing.T) {
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "example.com", "other.example.com")
+
+	service := testCreateService(t, []string{"example.com", "other.example.com"}, ServiceOptions{
+		TLSEnabled:         true,
+		TLSCertificatePath: certPath,
+		TLSPrivateKeyPath:  keyPath,
+	}, defaultTargetOptions)
+
+	statuses := service.HostCertificateStatuses()
+	require.Len(t, statuses, 2)
+
+	assert.Equal(t, CertificateIssued, statuses[0].State)
+	assert.NotNil(t, statuses[0].NotAfter)
+	assert.Empty(t, statuses[0].LastError)
+
+	assert.Equal(t, CertificateIssued, statuses[1].State)
+	assert.NotNil(t, statuses[1].NotAfter)
+}
+
+func TestHostCertificateStatuses_AutomaticCertificates(t *testing.T) {
+	options := ServiceOptions{TLSEnabled: true, ACMECachePath: t.TempDir()}
+	service := testCreateService(t, []string{"issued.example.com", "failed.example.com", "pending.example.com"}, options, defaultTargetOptions)
+
+	cache := autocert.DirCache(options.ScopedCachePath())
+	require.NoError(t, cache.Put(context.Background(), "issued.example.com", []byte(keyPem+"\n"+certPem)))
+
+	service.certIssuance.record("failed.example.com", errors.New("acme: authorization failed"))
+
+	statuses := service.HostCertificateStatuses()
+	require.Len(t, statuses, 3)
+
+	assert.Equal(t, CertificateIssued, statuses[0].State)
+	require.NotNil(t, statuses[0].NotAfter)
+	assert.Equal(t, 2018, statuses[0].NotAfter.Year())
+
+	assert.Equal(t, CertificateFailed, statuses[1].State)
+	assert.Equal(t, "acme: authorization failed", statuses[1].LastError)
+	assert.NotNil(t, statuses[1].LastAttempt)
+
+	assert.Equal(t, CertificatePending, statuses[2].State)
+	assert.Nil(t, statuses[2].LastAttempt)
+}
+
+func TestHostCertificateStatuses_RecordsIssuanceAttempts(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", 200)
+
+	options := ServiceOptions{TLSEnabled: true, ACMECachePath: t.TempDir(), ACMEDirectory: "http://127.0.0.1:1/directory"}
+	require.NoError(t, router.SetServiceTarget("service1", []string{"example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	_, err := router.GetCertificate(&tls.ClientHelloInfo{ServerName: "EXAMPLE.com"})
+	require.Error(t, err)
+
+	statuses, err := router.HostCertificateStatuses("service1")
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	assert.Equal(t, CertificateFailed, statuses[0].State)
+	assert.NotEmpty(t, statuses[0].LastError)
+
+	_, err = router.HostCertificateStatuses("unknown")
+	assert.Equal(t, ErrorServiceNotFound, err)
+}
+
+func TestHostCertificateStatuses_NoTLS(t *testing.T) {
+	service := testCreateService(t, []string{"example.com"}, defaultServiceOptions, defaultTargetOptions)
+
+	assert.Empty(t, service.HostCertificateStatuses())
+}
+
+func TestHostCertificateStatuses_RestoredService(t *testing.T) {
+	options := ServiceOptions{TLSEnabled: true, ACMECachePath: t.TempDir(), ACMEDirectory: "http://127.0.0.1:1/directory"}
+	service := testCreateService(t, []string{"example.com"}, options, defaultTargetOptions)
+
+	data, err := json.Marshal(service)
+	require.NoError(t, err)
+
+	var restored Service
+	require.NoError(t, json.Unmarshal(data, &restored))
+
+	_, err = restored.getCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	require.Error(t, err)
+	assert.Equal(t, CertificateFailed, restored.HostCertificateStatuses()[0].State)
+}
@@ -1,10 +1,19 @@
 package server
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -53,6 +62,96 @@ func TestErrorWhenKeyFormatIsInvalid(t *testing.T) {
 	require.ErrorContains(t, err, "unable to load certificate")
 }
 
+func TestStaticCertManager_ReplaceCertificate(t *testing.T) {
+	firstCert, firstKey := prepareTestCertificateFilesForHosts(t, "example.com")
+	secondCert, secondKey := prepareTestCertificateFilesForHosts(t, "example.com", "*.example.com")
+	otherCert, otherKey := prepareTestCertificateFilesForHosts(t, "other.example.org")
+
+	manager, err := NewStaticCertManager(firstCert, firstKey)
+	require.NoError(t, err)
+
+	_, err = loadStaticCertificateForHosts(otherCert, otherKey, []string{"example.com"})
+	assert.ErrorIs(t, err, ErrorCertificateHostMismatch)
+
+	second, err := loadStaticCertificateForHosts(secondCert, secondKey, []string{"example.com", "*.example.com"})
+	require.NoError(t, err)
+	manager.replace(second)
+	current, _ := manager.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Equal(t, []string{"example.com", "*.example.com"}, current.Leaf.DNSNames)
+}
+
+func TestStaticCertManager_SameCertificateIsVerifiedAgainstNewHosts(t *testing.T) {
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "example.com")
+
+	_, err := loadStaticCertificateForHosts(certPath, keyPath, []string{"example.com"})
+	assert.NoError(t, err)
+
+	_, err = loadStaticCertificateForHosts(certPath, keyPath, []string{"example.com", "other.example.com"})
+	assert.ErrorIs(t, err, ErrorCertificateHostMismatch)
+}
+
+func TestStaticCertManager_SwappedOnDeployWithoutNewTarget(t *testing.T) {
+	firstCert, firstKey := prepareTestCertificateFilesForHosts(t, "example.com")
+	secondCert, secondKey := prepareTestCertificateFilesForHosts(t, "example.com")
+	otherCert, otherKey := prepareTestCertificateFilesForHosts(t, "other.example.org")
+
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	deploy := func(certPath, keyPath string) error {
+		options := ServiceOptions{TLSEnabled: true, TLSCertificatePath: certPath, TLSPrivateKeyPath: keyPath}
+		return router.SetServiceTarget("service1", []string{"example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout)
+	}
+
+	require.NoError(t, deploy(firstCert, firstKey))
+	service := router.serviceForName("service1")
+	activeTarget := service.ActiveTarget()
+	manager := service.config().certManager
+	first, _ := router.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+
+	assert.ErrorIs(t, deploy(otherCert, otherKey), ErrorCertificateHostMismatch)
+	current, _ := router.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Same(t, first, current)
+
+	require.NoError(t, deploy(secondCert, secondKey))
+	current, _ = router.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.NotEqual(t, first.Certificate[0], current.Certificate[0])
+
+	assert.Same(t, activeTarget, service.ActiveTarget())
+	assert.Same(t, manager, service.config().certManager)
+}
+
+func TestStaticCertManager_NotSwappedWhenDeployFails(t *testing.T) {
+	firstCert, firstKey := prepareTestCertificateFilesForHosts(t, "example.com")
+	secondCert, secondKey := prepareTestCertificateFilesForHosts(t, "example.com")
+
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	options := ServiceOptions{TLSEnabled: true, TLSCertificatePath: firstCert, TLSPrivateKeyPath: firstKey}
+	require.NoError(t, router.SetServiceTarget("service1", []string{"example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	first, _ := router.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+
+	options = ServiceOptions{TLSEnabled: true, TLSCertificatePath: secondCert, TLSPrivateKeyPath: secondKey, Schedule: []string{"not a schedule"}}
+	assert.Error(t, router.SetServiceTarget("service1", []string{"example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	current, _ := router.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Same(t, first, current)
+}
+
+func TestStaticCertManager_VerifiedAgainstChangedHosts(t *testing.T) {
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "example.com")
+
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	options := ServiceOptions{TLSEnabled: true, TLSCertificatePath: certPath, TLSPrivateKeyPath: keyPath}
+	require.NoError(t, router.SetServiceTarget("service1", []string{"example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	err := router.SetServiceTarget("service1", []string{"example.com", "other.example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout)
+	assert.ErrorIs(t, err, ErrorCertificateHostMismatch)
+}
+
 // Helpers
 
 func prepareTestCertificateFiles(t *testing.T) (string, string) {
@@ -67,3 +166,32 @@ func prepareTestCertificateFiles(t *testing.T) (string, string) {
 
 	return certFile, keyFile
 }
+
+func prepareTestCertificateFilesForHosts(t *testing.T, hosts ...string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{Organization: []string{"Acme Co"}},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := path.Join(dir, "cert.pem")
+	keyFile := path.Join(dir, "key.pem")
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0644))
+
+	return certFile, keyFile
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipv6RateLimitPrefix is the size of network that IPv6 clients are rate
+// limited by. A single client is usually given a whole /64, so limiting each
+// address on its own would be easy to get around.
+const ipv6RateLimitPrefix = 64
+
+// WithClientAddressMiddleware tidies up the client address of each request,
+// before anything logs, matches or forwards it. Zones are removed from IPv6
+// addresses, since they only mean anything on this host. With unmapIPv4,
+// IPv4 clients that arrive on a dual-stack listener, as IPv4-mapped IPv6
+// addresses (::ffff:192.0.2.1), are given their plain IPv4 address instead.
+func WithClientAddressMiddleware(unmapIPv4 bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			addr := addrPort.Addr().WithZone("")
+			if unmapIPv4 {
+				addr = addr.Unmap()
+			}
+			r.RemoteAddr = netip.AddrPortFrom(addr, addrPort.Port()).String()
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Private
+
+// clientIP returns the IP address a request came from, for matching against
+// networks. IPv4-mapped addresses are unmapped, so that they match IPv4
+// networks, and zones are ignored.
+func clientIP(remoteAddr string) (net.IP, bool) {
+	addr, ok := parseClientAddr(remoteAddr)
+	if !ok {
+		return nil, false
+	}
+	return net.IP(addr.AsSlice()), true
+}
+
+// rateLimitKey identifies a client for rate limiting: by address for IPv4,
+// and by network prefix for IPv6.
+func rateLimitKey(remoteAddr string) string {
+	addr, ok := parseClientAddr(remoteAddr)
+	if !ok {
+		return remoteAddr
+	}
+
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(ipv6RateLimitPrefix)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+func parseClientAddr(remoteAddr string) (netip.Addr, bool) {
+	var addr netip.Addr
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		addr = addrPort.Addr()
+	} else if parsed, err := netip.ParseAddr(strings.Trim(remoteAddr, "[]")); err == nil {
+		addr = parsed
+	} else {
+		return netip.Addr{}, false
+	}
+
+	return addr.WithZone("").Unmap(), true
+}
+
+// splitHostPort returns the host from a Host header, with or without a port,
+// and without the brackets around an IPv6 literal.
+func splitHostPort(hostport string) (string, string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.Trim(hostport, "[]"), ""
+	}
+	return host, port
+}
+
+// joinHost is the reverse of splitHostPort for a host on its own, putting
+// IPv6 literals back in brackets so that they can be used in a URL.
+func joinHost(host string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientAddressMiddleware_RemovesZones(t *testing.T) {
+	assert.Equal(t, "[fe80::1]:1234", testClientAddress(t, false, "[fe80::1%eth0]:1234"))
+	assert.Equal(t, "[2001:db8::1]:1234", testClientAddress(t, false, "[2001:db8::1]:1234"))
+	assert.Equal(t, "192.0.2.1:1234", testClientAddress(t, false, "192.0.2.1:1234"))
+}
+
+func TestClientAddressMiddleware_UnmapsIPv4WhenEnabled(t *testing.T) {
+	assert.Equal(t, "[::ffff:192.0.2.1]:1234", testClientAddress(t, false, "[::ffff:192.0.2.1]:1234"))
+	assert.Equal(t, "192.0.2.1:1234", testClientAddress(t, true, "[::ffff:192.0.2.1]:1234"))
+	assert.Equal(t, "[2001:db8::1]:1234", testClientAddress(t, true, "[2001:db8::1]:1234"))
+}
+
+func TestClientAddressMiddleware_ForwardsUnmappedAddress(t *testing.T) {
+	var forwardedFor string
+	_, target := testBackendWithHandler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor = r.Header.Get("X-Forwarded-For")
+	}))
+
+	router := testRouter(t)
+	require.NoError(t, router.SetServiceTarget("default", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "[::ffff:192.0.2.1]:1234"
+	WithClientAddressMiddleware(true, router).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "192.0.2.1", forwardedFor)
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "[fe80::1%eth0]:1234"
+	WithClientAddressMiddleware(false, router).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "fe80::1", forwardedFor)
+}
+
+func TestClientAddress_ClientIPMatchesNetworks(t *testing.T) {
+	network, err := ParseTrustedNetwork("10.0.0.0/8")
+	require.NoError(t, err)
+
+	ip, ok := clientIP("[::ffff:10.1.2.3]:1234")
+	require.True(t, ok)
+	assert.True(t, network.Contains(ip))
+
+	network, err = ParseTrustedNetwork("fe80::/10")
+	require.NoError(t, err)
+
+	ip, ok = clientIP("[fe80::1%eth0]:1234")
+	require.True(t, ok)
+	assert.True(t, network.Contains(ip))
+
+	_, ok = clientIP("not an address")
+	assert.False(t, ok)
+}
+
+func TestClientAddress_RateLimitKey(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", rateLimitKey("192.0.2.1:1234"))
+	assert.Equal(t, "192.0.2.1", rateLimitKey("[::ffff:192.0.2.1]:1234"))
+	assert.Equal(t, "2001:db8:1:2::/64", rateLimitKey("[2001:db8:1:2:3:4:5:6]:1234"))
+	assert.Equal(t, "2001:db8:1:2::/64", rateLimitKey("[2001:db8:1:2::9%eth0]:1234"))
+}
+
+func TestClientAddress_IPv6HostLiterals(t *testing.T) {
+	host, port := splitHostPort("[2001:db8::1]:8080")
+	assert.Equal(t, "2001:db8::1", host)
+	assert.Equal(t, "8080", port)
+
+	host, port = splitHostPort("[2001:db8::1]")
+	assert.Equal(t, "2001:db8::1", host)
+	assert.Equal(t, "", port)
+
+	assert.Equal(t, "[2001:db8::1]", joinHost("2001:db8::1"))
+	assert.Equal(t, "example.com", joinHost("example.com"))
+
+	service := testCreateService(t, defaultEmptyHosts, ServiceOptions{TLSEnabled: true}, defaultTargetOptions)
+
+	req := httptest.NewRequest(http.MethodGet, "http://[2001:db8::1]/path", nil)
+	w := httptest.NewRecorder()
+	service.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "https://[2001:db8::1]/path", w.Header().Get("Location"))
+
+	req = httptest.NewRequest(http.MethodGet, "http://[2001:db8::1]:8080/", nil)
+	assert.True(t, hostIsAllowed(req, []string{"[2001:db8::1]:8080"}))
+	req = httptest.NewRequest(http.MethodGet, "http://[2001:db8::1]/", nil)
+	assert.True(t, hostIsAllowed(req, []string{"[2001:db8::1]"}))
+	assert.False(t, hostIsAllowed(req, []string{"*"}))
+}
+
+// Helpers
+
+func testClientAddress(t *testing.T, unmapIPv4 bool, remoteAddr string) string {
+	t.Helper()
+
+	var seen string
+	handler := WithClientAddressMiddleware(unmapIPv4, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.RemoteAddr
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	return seen
+}
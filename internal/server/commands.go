@@ -2,18 +2,21 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/rpc"
-	"sync"
 	"time"
 )
 
-var registered sync.Once
+var ErrorInvalidDeployArgs = errors.New("invalid deploy options")
 
 type CommandHandler struct {
 	rpcListener net.Listener
 	router      *Router
+	auditLog    *AuditLog
+	caller      AuditCaller
+	diagnose    func() []DoctorProblem
 }
 
 type DeployArgs struct {
@@ -24,6 +27,21 @@ type DeployArgs struct {
 	DrainTimeout   time.Duration
 	ServiceOptions ServiceOptions
 	TargetOptions  TargetOptions
+	Force          bool
+}
+
+type PlanDeployArgs struct {
+	DeployArgs
+	ProbeTarget bool
+}
+
+type CloneArgs struct {
+	Service       string
+	NewService    string
+	TargetURL     string
+	Hosts         []string
+	DeployTimeout time.Duration
+	DrainTimeout  time.Duration
 }
 
 type PauseArgs struct {
@@ -46,6 +64,11 @@ type RemoveArgs struct {
 	Service string
 }
 
+type HostsArgs struct {
+	Service string
+	Hosts   []string
+}
+
 type RolloutDeployArgs struct {
 	Service       string
 	TargetURL     string
@@ -57,6 +80,7 @@ type RolloutSetArgs struct {
 	Service    string
 	Percentage int
 	Allowlist  []string
+	Options    RolloutOptions
 }
 
 type RolloutStopArgs struct {
@@ -67,22 +91,51 @@ type ListResponse struct {
 	Targets ServiceDescriptionMap `json:"services"`
 }
 
-func NewCommandHandler(router *Router) *CommandHandler {
+type InflightArgs struct {
+	Service string
+}
+
+type InflightResponse struct {
+	Requests []InflightRequestDescription `json:"requests"`
+}
+
+type HistoryArgs struct {
+	Service string
+}
+
+type HistoryResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+type CertsCheckArgs struct {
+	Within time.Duration
+}
+
+type CertsCheckResponse struct {
+	Expiring []CertificateStatus `json:"expiring"`
+}
+
+type CertsStatusArgs struct {
+	Service string
+}
+
+type CertsStatusResponse struct {
+	Hosts []HostCertificateStatus `json:"hosts"`
+}
+
+type DoctorResponse struct {
+	Problems []DoctorProblem `json:"problems"`
+}
+
+func NewCommandHandler(router *Router, auditLog *AuditLog) *CommandHandler {
 	return &CommandHandler{
-		router: router,
+		router:   router,
+		auditLog: auditLog,
 	}
 }
 
 func (h *CommandHandler) Start(socketPath string) error {
 	var err error
-	registered.Do(func() {
-		err = rpc.RegisterName("kamal-proxy", h)
-	})
-	if err != nil {
-		slog.Error("Failed to register RPC handler", "error", err)
-		return err
-	}
-
 	h.rpcListener, err = net.Listen("unix", socketPath)
 	if err != nil {
 		slog.Error("Failed to start RPC listener", "error", err)
@@ -102,7 +155,7 @@ func (h *CommandHandler) Start(socketPath string) error {
 				}
 			}
 
-			go rpc.ServeConn(conn)
+			go h.serveConn(conn)
 		}
 	}()
 
@@ -114,23 +167,74 @@ func (h *CommandHandler) Close() error {
 }
 
 func (h *CommandHandler) Deploy(args DeployArgs, reply *bool) error {
-	return h.router.SetServiceTarget(args.Service, args.Hosts, args.TargetURL, args.ServiceOptions, args.TargetOptions, args.DeployTimeout, args.DrainTimeout)
+	err := args.normalize()
+	if err != nil {
+		h.audit(args.Service, "deploy", args, err)
+		return err
+	}
+
+	if args.Force {
+		err = h.router.ForceServiceTarget(args.Service, args.Hosts, args.TargetURL, args.ServiceOptions, args.TargetOptions, args.DrainTimeout)
+	} else {
+		err = h.router.SetServiceTarget(args.Service, args.Hosts, args.TargetURL, args.ServiceOptions, args.TargetOptions, args.DeployTimeout, args.DrainTimeout)
+	}
+	h.audit(args.Service, "deploy", args, err)
+	return err
+}
+
+func (h *CommandHandler) PlanDeploy(args PlanDeployArgs, reply *ChangePlan) error {
+	err := args.normalize()
+	if err != nil {
+		return err
+	}
+
+	plan, err := h.router.PlanServiceTarget(args.Service, args.Hosts, args.TargetURL, args.ServiceOptions, args.TargetOptions, args.ProbeTarget)
+	if err != nil {
+		return err
+	}
+
+	*reply = plan
+	return nil
+}
+
+func (h *CommandHandler) Clone(args CloneArgs, reply *bool) error {
+	err := h.router.CloneService(args.Service, args.NewService, args.Hosts, args.TargetURL, args.DeployTimeout, args.DrainTimeout)
+	h.audit(args.NewService, "clone", args, err)
+	return err
 }
 
 func (h *CommandHandler) Pause(args PauseArgs, reply *bool) error {
-	return h.router.PauseService(args.Service, args.DrainTimeout, args.PauseTimeout)
+	err := h.router.PauseService(args.Service, args.DrainTimeout, args.PauseTimeout)
+	h.audit(args.Service, "pause", args, err)
+	return err
 }
 
 func (h *CommandHandler) Stop(args StopArgs, reply *bool) error {
-	return h.router.StopService(args.Service, args.DrainTimeout, args.Message)
+	err := h.router.StopService(args.Service, args.DrainTimeout, args.Message)
+	h.audit(args.Service, "stop", args, err)
+	return err
 }
 
 func (h *CommandHandler) Resume(args ResumeArgs, reply *bool) error {
-	return h.router.ResumeService(args.Service)
+	err := h.router.ResumeService(args.Service)
+	h.audit(args.Service, "resume", args, err)
+	return err
 }
 
 func (h *CommandHandler) Remove(args RemoveArgs, reply *bool) error {
-	return h.router.RemoveService(args.Service)
+	err := h.router.RemoveService(args.Service)
+	h.audit(args.Service, "remove", args, err)
+	return err
+}
+
+func (h *CommandHandler) PlanRemove(args RemoveArgs, reply *ChangePlan) error {
+	plan, err := h.router.PlanRemoveService(args.Service)
+	if err != nil {
+		return err
+	}
+
+	*reply = plan
+	return nil
 }
 
 func (h *CommandHandler) List(args bool, reply *ListResponse) error {
@@ -139,14 +243,191 @@ func (h *CommandHandler) List(args bool, reply *ListResponse) error {
 	return nil
 }
 
+func (h *CommandHandler) AddHosts(args HostsArgs, reply *bool) error {
+	err := h.router.AddServiceHosts(args.Service, args.Hosts)
+	h.audit(args.Service, "host add", args, err)
+	return err
+}
+
+func (h *CommandHandler) RemoveHosts(args HostsArgs, reply *bool) error {
+	err := h.router.RemoveServiceHosts(args.Service, args.Hosts)
+	h.audit(args.Service, "host remove", args, err)
+	return err
+}
+
 func (h *CommandHandler) RolloutDeploy(args RolloutDeployArgs, reply *bool) error {
-	return h.router.SetRolloutTarget(args.Service, args.TargetURL, args.DeployTimeout, args.DrainTimeout)
+	err := h.router.SetRolloutTarget(args.Service, args.TargetURL, args.DeployTimeout, args.DrainTimeout)
+	h.audit(args.Service, "rollout deploy", args, err)
+	return err
 }
 
 func (h *CommandHandler) RolloutSet(args RolloutSetArgs, reply *bool) error {
-	return h.router.SetRolloutSplit(args.Service, args.Percentage, args.Allowlist)
+	err := h.router.SetRolloutSplit(args.Service, args.Percentage, args.Allowlist, args.Options)
+	h.audit(args.Service, "rollout set", args, err)
+	return err
 }
 
 func (h *CommandHandler) RolloutStop(args RolloutStopArgs, reply *bool) error {
-	return h.router.StopRollout(args.Service)
+	err := h.router.StopRollout(args.Service)
+	h.audit(args.Service, "rollout stop", args, err)
+	return err
+}
+
+func (h *CommandHandler) History(args HistoryArgs, reply *HistoryResponse) error {
+	if h.auditLog == nil {
+		reply.Entries = []AuditEntry{}
+		return nil
+	}
+
+	entries, err := h.auditLog.History(args.Service)
+	if err != nil {
+		return err
+	}
+
+	reply.Entries = entries
+	return nil
+}
+
+func (h *CommandHandler) Inflight(args InflightArgs, reply *InflightResponse) error {
+	requests, err := h.router.InflightRequests(args.Service)
+	if err != nil {
+		return err
+	}
+
+	reply.Requests = requests
+	return nil
+}
+
+func (h *CommandHandler) CertsCheck(args CertsCheckArgs, reply *CertsCheckResponse) error {
+	reply.Expiring = []CertificateStatus{}
+
+	for _, status := range h.router.CertificateStatuses() {
+		if status.ExpiresWithin(args.Within) {
+			reply.Expiring = append(reply.Expiring, status)
+		}
+	}
+
+	return nil
+}
+
+func (h *CommandHandler) CertsStatus(args CertsStatusArgs, reply *CertsStatusResponse) error {
+	hosts, err := h.router.HostCertificateStatuses(args.Service)
+	if err != nil {
+		return err
+	}
+
+	reply.Hosts = hosts
+	return nil
+}
+
+func (h *CommandHandler) Doctor(args bool, reply *DoctorResponse) error {
+	reply.Problems = []DoctorProblem{}
+	if h.diagnose != nil {
+		reply.Problems = h.diagnose()
+	}
+
+	return nil
+}
+
+// Private
+
+// normalize fills in defaults for any options left unset, and rejects those
+// the proxy can't run with. The deploy command does this too, with friendlier
+// errors, but the socket can also be reached by other clients that send their
+// arguments as they are.
+func (a *DeployArgs) normalize() error {
+	if a.DeployTimeout == 0 {
+		a.DeployTimeout = DefaultDeployTimeout
+	}
+
+	healthCheck := &a.TargetOptions.HealthCheckConfig
+	healthCheck.applyDefaults()
+	if a.TargetOptions.ResponseTimeout == 0 {
+		a.TargetOptions.ResponseTimeout = DefaultTargetTimeout
+	}
+	if a.ServiceOptions.AutoStopWindow == 0 {
+		a.ServiceOptions.AutoStopWindow = DefaultAutoStopWindow
+	}
+
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrorInvalidDeployArgs, fmt.Sprintf(format, args...))
+	}
+
+	if a.ServiceOptions.StandbyTarget != "" {
+		standbyHealthCheck := *healthCheck
+		if a.ServiceOptions.StandbyHealthCheckConfig != nil {
+			standbyHealthCheck = *a.ServiceOptions.StandbyHealthCheckConfig
+			standbyHealthCheck.applyDefaults()
+		}
+
+		standby, standbyHealthCheck, err := ParseTargetHealthCheck(a.ServiceOptions.StandbyTarget, standbyHealthCheck)
+		if err != nil {
+			return invalid("standby target %q: %v", a.ServiceOptions.StandbyTarget, err)
+		}
+		if standbyHealthCheck.Interval < 0 || standbyHealthCheck.Timeout < 0 {
+			return invalid("health check interval and timeout must be positive")
+		}
+		a.ServiceOptions.StandbyTarget, a.ServiceOptions.StandbyHealthCheckConfig = standby, &standbyHealthCheck
+	}
+
+	target, targetHealthCheck, err := ParseTargetHealthCheck(a.TargetURL, *healthCheck)
+	if err != nil {
+		return invalid("target %q: %v", a.TargetURL, err)
+	}
+	a.TargetURL, *healthCheck = target, targetHealthCheck
+
+	switch {
+	case healthCheck.Interval < 0 || healthCheck.Timeout < 0:
+		return invalid("health check interval and timeout must be positive")
+	case a.TargetOptions.ResponseTimeout < 0:
+		return invalid("target timeout must be positive")
+	case a.TargetOptions.MaxResponseTimeout != 0 && a.TargetOptions.MaxResponseTimeout <= a.TargetOptions.ResponseTimeout:
+		return invalid("max target timeout must be longer than target timeout")
+	case a.TargetOptions.WarmConnections < 0 || a.TargetOptions.WarmConnections > MaxIdleConnsPerHost:
+		return invalid("warm connections must be between 0 and %d", MaxIdleConnsPerHost)
+	case a.TargetOptions.WebSocketDrainCloseCode != 0 && !IsValidWebSocketDrainCloseCode(a.TargetOptions.WebSocketDrainCloseCode):
+		return invalid("websocket drain close code %d can't be sent to clients", a.TargetOptions.WebSocketDrainCloseCode)
+	case a.ServiceOptions.TLSEnabled && len(a.Hosts) == 0:
+		return invalid("host must be set when using TLS")
+	case a.ServiceOptions.AutoStopErrorRate < 0 || a.ServiceOptions.AutoStopErrorRate > 1:
+		return invalid("auto stop error rate must be between 0 and 1")
+	case a.ServiceOptions.AutoStopWindow < 0:
+		return invalid("auto stop window must be positive")
+	case a.ServiceOptions.RateLimit < 0 || a.ServiceOptions.RateLimitBurst < 0:
+		return invalid("rate limit must not be negative")
+	case a.ServiceOptions.HostGroupLimit < 0:
+		return invalid("host group limit must not be negative")
+	}
+
+	for _, value := range healthCheck.Headers {
+		_, _, err := ParseHealthCheckHeader(value)
+		if err != nil {
+			return invalid("health check header %q", value)
+		}
+	}
+
+	return nil
+}
+
+// serveConn serves each connection with its own RPC server, so that the
+// handler knows who is on the other end of the socket.
+func (h *CommandHandler) serveConn(conn net.Conn) {
+	handler := *h
+	handler.caller = auditCallerForConn(conn)
+
+	server := rpc.NewServer()
+	err := server.RegisterName("kamal-proxy", &handler)
+	if err != nil {
+		slog.Error("Failed to register RPC handler", "error", err)
+		conn.Close()
+		return
+	}
+
+	server.ServeConn(conn)
+}
+
+func (h *CommandHandler) audit(service, command string, args any, err error) {
+	if h.auditLog != nil {
+		h.auditLog.Record(service, command, h.caller, args, err)
+	}
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 	"syscall"
+	"time"
 )
 
 const (
@@ -13,9 +14,36 @@ const (
 )
 
 type Config struct {
-	Bind      string
-	HttpPort  int
-	HttpsPort int
+	Bind        string
+	HttpPort    int
+	HttpsPort   int
+	TunnelPort  int
+	TunnelToken string
+
+	CertExpiryWarning      time.Duration
+	InternalPathPrefix     string
+	ShutdownGracePeriod    time.Duration
+	StateStore             string
+	RequestSummaryInterval time.Duration
+	MalformedRequestPages  string
+
+	DisableSessionTickets bool
+	SessionTicketKeyFile  string
+	SessionTicketRotation time.Duration
+
+	BufferMemoryBudget       int64
+	BufferMemoryBudgetAction string
+
+	HandshakeRatePerIP int
+	HandshakeRate      int
+	HandshakeBurst     int
+
+	InternalHttpPort        int
+	InternalBind            string
+	InternalAllowedNetworks []string
+
+	MissingHost        string
+	UnmapIPv4Addresses bool
 
 	AlternateConfigDir string
 }
@@ -28,6 +56,14 @@ func (c Config) StatePath() string {
 	return path.Join(c.dataDirectory(), "kamal-proxy.state")
 }
 
+func (c Config) AuditLogPath() string {
+	return path.Join(c.dataDirectory(), "kamal-proxy.audit.log")
+}
+
+func (c Config) DeployOptionsPath(service string) string {
+	return path.Join(c.dataDirectory(), "deploy", service+".opts")
+}
+
 func (c Config) CertificatePath() string {
 	return path.Join(c.dataDirectory(), "certs")
 }
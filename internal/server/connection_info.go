@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ConnectionProtoHeader     = "X-Kamal-Proto"
+	ConnectionClientRTTHeader = "X-Kamal-Client-RTT"
+)
+
+var contextKeyConnection = contextKey("connection")
+
+// ConnectionConnContext makes the client's underlying network connection
+// available to the requests served on it. It is intended to be used as an
+// http.Server's ConnContext.
+func ConnectionConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	if recorder, ok := c.(*clientHelloConn); ok {
+		c = recorder.Conn
+	}
+	if malformed, ok := c.(*malformedRequestConn); ok {
+		c = malformed.Conn
+	}
+
+	return context.WithValue(ctx, contextKeyConnection, c)
+}
+
+// Private
+
+// forwardConnectionInfo tells the target how the client is connected to us:
+// the protocol it negotiated, and the kernel's current estimate of the
+// round-trip time to it, in milliseconds. Together with X-Request-Start, that
+// lets monitoring tools tell network latency apart from queueing.
+func (t *Target) forwardConnectionInfo(req *httputil.ProxyRequest) {
+	if !t.options.ForwardConnectionInfo {
+		return
+	}
+
+	req.Out.Header.Del(ConnectionClientRTTHeader)
+	req.Out.Header.Set(ConnectionProtoHeader, negotiatedProtocol(req.In))
+
+	conn, ok := req.In.Context().Value(contextKeyConnection).(net.Conn)
+	if !ok {
+		return
+	}
+
+	if rtt, ok := clientRTT(conn); ok {
+		ms := float64(rtt) / float64(time.Millisecond)
+		req.Out.Header.Set(ConnectionClientRTTHeader, strconv.FormatFloat(ms, 'f', 3, 64))
+	}
+}
+
+func negotiatedProtocol(r *http.Request) string {
+	switch r.ProtoMajor {
+	case 2:
+		return "h2"
+	case 3:
+		return "h3"
+	default:
+		return strings.ToLower(r.Proto)
+	}
+}
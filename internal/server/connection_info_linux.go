@@ -0,0 +1,35 @@
+//go:build linux && !386
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func clientRTT(conn net.Conn) (time.Duration, bool) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, false
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	err = rawConn.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || errno != 0 {
+		return 0, false
+	}
+
+	return time.Duration(info.Rtt) * time.Microsecond, true
+}
@@ -0,0 +1,12 @@
+//go:build !linux || 386
+
+package server
+
+import (
+	"net"
+	"time"
+)
+
+func clientRTT(conn net.Conn) (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,38 @@
+package server
+
+import "time"
+
+// DeployTimings records how long each phase of a deployment took, so that a
+// slow deployment can be attributed to its health checks, draining, or
+// saving state.
+type DeployTimings struct {
+	Resolve      time.Duration `json:"resolve"`
+	CreateTarget time.Duration `json:"create_target"`
+	HealthCheck  time.Duration `json:"health_check"`
+	WarmUp       time.Duration `json:"warm_up"`
+	Swap         time.Duration `json:"swap"`
+	Drain        time.Duration `json:"drain"`
+	SaveState    time.Duration `json:"save_state"`
+	Total        time.Duration `json:"total"`
+}
+
+// Private
+
+func (dt *DeployTimings) measure(phase *time.Duration, fn func()) {
+	started := time.Now()
+	fn()
+	*phase = time.Since(started)
+}
+
+func (dt *DeployTimings) logAttrs() []any {
+	return []any{
+		"resolve_ms", dt.Resolve.Milliseconds(),
+		"create_target_ms", dt.CreateTarget.Milliseconds(),
+		"health_check_ms", dt.HealthCheck.Milliseconds(),
+		"warm_up_ms", dt.WarmUp.Milliseconds(),
+		"swap_ms", dt.Swap.Milliseconds(),
+		"drain_ms", dt.Drain.Milliseconds(),
+		"save_state_ms", dt.SaveState.Milliseconds(),
+		"total_ms", dt.Total.Milliseconds(),
+	}
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	dnsCertIssueTimeout  = 10 * time.Minute
+	dnsCertRenewalPeriod = 30 * 24 * time.Hour
+	dnsAccountKeyName    = "acme_account+key" // Shared with autocert, which uses the same cache
+)
+
+// dnsChallengePropagationDelay is how long to wait after creating a challenge
+// record before asking the ACME server to check it.
+var dnsChallengePropagationDelay = 30 * time.Second
+
+var (
+	ErrorCertificatePending = errors.New("certificate has not been issued yet")
+	ErrorHostNotAllowed     = errors.New("host not allowed by certificate policy")
+)
+
+// DNSCertManager provisions certificates with DNS-01 ACME challenges, which,
+// unlike the challenges autocert uses, can prove control of a wildcard host.
+//
+// Issuing a certificate this way takes too long to do during a TLS handshake,
+// since the challenge record has to propagate first. So certificates are
+// requested in the background once the service is deployed, and handshakes
+// for a host fail until its certificate is ready. They are renewed in the
+// background too, when they get close to expiry. When an attempt fails, the
+// host isn't tried again until a backoff has passed, however many handshakes
+// ask for it in the meantime.
+//
+// A manager is kept for as long as its service's ACME settings stay the same,
+// so that redeploying doesn't start new orders for hosts that are already
+// being issued.
+type DNSCertManager struct {
+	settings string
+	provider DNSProvider
+	client   *acme.Client
+	email    string
+	cache    autocert.Cache
+	issuance *certIssuanceTracker
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	hosts   []string
+	certs   map[string]*tls.Certificate
+	issuing map[string]bool
+
+	registerLock sync.Mutex
+	registered   bool
+}
+
+func NewDNSCertManager(hosts []string, provider DNSProvider, options ServiceOptions) *DNSCertManager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &DNSCertManager{
+		settings: dnsCertManagerSettings(options),
+		hosts:    hosts,
+		provider: provider,
+		client:   &acme.Client{DirectoryURL: options.ACMEDirectory},
+		email:    options.ACMEEmail,
+		cache:    newCertExpiryCache(autocert.DirCache(options.ScopedCachePath())),
+		issuance: newCertIssuanceTracker(),
+		certs:    map[string]*tls.Certificate{},
+		issuing:  map[string]bool{},
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start requests certificates for each of the hosts that doesn't have one
+// yet.
+func (m *DNSCertManager) Start() {
+	m.lock.Lock()
+	hosts := m.hosts
+	m.lock.Unlock()
+
+	for _, host := range hosts {
+		if _, err := m.certificate(host); err != nil {
+			m.issueInBackground(host)
+		}
+	}
+}
+
+// UpdateHosts changes the hosts that certificates are provided for, and
+// requests those that are missing.
+func (m *DNSCertManager) UpdateHosts(hosts []string) {
+	m.lock.Lock()
+	m.hosts = hosts
+	m.lock.Unlock()
+
+	m.Start()
+}
+
+// Close abandons any certificates that are being issued.
+func (m *DNSCertManager) Close() {
+	m.cancel()
+}
+
+func (m *DNSCertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.lock.Lock()
+	host := certHostFor(m.hosts, normalizeRequestHost(hello.ServerName))
+	m.lock.Unlock()
+
+	if host == "" {
+		return nil, ErrorHostNotAllowed
+	}
+
+	cert, err := m.certificate(host)
+	if err != nil {
+		m.issueInBackground(host)
+		return nil, err
+	}
+
+	if time.Until(cert.Leaf.NotAfter) < dnsCertRenewalPeriod {
+		m.issueInBackground(host)
+	}
+	return cert, nil
+}
+
+// HTTPHandler passes requests straight through, since DNS challenges don't
+// need anything served over HTTP.
+func (m *DNSCertManager) HTTPHandler(handler http.Handler) http.Handler {
+	return handler
+}
+
+// Private
+
+// usesSettings is true when the manager can provide certificates for a
+// service with these options.
+func (m *DNSCertManager) usesSettings(options ServiceOptions) bool {
+	return m.settings == dnsCertManagerSettings(options)
+}
+
+func dnsCertManagerSettings(options ServiceOptions) string {
+	return options.TLSDNSProvider + "\n" + options.ScopedCachePath()
+}
+
+func (m *DNSCertManager) certificate(host string) (*tls.Certificate, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if cert, ok := m.certs[host]; ok {
+		return cert, nil
+	}
+
+	data, err := m.cache.Get(context.Background(), host)
+	if err != nil {
+		return nil, ErrorCertificatePending
+	}
+
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		slog.Error("DNS: unable to load cached certificate", "host", host, "error", err)
+		return nil, ErrorCertificatePending
+	}
+
+	m.certs[host] = &cert
+	return &cert, nil
+}
+
+func (m *DNSCertManager) issueInBackground(host string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.issuing[host] || m.ctx.Err() != nil || m.issuance.backingOff(host) {
+		return
+	}
+	m.issuing[host] = true
+
+	go func() {
+		ctx, cancel := context.WithTimeout(m.ctx, dnsCertIssueTimeout)
+		defer cancel()
+
+		cert, err := m.issue(ctx, host)
+		m.issuance.record(host, err)
+
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		delete(m.issuing, host)
+		if err != nil {
+			slog.Error("DNS: unable to issue certificate", "host", host, "error", err)
+			return
+		}
+
+		m.certs[host] = cert
+		slog.Info("DNS: issued certificate", "host", host, "expires", cert.Leaf.NotAfter)
+	}()
+}
+
+func (m *DNSCertManager) issue(ctx context.Context, host string) (*tls.Certificate, error) {
+	err := m.register(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(host))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		err = m.authorize(ctx, authzURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{host}}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.store(ctx, host, key, der)
+}
+
+// authorize answers the DNS-01 challenge for one of the order's
+// authorizations. For a wildcard, the record goes on the parent domain.
+func (m *DNSCertManager) authorize(ctx context.Context, authzURL string) error {
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("ACME server offered no dns-01 challenge for %s", authz.Identifier.Value)
+	}
+
+	value, err := m.client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	name := "_acme-challenge." + authz.Identifier.Value
+	err = m.provider.Present(ctx, name, value)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.provider.CleanUp(context.WithoutCancel(ctx), name, value); err != nil {
+			slog.Warn("DNS: unable to remove challenge record", "name", name, "error", err)
+		}
+	}()
+
+	select {
+	case <-time.After(dnsChallengePropagationDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	_, err = m.client.Accept(ctx, challenge)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+func (m *DNSCertManager) register(ctx context.Context) error {
+	m.registerLock.Lock()
+	defer m.registerLock.Unlock()
+
+	if m.registered {
+		return nil
+	}
+
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return err
+	}
+	m.client.Key = key
+
+	account := &acme.Account{}
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+
+	_, err = m.client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+
+	m.registered = true
+	return nil
+}
+
+func (m *DNSCertManager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := m.cache.Get(ctx, dnsAccountKeyName)
+	if err == nil {
+		if block, _ := pem.Decode(data); block != nil {
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.cache.Put(ctx, dnsAccountKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	return key, err
+}
+
+// store caches the certificate in the same form as autocert, with the
+// private key followed by the chain.
+func (m *DNSCertManager) store(ctx context.Context, host string, key *ecdsa.PrivateKey, der [][]byte) (*tls.Certificate, error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var data bytes.Buffer
+	pem.Encode(&data, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, cert := range der {
+		pem.Encode(&data, &pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	}
+
+	err = m.cache.Put(ctx, host, data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(data.Bytes(), data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestDNSCertManager_ServesCachedWildcardCertificate(t *testing.T) {
+	options := ServiceOptions{TLSEnabled: true, ACMECachePath: t.TempDir(), ACMEDirectory: "http://127.0.0.1:1/directory"}
+	testCacheCertificate(t, options, "*.example.com")
+
+	manager := NewDNSCertManager([]string{"*.example.com", "example.com"}, &testDNSProvider{}, options)
+	manager.Start()
+
+	cert, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "App.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"*.example.com"}, cert.Leaf.DNSNames)
+
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Equal(t, ErrorCertificatePending, err)
+
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "deeper.app.example.com"})
+	assert.Equal(t, ErrorHostNotAllowed, err)
+
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"})
+	assert.Equal(t, ErrorHostNotAllowed, err)
+
+	// The pending certificate, and the renewal of the one that's close to
+	// expiry, are attempted in the background.
+	testWaitForIssuance(t, manager, "example.com", "*.example.com")
+}
+
+func TestDNSCertManager_WildcardHostsAllowedWithDNSProvider(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", 200)
+
+	options := ServiceOptions{
+		TLSEnabled:     true,
+		TLSDNSProvider: DNSProviderCloudflare,
+		ACMECachePath:  t.TempDir(),
+		ACMEDirectory:  "http://127.0.0.1:1/directory",
+	}
+	require.NoError(t, router.SetServiceTarget("service1", []string{"*.example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	// Issuance starts when the service is deployed, and fails here since
+	// there's no ACME server.
+	assert.Eventually(t, func() bool {
+		statuses, err := router.HostCertificateStatuses("service1")
+		return err == nil && len(statuses) == 1 && statuses[0].State == CertificateFailed
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDNSCertManager_NothingIssuedUntilStarted(t *testing.T) {
+	options := ServiceOptions{TLSEnabled: true, ACMECachePath: t.TempDir(), ACMEDirectory: "http://127.0.0.1:1/directory"}
+
+	manager := NewDNSCertManager([]string{"example.com"}, &testDNSProvider{}, options)
+	assert.Empty(t, manager.issuing)
+
+	manager.Close()
+	manager.Start()
+	assert.Empty(t, manager.issuing)
+}
+
+func TestDNSCertManager_KeptAcrossDeploys(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", 200)
+
+	options := ServiceOptions{
+		TLSEnabled:     true,
+		TLSDNSProvider: DNSProviderCloudflare,
+		ACMECachePath:  t.TempDir(),
+		ACMEDirectory:  "http://127.0.0.1:1/directory",
+	}
+	require.NoError(t, router.SetServiceTarget("service1", []string{"*.example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	manager := router.serviceForName("service1").config().certManager.(*DNSCertManager)
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"*.example.com", "example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	assert.Same(t, manager, router.serviceForName("service1").config().certManager)
+	testWaitForIssuance(t, manager, "*.example.com", "example.com")
+
+	options.ACMEEmail = "admin@example.com"
+	require.NoError(t, router.SetServiceTarget("service1", []string{"*.example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	assert.NotSame(t, manager, router.serviceForName("service1").config().certManager)
+	assert.Error(t, manager.ctx.Err())
+}
+
+func TestDNSCertManager_NotStartedWhenPlanning(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", 200)
+
+	options := ServiceOptions{
+		TLSEnabled:     true,
+		TLSDNSProvider: DNSProviderCloudflare,
+		ACMECachePath:  t.TempDir(),
+		ACMEDirectory:  "http://127.0.0.1:1/directory",
+	}
+	_, err := router.PlanServiceTarget("service1", []string{"*.example.com"}, target, options, defaultTargetOptions, false)
+	require.NoError(t, err)
+
+	// Issuing would start by saving an account key to the cache.
+	assert.Never(t, func() bool {
+		entries, _ := os.ReadDir(options.ACMECachePath)
+		return len(entries) > 0
+	}, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestDNSCertManager_FailedHostNotRetriedDuringBackoff(t *testing.T) {
+	options := ServiceOptions{TLSEnabled: true, ACMECachePath: t.TempDir(), ACMEDirectory: "http://127.0.0.1:1/directory"}
+
+	manager := NewDNSCertManager([]string{"example.com"}, &testDNSProvider{}, options)
+	t.Cleanup(manager.Close)
+
+	_, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Equal(t, ErrorCertificatePending, err)
+	testWaitForIssuance(t, manager, "example.com")
+
+	failed, ok := manager.issuance.lookup("example.com")
+	require.True(t, ok)
+	require.Error(t, failed.err)
+
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Equal(t, ErrorCertificatePending, err)
+
+	manager.lock.Lock()
+	assert.False(t, manager.issuing["example.com"])
+	manager.lock.Unlock()
+
+	attempt, _ := manager.issuance.lookup("example.com")
+	assert.Equal(t, failed.at, attempt.at)
+}
+
+func TestCertIssuanceTracker_Backoff(t *testing.T) {
+	tracker := newCertIssuanceTracker()
+	assert.False(t, tracker.backingOff("example.com"))
+
+	tracker.record("example.com", errors.New("acme: rate limited"))
+	assert.True(t, tracker.backingOff("example.com"))
+
+	for _, test := range []struct {
+		failures int
+		elapsed  time.Duration
+		backoff  bool
+	}{
+		{1, 59 * time.Second, true},
+		{1, 61 * time.Second, false},
+		{2, 119 * time.Second, true},
+		{2, 121 * time.Second, false},
+		{7, 59 * time.Minute, true},
+		{20, 59 * time.Minute, true},
+		{20, 61 * time.Minute, false},
+	} {
+		tracker.attempts["example.com"] = certIssuanceAttempt{at: time.Now().Add(-test.elapsed), err: errors.New("failed"), failures: test.failures}
+		assert.Equal(t, test.backoff, tracker.backingOff("example.com"), "%d failures, %s", test.failures, test.elapsed)
+	}
+
+	tracker.record("example.com", nil)
+	assert.False(t, tracker.backingOff("example.com"))
+}
+
+func TestDNSCertManager_UnknownProvider(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", 200)
+
+	options := ServiceOptions{TLSEnabled: true, TLSDNSProvider: "carrier-pigeon", ACMECachePath: t.TempDir()}
+	err := router.SetServiceTarget("service1", []string{"*.example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout)
+	assert.Equal(t, ErrorUnknownDNSProvider, err)
+}
+
+// Private
+
+type testDNSProvider struct{}
+
+func (p *testDNSProvider) Present(ctx context.Context, name string, value string) error { return nil }
+func (p *testDNSProvider) CleanUp(ctx context.Context, name string, value string) error { return nil }
+
+func testWaitForIssuance(t *testing.T, manager *DNSCertManager, hosts ...string) {
+	t.Helper()
+
+	assert.Eventually(t, func() bool {
+		manager.lock.Lock()
+		defer manager.lock.Unlock()
+
+		for _, host := range hosts {
+			if _, attempted := manager.issuance.lookup(host); !attempted || manager.issuing[host] {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
+
+func testCacheCertificate(t *testing.T, options ServiceOptions, host string) {
+	t.Helper()
+
+	certFile, keyFile := prepareTestCertificateFilesForHosts(t, host)
+	certData, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	keyData, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+
+	cache := autocert.DirCache(options.ScopedCachePath())
+	require.NoError(t, cache.Put(context.Background(), host, append(keyData, certData...)))
+}
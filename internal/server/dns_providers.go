@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DNSProviderCloudflare = "cloudflare"
+	DNSProviderRoute53    = "route53"
+
+	dnsProviderTimeout  = 30 * time.Second
+	dnsChallengeTTL     = 60
+	cloudflareAPIURL    = "https://api.cloudflare.com/client/v4"
+	route53APIURL       = "https://route53.amazonaws.com"
+	route53Region       = "us-east-1"
+	route53Service      = "route53"
+	route53XMLNamespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+)
+
+var (
+	ErrorUnknownDNSProvider = errors.New("DNS provider must be \"cloudflare\" or \"route53\"")
+	ErrorDNSProviderFailed  = errors.New("DNS provider request failed")
+	ErrorDNSZoneNotFound    = errors.New("no DNS zone found for host")
+)
+
+// DNSProvider creates and removes the TXT records that answer DNS-01 ACME
+// challenges. Each provider reads its credentials from the environment.
+type DNSProvider interface {
+	Present(ctx context.Context, name string, value string) error
+	CleanUp(ctx context.Context, name string, value string) error
+}
+
+func NewDNSProvider(name string) (DNSProvider, error) {
+	switch name {
+	case DNSProviderCloudflare:
+		return NewCloudflareDNSProvider(cloudflareAPIURL, os.Getenv("CLOUDFLARE_API_TOKEN")), nil
+	case DNSProviderRoute53:
+		return NewRoute53DNSProvider(route53APIURL, awsCredentialsFromEnvironment()), nil
+	}
+	return nil, ErrorUnknownDNSProvider
+}
+
+// CloudflareDNSProvider manages records with the Cloudflare API, using an API
+// token that can edit the zone's DNS, given in CLOUDFLARE_API_TOKEN.
+type CloudflareDNSProvider struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+func NewCloudflareDNSProvider(endpoint string, token string) *CloudflareDNSProvider {
+	return &CloudflareDNSProvider{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+		client:   &http.Client{Timeout: dnsProviderTimeout},
+	}
+}
+
+func (p *CloudflareDNSProvider) Present(ctx context.Context, name string, value string) error {
+	zoneID, err := p.findZone(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	record := map[string]any{"type": "TXT", "name": name, "content": value, "ttl": dnsChallengeTTL}
+	return p.request(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", record, nil)
+}
+
+func (p *CloudflareDNSProvider) CleanUp(ctx context.Context, name string, value string) error {
+	zoneID, err := p.findZone(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"type": {"TXT"}, "name": {name}, "content": {value}}
+	var records []struct {
+		ID string `json:"id"`
+	}
+	err = p.request(ctx, http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil, &records)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		err = p.request(ctx, http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+record.ID, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Route53DNSProvider manages records with the Route 53 API, using the
+// standard AWS environment variables for credentials.
+type Route53DNSProvider struct {
+	endpoint    string
+	credentials awsCredentials
+	client      *http.Client
+}
+
+func NewRoute53DNSProvider(endpoint string, credentials awsCredentials) *Route53DNSProvider {
+	return &Route53DNSProvider{
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		credentials: credentials,
+		client:      &http.Client{Timeout: dnsProviderTimeout},
+	}
+}
+
+func (p *Route53DNSProvider) Present(ctx context.Context, name string, value string) error {
+	return p.changeRecord(ctx, "UPSERT", name, value)
+}
+
+func (p *Route53DNSProvider) CleanUp(ctx context.Context, name string, value string) error {
+	return p.changeRecord(ctx, "DELETE", name, value)
+}
+
+// Private
+
+// dnsZoneCandidates lists the domains that could be the zone a record is in,
+// from the most specific to the least.
+func dnsZoneCandidates(name string) []string {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+
+	candidates := []string{}
+	for i := 1; i < len(labels)-1; i++ {
+		candidates = append(candidates, strings.Join(labels[i:], "."))
+	}
+	return candidates
+}
+
+func (p *CloudflareDNSProvider) findZone(ctx context.Context, name string) (string, error) {
+	for _, candidate := range dnsZoneCandidates(name) {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		err := p.request(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(candidate), nil, &zones)
+		if err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrorDNSZoneNotFound, name)
+}
+
+func (p *CloudflareDNSProvider) request(ctx context.Context, method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.endpoint+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Success bool            `json:"success"`
+		Result  json.RawMessage `json:"result"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil || !response.Success {
+		return fmt.Errorf("%w (cloudflare %d)", ErrorDNSProviderFailed, resp.StatusCode)
+	}
+
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name `xml:"ChangeResourceRecordSetsRequest"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Value   string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+func (p *Route53DNSProvider) changeRecord(ctx context.Context, action string, name string, value string) error {
+	zoneID, err := p.findZone(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	body, err := xml.Marshal(route53ChangeRequest{
+		XMLNS:  route53XMLNamespace,
+		Action: action,
+		Name:   name + ".",
+		Type:   "TXT",
+		TTL:    dnsChallengeTTL,
+		Value:  `"` + value + `"`,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.request(ctx, http.MethodPost, "/2013-04-01/hostedzone/"+zoneID+"/rrset", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (p *Route53DNSProvider) findZone(ctx context.Context, name string) (string, error) {
+	for _, candidate := range dnsZoneCandidates(name) {
+		query := url.Values{"dnsname": {candidate}, "maxitems": {"1"}}
+		resp, err := p.request(ctx, http.MethodGet, "/2013-04-01/hostedzonesbyname?"+query.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		var zones struct {
+			HostedZones []struct {
+				ID   string `xml:"Id"`
+				Name string `xml:"Name"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&zones)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("%w (route53: %s)", ErrorDNSProviderFailed, err)
+		}
+
+		// Zones are listed in order starting from the name we asked for, so
+		// the first is only ours if its name matches.
+		if len(zones.HostedZones) > 0 && zones.HostedZones[0].Name == candidate+"." {
+			return strings.TrimPrefix(zones.HostedZones[0].ID, "/hostedzone/"), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrorDNSZoneNotFound, name)
+}
+
+func (p *Route53DNSProvider) request(ctx context.Context, method string, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+
+	p.credentials.sign(req, body, route53Region, route53Service, time.Now().UTC())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w (route53 %d)", ErrorDNSProviderFailed, resp.StatusCode)
+	}
+	return resp, nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSZoneCandidates(t *testing.T) {
+	assert.Equal(t, []string{"app.example.com", "example.com"}, dnsZoneCandidates("_acme-challenge.app.example.com"))
+	assert.Equal(t, []string{"example.com"}, dnsZoneCandidates("_acme-challenge.example.com."))
+}
+
+func TestNewDNSProvider(t *testing.T) {
+	_, err := NewDNSProvider(DNSProviderCloudflare)
+	assert.NoError(t, err)
+
+	_, err = NewDNSProvider(DNSProviderRoute53)
+	assert.NoError(t, err)
+
+	_, err = NewDNSProvider("carrier-pigeon")
+	assert.Equal(t, ErrorUnknownDNSProvider, err)
+}
+
+func TestCloudflareDNSProvider(t *testing.T) {
+	var lock sync.Mutex
+	records := map[string]map[string]any{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false}`))
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/zones":
+			if r.URL.Query().Get("name") == "example.com" {
+				w.Write([]byte(`{"success":true,"result":[{"id":"zone1"}]}`))
+			} else {
+				w.Write([]byte(`{"success":true,"result":[]}`))
+			}
+
+		case r.Method == http.MethodPost && r.URL.Path == "/zones/zone1/dns_records":
+			var record map[string]any
+			json.NewDecoder(r.Body).Decode(&record)
+			records["record1"] = record
+			w.Write([]byte(`{"success":true,"result":{"id":"record1"}}`))
+
+		case r.Method == http.MethodGet && r.URL.Path == "/zones/zone1/dns_records":
+			result := []map[string]any{}
+			for id, record := range records {
+				if record["name"] == r.URL.Query().Get("name") && record["content"] == r.URL.Query().Get("content") {
+					result = append(result, map[string]any{"id": id})
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "result": result})
+
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/zones/zone1/dns_records/"):
+			delete(records, strings.TrimPrefix(r.URL.Path, "/zones/zone1/dns_records/"))
+			w.Write([]byte(`{"success":true,"result":{}}`))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false}`))
+		}
+	}))
+	defer server.Close()
+
+	provider := NewCloudflareDNSProvider(server.URL, "secret")
+
+	require.NoError(t, provider.Present(context.Background(), "_acme-challenge.app.example.com", "token"))
+	assert.Equal(t, "TXT", records["record1"]["type"])
+	assert.Equal(t, "_acme-challenge.app.example.com", records["record1"]["name"])
+	assert.Equal(t, "token", records["record1"]["content"])
+
+	require.NoError(t, provider.CleanUp(context.Background(), "_acme-challenge.app.example.com", "token"))
+	assert.Empty(t, records)
+
+	err := provider.Present(context.Background(), "_acme-challenge.example.org", "token")
+	assert.ErrorIs(t, err, ErrorDNSZoneNotFound)
+
+	err = NewCloudflareDNSProvider(server.URL, "wrong").Present(context.Background(), "_acme-challenge.example.com", "token")
+	assert.ErrorIs(t, err, ErrorDNSProviderFailed)
+}
+
+func TestRoute53DNSProvider(t *testing.T) {
+	var lock sync.Mutex
+	var changes []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/route53/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/2013-04-01/hostedzonesbyname":
+			// Route 53 lists zones from the requested name onwards, whether
+			// or not it exists.
+			w.Write([]byte(`<ListHostedZonesByNameResponse><HostedZones><HostedZone><Id>/hostedzone/Z123</Id><Name>example.com.</Name></HostedZone></HostedZones></ListHostedZonesByNameResponse>`))
+
+		case r.Method == http.MethodPost && r.URL.Path == "/2013-04-01/hostedzone/Z123/rrset":
+			body, _ := io.ReadAll(r.Body)
+			changes = append(changes, string(body))
+			w.Write([]byte(`<ChangeResourceRecordSetsResponse/>`))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	provider := NewRoute53DNSProvider(server.URL, awsCredentials{accessKey: "AKID", secretKey: "secret"})
+
+	require.NoError(t, provider.Present(context.Background(), "_acme-challenge.app.example.com", "token"))
+	require.NoError(t, provider.CleanUp(context.Background(), "_acme-challenge.app.example.com", "token"))
+
+	require.Len(t, changes, 2)
+	assert.Contains(t, changes[0], "<Action>UPSERT</Action>")
+	assert.Contains(t, changes[0], "<Name>_acme-challenge.app.example.com.</Name>")
+	assert.Contains(t, changes[0], "<Value>&#34;token&#34;</Value>")
+	assert.Contains(t, changes[1], "<Action>DELETE</Action>")
+
+	err := NewRoute53DNSProvider(server.URL, awsCredentials{accessKey: "OTHER"}).Present(context.Background(), "_acme-challenge.example.com", "token")
+	assert.ErrorIs(t, err, ErrorDNSProviderFailed)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"time"
+)
+
+type DoctorSeverity int
+
+const (
+	DoctorSeverityError DoctorSeverity = iota
+	DoctorSeverityWarning
+)
+
+func (ds DoctorSeverity) String() string {
+	switch ds {
+	case DoctorSeverityError:
+		return "error"
+	case DoctorSeverityWarning:
+		return "warning"
+	default:
+		return ""
+	}
+}
+
+func (ds DoctorSeverity) MarshalText() ([]byte, error) {
+	return []byte(ds.String()), nil
+}
+
+type DoctorProblem struct {
+	Severity DoctorSeverity `json:"severity"`
+	Check    string         `json:"check"`
+	Message  string         `json:"message"`
+}
+
+// Diagnose looks for the problems that most often stop a running proxy from
+// serving its services, with the most serious first.
+func (s *Server) Diagnose() []DoctorProblem {
+	problems := []DoctorProblem{}
+
+	listeners := []struct {
+		name     string
+		port     int
+		listener net.Listener
+	}{
+		{"HTTP", s.config.HttpPort, s.httpListener},
+		{"HTTPS", s.config.HttpsPort, s.httpsListener},
+	}
+
+	for _, l := range listeners {
+		if err := checkListener(l.listener); err != nil {
+			problems = append(problems, DoctorProblem{DoctorSeverityError, "ports",
+				fmt.Sprintf("%s port %d is not reachable from localhost: %v", l.name, l.port, err)})
+		}
+	}
+
+	problems = append(problems, s.router.stateProblems()...)
+
+	warningPeriod := s.config.CertExpiryWarning
+	if warningPeriod == 0 {
+		warningPeriod = DefaultCertExpiryWarning
+	}
+	problems = append(problems, s.router.certificateProblems(warningPeriod)...)
+
+	slices.SortStableFunc(problems, func(a, b DoctorProblem) int {
+		return cmp.Or(cmp.Compare(a.Severity, b.Severity), cmp.Compare(a.Message, b.Message))
+	})
+
+	return problems
+}
+
+// Private
+
+// stateProblems compares the saved state with the services that are running,
+// since the two differing means a restart would change what is served.
+func (r *Router) stateProblems() []DoctorProblem {
+	problem := func(format string, args ...any) []DoctorProblem {
+		return []DoctorProblem{{DoctorSeverityError, "state", fmt.Sprintf(format, args...)}}
+	}
+
+	live := map[string]string{}
+	r.withReadLock(func() error {
+		for name, service := range r.services {
+			live[name] = service.active.Target()
+		}
+		return nil
+	})
+
+	data, err := r.stateStore.Load()
+	if errors.Is(err, os.ErrNotExist) {
+		if len(live) > 0 {
+			return problem("no state has been saved to %s, so services will be lost on restart", r.stateStore)
+		}
+		return nil
+	}
+	if err != nil {
+		return problem("unable to read state from %s: %v", r.stateStore, err)
+	}
+
+	var saved []marshalledService
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return problem("state in %s can't be parsed: %v", r.stateStore, err)
+	}
+
+	problems := []DoctorProblem{}
+	for _, ms := range saved {
+		target, ok := live[ms.Name]
+		switch {
+		case !ok:
+			problems = append(problems, problem("service %s is in the saved state but not running", ms.Name)...)
+		case target != ms.ActiveTarget:
+			problems = append(problems, problem("service %s is running %s, but the saved state has %s", ms.Name, target, ms.ActiveTarget)...)
+		}
+		delete(live, ms.Name)
+	}
+	for name := range live {
+		problems = append(problems, problem("service %s is running but missing from the saved state", name)...)
+	}
+
+	return problems
+}
+
+// certificateProblems reports certificates that have expired or are close to
+// it, and TLS hosts that don't have one at all.
+func (r *Router) certificateProblems(warningPeriod time.Duration) []DoctorProblem {
+	problems := []DoctorProblem{}
+
+	r.withReadLock(func() error {
+		for name, service := range r.services {
+			config := service.config()
+			if config.certManager == nil {
+				continue
+			}
+
+			for _, host := range config.hosts {
+				notAfter, ok := certificateExpiry(config.certManager, host)
+				switch {
+				case !ok:
+					problems = append(problems, DoctorProblem{DoctorSeverityWarning, "certificates",
+						fmt.Sprintf("service %s has no certificate for %s yet", name, host)})
+				case time.Now().After(notAfter):
+					problems = append(problems, DoctorProblem{DoctorSeverityError, "certificates",
+						fmt.Sprintf("certificate for %s (service %s) expired at %s", host, name, notAfter.Format(time.RFC3339))})
+				case time.Until(notAfter) < warningPeriod:
+					problems = append(problems, DoctorProblem{DoctorSeverityWarning, "certificates",
+						fmt.Sprintf("certificate for %s (service %s) expires at %s", host, name, notAfter.Format(time.RFC3339))})
+				}
+			}
+		}
+		return nil
+	})
+
+	return problems
+}
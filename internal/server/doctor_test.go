@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoctor_NoProblemsWhenHealthy(t *testing.T) {
+	server, _ := testServer(t)
+
+	_, target := testBackend(t, "first", http.StatusOK)
+	require.NoError(t, server.router.SetServiceTarget("default", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	assert.Empty(t, server.Diagnose())
+}
+
+func TestDoctor_StateDifferingFromLiveServices(t *testing.T) {
+	server, _ := testServer(t)
+
+	_, target := testBackend(t, "first", http.StatusOK)
+	require.NoError(t, server.router.SetServiceTarget("default", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	require.NoError(t, os.WriteFile(server.config.StatePath(), []byte(`[{"name":"default","active_target":"other:3000"},{"name":"gone"}]`), 0o600))
+
+	problems := server.Diagnose()
+	require.Len(t, problems, 2)
+
+	assert.Equal(t, DoctorSeverityError, problems[0].Severity)
+	assert.Equal(t, "state", problems[0].Check)
+	assert.Equal(t, "service default is running "+target+", but the saved state has other:3000", problems[0].Message)
+	assert.Equal(t, "service gone is in the saved state but not running", problems[1].Message)
+}
+
+func TestDoctor_UnparseableState(t *testing.T) {
+	server, _ := testServer(t)
+
+	require.NoError(t, os.WriteFile(server.config.StatePath(), []byte(`not json`), 0o600))
+
+	problems := server.Diagnose()
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0].Message, "can't be parsed")
+}
+
+func TestDoctor_TLSHostWithoutCertificate(t *testing.T) {
+	server, _ := testServer(t)
+
+	_, target := testBackend(t, "first", http.StatusOK)
+	serviceOptions := ServiceOptions{TLSEnabled: true, ACMECachePath: t.TempDir()}
+	require.NoError(t, server.router.SetServiceTarget("default", []string{"example.com"}, target, serviceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	problems := server.Diagnose()
+	require.Len(t, problems, 1)
+	assert.Equal(t, DoctorSeverityWarning, problems[0].Severity)
+	assert.Equal(t, "service default has no certificate for example.com yet", problems[0].Message)
+}
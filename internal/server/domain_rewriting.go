@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var ErrorInvalidDomainRewrite = errors.New("domain rewrite must be in the form <domain> or <domain>=<new domain>")
+
+// DomainRewrite replaces references to a domain that a target believes it is
+// serving on, in the Domain of its cookies and the host of its redirects.
+// When To is empty, cookies are scoped to the host the request was made to
+// instead, and redirects are sent there.
+type DomainRewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func ParseDomainRewrite(value string) (DomainRewrite, error) {
+	from, to, _ := strings.Cut(value, "=")
+	from = normalizeDomain(from)
+	to = normalizeDomain(to)
+
+	if from == "" || strings.ContainsAny(from+to, "/:; ") {
+		return DomainRewrite{}, ErrorInvalidDomainRewrite
+	}
+
+	return DomainRewrite{From: from, To: to}, nil
+}
+
+func (dr DomainRewrite) Matches(domain string) bool {
+	return normalizeDomain(domain) == dr.From
+}
+
+// Private
+
+func rewriteResponseDomains(resp *http.Response, rewrites []DomainRewrite) {
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) > 0 {
+		resp.Header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			resp.Header.Add("Set-Cookie", rewriteCookieDomain(cookie, rewrites))
+		}
+	}
+
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", rewriteLocationDomain(location, resp.Request.Host, rewrites))
+	}
+}
+
+// rewriteCookieDomain changes the Domain attribute of a Set-Cookie header. We
+// edit the header as text, rather than parsing it, so that everything else
+// about the cookie is passed through exactly as the target sent it.
+func rewriteCookieDomain(cookie string, rewrites []DomainRewrite) string {
+	attributes := strings.Split(cookie, ";")
+
+	for i := 1; i < len(attributes); i++ {
+		name, value, _ := strings.Cut(attributes[i], "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "domain") {
+			continue
+		}
+
+		rewrite, ok := findDomainRewrite(value, rewrites)
+		if !ok {
+			continue
+		}
+
+		if rewrite.To == "" {
+			attributes = append(attributes[:i], attributes[i+1:]...)
+			i--
+		} else {
+			attributes[i] = " Domain=" + rewrite.To
+		}
+	}
+
+	return strings.Join(attributes, ";")
+}
+
+func rewriteLocationDomain(location string, requestHost string, rewrites []DomainRewrite) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return location
+	}
+
+	rewrite, ok := findDomainRewrite(u.Hostname(), rewrites)
+	if !ok {
+		return location
+	}
+
+	switch {
+	case rewrite.To == "":
+		u.Host = requestHost
+	case u.Port() != "":
+		u.Host = net.JoinHostPort(rewrite.To, u.Port())
+	default:
+		u.Host = rewrite.To
+	}
+
+	return u.String()
+}
+
+func findDomainRewrite(domain string, rewrites []DomainRewrite) (DomainRewrite, bool) {
+	for _, rewrite := range rewrites {
+		if rewrite.Matches(domain) {
+			return rewrite, true
+		}
+	}
+	return DomainRewrite{}, false
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "."))
+}
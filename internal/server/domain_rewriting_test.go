@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainRewrite_Parse(t *testing.T) {
+	rewrite, err := ParseDomainRewrite("old.example.com=new.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, DomainRewrite{From: "old.example.com", To: "new.example.com"}, rewrite)
+
+	rewrite, err = ParseDomainRewrite(".Old.Example.com")
+	require.NoError(t, err)
+	assert.Equal(t, DomainRewrite{From: "old.example.com"}, rewrite)
+
+	for _, value := range []string{"", "=new.example.com", "old.example.com=new.example.com/path", "old.example.com:8080"} {
+		_, err = ParseDomainRewrite(value)
+		assert.Equal(t, ErrorInvalidDomainRewrite, err, value)
+	}
+}
+
+func TestDomainRewrite_CookieDomains(t *testing.T) {
+	rewrites := []DomainRewrite{
+		{From: "old.example.com", To: "new.example.com"},
+		{From: "legacy.example.com"},
+	}
+
+	assert.Equal(t, "session=abc; Path=/; Domain=new.example.com; HttpOnly",
+		rewriteCookieDomain("session=abc; Path=/; domain=.old.example.com; HttpOnly", rewrites))
+
+	assert.Equal(t, "session=abc; Path=/; Secure",
+		rewriteCookieDomain("session=abc; Path=/; Domain=legacy.example.com; Secure", rewrites))
+
+	assert.Equal(t, "session=abc; Domain=other.example.com",
+		rewriteCookieDomain("session=abc; Domain=other.example.com", rewrites))
+
+	assert.Equal(t, "domain=old.example.com",
+		rewriteCookieDomain("domain=old.example.com", rewrites), "cookie names are not attributes")
+}
+
+func TestDomainRewrite_Locations(t *testing.T) {
+	rewrites := []DomainRewrite{
+		{From: "old.example.com", To: "new.example.com"},
+		{From: "legacy.example.com"},
+	}
+
+	assert.Equal(t, "https://new.example.com/login?next=%2F", rewriteLocationDomain("https://old.example.com/login?next=%2F", "app.example.com", rewrites))
+	assert.Equal(t, "http://new.example.com:8080/", rewriteLocationDomain("http://old.example.com:8080/", "app.example.com", rewrites))
+	assert.Equal(t, "https://app.example.com/login", rewriteLocationDomain("https://legacy.example.com/login", "app.example.com", rewrites))
+	assert.Equal(t, "/login", rewriteLocationDomain("/login", "app.example.com", rewrites))
+	assert.Equal(t, "https://other.example.com/", rewriteLocationDomain("https://other.example.com/", "app.example.com", rewrites))
+}
+
+func TestDomainRewrite_AppliedByTarget(t *testing.T) {
+	targetOptions := defaultTargetOptions
+	targetOptions.DomainRewrites = []DomainRewrite{{From: "old.example.com"}}
+
+	target := testTargetWithOptions(t, targetOptions, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "a=1; Domain=old.example.com")
+		w.Header().Add("Set-Cookie", "b=2; Path=/")
+		http.Redirect(w, r, "https://old.example.com/login", http.StatusFound)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, []string{"a=1", "b=2; Path=/"}, w.Header().Values("Set-Cookie"))
+	assert.Equal(t, "https://app.example.com/login", w.Header().Get("Location"))
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// WithDrainingMiddleware asks clients to close their connections once
+// draining has started, so that they can reconnect elsewhere before the
+// proxy stops.
+func WithDrainingMiddleware(draining *atomic.Bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&drainingResponseWriter{ResponseWriter: w, draining: draining}, r)
+	})
+}
+
+type drainingResponseWriter struct {
+	http.ResponseWriter
+	draining      *atomic.Bool
+	headerWritten bool
+}
+
+func (w *drainingResponseWriter) WriteHeader(statusCode int) {
+	if !w.headerWritten && statusCode >= http.StatusOK {
+		w.headerWritten = true
+
+		if w.draining.Load() {
+			// On HTTP/2 connections, this also makes the server send a GOAWAY.
+			w.Header().Set("Connection", "close")
+			w.Header().Del("Alt-Svc")
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *drainingResponseWriter) Write(b []byte) (int, error) {
+	if !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *drainingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	return hijacker.Hijack()
+}
+
+func (w *drainingResponseWriter) Flush() {
+	flusher, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
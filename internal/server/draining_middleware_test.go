@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainingMiddleware_LeavesResponsesAloneUntilDraining(t *testing.T) {
+	var draining atomic.Bool
+	handler := WithDrainingMiddleware(&draining, testDrainingHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Connection"))
+	assert.Equal(t, `h3=":443"`, w.Header().Get("Alt-Svc"))
+}
+
+func TestDrainingMiddleware_AsksClientsToCloseWhenDraining(t *testing.T) {
+	var draining atomic.Bool
+	draining.Store(true)
+	handler := WithDrainingMiddleware(&draining, testDrainingHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "close", w.Header().Get("Connection"))
+	assert.Empty(t, w.Header().Get("Alt-Svc"))
+	assert.Equal(t, "ok", w.Body.String())
+}
+
+// Helpers
+
+func testDrainingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":443"`)
+		w.Write([]byte("ok"))
+	})
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAutoStopWindow  = 5 * time.Minute
+	DefaultAutoStopMessage = "This service has been stopped because it was failing"
+
+	// errorBudgetInterval is how often the error rate is measured. The service
+	// is stopped once every measurement across the window is over the limit.
+	errorBudgetInterval = time.Minute
+
+	// errorBudgetMinRequests is the fewest requests in an interval for its
+	// error rate to count, so that a handful of failures on a quiet service
+	// doesn't stop it.
+	errorBudgetMinRequests = 10
+
+	autoStopWebhookTimeout = 10 * time.Second
+)
+
+// AutoStopEvent is sent to the auto-stop webhook when a service is stopped
+// for exceeding its error rate.
+type AutoStopEvent struct {
+	Event     string    `json:"event"`
+	Service   string    `json:"service"`
+	ErrorRate float64   `json:"error_rate"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+// errorBudget watches the rate of server errors a service responds with, and
+// calls exceeded when that rate stays above the limit for the whole window.
+type errorBudget struct {
+	limit    float64
+	window   time.Duration
+	exceeded func(rate float64)
+
+	lock         sync.Mutex
+	now          func() time.Time
+	bucketStart  time.Time
+	requests     int
+	errors       int
+	failingSince time.Time
+}
+
+func newErrorBudget(limit float64, window time.Duration, exceeded func(rate float64)) *errorBudget {
+	return &errorBudget{
+		limit:    limit,
+		window:   window,
+		exceeded: exceeded,
+		now:      time.Now,
+	}
+}
+
+func (b *errorBudget) Record(statusCode int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	if b.bucketStart.IsZero() {
+		b.bucketStart = now
+	}
+
+	if now.Sub(b.bucketStart) >= errorBudgetInterval {
+		b.measure(now)
+	}
+
+	b.requests++
+	if statusCode >= 500 && statusCode <= 599 {
+		b.errors++
+	}
+}
+
+// Private
+
+// measure checks the interval that started at bucketStart. Its requests all
+// arrived within errorBudgetInterval, since the next one after that measures
+// it; so it only counts towards the window up to the end of that interval.
+// When nothing arrived in the interval after it, that quiet interval breaks
+// any run of failing ones.
+func (b *errorBudget) measure(now time.Time) {
+	rate := float64(b.errors) / float64(max(b.requests, 1))
+	bucketEnd := b.bucketStart.Add(errorBudgetInterval)
+
+	if b.requests >= errorBudgetMinRequests && rate > b.limit {
+		if b.failingSince.IsZero() {
+			b.failingSince = b.bucketStart
+		}
+		if bucketEnd.Sub(b.failingSince) >= b.window {
+			b.failingSince = time.Time{}
+			go b.exceeded(rate)
+		}
+	} else {
+		b.failingSince = time.Time{}
+	}
+
+	if now.Sub(bucketEnd) >= errorBudgetInterval {
+		b.failingSince = time.Time{}
+	}
+
+	b.bucketStart = now
+	b.requests = 0
+	b.errors = 0
+}
+
+func (s *Service) autoStop(rate float64) {
+	if s.pauseController.GetState() == PauseStateStopped {
+		return
+	}
+
+	options := s.config().options
+	message := options.AutoStopMessage
+	if message == "" {
+		message = DefaultAutoStopMessage
+	}
+
+	slog.Warn("Stopping service that exceeded its error rate", "service", s.name, "error_rate", rate, "limit", options.AutoStopErrorRate)
+	s.pauseController.Stop(message)
+
+	if options.AutoStopWebhook != "" {
+		event := AutoStopEvent{
+			Event:     "auto_stop",
+			Service:   s.name,
+			ErrorRate: rate,
+			Message:   message,
+			Time:      time.Now().UTC(),
+		}
+
+		err := sendAutoStopWebhook(options.AutoStopWebhook, event)
+		if err != nil {
+			slog.Error("Failed to send auto-stop webhook", "service", s.name, "url", options.AutoStopWebhook, "error", err)
+		}
+	}
+}
+
+func sendAutoStopWebhook(url string, event AutoStopEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), autoStopWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", healthCheckUserAgent)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorBudget_ExceededWhenErrorRateStaysHighForWindow(t *testing.T) {
+	exceeded := make(chan float64, 1)
+	budget := newErrorBudget(0.5, 3*time.Minute, func(rate float64) { exceeded <- rate })
+
+	now := time.Now()
+	budget.now = func() time.Time { return now }
+
+	recordMinute := func(errors, successes int) {
+		for range errors {
+			budget.Record(http.StatusBadGateway)
+		}
+		for range successes {
+			budget.Record(http.StatusOK)
+		}
+		now = now.Add(errorBudgetInterval)
+	}
+
+	recordMinute(20, 0)
+	recordMinute(20, 0)
+	recordMinute(5, 20)
+	recordMinute(20, 0)
+	recordMinute(20, 0)
+
+	select {
+	case <-exceeded:
+		t.Fatal("budget exceeded before the error rate stayed high for the window")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	recordMinute(15, 5)
+	budget.Record(http.StatusOK)
+
+	select {
+	case rate := <-exceeded:
+		assert.Equal(t, 0.75, rate)
+	case <-time.After(time.Second):
+		t.Fatal("budget not exceeded")
+	}
+}
+
+func TestErrorBudget_IgnoresQuietIntervals(t *testing.T) {
+	exceeded := make(chan float64, 1)
+	budget := newErrorBudget(0.1, time.Minute, func(rate float64) { exceeded <- rate })
+
+	now := time.Now()
+	budget.now = func() time.Time { return now }
+
+	for range 5 {
+		for range errorBudgetMinRequests - 1 {
+			budget.Record(http.StatusInternalServerError)
+		}
+		now = now.Add(errorBudgetInterval)
+	}
+	budget.Record(http.StatusOK)
+
+	select {
+	case <-exceeded:
+		t.Fatal("budget exceeded by too few requests")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestErrorBudget_BurstFollowedByQuietPeriod(t *testing.T) {
+	exceeded := make(chan float64, 1)
+	budget := newErrorBudget(0.5, 5*time.Minute, func(rate float64) { exceeded <- rate })
+
+	now := time.Now()
+	budget.now = func() time.Time { return now }
+
+	for range errorBudgetMinRequests {
+		budget.Record(http.StatusBadGateway)
+	}
+
+	now = now.Add(6 * time.Minute)
+	budget.Record(http.StatusBadGateway)
+
+	// Failing again after the gap starts a new run
+	for range 4 {
+		for range errorBudgetMinRequests {
+			budget.Record(http.StatusBadGateway)
+		}
+		now = now.Add(errorBudgetInterval)
+	}
+	budget.Record(http.StatusOK)
+
+	select {
+	case <-exceeded:
+		t.Fatal("budget exceeded by a burst of errors followed by a quiet period")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestService_AutoStopSendsWebhook(t *testing.T) {
+	events := make(chan AutoStopEvent, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event AutoStopEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer webhook.Close()
+
+	serviceOptions := ServiceOptions{
+		AutoStopErrorRate: 0.5,
+		AutoStopWindow:    time.Minute,
+		AutoStopMessage:   "Failing",
+		AutoStopWebhook:   webhook.URL,
+	}
+	service := testCreateServiceWithHandler(t, defaultEmptyHosts, serviceOptions, defaultTargetOptions,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}),
+	)
+
+	service.autoStop(0.9)
+
+	assert.Equal(t, PauseStateStopped, service.pauseController.GetState())
+	assert.Equal(t, "Failing", service.pauseController.GetStopMessage())
+
+	event := <-events
+	assert.Equal(t, "auto_stop", event.Event)
+	assert.Equal(t, "test", event.Service)
+	assert.Equal(t, 0.9, event.ErrorRate)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	service.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+}
+
+func TestService_ServerErrorsRecordedInErrorBudget(t *testing.T) {
+	serviceOptions := ServiceOptions{AutoStopErrorRate: 0.5, AutoStopWindow: time.Minute}
+	service := testCreateServiceWithHandler(t, defaultEmptyHosts, serviceOptions, defaultTargetOptions,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}),
+	)
+
+	for range 3 {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		service.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	service.config().errorBudget.lock.Lock()
+	defer service.config().errorBudget.lock.Unlock()
+
+	assert.Equal(t, 3, service.config().errorBudget.requests)
+	assert.Equal(t, 3, service.config().errorBudget.errors)
+}
+
+func TestService_ErrorBudgetRemovedWhileRequestsInFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	serviceOptions := ServiceOptions{AutoStopErrorRate: 0.5, AutoStopWindow: time.Minute}
+	service := testCreateServiceWithHandler(t, defaultEmptyHosts, serviceOptions, defaultTargetOptions,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusInternalServerError)
+		}),
+	)
+	budget := service.config().errorBudget
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		service.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	<-started
+	require.NoError(t, service.UpdateOptions(defaultEmptyHosts, ServiceOptions{}))
+	assert.Nil(t, service.config().errorBudget)
+	close(release)
+	<-done
+
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	assert.Equal(t, 1, budget.errors)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// handshakeBucketSweepInterval is how often the per-IP buckets of clients
+// that have gone quiet are discarded.
+const handshakeBucketSweepInterval = time.Minute
+
+// HandshakeRateLimiter limits how quickly new TLS connections are accepted,
+// both from each IP address and in total. Handshakes are expensive, and
+// happen before any request can be inspected, so a flood of them has to be
+// refused at the connection level.
+type HandshakeRateLimiter struct {
+	perIP  float64
+	global float64
+	burst  float64
+
+	lock      sync.Mutex
+	now       func() time.Time
+	total     tokenBucket
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewHandshakeRateLimiter creates a limiter allowing the given number of new
+// connections per second from each IP address and overall, where 0 means no
+// limit. Each may be exceeded in bursts of up to burst connections.
+func NewHandshakeRateLimiter(perIP, global, burst int) *HandshakeRateLimiter {
+	return &HandshakeRateLimiter{
+		perIP:   float64(perIP),
+		global:  float64(global),
+		burst:   float64(burst),
+		now:     time.Now,
+		clients: map[string]*tokenBucket{},
+	}
+}
+
+func (l *HandshakeRateLimiter) Allow(ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	if l.perIP > 0 {
+		bucket, ok := l.clients[ip]
+		if !ok {
+			bucket = &tokenBucket{}
+			l.clients[ip] = bucket
+		}
+		if !bucket.take(now, l.perIP, l.burstFor(l.perIP)) {
+			return false
+		}
+	}
+
+	if l.global > 0 {
+		return l.total.take(now, l.global, l.burstFor(l.global))
+	}
+
+	return true
+}
+
+// WithHandshakeRateLimit wraps a listener so that connections beyond the
+// limiter's rate are reset as soon as they are accepted.
+func WithHandshakeRateLimit(l net.Listener, limiter *HandshakeRateLimiter) net.Listener {
+	return &rateLimitedListener{Listener: l, limiter: limiter}
+}
+
+// Private
+
+func (l *HandshakeRateLimiter) burstFor(rate float64) float64 {
+	return max(l.burst, rate)
+}
+
+func (l *HandshakeRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < handshakeBucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, bucket := range l.clients {
+		if bucket.full(now, l.perIP, l.burstFor(l.perIP)) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	b.refill(now, rate, burst)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) full(now time.Time, rate, burst float64) bool {
+	if b.last.IsZero() {
+		return true
+	}
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+		return
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+}
+
+type rateLimitedListener struct {
+	net.Listener
+	limiter *HandshakeRateLimiter
+}
+
+func (l *rateLimitedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		key := rateLimitKey(c.RemoteAddr().String())
+		if l.limiter.Allow(key) {
+			return c, nil
+		}
+
+		slog.Debug("Refusing TLS connection over the handshake rate limit", "client", key)
+		resetConnection(c)
+	}
+}
+
+// resetConnection closes a connection without the usual graceful shutdown,
+// so the client gets a reset and we don't keep any state for it.
+func resetConnection(c net.Conn) {
+	if tcpConn, ok := c.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	c.Close()
+}
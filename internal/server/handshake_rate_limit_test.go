@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeRateLimiter_PerIP(t *testing.T) {
+	limiter := NewHandshakeRateLimiter(2, 0, 4)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for range 4 {
+		assert.True(t, limiter.Allow("192.0.2.1"))
+	}
+	assert.False(t, limiter.Allow("192.0.2.1"))
+	assert.True(t, limiter.Allow("192.0.2.2"), "other clients are unaffected")
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, limiter.Allow("192.0.2.1"))
+	assert.False(t, limiter.Allow("192.0.2.1"))
+}
+
+func TestHandshakeRateLimiter_Global(t *testing.T) {
+	limiter := NewHandshakeRateLimiter(0, 3, 0)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	assert.True(t, limiter.Allow("192.0.2.1"))
+	assert.True(t, limiter.Allow("192.0.2.2"))
+	assert.True(t, limiter.Allow("192.0.2.3"))
+	assert.False(t, limiter.Allow("192.0.2.4"))
+
+	now = now.Add(time.Second)
+	assert.True(t, limiter.Allow("192.0.2.4"))
+}
+
+func TestHandshakeRateLimiter_ForgetsQuietClients(t *testing.T) {
+	limiter := NewHandshakeRateLimiter(1, 0, 0)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	assert.True(t, limiter.Allow("192.0.2.1"))
+	assert.Len(t, limiter.clients, 1)
+
+	now = now.Add(2 * handshakeBucketSweepInterval)
+	assert.True(t, limiter.Allow("192.0.2.2"))
+	assert.Len(t, limiter.clients, 1)
+}
+
+func TestHandshakeRateLimiter_ResetsConnectionsOverLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	limited := WithHandshakeRateLimit(l, NewHandshakeRateLimiter(1, 0, 1))
+	t.Cleanup(func() { limited.Close() })
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+
+	second, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+
+	c := <-accepted
+	defer c.Close()
+
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.ErrorContains(t, err, "reset")
+	assert.Empty(t, accepted)
+}
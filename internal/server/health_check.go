@@ -8,16 +8,21 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	healthCheckUserAgent = "kamal-proxy"
+	healthCheckUserAgent     = "kamal-proxy"
+	healthCheckStatsInterval = time.Hour
 )
 
 var (
 	ErrorHealthCheckRequestTimedOut  = errors.New("Request timed out")
 	ErrorHealthCheckUnexpectedStatus = errors.New("Unexpected status")
+	ErrorInvalidHealthCheckOverride  = errors.New("target options must be health=<path> or health-port=<port>")
+	ErrorInvalidHealthCheckHeader    = errors.New("health check headers must be given as \"Name: value\"")
 )
 
 type HealthCheckConsumer interface {
@@ -25,23 +30,32 @@ type HealthCheckConsumer interface {
 }
 
 type HealthCheck struct {
-	consumer HealthCheckConsumer
-	endpoint *url.URL
-	interval time.Duration
-	timeout  time.Duration
+	consumer  HealthCheckConsumer
+	client    *http.Client
+	endpoint  *url.URL
+	interval  time.Duration
+	timeout   time.Duration
+	logChecks bool
+	stats     healthCheckStats
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func NewHealthCheck(consumer HealthCheckConsumer, endpoint *url.URL, interval time.Duration, timeout time.Duration) *HealthCheck {
+// NewHealthCheck starts checking the endpoint every interval, reporting each
+// result to the consumer. When logChecks is set, each result is logged with
+// its status and latency, and a summary of the results is logged every hour.
+func NewHealthCheck(consumer HealthCheckConsumer, client *http.Client, endpoint *url.URL, interval time.Duration, timeout time.Duration, logChecks bool) *HealthCheck {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	hc := &HealthCheck{
-		consumer: consumer,
-		endpoint: endpoint,
-		interval: interval,
-		timeout:  timeout,
+		consumer:  consumer,
+		client:    client,
+		endpoint:  endpoint,
+		interval:  interval,
+		timeout:   timeout,
+		logChecks: logChecks,
+		stats:     healthCheckStats{since: time.Now()},
 
 		ctx:    ctx,
 		cancel: cancel,
@@ -51,12 +65,86 @@ func NewHealthCheck(consumer HealthCheckConsumer, endpoint *url.URL, interval ti
 	return hc
 }
 
+// ParseTargetHealthCheck splits any health check overrides from a target
+// given as <address>[;health=<path>][;health-port=<port>], for targets that
+// don't share the usual health check endpoint. It returns the address and
+// the config with the overrides applied.
+func ParseTargetHealthCheck(value string, config HealthCheckConfig) (string, HealthCheckConfig, error) {
+	address, params, _ := strings.Cut(value, ";")
+	if params == "" {
+		return address, config, nil
+	}
+
+	for _, param := range strings.Split(params, ";") {
+		key, val, _ := strings.Cut(param, "=")
+		switch key {
+		case "health":
+			if !strings.HasPrefix(val, "/") {
+				return "", config, ErrorInvalidHealthCheckOverride
+			}
+			config.Path = val
+		case "health-port":
+			port, err := strconv.Atoi(val)
+			if err != nil || port < 1 || port > 65535 {
+				return "", config, ErrorInvalidHealthCheckOverride
+			}
+			config.Port = port
+		default:
+			return "", config, ErrorInvalidHealthCheckOverride
+		}
+	}
+
+	return address, config, nil
+}
+
+// ParseHealthCheckHeader splits a header given as "Name: value".
+func ParseHealthCheckHeader(value string) (string, string, error) {
+	name, val, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return "", "", ErrorInvalidHealthCheckHeader
+	}
+	return http.CanonicalHeaderKey(name), strings.TrimSpace(val), nil
+}
+
+// CheckHealthOnce performs a single health check, returning the result rather
+// than reporting it to a consumer.
+func CheckHealthOnce(client *http.Client, endpoint *url.URL, timeout time.Duration) error {
+	hc := &HealthCheck{
+		client:   client,
+		endpoint: endpoint,
+		timeout:  timeout,
+		ctx:      context.Background(),
+	}
+
+	_, err := hc.perform()
+	return err
+}
+
 func (hc *HealthCheck) Close() {
 	hc.cancel()
 }
 
+func (hc *HealthCheck) Done() <-chan struct{} {
+	return hc.ctx.Done()
+}
+
 // Private
 
+// applyDefaults fills in the settings that a health check can't run without,
+// for configs that arrive without them.
+func (c *HealthCheckConfig) applyDefaults() {
+	if c.Path == "" {
+		c.Path = DefaultHealthCheckPath
+	}
+	if c.Interval == 0 {
+		c.Interval = DefaultHealthCheckInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultHealthCheckTimeout
+	}
+}
+
 func (hc *HealthCheck) run() {
 	ticker := time.NewTicker(hc.interval)
 	defer ticker.Stop()
@@ -74,46 +162,134 @@ func (hc *HealthCheck) run() {
 }
 
 func (hc *HealthCheck) check() {
+	started := time.Now()
+	status, err := hc.perform()
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	hc.reportResult(status, time.Since(started), err)
+}
+
+func (hc *HealthCheck) perform() (int, error) {
 	ctx, cancel := context.WithTimeout(hc.ctx, hc.timeout)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.endpoint.String(), nil)
 	if err != nil {
-		hc.reportResult(false, err)
-		return
+		return 0, err
 	}
 
 	req.Header.Set("User-Agent", healthCheckUserAgent)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := hc.client.Do(req)
 	if err != nil {
-		if errors.Is(err, context.Canceled) {
-			return
-		}
 		if errors.Is(err, context.DeadlineExceeded) {
 			err = ErrorHealthCheckRequestTimedOut
 		}
-		hc.reportResult(false, err)
-		return
+		return 0, err
 	}
 	defer resp.Body.Close()
 
 	_, _ = io.Copy(io.Discard, resp.Body)
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		hc.reportResult(false, fmt.Errorf("%w (%d)", ErrorHealthCheckUnexpectedStatus, resp.StatusCode))
-		return
+		return resp.StatusCode, fmt.Errorf("%w (%d)", ErrorHealthCheckUnexpectedStatus, resp.StatusCode)
 	}
 
-	hc.reportResult(true, nil)
+	return resp.StatusCode, nil
 }
 
-func (hc *HealthCheck) reportResult(success bool, err error) {
+func (hc *HealthCheck) reportResult(status int, latency time.Duration, err error) {
+	success := err == nil
+
+	attrs := []any{}
+	if hc.logChecks {
+		attrs = append(attrs, "endpoint", hc.endpoint.String(), "status", status, "latency_ms", latency.Milliseconds())
+	}
+
 	if success {
-		slog.Info("Healthcheck succeeded")
+		slog.Info("Healthcheck succeeded", attrs...)
 	} else {
-		slog.Info("Healthcheck failed", "error", err)
+		slog.Info("Healthcheck failed", append(attrs, "error", err)...)
+	}
+
+	if hc.logChecks {
+		hc.stats.record(success, latency)
+		if time.Since(hc.stats.since) >= healthCheckStatsInterval {
+			slog.Info("Healthcheck summary", append([]any{"endpoint", hc.endpoint.String()}, hc.stats.attrs()...)...)
+			hc.stats = healthCheckStats{since: time.Now()}
+		}
 	}
 
 	hc.consumer.HealthCheckCompleted(success)
 }
+
+// healthCheckRequestTransport adds a target's configured host and headers to
+// its health checks.
+type healthCheckRequestTransport struct {
+	transport http.RoundTripper
+	host      string
+	header    http.Header
+}
+
+func newHealthCheckRequestTransport(transport http.RoundTripper, config HealthCheckConfig) *healthCheckRequestTransport {
+	header := http.Header{}
+	for _, value := range config.Headers {
+		if name, val, err := ParseHealthCheckHeader(value); err == nil {
+			header.Add(name, val)
+		}
+	}
+
+	return &healthCheckRequestTransport{transport: transport, host: config.Host, header: header}
+}
+
+func (t *healthCheckRequestTransport) CloseIdleConnections() {
+	(&http.Client{Transport: t.transport}).CloseIdleConnections()
+}
+
+func (t *healthCheckRequestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.host != "" {
+		req.Host = t.host
+	}
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// healthCheckStats accumulates the results of a target's health checks
+// between summaries.
+type healthCheckStats struct {
+	since        time.Time
+	successes    int
+	failures     int
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+func (s *healthCheckStats) record(success bool, latency time.Duration) {
+	if success {
+		s.successes++
+	} else {
+		s.failures++
+	}
+
+	s.totalLatency += latency
+	s.maxLatency = max(s.maxLatency, latency)
+}
+
+func (s *healthCheckStats) attrs() []any {
+	var avgLatency time.Duration
+	if checks := s.successes + s.failures; checks > 0 {
+		avgLatency = s.totalLatency / time.Duration(checks)
+	}
+
+	return []any{
+		"successes", s.successes,
+		"failures", s.failures,
+		"avg_latency_ms", avgLatency.Milliseconds(),
+		"max_latency_ms", s.maxLatency.Milliseconds(),
+	}
+}
@@ -1,13 +1,18 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -22,7 +27,7 @@ func TestHealthCheck(t *testing.T) {
 
 		serverURL.Path = path
 
-		hc := NewHealthCheck(consumer, serverURL, shortTimeout, shortTimeout)
+		hc := NewHealthCheck(consumer, http.DefaultClient, serverURL, shortTimeout, shortTimeout, false)
 		t.Cleanup(hc.Close)
 
 		for _, exp := range expected {
@@ -85,3 +90,147 @@ func testHealthCheckTarget(t testing.TB) *url.URL {
 	serverURL, _ := url.Parse(server.URL)
 	return serverURL
 }
+
+func TestHealthCheck_LoggingChecks(t *testing.T) {
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	serverURL := testHealthCheckTarget(t)
+	serverURL.Path = "/error"
+
+	consumer := make(mockHealthCheckConsumer)
+	hc := NewHealthCheck(consumer, http.DefaultClient, serverURL, time.Hour, shortTimeout, true)
+	assert.False(t, <-consumer)
+	hc.Close()
+
+	var logline struct {
+		Level     string `json:"level"`
+		Msg       string `json:"msg"`
+		Status    int    `json:"status"`
+		LatencyMS *int64 `json:"latency_ms"`
+	}
+	require.NoError(t, json.NewDecoder(&out).Decode(&logline))
+
+	assert.Equal(t, "INFO", logline.Level)
+	assert.Equal(t, "Healthcheck failed", logline.Msg)
+	assert.Equal(t, http.StatusInternalServerError, logline.Status)
+	assert.NotNil(t, logline.LatencyMS)
+}
+
+func TestHealthCheck_LoggingWithoutLogChecks(t *testing.T) {
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	serverURL := testHealthCheckTarget(t)
+	serverURL.Path = "/error"
+
+	consumer := make(mockHealthCheckConsumer)
+	hc := NewHealthCheck(consumer, http.DefaultClient, serverURL, time.Hour, shortTimeout, false)
+	assert.False(t, <-consumer)
+	hc.Close()
+
+	var logline struct {
+		Level     string `json:"level"`
+		Msg       string `json:"msg"`
+		Error     string `json:"error"`
+		LatencyMS *int64 `json:"latency_ms"`
+	}
+	require.NoError(t, json.NewDecoder(&out).Decode(&logline))
+
+	assert.Equal(t, "INFO", logline.Level)
+	assert.Equal(t, "Healthcheck failed", logline.Msg)
+	assert.NotEmpty(t, logline.Error)
+	assert.Nil(t, logline.LatencyMS)
+}
+
+func TestHealthCheck_Stats(t *testing.T) {
+	stats := healthCheckStats{}
+	stats.record(true, 10*time.Millisecond)
+	stats.record(true, 20*time.Millisecond)
+	stats.record(false, 60*time.Millisecond)
+
+	assert.Equal(t, []any{
+		"successes", 2,
+		"failures", 1,
+		"avg_latency_ms", int64(30),
+		"max_latency_ms", int64(60),
+	}, stats.attrs())
+}
+
+func TestHealthCheck_ParseTargetOverrides(t *testing.T) {
+	config := HealthCheckConfig{Path: DefaultHealthCheckPath}
+
+	address, parsed, err := ParseTargetHealthCheck("app1:3000", config)
+	require.NoError(t, err)
+	assert.Equal(t, "app1:3000", address)
+	assert.Equal(t, config, parsed)
+
+	address, parsed, err = ParseTargetHealthCheck("app1:3000;health=/healthz;health-port=9000", config)
+	require.NoError(t, err)
+	assert.Equal(t, "app1:3000", address)
+	assert.Equal(t, "/healthz", parsed.Path)
+	assert.Equal(t, 9000, parsed.Port)
+
+	for _, value := range []string{"app1:3000;health=healthz", "app1:3000;health-port=none", "app1:3000;health-port=0", "app1:3000;other=1"} {
+		_, _, err = ParseTargetHealthCheck(value, config)
+		assert.Equal(t, ErrorInvalidHealthCheckOverride, err, value)
+	}
+}
+
+func TestHealthCheck_CheckedOnOverriddenPort(t *testing.T) {
+	healthServer, _ := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	healthURL, _ := url.Parse(healthServer.URL)
+	healthPort, _ := strconv.Atoi(healthURL.Port())
+
+	options := defaultTargetOptions
+	options.HealthCheckConfig.Path = "/healthz"
+	options.HealthCheckConfig.Port = healthPort
+
+	target := testTargetWithOptions(t, options, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	assert.Equal(t, healthURL.Host, target.healthCheckURL().Host)
+	assert.NoError(t, target.ProbeHealth())
+}
+
+func TestHealthCheck_SendsConfiguredHostAndHeaders(t *testing.T) {
+	options := defaultTargetOptions
+	options.HealthCheckConfig.Host = "health.internal"
+	options.HealthCheckConfig.Headers = []string{"X-Health-Token: secret", "x-tenant: checks"}
+
+	target := testTargetWithOptions(t, options, func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "health.internal" || r.Header.Get("X-Health-Token") != "secret" || r.Header.Get("X-Tenant") != "checks" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	assert.NoError(t, target.ProbeHealth())
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode, "other requests are left alone")
+}
+
+func TestHealthCheck_ParseHeader(t *testing.T) {
+	name, value, err := ParseHealthCheckHeader("x-health-token:  secret ")
+	require.NoError(t, err)
+	assert.Equal(t, "X-Health-Token", name)
+	assert.Equal(t, "secret", value)
+
+	for _, value := range []string{"X-Health-Token", ": secret", "X Health: secret"} {
+		_, _, err = ParseHealthCheckHeader(value)
+		assert.Equal(t, ErrorInvalidHealthCheckHeader, err, value)
+	}
+}
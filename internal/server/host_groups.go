@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// HostGroupOverflow is the group given to hosts once the limit of distinct
+// groups has been reached.
+const HostGroupOverflow = "_other"
+
+// hostGroups labels requests to a wildcard service with the part of the host
+// that the wildcard matched, such as the tenant in tenant.example.com. Only the
+// first few distinct labels are kept, so that a flood of random hosts can't
+// make the logs impossible to aggregate.
+type hostGroups struct {
+	hosts []string
+	limit int
+
+	lock sync.Mutex
+	seen map[string]bool
+}
+
+func newHostGroups(hosts []string, limit int) *hostGroups {
+	return &hostGroups{
+		hosts: hosts,
+		limit: limit,
+		seen:  map[string]bool{},
+	}
+}
+
+// GroupForRequest returns the label for a request, or an empty string when it
+// wasn't matched by a wildcard.
+func (hg *hostGroups) GroupForRequest(r *http.Request) string {
+	group := hg.groupForHost(r.Host)
+	if group == "" {
+		return ""
+	}
+
+	hg.lock.Lock()
+	defer hg.lock.Unlock()
+
+	if !hg.seen[group] {
+		if len(hg.seen) >= hg.limit {
+			return HostGroupOverflow
+		}
+		hg.seen[group] = true
+	}
+
+	return group
+}
+
+// Private
+
+func (hg *hostGroups) groupForHost(host string) string {
+	host, _ = splitHostPort(host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if len(hg.hosts) == 0 {
+		return host // A catch-all service matches every host
+	}
+
+	if slices.Contains(hg.hosts, host) {
+		return "" // Exact hosts are routed ahead of wildcards
+	}
+
+	for _, pattern := range hg.hosts {
+		suffix, ok := strings.CutPrefix(pattern, "*")
+		if !ok {
+			continue
+		}
+
+		group, ok := strings.CutSuffix(host, suffix)
+		if ok && group != "" {
+			return group
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostGroups_WildcardHosts(t *testing.T) {
+	groups := newHostGroups([]string{"app.example.com", "*.example.com"}, 10)
+
+	assert.Equal(t, "tenant", groups.GroupForRequest(testHostGroupRequest("tenant.example.com")))
+	assert.Equal(t, "tenant", groups.GroupForRequest(testHostGroupRequest("Tenant.Example.com:8080")))
+	assert.Equal(t, "a.b", groups.GroupForRequest(testHostGroupRequest("a.b.example.com")))
+	assert.Equal(t, "", groups.GroupForRequest(testHostGroupRequest("app.example.com")))
+}
+
+func TestHostGroups_CatchAllService(t *testing.T) {
+	groups := newHostGroups(nil, 10)
+
+	assert.Equal(t, "one.example.com", groups.GroupForRequest(testHostGroupRequest("one.example.com")))
+	assert.Equal(t, "other.test", groups.GroupForRequest(testHostGroupRequest("other.test:3000")))
+}
+
+func TestHostGroups_LimitsDistinctGroups(t *testing.T) {
+	groups := newHostGroups([]string{"*.example.com"}, 2)
+
+	assert.Equal(t, "one", groups.GroupForRequest(testHostGroupRequest("one.example.com")))
+	assert.Equal(t, "two", groups.GroupForRequest(testHostGroupRequest("two.example.com")))
+	assert.Equal(t, HostGroupOverflow, groups.GroupForRequest(testHostGroupRequest("three.example.com")))
+	assert.Equal(t, "one", groups.GroupForRequest(testHostGroupRequest("one.example.com")))
+}
+
+func testHostGroupRequest(host string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = host
+	return req
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+var ErrorInvalidHost = errors.New("invalid host")
+
+// NormalizeHost returns the form that hosts are stored and looked up in:
+// lowercase, without a trailing dot, and with internationalized names
+// converted to punycode. Browsers always send the punycode form, and
+// certificates are issued for it, so a service deployed with a Unicode host
+// needs to be known by it too. A leading wildcard is left in place.
+func NormalizeHost(host string) (string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if isASCII(host) {
+		return host, nil
+	}
+
+	wildcard := strings.HasPrefix(host, "*.")
+	if wildcard {
+		host = strings.TrimPrefix(host, "*.")
+	}
+
+	host, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", ErrorInvalidHost
+	}
+
+	if wildcard {
+		host = "*." + host
+	}
+	return host, nil
+}
+
+// Private
+
+func normalizeHosts(hosts []string) ([]string, error) {
+	result := make([]string, len(hosts))
+	for i, host := range hosts {
+		normalized, err := NormalizeHost(host)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = normalized
+	}
+	return result, nil
+}
+
+// normalizeRequestHost is NormalizeHost for hosts that arrive on requests,
+// where anything that can't be normalized is left to fail to match.
+func normalizeRequestHost(host string) string {
+	normalized, err := NormalizeHost(host)
+	if err != nil {
+		return host
+	}
+	return normalized
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
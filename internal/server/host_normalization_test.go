@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := map[string]string{
+		"example.com":           "example.com",
+		"Example.COM.":          "example.com",
+		"bücher.example":        "xn--bcher-kva.example",
+		"BÜCHER.example":        "xn--bcher-kva.example",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+		"*.bücher.example":      "*.xn--bcher-kva.example",
+		"under_score.example":   "under_score.example",
+	}
+
+	for host, expected := range tests {
+		normalized, err := NormalizeHost(host)
+		require.NoError(t, err, host)
+		assert.Equal(t, expected, normalized, host)
+	}
+
+	_, err := NormalizeHost("bücher-.example")
+	assert.ErrorIs(t, err, ErrorInvalidHost)
+}
+
+func TestRouter_RoutesInternationalizedHostsInEitherForm(t *testing.T) {
+	router := testRouter(t)
+	_, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	require.NoError(t, router.SetServiceTarget("first", []string{"bücher.example"}, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	statusCode, body := sendGETRequest(router, "http://xn--bcher-kva.example/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+
+	statusCode, body = sendGETRequest(router, "http://Bücher.example/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+
+	err := router.SetServiceTarget("second", []string{"xn--bcher-kva.example"}, second, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout)
+	assert.ErrorIs(t, err, ErrorHostInUse)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// hostIsAllowed checks a request's Host header against a list of patterns,
+// such as "example.com" or "*.example.com". It's meant for services that
+// accept any host, where the application would otherwise trust whatever
+// host the client sent, such as when generating links in emails.
+//
+// As well as not matching a pattern, a host is rejected if it is an IP
+// address that isn't listed explicitly, or if it names a port other than the
+// one the request arrived on (unless a pattern includes that port).
+func hostIsAllowed(r *http.Request, patterns []string) bool {
+	host, port := splitHostPort(r.Host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if host == "" {
+		return false
+	}
+
+	isIP := net.ParseIP(host) != nil
+	if port != "" && port != localPortForRequest(r) {
+		host = net.JoinHostPort(host, port)
+	} else if isIP {
+		host = joinHost(host)
+	}
+
+	if isIP {
+		return matchesAnyIPPattern(host, patterns)
+	}
+	return matchesAnyHostPattern(host, patterns)
+}
+
+// matchesAnyIPPattern matches IP addresses only when they're listed exactly,
+// with IPv6 addresses in brackets. They can't be used as glob patterns, as
+// the brackets would be taken for a character class.
+func matchesAnyIPPattern(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.EqualFold(pattern, host) || strings.EqualFold(joinHost(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyHostPattern(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		matched, _ := path.Match(strings.ToLower(pattern), host)
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func localPortForRequest(r *http.Request) string {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return strconv.Itoa(addr.Port)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var ErrorStreamIdleTimeout = errors.New("stream idle timeout")
+
+// idleTimeoutReadCloser closes the underlying reader if nothing has been read
+// from it for a while. A response that is actively streaming is never cut
+// off, no matter how long it runs; one that has gone silent is reaped.
+type idleTimeoutReadCloser struct {
+	io.ReadCloser
+	timer    *time.Timer
+	timeout  time.Duration
+	timedOut atomic.Bool
+}
+
+func newIdleTimeoutReadCloser(rc io.ReadCloser, timeout time.Duration, onTimeout func()) *idleTimeoutReadCloser {
+	r := &idleTimeoutReadCloser{
+		ReadCloser: rc,
+		timeout:    timeout,
+	}
+
+	r.timer = time.AfterFunc(timeout, func() {
+		r.timedOut.Store(true)
+		onTimeout()
+		r.ReadCloser.Close()
+	})
+
+	return r
+}
+
+func (r *idleTimeoutReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil && err != io.EOF && r.timedOut.Load() {
+		err = ErrorStreamIdleTimeout
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReadCloser) Close() error {
+	r.timer.Stop()
+	return r.ReadCloser.Close()
+}
+
+// idleTimeoutReadWriteCloser does the same for an upgraded connection, where
+// traffic in either direction counts as activity.
+type idleTimeoutReadWriteCloser struct {
+	*idleTimeoutReadCloser
+	writer io.Writer
+}
+
+func newIdleTimeoutReadWriteCloser(rwc io.ReadWriteCloser, timeout time.Duration, onTimeout func()) *idleTimeoutReadWriteCloser {
+	return &idleTimeoutReadWriteCloser{
+		idleTimeoutReadCloser: newIdleTimeoutReadCloser(rwc, timeout, onTimeout),
+		writer:                rwc,
+	}
+}
+
+func (rw *idleTimeoutReadWriteCloser) Write(p []byte) (int, error) {
+	n, err := rw.writer.Write(p)
+	if n > 0 {
+		rw.timer.Reset(rw.timeout)
+	}
+	if err != nil && rw.timedOut.Load() {
+		err = ErrorStreamIdleTimeout
+	}
+	return n, err
+}
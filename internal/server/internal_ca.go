@@ -0,0 +1,298 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	InternalCADirName  = "internal-ca"
+	InternalCACertFile = "ca.pem"
+
+	internalCAKeyFile          = "ca-key.pem"
+	internalCAValidity         = 10 * 365 * 24 * time.Hour
+	internalCertValidity       = 90 * 24 * time.Hour
+	internalCertRenewalPeriod  = 30 * 24 * time.Hour
+	internalCertBackdate       = time.Hour
+	internalCACommonName       = "kamal-proxy internal CA"
+	internalCASerialNumberBits = 128
+)
+
+var (
+	ErrorInvalidInternalCA            = errors.New("unable to load internal CA")
+	ErrorHostNotPermittedByInternalCA = errors.New("host is not within the domains the internal CA can issue certificates for")
+)
+
+// internalCAPermittedDomains are the names the internal CA is constrained to.
+// They're reserved for private use, so a client that trusts the CA can't be
+// given a certificate for a public domain, even by someone who has its key.
+var internalCAPermittedDomains = []string{"internal", "home.arpa", "local", "test"}
+
+// internalCALock stops services that are created at the same time from each
+// generating their own CA.
+var internalCALock sync.Mutex
+
+// InternalCertManager mints certificates for internal host names, such as
+// *.internal, from a CA of the proxy's own. Unlike ACME, this works for names
+// that can't be reached or verified from the internet, but clients have to
+// be told to trust the CA.
+//
+// The CA is created the first time it's needed, and kept in the certificate
+// directory so that it can be distributed to clients. It's shared by every
+// service that uses it.
+type InternalCertManager struct {
+	hosts  []string
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	lock  sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func NewInternalCertManager(hosts []string, options ServiceOptions) (*InternalCertManager, error) {
+	err := checkInternalCAHosts(hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, caKey, err := loadOrCreateInternalCA(InternalCADir(options.ACMECachePath))
+	if err != nil {
+		return nil, err
+	}
+
+	return &InternalCertManager{
+		hosts:  hosts,
+		caCert: caCert,
+		caKey:  caKey,
+		certs:  map[string]*tls.Certificate{},
+	}, nil
+}
+
+// InternalCADir is where the internal CA is kept, within the certificate
+// directory.
+func InternalCADir(certificatePath string) string {
+	return path.Join(certificatePath, InternalCADirName)
+}
+
+func (m *InternalCertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := certHostFor(m.hosts, normalizeRequestHost(hello.ServerName))
+	if host == "" {
+		return nil, ErrorHostNotAllowed
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if cert, ok := m.certs[host]; ok && time.Until(cert.Leaf.NotAfter) > internalCertRenewalPeriod {
+		return cert, nil
+	}
+
+	cert, err := m.mint(host)
+	if err != nil {
+		slog.Error("Internal CA: unable to issue certificate", "host", host, "error", err)
+		return nil, err
+	}
+
+	m.certs[host] = cert
+	slog.Info("Internal CA: issued certificate", "host", host, "expires", cert.Leaf.NotAfter)
+	return cert, nil
+}
+
+// HTTPHandler passes requests straight through, since there are no
+// challenges to answer.
+func (m *InternalCertManager) HTTPHandler(handler http.Handler) http.Handler {
+	return handler
+}
+
+// Private
+
+// checkInternalCAHosts ensures that every host is one the internal CA's name
+// constraints allow, since clients would reject a certificate for any other.
+func checkInternalCAHosts(hosts []string) error {
+	for _, host := range hosts {
+		if !internalCAPermits(strings.TrimPrefix(host, "*.")) {
+			return fmt.Errorf("%w: %s", ErrorHostNotPermittedByInternalCA, host)
+		}
+	}
+	return nil
+}
+
+func internalCAPermits(host string) bool {
+	for _, domain := range internalCAPermittedDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *InternalCertManager) certificate(host string) (*tls.Certificate, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cert, ok := m.certs[host]
+	return cert, ok
+}
+
+func (m *InternalCertManager) mint(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    now.Add(-internalCertBackdate),
+		NotAfter:     now.Add(internalCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, m.caCert, &key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, m.caCert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func loadOrCreateInternalCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	internalCALock.Lock()
+	defer internalCALock.Unlock()
+
+	certPath := path.Join(dir, InternalCACertFile)
+	keyPath := path.Join(dir, internalCAKeyFile)
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		cert, key, err := parseInternalCA(certPEM, keyPEM)
+		if err == nil && len(cert.PermittedDNSDomains) == 0 {
+			slog.Warn("Internal CA: CA certificate has no name constraints, so it can be used to issue certificates for any domain; remove it to create a constrained one", "path", certPath)
+		}
+		return cert, key, err
+	}
+	if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+		return nil, nil, ErrorInvalidInternalCA
+	}
+
+	cert, key, err := createInternalCA()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slog.Info("Internal CA: created CA certificate", "path", certPath, "expires", cert.NotAfter)
+	return cert, key, nil
+}
+
+func createInternalCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: internalCACommonName},
+		NotBefore:             now.Add(-internalCertBackdate),
+		NotAfter:              now.Add(internalCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         internalCAPermittedDomains,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func parseInternalCA(certPEM, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, ErrorInvalidInternalCA
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil || !cert.IsCA {
+		return nil, nil, ErrorInvalidInternalCA
+	}
+
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, ErrorInvalidInternalCA
+	}
+
+	return cert, key, nil
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), internalCASerialNumberBits))
+}
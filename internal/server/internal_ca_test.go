@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInternalCertManager_IssuesCertificatesFromItsCA(t *testing.T) {
+	options := ServiceOptions{ACMECachePath: t.TempDir()}
+
+	manager, err := NewInternalCertManager([]string{"app.internal", "*.apps.internal"}, options)
+	require.NoError(t, err)
+
+	roots := testInternalCARoots(t, options.ACMECachePath)
+
+	for name, host := range map[string]string{"app.internal": "app.internal", "one.apps.internal": "*.apps.internal"} {
+		cert, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		require.NoError(t, err)
+
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+		assert.NoError(t, err, name)
+
+		again, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		require.NoError(t, err)
+		assert.Same(t, cert, again)
+
+		notAfter, ok := certificateExpiry(manager, host)
+		assert.True(t, ok)
+		assert.Equal(t, cert.Leaf.NotAfter, notAfter)
+	}
+
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.internal"})
+	assert.Equal(t, ErrorHostNotAllowed, err)
+}
+
+func TestInternalCertManager_SharesCABetweenServices(t *testing.T) {
+	options := ServiceOptions{ACMECachePath: t.TempDir()}
+
+	first, err := NewInternalCertManager([]string{"one.internal"}, options)
+	require.NoError(t, err)
+	second, err := NewInternalCertManager([]string{"two.internal"}, options)
+	require.NoError(t, err)
+
+	assert.Equal(t, first.caCert.Raw, second.caCert.Raw)
+
+	info, err := os.Stat(filepath.Join(InternalCADir(options.ACMECachePath), "ca-key.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestInternalCertManager_CAIsConstrainedToInternalDomains(t *testing.T) {
+	options := ServiceOptions{ACMECachePath: t.TempDir()}
+
+	manager, err := NewInternalCertManager([]string{"app.internal"}, options)
+	require.NoError(t, err)
+
+	assert.True(t, manager.caCert.PermittedDNSDomainsCritical)
+	assert.Equal(t, internalCAPermittedDomains, manager.caCert.PermittedDNSDomains)
+
+	// Even a certificate minted directly with the CA's key isn't trusted for
+	// a public domain.
+	cert, err := manager.mint("example.com")
+	require.NoError(t, err)
+
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: testInternalCARoots(t, options.ACMECachePath)})
+	assert.ErrorAs(t, err, &x509.CertificateInvalidError{})
+}
+
+func TestInternalCertManager_RejectsHostsOutsideInternalDomains(t *testing.T) {
+	options := ServiceOptions{ACMECachePath: t.TempDir()}
+
+	for _, host := range []string{"app.example.com", "*.example.com", "internal.example.com", "notinternal"} {
+		_, err := NewInternalCertManager([]string{"app.internal", host}, options)
+		assert.ErrorIs(t, err, ErrorHostNotPermittedByInternalCA, host)
+	}
+
+	_, err := os.Stat(InternalCADir(options.ACMECachePath))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	for _, host := range []string{"internal", "app.internal", "*.apps.internal", "printer.home.arpa", "app.local", "app.test"} {
+		assert.NoError(t, checkInternalCAHosts([]string{host}), host)
+	}
+}
+
+func TestInternalCertManager_InvalidCA(t *testing.T) {
+	options := ServiceOptions{ACMECachePath: t.TempDir()}
+
+	dir := InternalCADir(options.ACMECachePath)
+	require.NoError(t, os.MkdirAll(dir, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, InternalCACertFile), []byte("nope"), 0o644))
+
+	_, err := NewInternalCertManager([]string{"app.internal"}, options)
+	assert.Equal(t, ErrorInvalidInternalCA, err)
+}
+
+func TestRouter_ServiceWithInternalCA(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	options := ServiceOptions{TLSEnabled: true, TLSInternalCA: true, ACMECachePath: t.TempDir()}
+	require.NoError(t, router.SetServiceTarget("service1", []string{"*.internal"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	cert, err := router.GetCertificate(&tls.ClientHelloInfo{ServerName: "app.internal"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"*.internal"}, cert.Leaf.DNSNames)
+}
+
+// Private
+
+func testInternalCARoots(t *testing.T, certificatePath string) *x509.CertPool {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(InternalCADir(certificatePath), InternalCACertFile))
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(data))
+	return roots
+}
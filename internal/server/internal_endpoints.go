@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+const DefaultInternalPathPrefix = "/.kamal/"
+
+// InternalEndpointsMiddleware serves the proxy's own endpoints under a
+// reserved path prefix, on every host. Requests under the prefix are never
+// forwarded to targets, even when they don't match an endpoint.
+//
+// The health endpoints only include their details, such as service names and
+// hosts, when detailed is set, which it is for the internal listener.
+type InternalEndpointsMiddleware struct {
+	prefix   string
+	router   *Router
+	health   func() ProxyHealth
+	detailed bool
+	mux      *http.ServeMux
+	next     http.Handler
+}
+
+func WithInternalEndpointsMiddleware(prefix string, router *Router, health func() ProxyHealth, detailed bool, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+
+	h := &InternalEndpointsMiddleware{
+		prefix:   "/" + strings.Trim(prefix, "/") + "/",
+		router:   router,
+		health:   health,
+		detailed: detailed,
+		next:     next,
+	}
+
+	h.mux = http.NewServeMux()
+	h.mux.HandleFunc("GET "+h.prefix+"up", h.up)
+	h.mux.HandleFunc("GET "+h.prefix+"version", h.version)
+	h.mux.HandleFunc("GET "+h.prefix+"acme", h.acme)
+	h.mux.HandleFunc("GET "+h.prefix+"upstreams", h.upstreams)
+	if health != nil {
+		h.mux.HandleFunc("GET "+h.prefix+"health", h.healthStatus)
+	}
+	h.mux.HandleFunc("/", h.notFound)
+
+	return h
+}
+
+func (h *InternalEndpointsMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.isReserved(r.URL.Path) {
+		h.mux.ServeHTTP(w, r)
+		return
+	}
+
+	h.next.ServeHTTP(w, r)
+}
+
+// Private
+
+func (h *InternalEndpointsMiddleware) isReserved(path string) bool {
+	return strings.HasPrefix(path, h.prefix) || path == strings.TrimSuffix(h.prefix, "/")
+}
+
+func (h *InternalEndpointsMiddleware) up(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+func (h *InternalEndpointsMiddleware) version(w http.ResponseWriter, r *http.Request) {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+	}
+
+	h.writeJSON(w, http.StatusOK, map[string]string{"version": version})
+}
+
+func (h *InternalEndpointsMiddleware) acme(w http.ResponseWriter, r *http.Request) {
+	// Only totals are reported here, since this is visible on every host and
+	// shouldn't reveal which other hosts the proxy serves.
+	statuses := h.router.CertificateStatuses()
+	expiring := 0
+	for _, status := range statuses {
+		if status.ExpiresWithin(DefaultCertExpiryWarning) {
+			expiring++
+		}
+	}
+
+	daysRemaining, warnings := h.router.certExpiry.snapshot()
+	result := map[string]any{
+		"certificates":      int64(len(statuses)),
+		"expiring_soon":     int64(expiring),
+		"expiry_warnings":   warnings,
+		"challenges_served": h.router.ACMEChallengesServed(),
+	}
+	if h.detailed {
+		result["days_remaining"] = daysRemaining
+	}
+
+	h.writeJSON(w, http.StatusOK, result)
+}
+
+func (h *InternalEndpointsMiddleware) healthStatus(w http.ResponseWriter, r *http.Request) {
+	health := h.health()
+	if !h.detailed {
+		health = ProxyHealth{Healthy: health.Healthy}
+	}
+
+	status := http.StatusOK
+	if !health.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	h.writeJSON(w, status, health)
+}
+
+func (h *InternalEndpointsMiddleware) upstreams(w http.ResponseWriter, r *http.Request) {
+	health := h.router.UpstreamHealth()
+
+	if !h.detailed {
+		health = UpstreamHealth{Healthy: health.Healthy}
+	}
+
+	if !health.Healthy {
+		h.writeJSON(w, http.StatusServiceUnavailable, health)
+		return
+	}
+
+	etag := health.ETag()
+	lastModified := health.LastModified()
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if isNotModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, health)
+}
+
+func (h *InternalEndpointsMiddleware) notFound(w http.ResponseWriter, r *http.Request) {
+	SetErrorResponse(w, r, http.StatusNotFound, nil)
+}
+
+func (h *InternalEndpointsMiddleware) writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
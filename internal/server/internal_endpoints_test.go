@@ -0,0 +1,195 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInternalEndpoints_ServedOnAllHosts(t *testing.T) {
+	handler := testInternalEndpointsHandler(t, DefaultInternalPathPrefix)
+
+	for _, host := range []string{"example.com", "other.example.com"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://"+host+"/.kamal/up", nil))
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, "OK", w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/.kamal/version", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), `"version"`)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/.kamal/acme", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.JSONEq(t, `{"certificates":0,"expiring_soon":0,"expiry_warnings":0,"challenges_served":0}`, w.Body.String())
+}
+
+func TestInternalEndpoints_ReservedPathsAreNotForwarded(t *testing.T) {
+	handler := testInternalEndpointsHandler(t, DefaultInternalPathPrefix)
+
+	for _, path := range []string{"/.kamal/unknown", "/.kamal", "/.kamal/"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		assert.Equal(t, http.StatusNotFound, w.Result().StatusCode, path)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/.kamalish", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "app", w.Body.String())
+}
+
+func TestInternalEndpoints_CustomPrefix(t *testing.T) {
+	handler := testInternalEndpointsHandler(t, "_proxy")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/_proxy/up", nil))
+	assert.Equal(t, "OK", w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/.kamal/up", nil))
+	assert.Equal(t, "app", w.Body.String())
+}
+
+func TestInternalEndpoints_Disabled(t *testing.T) {
+	handler := testInternalEndpointsHandler(t, "")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/.kamal/up", nil))
+	assert.Equal(t, "app", w.Body.String())
+}
+
+func TestInternalEndpoints_HealthDetailsOnlyWhenDetailed(t *testing.T) {
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	health := func() ProxyHealth {
+		return ProxyHealth{Healthy: false, Checks: map[string]string{"state_file": "read-only file system"}}
+	}
+
+	for detailed, shown := range map[bool]bool{true: true, false: false} {
+		handler := WithInternalEndpointsMiddleware(DefaultInternalPathPrefix, testRouter(t), health, detailed, app)
+
+		// Being on a private network doesn't make a request trusted, since
+		// proxied clients can appear to be.
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/.kamal/health", nil)
+		req.RemoteAddr = "10.0.0.5:51234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+		assert.Equal(t, shown, strings.Contains(w.Body.String(), "read-only file system"))
+	}
+}
+
+func TestInternalEndpoints_UpstreamHealth(t *testing.T) {
+	var checks atomic.Int32
+	var healthy atomic.Bool
+	healthy.Store(true)
+
+	_, target := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == DefaultHealthCheckPath {
+			checks.Add(1)
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}
+	})
+
+	router := testRouter(t)
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := WithInternalEndpointsMiddleware(DefaultInternalPathPrefix, router, nil, true, app)
+
+	sendRequest := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/.kamal/upstreams", nil)
+		req.RemoteAddr = "10.0.0.5:51234"
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	checks.Store(0)
+	w := sendRequest(nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"service1"`)
+
+	etag := w.Header().Get("ETag")
+	lastModified := w.Header().Get("Last-Modified")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, lastModified)
+
+	w = sendRequest(http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = sendRequest(http.Header{"If-Modified-Since": {lastModified}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = sendRequest(http.Header{"If-None-Match": {`"other"`}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, int32(1), checks.Load(), "healthy results should be reused")
+
+	healthy.Store(false)
+	router.serviceForName("service1").ActiveTarget().healthCache.health.CheckedAt = time.Time{}
+
+	w = sendRequest(http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "Unexpected status")
+}
+
+func TestInternalEndpoints_UpstreamHealthFailuresAreReused(t *testing.T) {
+	var checks atomic.Int32
+	var failing atomic.Bool
+	_, target := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == DefaultHealthCheckPath && failing.Load() {
+			checks.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	router := testRouter(t)
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := WithInternalEndpointsMiddleware(DefaultInternalPathPrefix, router, nil, false, app)
+
+	failing.Store(true)
+
+	requests := []func(){}
+	for range 10 {
+		requests = append(requests, func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/.kamal/upstreams", nil))
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		})
+	}
+	PerformConcurrently(requests...)
+	PerformConcurrently(requests...)
+
+	assert.Equal(t, int32(1), checks.Load())
+}
+
+// Helpers
+
+func testInternalEndpointsHandler(t *testing.T, prefix string) http.Handler {
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	})
+
+	return WithInternalEndpointsMiddleware(prefix, testRouter(t), nil, false, app)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// DefaultInternalBind is the address the internal listener is served on
+// unless another is given, so that it's only reachable from the host itself.
+const DefaultInternalBind = "127.0.0.1"
+
+// DefaultInternalAllowedNetworks are the networks that may use the internal
+// listener unless others are given: loopback and private addresses. Docker's
+// own range, 172.16.0.0/12, isn't included, since connections forwarded by
+// docker-proxy from anywhere come from there; give your Docker network
+// explicitly instead.
+var DefaultInternalAllowedNetworks = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "192.168.0.0/16", "fc00::/7",
+}
+
+var contextKeyInternalTraffic = contextKey("internal-traffic")
+
+// WithInternalTrafficMiddleware serves the internal listener, and must be its
+// outermost handler, so that nothing is served to clients that aren't on one
+// of the allowed networks. Their requests are routed to the same services as
+// public ones, but are marked as internal, so that they skip the HTTPS
+// redirect and the service's allowed hosts.
+func WithInternalTrafficMiddleware(allowed []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAllowedInternalClient(r, allowed) {
+			SetErrorResponse(w, r, http.StatusForbidden, nil)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contextKeyInternalTraffic, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Private
+
+func isInternalTraffic(r *http.Request) bool {
+	internal, _ := r.Context().Value(contextKeyInternalTraffic).(bool)
+	return internal
+}
+
+func isAllowedInternalClient(r *http.Request, allowed []*net.IPNet) bool {
+	ip, ok := clientIP(r.RemoteAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseInternalAllowedNetworks(values []string) ([]*net.IPNet, error) {
+	if len(values) == 0 {
+		values = DefaultInternalAllowedNetworks
+	}
+
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		network, err := ParseTrustedNetwork(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInternalTraffic_SkipsRedirectAndAllowedHosts(t *testing.T) {
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	router := testRouter(t)
+	options := ServiceOptions{TLSEnabled: true, AllowedHosts: []string{"example.com"}}
+	require.NoError(t, router.SetServiceTarget("default", defaultEmptyHosts, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	allowed, err := parseInternalAllowedNetworks(nil)
+	require.NoError(t, err)
+	internal := WithInternalTrafficMiddleware(allowed, router)
+
+	statusCode, _ := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusMovedPermanently, statusCode)
+
+	req := httptest.NewRequest(http.MethodGet, "http://app:3000/", nil)
+	req.RemoteAddr = "10.0.0.5:1234"
+	w := httptest.NewRecorder()
+	internal.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "first", w.Body.String())
+}
+
+func TestInternalTraffic_RejectsClientsOutsideAllowedNetworks(t *testing.T) {
+	allowed, err := parseInternalAllowedNetworks([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	handler := WithInternalTrafficMiddleware(allowed, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, isInternalTraffic(r))
+	}))
+
+	for addr, expected := range map[string]int{
+		"10.1.2.3:1234":          http.StatusOK,
+		"[::ffff:10.1.2.3]:1234": http.StatusOK,
+		"172.18.0.5:1234":        http.StatusForbidden,
+		"[2001:db8::1]:1234":     http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, expected, w.Code, addr)
+	}
+
+	_, err = parseInternalAllowedNetworks([]string{"not a network"})
+	assert.Equal(t, ErrorInvalidTrustedNetwork, err)
+}
+
+func TestInternalTraffic_DockerProxyRangeNotAllowedByDefault(t *testing.T) {
+	allowed, err := parseInternalAllowedNetworks(nil)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "172.17.0.1:1234"
+	assert.False(t, isAllowedInternalClient(req, allowed))
+}
+
+func TestInternalTraffic_ProxyEndpointsCheckAllowedNetworks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	config := &Config{
+		Bind:                    "127.0.0.1",
+		AlternateConfigDir:      t.TempDir(),
+		InternalPathPrefix:      DefaultInternalPathPrefix,
+		InternalHttpPort:        port,
+		InternalAllowedNetworks: []string{"10.0.0.0/8"},
+	}
+	server := NewServer(config, NewRouter(NewFileStateStore(config.StatePath())))
+	require.NoError(t, server.Start())
+	t.Cleanup(server.Stop)
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/.kamal/health", port))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestInternalTraffic_NotMarkedOnPublicListener(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.False(t, isInternalTraffic(req))
+}
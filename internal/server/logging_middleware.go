@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,8 +21,15 @@ var (
 type loggingRequestContext struct {
 	Service         string
 	Target          string
+	HostGroup       string
+	MethodOverride  string
 	RequestHeaders  []string
 	ResponseHeaders []string
+
+	// Set when the client disconnected while its request body was being
+	// buffered, with how much of the body had arrived.
+	RequestIncomplete    bool
+	RequestBytesReceived int64
 }
 
 type LoggingMiddleware struct {
@@ -89,7 +97,7 @@ func (h *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		slog.String("method", r.Method),
 		slog.Int64("req_content_length", r.ContentLength),
 		slog.String("req_content_type", r.Header.Get("Content-Type")),
-		slog.Int64("resp_content_length", writer.bytesWritten),
+		slog.Int64("resp_content_length", writer.bytesWritten.Load()),
 		slog.String("resp_content_type", writer.Header().Get("Content-Type")),
 		slog.String("client_addr", clientAddr),
 		slog.String("client_port", clientPort),
@@ -100,6 +108,21 @@ func (h *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		slog.String("query", r.URL.RawQuery),
 	}
 
+	if loggingRequestContext.HostGroup != "" {
+		attrs = append(attrs, slog.String("host_group", loggingRequestContext.HostGroup))
+	}
+
+	if loggingRequestContext.MethodOverride != "" {
+		attrs = append(attrs, slog.String("method_override", loggingRequestContext.MethodOverride))
+	}
+
+	if loggingRequestContext.RequestIncomplete {
+		attrs = append(attrs,
+			slog.Bool("req_incomplete", true),
+			slog.Int64("req_bytes_received", loggingRequestContext.RequestBytesReceived),
+		)
+	}
+
 	attrs = append(attrs, h.retrieveCustomHeaders(loggingRequestContext.RequestHeaders, r.Header, "req")...)
 	attrs = append(attrs, h.retrieveCustomHeaders(loggingRequestContext.ResponseHeaders, writer.Header(), "resp")...)
 
@@ -119,11 +142,11 @@ func (h *LoggingMiddleware) retrieveCustomHeaders(headerNames []string, header h
 type loggerResponseWriter struct {
 	http.ResponseWriter
 	statusCode   int
-	bytesWritten int64
+	bytesWritten atomic.Int64
 }
 
 func newLoggerResponseWriter(w http.ResponseWriter) *loggerResponseWriter {
-	return &loggerResponseWriter{w, http.StatusOK, 0}
+	return &loggerResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 }
 
 // WriteHeader is used to capture the status code
@@ -135,7 +158,7 @@ func (r *loggerResponseWriter) WriteHeader(statusCode int) {
 // Write is used to capture the amount of data written
 func (r *loggerResponseWriter) Write(b []byte) (int, error) {
 	bytesWritten, err := r.ResponseWriter.Write(b)
-	r.bytesWritten += int64(bytesWritten)
+	r.bytesWritten.Add(int64(bytesWritten))
 	return bytesWritten, err
 }
 
@@ -146,10 +169,15 @@ func (r *loggerResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	}
 
 	con, rw, err := hijacker.Hijack()
-	if err == nil {
-		r.statusCode = http.StatusSwitchingProtocols
+	if err != nil {
+		return nil, nil, err
 	}
-	return con, rw, err
+
+	// Whatever is sent over the connection from now on, such as WebSocket
+	// messages, is the response. The copy to the client may still be finishing
+	// as the request is logged, hence counting atomically.
+	r.statusCode = http.StatusSwitchingProtocols
+	return &countingConn{Conn: con, written: &r.bytesWritten}, rw, nil
 }
 
 func (r *loggerResponseWriter) Flush() {
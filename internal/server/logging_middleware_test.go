@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -20,6 +23,7 @@ func TestMiddleware_LoggingMiddleware(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		LoggingRequestContext(r).Service = "myapp"
 		LoggingRequestContext(r).Target = "upstream:3000"
+		LoggingRequestContext(r).HostGroup = "app"
 		LoggingRequestContext(r).RequestHeaders = []string{"X-Custom"}
 		LoggingRequestContext(r).ResponseHeaders = []string{"Cache-Control", "X-Custom"}
 
@@ -63,6 +67,7 @@ func TestMiddleware_LoggingMiddleware(t *testing.T) {
 		Query             string `json:"query"`
 		Service           string `json:"service"`
 		Target            string `json:"target"`
+		HostGroup         string `json:"host_group"`
 		ReqXCustom        string `json:"req_x_custom"`
 		RespCacheControl  string `json:"resp_cache_control"`
 		RespXCustom       string `json:"resp_x_custom"`
@@ -92,9 +97,75 @@ func TestMiddleware_LoggingMiddleware(t *testing.T) {
 	assert.Equal(t, int64(8), logline.RespContentLength)
 	assert.Equal(t, "upstream:3000", logline.Target)
 	assert.Equal(t, "myapp", logline.Service)
+	assert.Equal(t, "app", logline.HostGroup)
 	assert.Equal(t, "hello", logline.ReqXCustom)
 	assert.Equal(t, "public, max-age=3600", logline.RespCacheControl)
 	assert.Equal(t, "goodbye", logline.RespXCustom)
 	assert.Equal(t, "HTTP/1.1", logline.Proto)
 	assert.Equal(t, "http", logline.Scheme)
 }
+
+func TestMiddleware_LoggingMiddlewareCountsHijackedConnectionBytes(t *testing.T) {
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		rw.Flush()
+
+		conn.Write([]byte("0123456789"))
+	})
+
+	server := httptest.NewServer(WithLoggingMiddleware(logger, 80, 443, handler))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "0123456789", string(body))
+
+	var logline struct {
+		Status            int   `json:"status"`
+		RespContentLength int64 `json:"resp_content_length"`
+	}
+	require.Eventually(t, func() bool { return out.Len() > 0 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, json.NewDecoder(strings.NewReader(out.String())).Decode(&logline))
+
+	assert.Equal(t, http.StatusSwitchingProtocols, logline.Status)
+	assert.Equal(t, int64(10), logline.RespContentLength)
+}
+
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Len()
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
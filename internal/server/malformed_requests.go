@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+)
+
+// Go's HTTP server answers requests it can't parse by itself, without calling
+// any handler, writing a terse plain text response straight to the connection.
+// We can recognise those by their exact form, which no handler's response can
+// have, since handlers' headers are written in sorted order and with a Date.
+//
+// http.Server has no hook for these responses, so this relies on that form.
+// Should a new version of Go change it, the responses are passed on as they
+// are, rather than replaced, and the tests for this file fail.
+const goServerErrorHeaders = "\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\n\r\n"
+
+var goServerErrorResponse = regexp.MustCompile(`(?s)^HTTP/1\.1 (\d{3}) ([^\r\n]*)` + regexp.QuoteMeta(goServerErrorHeaders))
+
+// MalformedRequests replaces Go's responses to malformed requests with our
+// own error pages, and logs and counts them. It works on plain HTTP
+// connections only: on HTTPS connections, the response is encrypted before
+// we could see it, and wrapping the decrypted connection would hide it from
+// http.Server, which needs the *tls.Conn itself.
+type MalformedRequests struct {
+	template *template.Template
+	count    atomic.Int64
+}
+
+func NewMalformedRequests(pages fs.FS) (*MalformedRequests, error) {
+	template, err := template.ParseFS(pages, "*.html")
+	if err != nil {
+		slog.Error("Failed to parse error page templates", "error", err)
+		return nil, ErrorUnableToLoadErrorPages
+	}
+
+	return &MalformedRequests{template: template}, nil
+}
+
+// WrapListener applies the handling to each connection accepted by l.
+func (m *MalformedRequests) WrapListener(l net.Listener) net.Listener {
+	return &malformedRequestListener{Listener: l, requests: m}
+}
+
+// Count is the number of malformed requests seen since the proxy started.
+func (m *MalformedRequests) Count() int64 {
+	return m.count.Load()
+}
+
+// Private
+
+func (m *MalformedRequests) response(conn net.Conn, original []byte) []byte {
+	match := goServerErrorResponse.FindSubmatch(original)
+	if match == nil {
+		return nil
+	}
+
+	statusCode, _ := strconv.Atoi(string(match[1]))
+	m.count.Add(1)
+
+	clientAddr, _ := splitHostPort(conn.RemoteAddr().String())
+	slog.Info("Malformed request", "client_addr", clientAddr, "status", statusCode, "error", string(match[2]))
+
+	var body bytes.Buffer
+	page := m.template.Lookup(fmt.Sprintf("%d.html", statusCode))
+	if page == nil || page.Execute(&body, nil) != nil {
+		body.Reset()
+		fmt.Fprintf(&body, "<h1>%d %s</h1>", statusCode, http.StatusText(statusCode))
+	}
+
+	var resp bytes.Buffer
+	fmt.Fprintf(&resp, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+	fmt.Fprintf(&resp, "Connection: close\r\nContent-Length: %d\r\nContent-Type: text/html; charset=utf-8\r\n\r\n", body.Len())
+	resp.Write(body.Bytes())
+
+	return resp.Bytes()
+}
+
+type malformedRequestListener struct {
+	net.Listener
+	requests *MalformedRequests
+}
+
+func (l *malformedRequestListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &malformedRequestConn{Conn: conn, requests: l.requests}, nil
+}
+
+type malformedRequestConn struct {
+	net.Conn
+	requests *MalformedRequests
+}
+
+func (c *malformedRequestConn) Write(b []byte) (int, error) {
+	if bytes.Contains(b, []byte(goServerErrorHeaders)) {
+		if replacement := c.requests.response(c.Conn, b); replacement != nil {
+			_, err := c.Conn.Write(replacement)
+			if err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+	}
+
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMalformedRequests_RendersErrorPage(t *testing.T) {
+	malformed, err := NewMalformedRequests(fstest.MapFS{
+		"400.html": &fstest.MapFile{Data: []byte("<p>That request didn't make sense</p>")},
+	})
+	require.NoError(t, err)
+
+	addr := testMalformedRequestsServer(t, malformed)
+
+	resp, body := sendRawRequest(t, addr, "GET / HTTP/1.1\r\nHost: example.com\r\nBad Header\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "<p>That request didn't make sense</p>", body)
+	assert.Equal(t, int64(1), malformed.Count())
+}
+
+func TestMalformedRequests_FallsBackWithoutPage(t *testing.T) {
+	malformed, err := NewMalformedRequests(fstest.MapFS{
+		"404.html": &fstest.MapFile{Data: []byte("<p>Not here</p>")},
+	})
+	require.NoError(t, err)
+
+	addr := testMalformedRequestsServer(t, malformed)
+
+	resp, body := sendRawRequest(t, addr, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "<h1>400 Bad Request</h1>", body)
+	assert.Equal(t, int64(1), malformed.Count())
+}
+
+func TestMalformedRequests_LeavesValidRequestsAlone(t *testing.T) {
+	malformed, err := NewMalformedRequests(fstest.MapFS{
+		"400.html": &fstest.MapFile{Data: []byte("<p>That request didn't make sense</p>")},
+	})
+	require.NoError(t, err)
+
+	addr := testMalformedRequestsServer(t, malformed)
+
+	resp, body := sendRawRequest(t, addr, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "handler says no\n", body)
+	assert.Equal(t, int64(0), malformed.Count())
+}
+
+func TestMalformedRequests_GoResponsesAreRecognised(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &http.Server{Handler: http.NotFoundHandler(), MaxHeaderBytes: 1024}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	for _, request := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: example.com\r\nBad Header\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: example.com\r\nX-Large: " + strings.Repeat("a", 8192) + "\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte(request))
+		require.NoError(t, err)
+
+		response, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		conn.Close()
+
+		assert.Regexp(t, goServerErrorResponse, string(response), "Go's response to a malformed request has changed form")
+	}
+}
+
+func TestServer_CountsMalformedRequests(t *testing.T) {
+	server, addr := testServer(t)
+
+	resp, _ := sendRawRequest(t, strings.TrimPrefix(addr, "http://"), "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	assert.Equal(t, int64(1), server.HealthStatus().MalformedRequests)
+}
+
+func TestServer_MalformedRequestsOverHTTPSAreLeftAlone(t *testing.T) {
+	server, _ := testServer(t)
+
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "example.com")
+	_, target := testBackend(t, "first", http.StatusOK)
+	options := ServiceOptions{TLSEnabled: true, TLSCertificatePath: certPath, TLSPrivateKeyPath: keyPath}
+	require.NoError(t, server.router.SetServiceTarget("service1", []string{"example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.HttpsPort()), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nBad Header\r\n\r\n"))
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, int64(0), server.HealthStatus().MalformedRequests)
+}
+
+// Private
+
+func testMalformedRequestsServer(t *testing.T, malformed *MalformedRequests) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "handler says no", http.StatusBadRequest)
+	})}
+	go server.Serve(malformed.WrapListener(l))
+	t.Cleanup(func() { server.Close() })
+
+	return l.Addr().String()
+}
+
+func sendRawRequest(t *testing.T, addr string, request string) (*http.Response, string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(request))
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, string(body)
+}
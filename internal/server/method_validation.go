@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+var ErrorInvalidHTTPMethod = errors.New("not a valid HTTP method")
+
+// overridableMethods are the methods a POST can be turned into with
+// X-HTTP-Method-Override. Turning requests into GET or HEAD isn't allowed,
+// since the target would expect those to be safe to repeat.
+var overridableMethods = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// ParseAllowedMethod normalizes a method name given as an option.
+func ParseAllowedMethod(value string) (string, error) {
+	method := strings.ToUpper(strings.TrimSpace(value))
+	if method == "" {
+		return "", ErrorInvalidHTTPMethod
+	}
+
+	for _, c := range method {
+		if c < 'A' || c > 'Z' {
+			return "", ErrorInvalidHTTPMethod
+		}
+	}
+
+	return method, nil
+}
+
+// handleDisallowedMethods rejects requests that use a method the service
+// doesn't accept, so that they don't tie up the target, and answers OPTIONS
+// requests when configured to. It returns true if the request was handled.
+//
+// HEAD is accepted whenever GET is. CORS preflight requests are always passed
+// through to the target when answering OPTIONS requests, since only the
+// application knows which origins it accepts.
+func (s *Service) handleDisallowedMethods(config *serviceConfig, w http.ResponseWriter, r *http.Request) bool {
+	if len(config.options.AllowedMethods) == 0 {
+		return false
+	}
+
+	if r.Method == http.MethodOptions && config.options.AnswerOptions {
+		if isCORSPreflight(r) {
+			return false
+		}
+
+		w.Header().Set("Allow", s.allowHeader(config))
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+
+	if s.methodIsAllowed(config, r.Method) {
+		return false
+	}
+
+	w.Header().Set("Allow", s.allowHeader(config))
+	SetErrorResponse(w, r, http.StatusMethodNotAllowed, nil)
+	return true
+}
+
+// applyMethodOverride turns a POST request into the method named in its
+// X-HTTP-Method-Override header, for legacy clients that are stuck behind
+// proxies that only pass GET and POST. The original method is still logged,
+// with the override alongside it. Requests with any other method, or an
+// override that isn't one of the overridable methods, are left unchanged.
+func (s *Service) applyMethodOverride(config *serviceConfig, r *http.Request) *http.Request {
+	if !config.options.MethodOverride || r.Method != http.MethodPost {
+		return r
+	}
+
+	method, err := ParseAllowedMethod(r.Header.Get(methodOverrideHeader))
+	if err != nil || !slices.Contains(overridableMethods, method) {
+		return r
+	}
+
+	LoggingRequestContext(r).MethodOverride = method
+
+	r = r.WithContext(r.Context())
+	r.Method = method
+	r.Header.Del(methodOverrideHeader)
+	return r
+}
+
+// Private
+
+func (s *Service) methodIsAllowed(config *serviceConfig, method string) bool {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	return slices.Contains(config.options.AllowedMethods, method)
+}
+
+func (s *Service) allowHeader(config *serviceConfig) string {
+	methods := slices.Clone(config.options.AllowedMethods)
+	if slices.Contains(methods, http.MethodGet) && !slices.Contains(methods, http.MethodHead) {
+		methods = append(methods, http.MethodHead)
+	}
+	if config.options.AnswerOptions && !slices.Contains(methods, http.MethodOptions) {
+		methods = append(methods, http.MethodOptions)
+	}
+	return strings.Join(methods, ", ")
+}
+
+func isCORSPreflight(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
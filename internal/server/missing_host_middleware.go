@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	MissingHostDefault = "default"
+	MissingHostReject  = "reject"
+)
+
+var ErrorInvalidMissingHostPolicy = errors.New("missing host policy must be \"default\", \"reject\" or a host name")
+
+// NormalizeMissingHostPolicy checks a policy for requests without a Host
+// header, which is either MissingHostDefault, MissingHostReject, or a host to
+// treat those requests as being for.
+func NormalizeMissingHostPolicy(policy string) (string, error) {
+	switch policy {
+	case "", MissingHostDefault:
+		return MissingHostDefault, nil
+	case MissingHostReject:
+		return MissingHostReject, nil
+	}
+
+	host, err := NormalizeHost(policy)
+	if err == nil {
+		_, err = idna.Lookup.ToASCII(host) // Rejects wildcards, ports and other stray characters
+	}
+	if err != nil || host == "" {
+		return "", ErrorInvalidMissingHostPolicy
+	}
+	return host, nil
+}
+
+// WithMissingHostMiddleware decides what happens to requests that arrive
+// without a Host header, which HTTP/1.0 clients are allowed to send. By
+// default they are routed to the service with no hosts, but they can instead
+// be rejected, or routed as though they were for a particular host. Either
+// way they are logged, since they usually come from misbehaving clients.
+func WithMissingHostMiddleware(policy string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		slog.Info("Request without Host header",
+			"policy", policy,
+			"proto", r.Proto,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"user_agent", r.Header.Get("User-Agent"),
+		)
+
+		switch policy {
+		case "", MissingHostDefault:
+		case MissingHostReject:
+			SetErrorResponse(w, r, http.StatusBadRequest, nil)
+			return
+		default:
+			r.Host = policy
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
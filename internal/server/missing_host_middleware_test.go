@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingHostMiddleware_LeavesRequestsWithHostAlone(t *testing.T) {
+	handler := WithMissingHostMiddleware(MissingHostReject, testMissingHostHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "example.com", w.Body.String())
+}
+
+func TestMissingHostMiddleware_Policies(t *testing.T) {
+	tests := map[string]struct {
+		policy     string
+		statusCode int
+		host       string
+	}{
+		"default": {MissingHostDefault, http.StatusOK, ""},
+		"reject":  {MissingHostReject, http.StatusBadRequest, ""},
+		"host":    {"app.example.com", http.StatusOK, "app.example.com"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			handler := WithMissingHostMiddleware(tc.policy, testMissingHostHandler())
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Proto, req.ProtoMinor = "HTTP/1.0", 0
+			req.Host = ""
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.statusCode, w.Code)
+			if tc.statusCode == http.StatusOK {
+				assert.Equal(t, tc.host, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMissingHostMiddleware_NormalizePolicy(t *testing.T) {
+	policy, err := NormalizeMissingHostPolicy("")
+	require.NoError(t, err)
+	assert.Equal(t, MissingHostDefault, policy)
+
+	policy, err = NormalizeMissingHostPolicy(MissingHostReject)
+	require.NoError(t, err)
+	assert.Equal(t, MissingHostReject, policy)
+
+	policy, err = NormalizeMissingHostPolicy("App.Example.COM")
+	require.NoError(t, err)
+	assert.Equal(t, "app.example.com", policy)
+
+	_, err = NormalizeMissingHostPolicy("not a host")
+	assert.Equal(t, ErrorInvalidMissingHostPolicy, err)
+}
+
+// Helpers
+
+func testMissingHostHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	})
+}
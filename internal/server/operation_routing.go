@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// We only look this far into a request body for the operation name. Clients
+// usually send it alongside the query, so it may come after a lot of text;
+// when it's beyond the limit, the request simply isn't rerouted.
+const operationRoutingBodyLimit = 64 * 1024
+
+// contextKeyOperationRouted marks a request that has already been routed by
+// its operation, so that it isn't routed again by the service it went to.
+var contextKeyOperationRouted = contextKey("operation-routed")
+
+var ErrorInvalidOperationRoute = errors.New("operation route must be in the form <operation>=<service>")
+
+// OperationRoute sends GraphQL operations whose name matches Operation (which
+// may contain shell-style wildcards) to another service.
+type OperationRoute struct {
+	Operation string `json:"operation"`
+	Service   string `json:"service"`
+}
+
+func ParseOperationRoute(value string) (OperationRoute, error) {
+	operation, service, ok := strings.Cut(value, "=")
+	if !ok || operation == "" || service == "" {
+		return OperationRoute{}, ErrorInvalidOperationRoute
+	}
+
+	_, err := path.Match(operation, "")
+	if err != nil {
+		return OperationRoute{}, ErrorInvalidOperationRoute
+	}
+
+	return OperationRoute{Operation: operation, Service: service}, nil
+}
+
+func (r OperationRoute) Matches(operationName string) bool {
+	matched, _ := path.Match(r.Operation, operationName)
+	return matched
+}
+
+// Private
+
+// operationNameForRequest finds the name of a request's GraphQL operation.
+// For a POST, that means reading up to limit bytes of its body, which are
+// counted against the request's buffer memory budget until release is
+// called. If the budget can't spare them, the body isn't read.
+func operationNameForRequest(req *http.Request, limit int64) (name string, release func()) {
+	release = func() {}
+
+	switch req.Method {
+	case http.MethodGet:
+		return req.URL.Query().Get("operationName"), release
+
+	case http.MethodPost:
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType != "application/json" || req.Body == nil || limit <= 0 {
+			return "", release
+		}
+
+		budget := bufferMemoryBudgetForRequest(req)
+		if !budget.reserve(limit) {
+			return "", release
+		}
+
+		prefix, err := peekRequestBody(req, limit)
+		used := int64(len(prefix))
+		budget.release(limit - used)
+		release = func() { budget.release(used) }
+
+		if err != nil {
+			return "", release
+		}
+		return operationNameFromJSON(prefix), release
+	}
+
+	return "", release
+}
+
+// peekRequestBody reads up to limit bytes from the start of the body, and then
+// puts them back so that the body can be read in full later.
+func peekRequestBody(req *http.Request, limit int64) ([]byte, error) {
+	prefix, err := io.ReadAll(io.LimitReader(req.Body, limit))
+
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), req.Body), req.Body}
+
+	return prefix, err
+}
+
+func operationNameFromJSON(data []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	token, err := decoder.Token()
+	if err != nil || token != json.Delim('{') {
+		return ""
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+
+		if token == "operationName" {
+			var name string
+			if decoder.Decode(&name) != nil {
+				return ""
+			}
+			return name
+		}
+
+		var skip json.RawMessage
+		if decoder.Decode(&skip) != nil {
+			return ""
+		}
+	}
+
+	return ""
+}
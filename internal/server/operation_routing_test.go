@@ -0,0 +1,84 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOperationRoute(t *testing.T) {
+	route, err := ParseOperationRoute("Report*=reports")
+	require.NoError(t, err)
+	assert.Equal(t, OperationRoute{Operation: "Report*", Service: "reports"}, route)
+
+	for _, value := range []string{"", "Report*", "=reports", "Report*=", "[=reports"} {
+		_, err := ParseOperationRoute(value)
+		assert.ErrorIs(t, err, ErrorInvalidOperationRoute, value)
+	}
+}
+
+func TestOperationRoute_Matches(t *testing.T) {
+	route := OperationRoute{Operation: "Report*", Service: "reports"}
+
+	assert.True(t, route.Matches("ReportSales"))
+	assert.True(t, route.Matches("Report"))
+	assert.False(t, route.Matches("GetUser"))
+}
+
+func TestOperationNameFromJSON(t *testing.T) {
+	assert.Equal(t, "ReportSales", operationNameFromJSON([]byte(`{"query":"query ReportSales { sales { total } }","variables":{"year":2024},"operationName":"ReportSales"}`)))
+	assert.Equal(t, "GetUser", operationNameFromJSON([]byte(`{"operationName":"GetUser","query":"query GetUser { `)))
+	assert.Equal(t, "", operationNameFromJSON([]byte(`{"query":"query ReportSales { sal`)))
+	assert.Equal(t, "", operationNameFromJSON([]byte(`[{"operationName":"GetUser"}]`)))
+	assert.Equal(t, "", operationNameFromJSON([]byte(`not json`)))
+}
+
+func TestOperationNameForRequest_PreservesBody(t *testing.T) {
+	body := `{"operationName":"GetUser","query":"query GetUser { user { name } }"}`
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	name, release := operationNameForRequest(req, operationRoutingBodyLimit)
+	defer release()
+	assert.Equal(t, "GetUser", name)
+
+	remaining, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(remaining))
+}
+
+func TestOperationNameForRequest_GET(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/graphql?operationName=GetUser&query=x", nil)
+	name, _ := operationNameForRequest(req, operationRoutingBodyLimit)
+	assert.Equal(t, "GetUser", name)
+}
+
+func TestOperationNameForRequest_CountsAgainstBufferMemoryBudget(t *testing.T) {
+	body := `{"operationName":"GetUser","query":"query GetUser { user { name } }"}`
+	budget := NewBufferMemoryBudget(operationRoutingBodyLimit, BufferMemoryBudgetReject)
+
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+	req = req.WithContext(WithBufferMemoryBudget(req.Context(), budget))
+	req.Header.Set("Content-Type", "application/json")
+
+	name, release := operationNameForRequest(req, operationRoutingBodyLimit)
+	assert.Equal(t, "GetUser", name)
+	assert.Equal(t, int64(len(body)), budget.Stats().InUse)
+
+	release()
+	assert.Equal(t, int64(0), budget.Stats().InUse)
+
+	// With the budget used up, the body isn't read at all
+	require.True(t, budget.reserve(operationRoutingBodyLimit))
+	req = httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+	req = req.WithContext(WithBufferMemoryBudget(req.Context(), budget))
+	req.Header.Set("Content-Type", "application/json")
+
+	name, _ = operationNameForRequest(req, operationRoutingBodyLimit)
+	assert.Equal(t, "", name)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"sync"
 	"testing"
 	"time"
@@ -77,3 +78,17 @@ func TestPauseController_StoppingPausedRequestsFailsThemImmediately(t *testing.T
 	assert.Equal(t, "Back in 15 mins!", message)
 	wg.Wait()
 }
+
+func TestPauseController_RestoreFromJSON(t *testing.T) {
+	p := NewPauseController()
+	require.NoError(t, p.Stop("Back soon"))
+
+	data, err := json.Marshal(p)
+	require.NoError(t, err)
+
+	var restored PauseController
+	require.NoError(t, json.Unmarshal(data, &restored))
+
+	assert.Equal(t, PauseStateStopped, restored.GetState())
+	assert.Equal(t, "Back soon", restored.GetStopMessage())
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"time"
+)
+
+// preflightEarliestTime is a date the clock can't sensibly be before. A host
+// whose clock hasn't been set often starts at the epoch, and certificates
+// can't be validated or issued until it's corrected.
+var preflightEarliestTime = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type PreflightProblem struct {
+	Check   string
+	Message string
+}
+
+func (p PreflightProblem) String() string {
+	return p.Check + ": " + p.Message
+}
+
+// RunPreflightChecks checks that the environment is ready for the proxy to
+// start, before anything is bound or restored. All problems are returned
+// together, so that they can be fixed in one go.
+func RunPreflightChecks(config *Config, stateStore StateStore) []PreflightProblem {
+	problems := []PreflightProblem{}
+	check := func(name string, err error) {
+		if err != nil {
+			problems = append(problems, PreflightProblem{Check: name, Message: err.Error()})
+		}
+	}
+
+	check("ports", checkPortsAvailable(config))
+	check("certificates", checkDirectoryWritable(config.CertificatePath()))
+	check("state", checkStateReadable(stateStore))
+	check("socket", checkDirectoryWritable(path.Dir(config.SocketPath())))
+	check("clock", checkClock(time.Now()))
+
+	return problems
+}
+
+// Private
+
+func checkPortsAvailable(config *Config) error {
+	addrs := []string{
+		fmt.Sprintf("%s:%d", config.Bind, config.HttpPort),
+		fmt.Sprintf("%s:%d", config.Bind, config.HttpsPort),
+	}
+	if config.TunnelPort != 0 {
+		addrs = append(addrs, fmt.Sprintf("%s:%d", config.Bind, config.TunnelPort))
+	}
+	if config.InternalHttpPort != 0 {
+		addrs = append(addrs, fmt.Sprintf("%s:%d", cmp.Or(config.InternalBind, DefaultInternalBind), config.InternalHttpPort))
+	}
+
+	errs := []error{}
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to listen on %s; is another process using it? (%w)", addr, err))
+			continue
+		}
+		l.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkDirectoryWritable(dir string) error {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("unable to create %s; check its parent's permissions (%w)", dir, err)
+	}
+
+	f, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("unable to write to %s; check its ownership and permissions (%w)", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	return nil
+}
+
+func checkStateReadable(stateStore StateStore) error {
+	data, err := stateStore.Load()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read %s (%w)", stateStore, err)
+	}
+
+	// Only the shape of the state is checked. Decoding it into services would
+	// set them up, starting certificate issuance and health checks that the
+	// restore then starts again.
+	var saved []marshalledService
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s; restore it from a backup, or remove it to start with no services (%w)", stateStore, err)
+	}
+
+	return nil
+}
+
+func checkClock(now time.Time) error {
+	if now.Before(preflightEarliestTime) {
+		return fmt.Errorf("system time %s is in the past; certificates can't be issued or verified until the clock is synchronized", now.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
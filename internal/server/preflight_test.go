@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreflight_PassesInUsableEnvironment(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	config := &Config{Bind: "127.0.0.1", AlternateConfigDir: t.TempDir()}
+
+	problems := RunPreflightChecks(config, NewFileStateStore(config.StatePath()))
+	assert.Empty(t, problems)
+}
+
+func TestPreflight_ReportsAllProblems(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	config := &Config{Bind: "127.0.0.1", HttpPort: l.Addr().(*net.TCPAddr).Port, AlternateConfigDir: t.TempDir()}
+	statePath := filepath.Join(t.TempDir(), "kamal-proxy.state")
+	require.NoError(t, os.WriteFile(statePath, []byte("{not json"), 0o600))
+
+	problems := RunPreflightChecks(config, NewFileStateStore(statePath))
+
+	checks := []string{}
+	for _, problem := range problems {
+		checks = append(checks, problem.Check)
+	}
+	assert.Equal(t, []string{"ports", "state"}, checks)
+}
+
+func TestPreflight_StateIsOnlyCheckedForShape(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "kamal-proxy.state")
+	state := `[{"name":"app","hosts":["app.example.com"],"active_target":"localhost:3000","target_options":{"signing_key_file":"/nonexistent/keys"}}]`
+	require.NoError(t, os.WriteFile(statePath, []byte(state), 0o600))
+
+	assert.NoError(t, checkStateReadable(NewFileStateStore(statePath)))
+}
+
+func TestPreflight_ClockSanity(t *testing.T) {
+	assert.NoError(t, checkClock(time.Now()))
+	assert.Error(t, checkClock(time.Unix(0, 0)))
+}
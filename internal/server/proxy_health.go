@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"time"
+)
+
+const (
+	proxyHealthDialTimeout   = time.Second
+	proxyHealthCheckInterval = 10 * time.Second
+)
+
+type ProxyHealth struct {
+	Healthy    bool                  `json:"healthy"`
+	Checks     map[string]string     `json:"checks"`
+	Goroutines int                   `json:"goroutines"`
+	OpenFiles  int                   `json:"open_files"`
+	Services   ServiceDescriptionMap `json:"services,omitempty"`
+
+	MalformedRequests int64             `json:"malformed_requests"`
+	BufferMemory      BufferMemoryStats `json:"buffer_memory"`
+}
+
+// HealthStatus reports the results of the checks on the things the proxy
+// depends on to do its job. Each check reports "ok", or a description of
+// what's wrong. The checks write to disk and dial the proxy's own listeners,
+// so they run periodically rather than for each request.
+func (s *Server) HealthStatus() ProxyHealth {
+	checks := s.healthChecks.Load()
+	if checks == nil {
+		checks = s.runHealthChecks()
+	}
+
+	health := ProxyHealth{
+		Checks:     *checks,
+		Goroutines: runtime.NumGoroutine(),
+		OpenFiles:  countOpenFiles(),
+		Services:   s.router.ListActiveServices(),
+
+		BufferMemory: s.bufferMemory.Stats(),
+	}
+
+	if s.malformed != nil {
+		health.MalformedRequests = s.malformed.Count()
+	}
+
+	health.Healthy = true
+	for _, result := range health.Checks {
+		if result != "ok" {
+			health.Healthy = false
+		}
+	}
+
+	return health
+}
+
+// Private
+
+func (s *Server) startHealthChecks() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopHealthChecks = cancel
+
+	s.runHealthChecks()
+
+	go func() {
+		ticker := time.NewTicker(proxyHealthCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.runHealthChecks()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *Server) runHealthChecks() *map[string]string {
+	checks := map[string]string{
+		"http_listener":     checkResult(checkListener(s.httpListener)),
+		"https_listener":    checkResult(checkListener(s.httpsListener)),
+		"state_file":        checkResult(checkWritableDirectory(path.Dir(s.config.StatePath()))),
+		"state_persistence": checkResult(s.router.StatePersistenceError()),
+		"certificate_cache": checkResult(checkCertificateCache(s.config.CertificatePath())),
+		"certificates":      checkResult(s.checkCertificates()),
+	}
+
+	s.healthChecks.Store(&checks)
+	return &checks
+}
+
+func (s *Server) checkCertificates() error {
+	warningPeriod := s.config.CertExpiryWarning
+	if warningPeriod == 0 {
+		warningPeriod = DefaultCertExpiryWarning
+	}
+
+	expiring := 0
+	for _, status := range s.router.CertificateStatuses() {
+		if status.ExpiresWithin(warningPeriod) {
+			expiring++
+		}
+	}
+
+	if expiring > 0 {
+		return fmt.Errorf("%d certificate(s) expiring within %s", expiring, warningPeriod)
+	}
+	return nil
+}
+
+func checkListener(listener net.Listener) error {
+	if listener == nil {
+		return fmt.Errorf("not listening")
+	}
+
+	addr := listener.Addr().(*net.TCPAddr)
+	host := addr.IP
+	if host.IsUnspecified() {
+		host = net.IPv4(127, 0, 0, 1)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host.String(), fmt.Sprint(addr.Port)), proxyHealthDialTimeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func checkWritableDirectory(dir string) error {
+	f, err := os.CreateTemp(dir, ".health-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkCertificateCache checks that new certificates can be stored. The cache
+// is created when the first one is, so it's fine for it not to exist yet.
+func checkCertificateCache(dir string) error {
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return checkWritableDirectory(dir)
+}
+
+// countOpenFiles relies on /proc, so it's only available on Linux; elsewhere
+// it reports -1.
+func countOpenFiles() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+func checkResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"io"
 	"log/slog"
 	"net/http"
 )
@@ -20,17 +21,60 @@ func WithRequestBufferMiddleware(maxMemBytes, maxBytes int64, next http.Handler)
 }
 
 func (h *RequestBufferMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	requestBuffer, err := NewBufferedReadCloser(r.Body, h.maxBytes, h.maxMemBytes)
+	body := &clientBodyReader{ReadCloser: r.Body}
+
+	requestBuffer, err := NewBufferedReadCloser(body, h.maxBytes, h.maxMemBytes, bufferMemoryBudgetForRequest(r))
 	if err != nil {
-		if err == ErrMaximumSizeExceeded {
+		switch {
+		case err == ErrMaximumSizeExceeded:
 			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
-		} else {
+		case err == ErrBufferMemoryBudgetExceeded:
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		case body.err != nil:
+			h.handleIncompleteRequest(w, r, body)
+		default:
 			slog.Error("Error buffering request", "path", r.URL.Path, "error", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		}
 		return
 	}
 
+	defer requestBuffer.Close()
+
 	r.Body = requestBuffer
 	h.next.ServeHTTP(w, r)
 }
+
+// Private
+
+// handleIncompleteRequest deals with a client that disconnected part way
+// through sending its body. Nothing has been sent to the target yet, so there
+// is nothing to cancel there; like any other request the client abandons, it
+// is given a 499 status, which only the logs will see.
+func (h *RequestBufferMiddleware) handleIncompleteRequest(w http.ResponseWriter, r *http.Request, body *clientBodyReader) {
+	slog.Info("Client disconnected while sending request", "path", r.URL.Path, "bytes_received", body.bytesRead, "error", body.err)
+
+	lrc := LoggingRequestContext(r)
+	lrc.RequestIncomplete = true
+	lrc.RequestBytesReceived = body.bytesRead
+
+	w.WriteHeader(StatusClientClosedRequest)
+}
+
+// clientBodyReader records how much of a request body has been read, and
+// any error in reading it, to tell a client that went away apart from a
+// failure to buffer what it sent.
+type clientBodyReader struct {
+	io.ReadCloser
+	bytesRead int64
+	err       error
+}
+
+func (b *clientBodyReader) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytesRead += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
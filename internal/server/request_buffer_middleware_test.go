@@ -1,10 +1,13 @@
 package server
 
 import (
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -35,3 +38,27 @@ func TestRequestBufferMiddleware(t *testing.T) {
 		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
 	})
 }
+
+func TestRequestBufferMiddleware_ClientDisconnectsDuringUpload(t *testing.T) {
+	called := false
+	middleware := WithRequestBufferMiddleware(4, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	var lrc *loggingRequestContext
+	handler := WithLoggingMiddleware(slog.New(slog.NewTextHandler(io.Discard, nil)), 80, 443, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lrc = LoggingRequestContext(r)
+		middleware.ServeHTTP(w, r)
+	}))
+
+	body := io.MultiReader(strings.NewReader("partial body"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	req := httptest.NewRequest("POST", "http://app.example.com/upload", body)
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, StatusClientClosedRequest, rec.Result().StatusCode)
+	assert.False(t, called)
+	assert.True(t, lrc.RequestIncomplete)
+	assert.Equal(t, int64(len("partial body")), lrc.RequestBytesReceived)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// requestRateLimitSweepInterval is how often the buckets of clients that
+	// have gone quiet are discarded.
+	requestRateLimitSweepInterval = time.Minute
+
+	// requestRateLimitMaxHeaderKeys limits how many header values have their
+	// own buckets. The client chooses the value, so without a limit, each new
+	// one would take more memory and get a fresh burst.
+	requestRateLimitMaxHeaderKeys = 10000
+)
+
+// requestRateLimiter limits how many requests per second each client can
+// make to a service, allowing short bursts above that. Clients are told
+// apart by their IP address (or IPv6 network), or by the value of a header,
+// such as an API key, when one is configured. Requests without the header
+// fall back to their IP address, as do those with a new value once the
+// limit on header values is reached.
+type requestRateLimiter struct {
+	rate   float64
+	burst  float64
+	header string
+
+	lock          sync.Mutex
+	now           func() time.Time
+	clients       map[string]*tokenBucket
+	headerKeys    map[string]*tokenBucket
+	maxHeaderKeys int
+	lastSweep     time.Time
+}
+
+func newRequestRateLimiter(rate float64, burst int, header string) *requestRateLimiter {
+	return &requestRateLimiter{
+		rate:          rate,
+		burst:         max(float64(burst), rate, 1),
+		header:        header,
+		now:           time.Now,
+		clients:       map[string]*tokenBucket{},
+		headerKeys:    map[string]*tokenBucket{},
+		maxHeaderKeys: requestRateLimitMaxHeaderKeys,
+	}
+}
+
+func (l *requestRateLimiter) allow(r *http.Request) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	return l.bucket(r).take(now, l.rate, l.burst)
+}
+
+// retryAfter is how many whole seconds it takes to earn another request.
+func (l *requestRateLimiter) retryAfter() string {
+	return strconv.Itoa(int(math.Ceil(1 / l.rate)))
+}
+
+// Private
+
+// sameSettings is true when the limiter was created with these settings, so
+// that it can be kept across deploys without resetting its clients' buckets.
+func (l *requestRateLimiter) sameSettings(rate float64, burst int, header string) bool {
+	return l.rate == rate && l.burst == max(float64(burst), rate, 1) && l.header == header
+}
+
+func (l *requestRateLimiter) bucket(r *http.Request) *tokenBucket {
+	if l.header != "" {
+		if value := r.Header.Get(l.header); value != "" {
+			if bucket, ok := l.headerKeys[value]; ok {
+				return bucket
+			}
+			if len(l.headerKeys) < l.maxHeaderKeys {
+				bucket := &tokenBucket{}
+				l.headerKeys[value] = bucket
+				return bucket
+			}
+		}
+	}
+
+	key := rateLimitKey(r.RemoteAddr)
+	bucket, ok := l.clients[key]
+	if !ok {
+		bucket = &tokenBucket{}
+		l.clients[key] = bucket
+	}
+	return bucket
+}
+
+// sweep discards the buckets of clients that have been quiet for long enough
+// to have earned a full burst again, since a new bucket would be the same.
+func (l *requestRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < requestRateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for _, buckets := range []map[string]*tokenBucket{l.clients, l.headerKeys} {
+		for key, bucket := range buckets {
+			if bucket.full(now, l.rate, l.burst) {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// handleRateLimitedRequests responds with 429 to requests over the service's
+// rate limit, returning true if it did.
+func (s *Service) handleRateLimitedRequests(config *serviceConfig, w http.ResponseWriter, r *http.Request) bool {
+	limiter := config.rateLimiter
+	if limiter == nil || isInternalTraffic(r) || limiter.allow(r) {
+		return false
+	}
+
+	s.counters.rateLimited.Add(1)
+
+	w.Header().Set("Retry-After", limiter.retryAfter())
+	SetErrorResponse(w, r, http.StatusTooManyRequests, nil)
+	return true
+}
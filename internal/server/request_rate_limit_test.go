@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestRateLimiter_AllowsBurstsThenRate(t *testing.T) {
+	now := time.Now()
+	limiter := newRequestRateLimiter(1, 2, "")
+	limiter.now = func() time.Time { return now }
+
+	request := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+
+	assert.True(t, limiter.allow(request("192.0.2.1:1000")))
+	assert.True(t, limiter.allow(request("192.0.2.1:1001")))
+	assert.False(t, limiter.allow(request("192.0.2.1:1002")))
+
+	assert.True(t, limiter.allow(request("192.0.2.2:1000")))
+
+	// IPv6 clients share a limit with the rest of their /64
+	assert.True(t, limiter.allow(request("[2001:db8::1]:1000")))
+	assert.True(t, limiter.allow(request("[2001:db8::2]:1000")))
+	assert.False(t, limiter.allow(request("[2001:db8::3]:1000")))
+
+	now = now.Add(time.Second)
+	assert.True(t, limiter.allow(request("192.0.2.1:1003")))
+	assert.False(t, limiter.allow(request("192.0.2.1:1004")))
+}
+
+func TestRequestRateLimiter_KeyedByHeader(t *testing.T) {
+	limiter := newRequestRateLimiter(1, 1, "X-Api-Key")
+
+	request := func(key string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:1000"
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		return req
+	}
+
+	assert.True(t, limiter.allow(request("first")))
+	assert.False(t, limiter.allow(request("first")))
+	assert.True(t, limiter.allow(request("second")))
+
+	assert.True(t, limiter.allow(request("")))
+	assert.False(t, limiter.allow(request("")))
+}
+
+func TestRequestRateLimiter_HeaderKeysAreLimited(t *testing.T) {
+	now := time.Now()
+	limiter := newRequestRateLimiter(1, 1, "X-Api-Key")
+	limiter.now = func() time.Time { return now }
+	limiter.maxHeaderKeys = 2
+
+	request := func(key string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:1000"
+		req.Header.Set("X-Api-Key", key)
+		return req
+	}
+
+	assert.True(t, limiter.allow(request("first")))
+	assert.True(t, limiter.allow(request("second")))
+
+	// Further values share the bucket of their IP address
+	assert.True(t, limiter.allow(request("third")))
+	assert.False(t, limiter.allow(request("fourth")))
+	assert.Len(t, limiter.headerKeys, 2)
+
+	// Quiet clients' buckets expire, making room for new values
+	now = now.Add(requestRateLimitSweepInterval)
+	assert.True(t, limiter.allow(request("fourth")))
+	assert.Len(t, limiter.headerKeys, 1)
+	assert.Empty(t, limiter.clients)
+}
+
+func TestService_RateLimitKeptAcrossDeploys(t *testing.T) {
+	options := ServiceOptions{RateLimit: 0.5, RateLimitBurst: 1}
+	service := testCreateService(t, defaultEmptyHosts, options, defaultTargetOptions)
+	limiter := service.config().rateLimiter
+
+	require.NoError(t, service.UpdateOptions(defaultEmptyHosts, options))
+	assert.Same(t, limiter, service.config().rateLimiter)
+
+	options.RateLimitBurst = 2
+	require.NoError(t, service.UpdateOptions(defaultEmptyHosts, options))
+	assert.NotSame(t, limiter, service.config().rateLimiter)
+
+	options.RateLimit = 0
+	require.NoError(t, service.UpdateOptions(defaultEmptyHosts, options))
+	assert.Nil(t, service.config().rateLimiter)
+}
+
+func TestService_RateLimit(t *testing.T) {
+	service := testCreateService(t, defaultEmptyHosts, ServiceOptions{RateLimit: 0.5, RateLimitBurst: 1}, defaultTargetOptions)
+
+	w := httptest.NewRecorder()
+	service.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	service.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+	assert.Equal(t, "2", w.Result().Header.Get("Retry-After"))
+
+	stats := service.Stats()
+	assert.Equal(t, int64(2), stats.Requests)
+	assert.Equal(t, int64(1), stats.RateLimited)
+	assert.Equal(t, int64(0), stats.Errors)
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// requestSummaryMaxSamples limits how many response times are kept for each
+// interval. Busier services are sampled, which keeps the percentiles
+// representative without holding on to every request.
+const requestSummaryMaxSamples = 10000
+
+// A service only has a summary when summaries are being logged, and a nil
+// summary records nothing.
+type requestSummary struct {
+	lock          sync.Mutex
+	statusClasses [5]int64
+	requests      int64
+	samples       []time.Duration
+}
+
+func newRequestSummary() *requestSummary {
+	return &requestSummary{}
+}
+
+func (s *requestSummary) record(statusCode int, duration time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests++
+	if class := statusCode / 100; class >= 1 && class <= 5 {
+		s.statusClasses[class-1]++
+	}
+
+	// Reservoir sampling, so that each request in the interval is equally
+	// likely to be kept.
+	if len(s.samples) < requestSummaryMaxSamples {
+		s.samples = append(s.samples, duration)
+	} else if i := rand.Int64N(s.requests); i < requestSummaryMaxSamples {
+		s.samples[i] = duration
+	}
+}
+
+// flush returns the attributes describing the requests recorded since the
+// last flush, and starts a new interval. It returns nothing when there have
+// been no requests.
+func (s *requestSummary) flush() []any {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	statusClasses, requests, samples := s.statusClasses, s.requests, s.samples
+	s.statusClasses, s.requests, s.samples = [5]int64{}, 0, nil
+	s.lock.Unlock()
+
+	if requests == 0 {
+		return nil
+	}
+
+	slices.Sort(samples)
+
+	return []any{
+		slog.Int64("requests", requests),
+		slog.Int64("status_1xx", statusClasses[0]),
+		slog.Int64("status_2xx", statusClasses[1]),
+		slog.Int64("status_3xx", statusClasses[2]),
+		slog.Int64("status_4xx", statusClasses[3]),
+		slog.Int64("status_5xx", statusClasses[4]),
+		slog.Float64("p50_ms", milliseconds(percentile(samples, 0.50))),
+		slog.Float64("p95_ms", milliseconds(percentile(samples, 0.95))),
+		slog.Float64("p99_ms", milliseconds(percentile(samples, 0.99))),
+	}
+}
+
+// logRequestSummariesPeriodically logs a summary of each service's requests
+// every interval, until the context is cancelled.
+func (r *Router) logRequestSummariesPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.logRequestSummaries()
+		}
+	}
+}
+
+func (r *Router) logRequestSummaries() {
+	r.withReadLock(func() error {
+		for name, service := range r.services {
+			if attrs := service.summary.flush(); attrs != nil {
+				slog.Info("Request summary", append([]any{"service", name}, attrs...)...)
+			}
+		}
+		return nil
+	})
+}
+
+// percentile uses the nearest-rank method on sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
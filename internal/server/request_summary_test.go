@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestSummary_CountsAndPercentiles(t *testing.T) {
+	summary := newRequestSummary()
+
+	for i := 1; i <= 100; i++ {
+		status := http.StatusOK
+		if i > 90 {
+			status = http.StatusServiceUnavailable
+		}
+		summary.record(status, time.Duration(i)*time.Millisecond)
+	}
+	summary.record(http.StatusNotFound, 0)
+
+	attrs := map[string]slog.Value{}
+	for _, attr := range summary.flush() {
+		attrs[attr.(slog.Attr).Key] = attr.(slog.Attr).Value
+	}
+
+	assert.Equal(t, int64(101), attrs["requests"].Int64())
+	assert.Equal(t, int64(90), attrs["status_2xx"].Int64())
+	assert.Equal(t, int64(1), attrs["status_4xx"].Int64())
+	assert.Equal(t, int64(10), attrs["status_5xx"].Int64())
+	assert.Equal(t, 50.0, attrs["p50_ms"].Float64())
+	assert.Equal(t, 95.0, attrs["p95_ms"].Float64())
+	assert.Equal(t, 99.0, attrs["p99_ms"].Float64())
+
+	assert.Nil(t, summary.flush(), "a new interval starts after each flush")
+}
+
+func TestRequestSummary_SamplesAreLimited(t *testing.T) {
+	summary := newRequestSummary()
+
+	for range requestSummaryMaxSamples * 2 {
+		summary.record(http.StatusOK, time.Millisecond)
+	}
+
+	assert.Len(t, summary.samples, requestSummaryMaxSamples)
+	assert.Equal(t, int64(requestSummaryMaxSamples*2), summary.requests)
+}
+
+func TestRouter_LogRequestSummaries(t *testing.T) {
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	router := testRouter(t)
+	router.summarizeRequests = true
+	_, target := testBackend(t, "first", http.StatusOK)
+	require.NoError(t, router.SetServiceTarget("service1", []string{"service1.example.com"}, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetServiceTarget("service2", []string{"service2.example.com"}, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	statusCode, _ := sendGETRequest(router, "http://service1.example.com/")
+	require.Equal(t, http.StatusOK, statusCode)
+
+	out.Reset()
+	router.logRequestSummaries()
+
+	var logline struct {
+		Msg       string  `json:"msg"`
+		Service   string  `json:"service"`
+		Requests  int64   `json:"requests"`
+		Status2xx int64   `json:"status_2xx"`
+		P99       float64 `json:"p99_ms"`
+	}
+	require.NoError(t, json.NewDecoder(&out).Decode(&logline))
+
+	assert.Equal(t, "Request summary", logline.Msg)
+	assert.Equal(t, "service1", logline.Service)
+	assert.Equal(t, int64(1), logline.Requests)
+	assert.Equal(t, int64(1), logline.Status2xx)
+	assert.Greater(t, logline.P99, 0.0)
+
+	assert.Empty(t, out.String(), "services without requests are not logged")
+}
+
+func TestRouter_RequestsNotSummarizedWhenDisabled(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	statusCode, _ := sendGETRequest(router, "http://example.com/")
+	require.Equal(t, http.StatusOK, statusCode)
+
+	assert.Nil(t, router.serviceForName("service1").summary)
+	assert.Nil(t, router.serviceForName("service1").summary.flush())
+}
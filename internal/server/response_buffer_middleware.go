@@ -2,38 +2,70 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"log/slog"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
+var contextKeyResponseBuffer = contextKey("response-buffer")
+
+// ResponseBufferMiddleware holds on to responses until they are complete, so
+// that slow clients don't tie up the target.
+//
+// Responses that are meant to be streamed, such as server-sent events, are
+// passed through instead. When a flush timeout is set, so are responses that
+// are still incomplete that long after their headers arrived, which covers
+// long-polling endpoints that hold the response open until there's something
+// to send.
 type ResponseBufferMiddleware struct {
-	maxMemBytes int64
-	maxBytes    int64
-	next        http.Handler
+	maxMemBytes  int64
+	maxBytes     int64
+	flushTimeout time.Duration
+	next         http.Handler
 }
 
-func WithResponseBufferMiddleware(maxMemBytes, maxBytes int64, next http.Handler) http.Handler {
+func WithResponseBufferMiddleware(maxMemBytes, maxBytes int64, flushTimeout time.Duration, next http.Handler) http.Handler {
 	return &ResponseBufferMiddleware{
-		maxMemBytes: maxMemBytes,
-		maxBytes:    maxBytes,
-		next:        next,
+		maxMemBytes:  maxMemBytes,
+		maxBytes:     maxBytes,
+		flushTimeout: flushTimeout,
+		next:         next,
+	}
+}
+
+// BypassResponseBuffer asks the buffer that a response is being written to,
+// if any, to stream the response rather than buffer it. It must be called
+// before the response's headers are written.
+func BypassResponseBuffer(r *http.Request) {
+	if w, ok := r.Context().Value(contextKeyResponseBuffer).(*bufferedResponseWriter); ok {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+
+		w.streamRequested = true
 	}
 }
 
 func (h *ResponseBufferMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	responseBuffer := NewBufferedWriteCloser(h.maxBytes, h.maxMemBytes)
-	responseWriter := &bufferedResponseWriter{ResponseWriter: w, statusCode: http.StatusOK, buffer: responseBuffer}
+	responseBuffer := NewBufferedWriteCloser(h.maxBytes, h.maxMemBytes, bufferMemoryBudgetForRequest(r))
+	responseWriter := &bufferedResponseWriter{ResponseWriter: w, statusCode: http.StatusOK, buffer: responseBuffer, flushTimeout: h.flushTimeout}
 	defer responseBuffer.Close()
 
+	r = r.WithContext(context.WithValue(r.Context(), contextKeyResponseBuffer, responseWriter))
 	h.next.ServeHTTP(responseWriter, r)
+	responseWriter.finish()
 
 	err := responseWriter.Send()
 	if err != nil {
 		if err == ErrMaximumSizeExceeded {
 			slog.Info("Response exceeded max response limit", "path", r.URL.Path)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		} else if err == ErrBufferMemoryBudgetExceeded {
+			slog.Info("Response exceeded buffer memory budget", "path", r.URL.Path)
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 		} else {
 			slog.Error("Error sending response", "path", r.URL.Path, "error", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -44,27 +76,24 @@ func (h *ResponseBufferMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Requ
 
 type bufferedResponseWriter struct {
 	http.ResponseWriter
-	statusCode    int
-	buffer        *Buffer
-	hijacked      bool
-	headerWritten bool
-	bypass        bool
+	statusCode      int
+	buffer          *Buffer
+	hijacked        bool
+	headerWritten   bool
+	headerSent      bool
+	bypass          bool
+	streamRequested bool
+	flushTimeout    time.Duration
+	flushTimer      *time.Timer
+	finished        bool
+	lock            sync.Mutex
 }
 
 func (w *bufferedResponseWriter) Send() error {
-	if w.buffer.Overflowed() {
-		return ErrMaximumSizeExceeded
-	}
-
-	if w.hijacked {
-		return nil
-	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
-	if w.headerWritten {
-		w.ResponseWriter.WriteHeader(w.statusCode)
-	}
-
-	return w.buffer.Send(w.ResponseWriter)
+	return w.send()
 }
 
 func (w *bufferedResponseWriter) Header() http.Header {
@@ -72,35 +101,47 @@ func (w *bufferedResponseWriter) Header() http.Header {
 }
 
 func (w *bufferedResponseWriter) WriteHeader(statusCode int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
 	if !w.headerWritten {
 		w.statusCode = statusCode
 		w.headerWritten = true
 
 		if w.ShouldSwitchToUnbuffered() {
-			w.SwitchToUnbuffered()
+			w.switchToUnbuffered()
+		} else if w.flushTimeout > 0 {
+			w.flushTimer = time.AfterFunc(w.flushTimeout, w.SwitchToUnbuffered)
 		}
 	}
 }
 
 func (w *bufferedResponseWriter) ShouldSwitchToUnbuffered() bool {
 	contentType, _, _ := strings.Cut(w.Header().Get("Content-Type"), ";")
-	return contentType == "text/event-stream"
+	return contentType == "text/event-stream" || w.streamRequested
 }
 
 func (w *bufferedResponseWriter) SwitchToUnbuffered() {
-	w.bypass = true
-	_ = w.Send()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.finished && !w.bypass && !w.hijacked {
+		w.switchToUnbuffered()
+	}
 }
 
 func (w *bufferedResponseWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
 	if w.bypass {
 		return w.ResponseWriter.Write(data)
 	}
 
 	n, err := w.buffer.Write(data)
-	if err == ErrMaximumSizeExceeded {
+	if err == ErrMaximumSizeExceeded || err == ErrBufferMemoryBudgetExceeded {
 		// Returning an error here will cause the ReverseProxy to panic. If the
-		// error is that we're exceeding the limit, just pretend it was all
+		// error is that we're exceeding a limit, just pretend it was all
 		// fine. We'll handle the overflow condition when we send the buffer to
 		// the client.
 		return len(data), nil
@@ -110,6 +151,9 @@ func (w *bufferedResponseWriter) Write(data []byte) (int, error) {
 }
 
 func (w *bufferedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
 	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
 		w.hijacked = true
 		return hijacker.Hijack()
@@ -118,6 +162,9 @@ func (w *bufferedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 }
 
 func (w *bufferedResponseWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
 	if w.bypass {
 		flusher, ok := w.ResponseWriter.(http.Flusher)
 		if ok {
@@ -125,3 +172,50 @@ func (w *bufferedResponseWriter) Flush() {
 		}
 	}
 }
+
+// Private
+
+func isCloseDelimited(resp *http.Response) bool {
+	return resp.ContentLength == -1 && len(resp.TransferEncoding) == 0 && resp.Request.Method != http.MethodHead
+}
+
+// finish stops the response from switching to unbuffered once the handler is
+// done writing it.
+func (w *bufferedResponseWriter) finish() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.finished = true
+	if w.flushTimer != nil {
+		w.flushTimer.Stop()
+	}
+}
+
+func (w *bufferedResponseWriter) send() error {
+	if w.buffer.Overflowed() {
+		return ErrMaximumSizeExceeded
+	}
+	if w.buffer.BudgetExceeded() {
+		return ErrBufferMemoryBudgetExceeded
+	}
+
+	if w.hijacked {
+		return nil
+	}
+
+	if w.headerWritten && !w.headerSent {
+		w.ResponseWriter.WriteHeader(w.statusCode)
+		w.headerSent = true
+	}
+
+	return w.buffer.Send(w.ResponseWriter)
+}
+
+func (w *bufferedResponseWriter) switchToUnbuffered() {
+	w.bypass = true
+	_ = w.send()
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -1,17 +1,20 @@
 package server
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestResponseBufferMiddleware(t *testing.T) {
 	sendRequest := func(requestBody, responseBody string) *httptest.ResponseRecorder {
-		middleware := WithResponseBufferMiddleware(4, 8, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware := WithResponseBufferMiddleware(4, 8, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(responseBody))
 		}))
 
@@ -40,7 +43,7 @@ func TestResponseBufferMiddleware_BufferedResponsesIgnoreFlushes(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/somepath", nil)
 	rec := httptest.NewRecorder()
 
-	middleware := WithResponseBufferMiddleware(1024, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	middleware := WithResponseBufferMiddleware(1024, 1024, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "http://example.com", http.StatusFound)
 
 		// Ensure this flush does not bypass the buffered response
@@ -61,7 +64,7 @@ func TestResponseBufferMiddleware_SSEResponsesBypassBufferAndAreFlushable(t *tes
 		req := httptest.NewRequest(http.MethodGet, "http://app.example.com/somepath", nil)
 		rec := httptest.NewRecorder()
 
-		middleware := WithResponseBufferMiddleware(1024, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware := WithResponseBufferMiddleware(1024, 1024, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", contentType)
 			w.WriteHeader(http.StatusOK)
 
@@ -81,3 +84,47 @@ func TestResponseBufferMiddleware_SSEResponsesBypassBufferAndAreFlushable(t *tes
 	checkContentType("text/event-stream; charset=utf-8", true)
 	checkContentType("text/plain", false)
 }
+
+func TestResponseBufferMiddleware_IncompleteResponsesStreamedAfterFlushTimeout(t *testing.T) {
+	server := httptest.NewServer(WithResponseBufferMiddleware(1024, 1024, 50*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if r.URL.Path == "/poll" {
+			time.Sleep(time.Second)
+		}
+		w.Write([]byte("done"))
+	})))
+	defer server.Close()
+
+	started := time.Now()
+	resp, err := http.Get(server.URL + "/poll")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Less(t, time.Since(started), 500*time.Millisecond, "headers should arrive before the response completes")
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "done", string(body))
+
+	resp, err = http.Get(server.URL + "/quick")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, int64(4), resp.ContentLength, "complete responses are still buffered")
+}
+
+func TestResponseBufferMiddleware_BypassedWhenRequested(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/somepath", nil)
+	rec := httptest.NewRecorder()
+
+	middleware := WithResponseBufferMiddleware(4, 8, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		BypassResponseBuffer(r)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("this response body is much too large to buffer"))
+	}))
+	middleware.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	assert.Equal(t, "this response body is much too large to buffer", rec.Body.String())
+}
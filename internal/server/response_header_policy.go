@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+)
+
+// ServerIdentifyingHeaders are response headers that reveal which software a
+// target is running, and which are removed when StripServerHeaders is set.
+var ServerIdentifyingHeaders = []string{
+	"Server",
+	"X-AspNet-Version",
+	"X-AspNetMvc-Version",
+	"X-Generator",
+	"X-Powered-By",
+	"X-Runtime",
+}
+
+// stripResponseHeaders removes the headers that the target's options say
+// should not reach the client.
+//
+// Hop-by-hop headers don't need to be handled here: the reverse proxy removes
+// them from every response before it is modified, whether the response is then
+// buffered or streamed.
+func (t *Target) stripResponseHeaders(resp *http.Response) {
+	if t.options.StripServerHeaders {
+		for _, header := range ServerIdentifyingHeaders {
+			resp.Header.Del(header)
+		}
+	}
+
+	for _, header := range t.options.StripResponseHeaders {
+		resp.Header.Del(header)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ResponseTimeoutHeader lets a target ask for longer than the usual response
+// timeout for a particular request, by including it in an interim (1xx)
+// response, such as 102 Processing. Its value is the total number of seconds
+// to wait for the final response, which is limited by MaxResponseTimeout.
+const ResponseTimeoutHeader = "X-Kamal-Timeout"
+
+// responseTimeoutError matches the error the transport gives when it times out
+// waiting for a response, so that both are reported as 504 Gateway Timeout.
+type responseTimeoutError struct{}
+
+func (responseTimeoutError) Error() string   { return "timeout awaiting response headers" }
+func (responseTimeoutError) Timeout() bool   { return true }
+func (responseTimeoutError) Temporary() bool { return true }
+
+var errResponseTimeout error = responseTimeoutError{}
+
+// Private
+
+// roundTripWithExtendableTimeout enforces the response timeout itself, rather
+// than leaving it to the transport, so that the target can extend it. As with
+// the transport's own timeout, it starts once the request has been written, so
+// that the time spent uploading doesn't count against it.
+func (t *Target) roundTripWithExtendableTimeout(req *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if t.options.ResponseTimeout <= 0 {
+		return next(req)
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timeout := &extendableTimeout{timeout: t.options.ResponseTimeout, expired: func() { cancel(errResponseTimeout) }}
+
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			timeout.start()
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			value := header.Get(ResponseTimeoutHeader)
+			if value == "" {
+				return nil
+			}
+
+			// The interim response is passed on to the client, which has no
+			// use for this.
+			header.Del(ResponseTimeoutHeader)
+
+			if extended, ok := t.extendedResponseTimeout(value); ok {
+				timeout.extend(extended)
+			}
+			return nil
+		},
+	}
+
+	resp, err := next(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+	if timeout.stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel(nil)
+		return nil, errResponseTimeout
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+
+	resp.Body = cancelOnClose(resp.Body, cancel)
+	return resp, nil
+}
+
+// extendedResponseTimeout parses a requested timeout, which can only extend the
+// usual timeout, and is limited to the configured maximum.
+func (t *Target) extendedResponseTimeout(value string) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+
+	timeout := min(time.Duration(seconds)*time.Second, t.options.MaxResponseTimeout)
+	return max(timeout, t.options.ResponseTimeout), true
+}
+
+// extendableTimeout runs out a timeout that can be extended while it's
+// running, measuring the extension from when it started.
+type extendableTimeout struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	expired func()
+	started time.Time
+	timer   *time.Timer
+}
+
+func (e *extendableTimeout) start() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.started = time.Now()
+	e.timer = time.AfterFunc(e.timeout, e.expired)
+}
+
+func (e *extendableTimeout) extend(timeout time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.timeout = timeout
+	if e.timer != nil {
+		e.timer.Reset(time.Until(e.started.Add(timeout)))
+	}
+}
+
+// stop reports whether the timeout had already run out.
+func (e *extendableTimeout) stop() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.timer != nil && !e.timer.Stop()
+}
+
+// cancelOnClose releases the request's context once the response body is
+// finished with, since the context must last as long as the body. The bodies
+// of upgraded connections stay writable, as the proxy needs them to be.
+func cancelOnClose(body io.ReadCloser, cancel context.CancelCauseFunc) io.ReadCloser {
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return &cancelOnCloseReadWriteCloser{ReadWriteCloser: rwc, cancel: cancel}
+	}
+	return &cancelOnCloseReadCloser{ReadCloser: body, cancel: cancel}
+}
+
+type cancelOnCloseReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelCauseFunc
+}
+
+func (r *cancelOnCloseReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel(nil)
+	return err
+}
+
+type cancelOnCloseReadWriteCloser struct {
+	io.ReadWriteCloser
+	cancel context.CancelCauseFunc
+}
+
+func (r *cancelOnCloseReadWriteCloser) Close() error {
+	err := r.ReadWriteCloser.Close()
+	r.cancel(nil)
+	return err
+}
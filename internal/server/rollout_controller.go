@@ -1,14 +1,36 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"hash/fnv"
 	"net/http"
 	"slices"
+	"time"
 )
 
-const RolloutCookieName = "kamal-rollout"
+const (
+	RolloutCookieName     = "kamal-rollout"
+	RolloutVariantHeader  = "X-Kamal-Variant"
+	RolloutVariantActive  = "active"
+	RolloutVariantRollout = "rollout"
+
+	rolloutCookieMaxAge = 30 * 24 * time.Hour
+)
+
+type RolloutOptions struct {
+	// Sticky gives clients without a rollout cookie a random one, so that
+	// they stay in the same group for the rest of the rollout.
+	Sticky bool `json:"sticky"`
+
+	// ExposeVariant includes the group that served each request in the
+	// response, as well as the request sent to the target.
+	ExposeVariant bool `json:"expose_variant"`
+}
 
 type RolloutController struct {
+	RolloutOptions
+
 	Percentage           int      `json:"percentage"`
 	PercentageSplitPoint float64  `json:"percentage_split_point"`
 	Allowlist            []string `json:"allowlist"`
@@ -38,6 +60,30 @@ func (rc *RolloutController) RequestUsesRolloutGroup(r *http.Request) bool {
 	return rc.valueInRolloutPercentage(splitValue)
 }
 
+// AssignRolloutCookie sets a random rollout cookie on a request that doesn't
+// have one, and on its response, so that the client keeps it.
+func (rc *RolloutController) AssignRolloutCookie(w http.ResponseWriter, r *http.Request) {
+	if rc.splitValue(r) != "" {
+		return
+	}
+
+	value := make([]byte, 16)
+	rand.Read(value)
+
+	cookie := &http.Cookie{
+		Name:     RolloutCookieName,
+		Value:    hex.EncodeToString(value),
+		Path:     "/",
+		MaxAge:   int(rolloutCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	r.AddCookie(cookie)
+	http.SetCookie(w, cookie)
+}
+
 func (rc *RolloutController) valueInAllowlist(value string) bool {
 	return slices.Contains(rc.Allowlist, value)
 }
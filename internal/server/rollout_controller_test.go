@@ -3,9 +3,11 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRolloutController_MatchesAllowlistItems(t *testing.T) {
@@ -52,3 +54,23 @@ func TestRolloutController_AllowListAndPercentageTogether(t *testing.T) {
 
 	assert.False(t, rc.RequestUsesRolloutGroup(&http.Request{}))
 }
+
+func TestRolloutController_AssignRolloutCookie(t *testing.T) {
+	rc := NewRolloutController(50, []string{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	rc.AssignRolloutCookie(w, req)
+
+	cookie, err := req.Cookie(RolloutCookieName)
+	require.NoError(t, err)
+	assert.Len(t, cookie.Value, 32)
+	assert.Contains(t, w.Header().Get("Set-Cookie"), RolloutCookieName+"="+cookie.Value)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: RolloutCookieName, Value: "existing"})
+	w = httptest.NewRecorder()
+	rc.AssignRolloutCookie(w, req)
+
+	assert.Empty(t, w.Header().Get("Set-Cookie"))
+}
@@ -6,22 +6,27 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"net"
 	"net/http"
 	"os"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	ErrorServiceNotFound             = errors.New("service not found")
+	ErrorServiceAlreadyExists        = errors.New("service already exists")
 	ErrorTargetFailedToBecomeHealthy = errors.New("target failed to become healthy within configured timeout")
 	ErrorHostInUse                   = errors.New("host settings conflict with another service")
 	ErrorNoServerName                = errors.New("no server name provided")
 	ErrorUnknownServerName           = errors.New("unknown server name")
 )
 
+const restoreProbeTimeout = time.Second
+
 type (
 	ServiceMap     map[string]*Service
 	HostServiceMap map[string]*Service
@@ -30,11 +35,12 @@ type (
 func (m ServiceMap) HostServices() HostServiceMap {
 	hostServices := HostServiceMap{}
 	for _, service := range m {
-		if len(service.hosts) == 0 {
+		hosts := service.config().hosts
+		if len(hosts) == 0 {
 			hostServices[""] = service
 			continue
 		}
-		for _, host := range service.hosts {
+		for _, host := range hosts {
 			hostServices[host] = service
 		}
 	}
@@ -73,10 +79,24 @@ func (m HostServiceMap) ServiceForHost(host string) *Service {
 }
 
 type Router struct {
-	statePath    string
+	stateStore   StateStore
 	services     ServiceMap
 	hostServices HostServiceMap
 	serviceLock  sync.RWMutex
+
+	acmeChallenges atomic.Int64
+	certExpiry     certExpiryMetrics
+	persistence    statePersistence
+	tunnels        *TunnelRegistry
+
+	// unrestored holds saved services that couldn't be restored, as they were
+	// saved, so that later saves keep them until they're deployed again or
+	// removed.
+	unrestored map[string]json.RawMessage
+
+	// summarizeRequests is set when request summaries are logged, so that
+	// services only pay for recording them then.
+	summarizeRequests bool
 }
 
 type ServiceDescription struct {
@@ -84,40 +104,81 @@ type ServiceDescription struct {
 	TLS    bool   `json:"tls"`
 	Target string `json:"target"`
 	State  string `json:"state"`
+
+	Standby    string `json:"standby,omitempty"`
+	FailedOver bool   `json:"failed_over,omitempty"`
+
+	LastDeploy *DeployTimings `json:"last_deploy,omitempty"`
+	Stats      ServiceStats   `json:"stats"`
 }
 
 type ServiceDescriptionMap map[string]ServiceDescription
 
-func NewRouter(statePath string) *Router {
+// ChangePlan describes what a command would do, without doing it.
+type ChangePlan struct {
+	Service     string   `json:"service"`
+	Action      string   `json:"action"`
+	Changes     []string `json:"changes"`
+	HealthCheck string   `json:"health_check,omitempty"`
+}
+
+type RestoreOptions struct {
+	ProbeTargets  bool
+	VerifyTargets bool
+}
+
+func NewRouter(stateStore StateStore) *Router {
 	return &Router{
-		statePath:    statePath,
+		stateStore:   stateStore,
 		services:     ServiceMap{},
 		hostServices: HostServiceMap{},
+		persistence:  newStatePersistence(),
+		unrestored:   map[string]json.RawMessage{},
 	}
 }
 
-func (r *Router) RestoreLastSavedState() error {
-	f, err := os.Open(r.statePath)
+func (r *Router) RestoreLastSavedState(options RestoreOptions) error {
+	data, err := r.stateStore.Load()
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			slog.Info("No previous state to restore", "path", r.statePath)
+			slog.Info("No previous state to restore", "store", r.stateStore)
 			return nil
 		}
-		slog.Error("Failed to restore saved state", "path", r.statePath, "error", err)
+		slog.Error("Failed to restore saved state", "store", r.stateStore, "error", err)
 		return err
 	}
-	defer f.Close()
 
-	var services []*Service
-	err = json.NewDecoder(f).Decode(&services)
+	var saved []json.RawMessage
+	err = json.Unmarshal(data, &saved)
 	if err != nil {
-		slog.Error("Failed to decode saved state", "path", r.statePath, "error", err)
+		slog.Error("Failed to decode saved state", "store", r.stateStore, "error", err)
 		return err
 	}
 
+	// A service that can't be restored, such as one whose certificate or key
+	// files have gone, shouldn't keep the others from being served.
+	services := []*Service{}
+	unrestored := map[string]json.RawMessage{}
+	for _, data := range saved {
+		var service Service
+		err := json.Unmarshal(data, &service)
+		if err != nil {
+			var ms marshalledService
+			json.Unmarshal(data, &ms)
+			slog.Error("Unable to restore service; it will be kept in the saved state", "service", ms.Name, "error", err)
+			unrestored[ms.Name] = data
+			continue
+		}
+		services = append(services, &service)
+	}
+
 	r.withWriteLock(func() error {
 		r.services = ServiceMap{}
+		r.unrestored = unrestored
 		for _, service := range services {
+			service.useTunnels(r.tunnels)
+			service.router = r
+			r.useRequestSummary(service)
 			r.services[service.name] = service
 		}
 
@@ -125,7 +186,14 @@ func (r *Router) RestoreLastSavedState() error {
 		return nil
 	})
 
-	slog.Info("Restored saved state", "path", r.statePath)
+	switch {
+	case options.VerifyTargets:
+		r.verifyRestoredTargets(services)
+	case options.ProbeTargets:
+		r.probeRestoredTargets(services)
+	}
+
+	slog.Info("Restored saved state", "store", r.stateStore)
 	return nil
 }
 
@@ -136,6 +204,16 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if isACMEChallenge(req) && service.serveACMEChallenge(w, req) {
+		r.acmeChallenges.Add(1)
+		return
+	}
+
+	if r.isMisdirected(req, service) {
+		SetErrorResponse(w, req, http.StatusMisdirectedRequest, nil)
+		return
+	}
+
 	service.ServeHTTP(w, req)
 }
 
@@ -143,26 +221,61 @@ func (r *Router) SetServiceTarget(name string, hosts []string, targetURL string,
 	options ServiceOptions, targetOptions TargetOptions,
 	deployTimeout time.Duration, drainTimeout time.Duration,
 ) error {
-	defer r.saveStateSnapshot()
+	return r.setServiceTarget(name, hosts, targetURL, options, targetOptions, deployTimeout, drainTimeout, false)
+}
 
-	slog.Info("Deploying", "service", name, "hosts", hosts, "target", targetURL, "tls", options.TLSEnabled)
+// ForceServiceTarget deploys a target without waiting for it to pass a
+// health check, treating it as healthy straight away. It's a last resort for
+// when the health check itself is broken, but the application works.
+func (r *Router) ForceServiceTarget(name string, hosts []string, targetURL string,
+	options ServiceOptions, targetOptions TargetOptions, drainTimeout time.Duration,
+) error {
+	return r.setServiceTarget(name, hosts, targetURL, options, targetOptions, 0, drainTimeout, true)
+}
 
-	target, err := r.deployNewTargetWithOptions(targetURL, targetOptions, deployTimeout)
-	if err != nil {
-		return err
-	}
+func (r *Router) CloneService(name string, newName string, hosts []string, targetURL string, deployTimeout time.Duration, drainTimeout time.Duration) error {
+	var options ServiceOptions
+	var targetOptions TargetOptions
+
+	// Copy the options under the lock, since a deploy to the service being
+	// cloned may be replacing them at the same time.
+	err := r.withReadLock(func() error {
+		service := r.services[name]
+		if service == nil {
+			return ErrorServiceNotFound
+		}
+		if r.services[newName] != nil {
+			return ErrorServiceAlreadyExists
+		}
+
+		active := service.ActiveTarget()
+		if active == nil {
+			return ErrorServiceHasNoTarget
+		}
 
-	err = r.setActiveTarget(name, hosts, target, options, drainTimeout)
+		options = service.config().options
+		targetOptions = active.options
+		if targetURL == "" {
+			targetURL = active.Target()
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	slog.Info("Deployed", "service", name, "hosts", hosts, "target", targetURL)
-	return nil
+	slog.Info("Cloning", "service", name, "new_service", newName)
+
+	return r.SetServiceTarget(newName, hosts, targetURL, options, targetOptions, deployTimeout, drainTimeout)
 }
 
 func (r *Router) SetRolloutTarget(name string, targetURL string, deployTimeout time.Duration, drainTimeout time.Duration) error {
-	defer r.saveStateSnapshot()
+	if err := r.StatePersistenceError(); err != nil {
+		return err
+	}
+
+	var timings DeployTimings
+	started := time.Now()
 
 	slog.Info("Deploying for rollout", "service", name, "target", targetURL)
 
@@ -172,18 +285,38 @@ func (r *Router) SetRolloutTarget(name string, targetURL string, deployTimeout t
 	}
 	targetOptions := service.ActiveTarget().options
 
-	target, err := r.deployNewTargetWithOptions(targetURL, targetOptions, deployTimeout)
+	targetURL, err := r.resolveTargetAddress(name, targetURL, true)
 	if err != nil {
 		return err
 	}
 
-	service.SetTarget(TargetSlotRollout, target, drainTimeout)
+	timings.measure(&timings.Resolve, func() { err = checkTargetResolves(name, targetURL) })
+	if err != nil {
+		return err
+	}
+
+	target, err := r.deployNewTargetWithOptions(targetURL, targetOptions, deployTimeout, &timings)
+	if err != nil {
+		return err
+	}
+
+	timings.measure(&timings.Swap, func() {
+		timings.Drain = service.SetTarget(TargetSlotRollout, target, drainTimeout)
+	})
+	timings.Swap -= timings.Drain
+
+	timings.measure(&timings.SaveState, func() { err = r.saveStateSnapshot() })
+	timings.Total = time.Since(started)
 
-	slog.Info("Deployed for rollout", "service", name, "target", targetURL)
+	slog.Info("Deployed for rollout", append([]any{"service", name, "target", targetURL}, timings.logAttrs()...)...)
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrorDeployNotPersisted, err)
+	}
 	return nil
 }
 
-func (r *Router) SetRolloutSplit(name string, percent int, allowList []string) error {
+func (r *Router) SetRolloutSplit(name string, percent int, allowList []string, options RolloutOptions) error {
 	defer r.saveStateSnapshot()
 
 	service := r.serviceForName(name)
@@ -191,7 +324,7 @@ func (r *Router) SetRolloutSplit(name string, percent int, allowList []string) e
 		return ErrorServiceNotFound
 	}
 
-	return service.SetRolloutSplit(percent, allowList)
+	return service.SetRolloutSplit(percent, allowList, options)
 }
 
 func (r *Router) StopRollout(name string) error {
@@ -205,16 +338,134 @@ func (r *Router) StopRollout(name string) error {
 	return service.StopRollout()
 }
 
+// PlanServiceTarget validates a deployment and reports what it would change,
+// optionally checking the health of the new target once. It does not alter
+// any state.
+func (r *Router) PlanServiceTarget(name string, hosts []string, targetURL string,
+	options ServiceOptions, targetOptions TargetOptions, probeTarget bool,
+) (ChangePlan, error) {
+	targetOptions.tunnels = r.tunnels
+
+	// A plan doesn't ask Docker about containers, so that it has no effects
+	// outside the proxy.
+	targetURL, err := r.resolveTargetAddress(name, targetURL, false)
+	if err != nil {
+		return ChangePlan{}, err
+	}
+
+	err = checkTargetResolves(name, targetURL)
+	if err == nil && options.StandbyTarget != "" {
+		err = checkTargetResolves(name, options.StandbyTarget)
+	}
+	if err != nil {
+		return ChangePlan{}, err
+	}
+
+	target, err := NewTarget(targetURL, targetOptions)
+	if err != nil {
+		return ChangePlan{}, err
+	}
+
+	hosts, err = normalizeHosts(hosts)
+	if err != nil {
+		return ChangePlan{}, err
+	}
+
+	err = checkServiceOptions(name, hosts, options)
+	if err != nil {
+		return ChangePlan{}, err
+	}
+
+	var conflict *Service
+	r.withReadLock(func() error {
+		conflict = r.hostServices.CheckHostAvailability(name, hosts)
+		return nil
+	})
+	if conflict != nil {
+		return ChangePlan{}, fmt.Errorf("%w (by %s)", ErrorHostInUse, conflict.name)
+	}
+
+	plan := ChangePlan{Service: name, Action: "create", Changes: []string{}}
+
+	service := r.serviceForName(name)
+	if service == nil {
+		plan.Changes = append(plan.Changes,
+			fmt.Sprintf("target: %s", targetURL),
+			fmt.Sprintf("hosts: %v", hosts),
+			fmt.Sprintf("tls: %t", options.TLSEnabled),
+		)
+	} else {
+		plan.Action = "update"
+		current := service.config()
+
+		if active := service.ActiveTarget(); active == nil || active.Target() != targetURL {
+			plan.Changes = append(plan.Changes, fmt.Sprintf("target: %s -> %s", describeTarget(active), targetURL))
+		}
+		if !slices.Equal(current.hosts, hosts) {
+			plan.Changes = append(plan.Changes, fmt.Sprintf("hosts: %v -> %v", current.hosts, hosts))
+		}
+		if current.options.TLSEnabled != options.TLSEnabled {
+			plan.Changes = append(plan.Changes, fmt.Sprintf("tls: %t -> %t", current.options.TLSEnabled, options.TLSEnabled))
+		}
+		if !reflect.DeepEqual(current.options, options) {
+			plan.Changes = append(plan.Changes, "service options changed")
+		}
+		if active := service.ActiveTarget(); active != nil && !reflect.DeepEqual(active.options, target.options) {
+			plan.Changes = append(plan.Changes, "target options changed")
+		}
+	}
+
+	if probeTarget {
+		defer target.closeIdleConnections()
+
+		err := target.ProbeHealth()
+		if err != nil {
+			plan.HealthCheck = err.Error()
+		} else {
+			plan.HealthCheck = "ok"
+		}
+	}
+
+	return plan, nil
+}
+
+func (r *Router) PlanRemoveService(name string) (ChangePlan, error) {
+	service := r.serviceForName(name)
+	if service == nil {
+		return ChangePlan{}, ErrorServiceNotFound
+	}
+
+	return ChangePlan{
+		Service: name,
+		Action:  "remove",
+		Changes: []string{
+			fmt.Sprintf("target: %s", describeTarget(service.ActiveTarget())),
+			fmt.Sprintf("hosts: %v", service.config().hosts),
+		},
+	}, nil
+}
+
 func (r *Router) RemoveService(name string) error {
 	defer r.saveStateSnapshot()
 
+	var replaced []replacedTarget
 	err := r.withWriteLock(func() error {
 		service := r.services[name]
 		if service == nil {
+			if _, ok := r.unrestored[name]; ok {
+				delete(r.unrestored, name)
+				return nil
+			}
 			return ErrorServiceNotFound
 		}
 
-		service.SetTarget(TargetSlotActive, nil, DefaultDrainTimeout)
+		replaced = append(replaced,
+			service.replaceTarget(TargetSlotActive, nil),
+			service.replaceTarget(TargetSlotRollout, nil),
+		)
+		if manager, ok := service.config().certManager.(*DNSCertManager); ok {
+			manager.Close()
+		}
 		delete(r.services, service.name)
 		r.hostServices = r.services.HostServices()
 
@@ -224,6 +475,12 @@ func (r *Router) RemoveService(name string) error {
 		return err
 	}
 
+	// Drain once the service is gone, so that other services can be found
+	// while it does.
+	for _, rt := range replaced {
+		rt.drain(DefaultDrainTimeout)
+	}
+
 	return nil
 }
 
@@ -265,16 +522,24 @@ func (r *Router) ListActiveServices() ServiceDescriptionMap {
 
 	r.withReadLock(func() error {
 		for name, service := range r.services {
-			host := strings.Join(service.hosts, ",")
+			config := service.config()
+			host := strings.Join(config.hosts, ",")
 			if host == "" {
 				host = "*"
 			}
 			if service.active != nil {
+				standby, failedOver := service.StandbyStatus()
 				result[name] = ServiceDescription{
 					Host:   host,
 					Target: service.active.Target(),
-					TLS:    service.options.TLSEnabled,
+					TLS:    config.options.TLSEnabled,
 					State:  service.pauseController.GetState().String(),
+
+					Standby:    standby,
+					FailedOver: failedOver,
+
+					LastDeploy: service.lastDeploy,
+					Stats:      service.Stats(),
 				}
 			}
 		}
@@ -284,6 +549,44 @@ func (r *Router) ListActiveServices() ServiceDescriptionMap {
 	return result
 }
 
+func (r *Router) InflightRequests(name string) ([]InflightRequestDescription, error) {
+	service := r.serviceForName(name)
+	if service == nil {
+		return nil, ErrorServiceNotFound
+	}
+
+	return service.InflightRequests(), nil
+}
+
+func (r *Router) CertificateStatuses() []CertificateStatus {
+	result := []CertificateStatus{}
+
+	r.withReadLock(func() error {
+		for _, service := range r.services {
+			result = append(result, service.CertificateStatuses()...)
+		}
+		return nil
+	})
+
+	return result
+}
+
+func (r *Router) HostCertificateStatuses(name string) ([]HostCertificateStatus, error) {
+	var result []HostCertificateStatus
+
+	err := r.withReadLock(func() error {
+		service := r.services[name]
+		if service == nil {
+			return ErrorServiceNotFound
+		}
+
+		result = service.HostCertificateStatuses()
+		return nil
+	})
+
+	return result, err
+}
+
 func (r *Router) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	host := hello.ServerName
 	if host == "" {
@@ -297,61 +600,256 @@ func (r *Router) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, e
 		return nil, ErrorUnknownServerName
 	}
 
-	if service.certManager == nil {
+	if service.config().certManager == nil {
 		slog.Debug("ACME: Unable to get certificate (service does not support TLS)")
 		return nil, ErrorUnknownServerName
 	}
 
-	return service.certManager.GetCertificate(hello)
+	return service.getCertificate(hello)
 }
 
 // Private
 
-func (r *Router) deployNewTargetWithOptions(targetURL string, targetOptions TargetOptions, deployTimeout time.Duration) (*Target, error) {
-	target, err := NewTarget(targetURL, targetOptions)
+func (r *Router) setServiceTarget(name string, hosts []string, targetURL string,
+	options ServiceOptions, targetOptions TargetOptions,
+	deployTimeout time.Duration, drainTimeout time.Duration, force bool,
+) error {
+	if err := r.StatePersistenceError(); err != nil {
+		return err
+	}
+
+	targetOptions.tunnels = r.tunnels
+
+	var timings DeployTimings
+	started := time.Now()
+
+	hosts, err := normalizeHosts(hosts)
+	if err != nil {
+		return err
+	}
+
+	targetURL, err = r.resolveTargetAddress(name, targetURL, true)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Deploying", "service", name, "hosts", hosts, "target", targetURL, "tls", options.TLSEnabled)
+
+	timings.measure(&timings.Resolve, func() {
+		err = checkTargetResolves(name, targetURL)
+		if err == nil && options.StandbyTarget != "" {
+			err = checkTargetResolves(name, options.StandbyTarget)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.deployServiceTarget(name, hosts, targetURL, options, targetOptions, deployTimeout, drainTimeout, force, &timings)
+
+	var saveErr error
+	timings.measure(&timings.SaveState, func() { saveErr = r.saveStateSnapshot() })
+	timings.Total = time.Since(started)
+
+	if err != nil {
+		slog.Info("Deploy failed", append([]any{"service", name, "target", targetURL, "error", err}, timings.logAttrs()...)...)
+		return err
+	}
+
+	r.withWriteLock(func() error {
+		r.services[name].lastDeploy = &timings
+		return nil
+	})
+
+	slog.Info("Deployed", append([]any{"service", name, "hosts", hosts, "target", targetURL}, timings.logAttrs()...)...)
+
+	if saveErr != nil {
+		return fmt.Errorf("%w: %w", ErrorDeployNotPersisted, saveErr)
+	}
+	return nil
+}
+
+func (r *Router) deployServiceTarget(name string, hosts []string, targetURL string,
+	options ServiceOptions, targetOptions TargetOptions,
+	deployTimeout time.Duration, drainTimeout time.Duration, force bool, timings *DeployTimings,
+) error {
+	var err error
+
+	target := r.unchangedActiveTarget(name, targetURL, targetOptions)
+	switch {
+	case target != nil:
+		slog.Info("Target is unchanged; updating service options in place", "service", name, "target", targetURL)
+	case force:
+		slog.Warn("Forcing deployment without a health check", "service", name, "target", targetURL)
+		timings.measure(&timings.CreateTarget, func() {
+			target, err = NewTarget(targetURL, targetOptions)
+		})
+		if err != nil {
+			return err
+		}
+		target.updateState(TargetStateHealthy)
+	default:
+		target, err = r.deployNewTargetWithOptions(targetURL, targetOptions, deployTimeout, timings)
+		if err != nil {
+			return err
+		}
+	}
+
+	var replaced replacedTarget
+	timings.measure(&timings.Swap, func() {
+		replaced, err = r.setActiveTarget(name, hosts, target, options)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Drain outside the router's lock, so that requests for every other
+	// service are still routed while it does.
+	timings.Drain = replaced.drain(drainTimeout)
+
+	return nil
+}
+
+// unchangedActiveTarget returns the service's active target if a deployment
+// would replace it with an identical one. Changes that only affect the
+// service, such as its hosts or TLS settings, can then be applied without
+// waiting for a new target to become healthy, or draining the current one.
+//
+// The container behind the address may have been replaced since it was
+// deployed, so its pooled connections are closed, and it's only reused if it
+// passes a health check.
+func (r *Router) unchangedActiveTarget(name string, targetURL string, targetOptions TargetOptions) *Target {
+	service := r.serviceForName(name)
+	if service == nil {
+		return nil
+	}
+
+	target := service.ActiveTarget()
+	if target == nil || target.Target() != targetURL || !target.IsHealthy() {
+		return nil
+	}
+
+	targetOptions.canonicalizeLogHeaders()
+	if !reflect.DeepEqual(target.options, targetOptions) || target.secretsChanged() {
+		return nil
+	}
+
+	target.closeIdleConnections()
+	err := target.ProbeHealth()
+	if err != nil {
+		slog.Info("Target is unchanged but failed a health check; deploying it again", "service", name, "target", targetURL, "error", err)
+		return nil
+	}
+
+	return target
+}
+
+func (r *Router) deployNewTargetWithOptions(targetURL string, targetOptions TargetOptions, deployTimeout time.Duration, timings *DeployTimings) (*Target, error) {
+	var target *Target
+	var err error
+
+	timings.measure(&timings.CreateTarget, func() {
+		target, err = NewTarget(targetURL, targetOptions)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	becameHealthy := target.WaitUntilHealthy(deployTimeout)
+	var becameHealthy bool
+	timings.measure(&timings.HealthCheck, func() {
+		becameHealthy = target.WaitUntilHealthy(deployTimeout)
+	})
 	if !becameHealthy {
 		slog.Info("Target failed to become healthy", "target", targetURL)
 		return nil, fmt.Errorf("%w (%s)", ErrorTargetFailedToBecomeHealthy, deployTimeout)
 	}
 
+	timings.measure(&timings.WarmUp, target.WarmConnections)
+
 	return target, nil
 }
 
+func (r *Router) probeRestoredTargets(services []*Service) {
+	// Targets are saved while they're healthy, but they may have stopped while
+	// we were down (or we may have stopped in the middle of draining them).
+	// Rather than route traffic to something that isn't there, take
+	// unreachable targets out of service until their health checks pass.
+	probes := []func(){}
+	forEachRestoredTarget(services, func(service *Service, target *Target) {
+		probes = append(probes, func() {
+			if !target.IsReachable(restoreProbeTimeout) {
+				slog.Warn("Restored target is unreachable; waiting for it to become healthy", "service", service.name, "target", target.Target())
+				target.BeginRecovery()
+			}
+		})
+	})
+
+	PerformConcurrently(probes...)
+}
+
+func (r *Router) verifyRestoredTargets(services []*Service) {
+	// A stricter version of probing: nothing is served until each target has
+	// passed a full health check.
+	forEachRestoredTarget(services, func(service *Service, target *Target) {
+		slog.Info("Verifying restored target", "service", service.name, "target", target.Target())
+		target.BeginRecovery()
+	})
+}
+
+func describeTarget(target *Target) string {
+	if target == nil {
+		return "(none)"
+	}
+	return target.Target()
+}
+
+func forEachRestoredTarget(services []*Service, fn func(*Service, *Target)) {
+	for _, service := range services {
+		for _, target := range []*Target{service.ActiveTarget(), service.RolloutTarget()} {
+			if target != nil {
+				fn(service, target)
+			}
+		}
+	}
+}
+
 func (r *Router) saveStateSnapshot() error {
-	services := []*Service{}
+	err := r.writeStateSnapshot()
+	r.recordStateSaved(err)
+	return err
+}
+
+func (r *Router) writeStateSnapshot() error {
+	services := []any{}
 	r.withReadLock(func() error {
 		for _, service := range r.services {
 			services = append(services, service)
 		}
+		for name, data := range r.unrestored {
+			if r.services[name] == nil {
+				services = append(services, data)
+			}
+		}
 		return nil
 	})
 
-	f, err := os.Create(r.statePath)
+	data, err := json.Marshal(services)
 	if err != nil {
 		return err
 	}
 
-	err = json.NewEncoder(f).Encode(services)
+	err = r.stateStore.Save(data)
 	if err != nil {
-		slog.Error("Unable to save state", "error", err, "path", r.statePath)
+		slog.Error("Unable to save state", "error", err, "store", r.stateStore)
 		return err
 	}
 
-	slog.Debug("Saved state", "path", r.statePath)
+	slog.Debug("Saved state", "store", r.stateStore)
 	return nil
 }
 
 func (r *Router) serviceForRequest(req *http.Request) *Service {
-	host, _, err := net.SplitHostPort(req.Host)
-	if err != nil {
-		host = req.Host
-	}
-
+	host, _ := splitHostPort(req.Host)
 	return r.serviceForHost(host)
 }
 
@@ -359,36 +857,66 @@ func (r *Router) serviceForHost(host string) *Service {
 	r.serviceLock.RLock()
 	defer r.serviceLock.RUnlock()
 
-	return r.hostServices.ServiceForHost(host)
+	return r.hostServices.ServiceForHost(normalizeRequestHost(host))
 }
 
-func (r *Router) setActiveTarget(name string, hosts []string, target *Target, options ServiceOptions, drainTimeout time.Duration) error {
+// setActiveTarget places the target in the service, creating the service if
+// it's new, and returns the target it replaced for the caller to drain.
+func (r *Router) setActiveTarget(name string, hosts []string, target *Target, options ServiceOptions) (replacedTarget, error) {
 	r.serviceLock.Lock()
 	defer r.serviceLock.Unlock()
 
 	conflict := r.hostServices.CheckHostAvailability(name, hosts)
 	if conflict != nil {
 		slog.Error("Host settings conflict with another service", "service", conflict.name)
-		return ErrorHostInUse
+		return replacedTarget{}, ErrorHostInUse
 	}
 
 	var err error
 	service := r.services[name]
 	if service == nil {
 		service, err = NewService(name, hosts, options)
+		if err == nil {
+			service.router = r
+			r.useRequestSummary(service)
+		}
 	} else {
 		err = service.UpdateOptions(hosts, options)
 	}
 	if err != nil {
-		return err
+		return replacedTarget{}, err
 	}
 
 	r.services[name] = service
 	r.hostServices = r.services.HostServices()
+	delete(r.unrestored, name)
 
-	service.SetTarget(TargetSlotActive, target, drainTimeout)
+	if service.ActiveTarget() == target {
+		return replacedTarget{}, nil
+	}
+	return service.replaceTarget(TargetSlotActive, target), nil
+}
 
-	return nil
+// useRequestSummary gives a service that's new to the router somewhere to
+// record its requests, if they're being summarized.
+func (r *Router) useRequestSummary(service *Service) {
+	if r.summarizeRequests {
+		service.summary = newRequestSummary()
+	}
+}
+
+// isMisdirected detects requests that arrived on a TLS connection that was
+// set up for a different service. Browsers will reuse an HTTP/2 connection for
+// any host that its certificate covers, so with certificates that cover
+// several hosts, a request can arrive on a connection we negotiated with
+// another service's certificate. Responding with 421 tells the browser to
+// retry on a new connection.
+func (r *Router) isMisdirected(req *http.Request, service *Service) bool {
+	if req.TLS == nil || req.TLS.ServerName == "" {
+		return false
+	}
+
+	return r.serviceForHost(req.TLS.ServerName) != service
 }
 
 func (r *Router) serviceForName(name string) *Service {
@@ -1,10 +1,15 @@
 package server
 
 import (
+	"crypto/tls"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -85,6 +90,73 @@ func TestRouter_UpdatingHostsOfActiveService(t *testing.T) {
 	assert.Equal(t, "first", body)
 }
 
+func TestRouter_UpdatingServiceOptionsReusesUnchangedTarget(t *testing.T) {
+	router := testRouter(t)
+
+	var healthChecks atomic.Int32
+	_, target := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == DefaultHealthCheckPath {
+			healthChecks.Add(1)
+		}
+	})
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"1.example.com"}, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	active := router.serviceForName("service1").ActiveTarget()
+	checks := healthChecks.Load()
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"1.example.com", "2.example.com"}, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	assert.Same(t, active, router.serviceForName("service1").ActiveTarget())
+	assert.Equal(t, checks+1, healthChecks.Load(), "the reused target is checked once")
+
+	statusCode, _ := sendGETRequest(router, "http://2.example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	targetOptions := defaultTargetOptions
+	targetOptions.ForwardHeaders = !targetOptions.ForwardHeaders
+	require.NoError(t, router.SetServiceTarget("service1", []string{"1.example.com", "2.example.com"}, target, defaultServiceOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	assert.NotSame(t, active, router.serviceForName("service1").ActiveTarget())
+	assert.Greater(t, healthChecks.Load(), checks)
+}
+
+func TestRouter_UnchangedTargetNotReusedWhenUnhealthy(t *testing.T) {
+	router := testRouter(t)
+
+	var healthy atomic.Bool
+	healthy.Store(true)
+	_, target := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == DefaultHealthCheckPath && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	active := router.serviceForName("service1").ActiveTarget()
+
+	healthy.Store(false)
+	err := router.SetServiceTarget("service1", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, time.Millisecond*200, DefaultDrainTimeout)
+	assert.ErrorIs(t, err, ErrorTargetFailedToBecomeHealthy)
+	assert.Same(t, active, router.serviceForName("service1").ActiveTarget())
+}
+
+func TestRouter_UnchangedTargetNotReusedWhenSigningKeysChange(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	targetOptions := defaultTargetOptions
+	targetOptions.SigningKeyFile = testSigningKeyFile(t, "old-key\n")
+
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, target, defaultServiceOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	active := router.serviceForName("service1").ActiveTarget()
+
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, target, defaultServiceOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	assert.Same(t, active, router.serviceForName("service1").ActiveTarget())
+
+	require.NoError(t, os.WriteFile(targetOptions.SigningKeyFile, []byte("new-key\nold-key\n"), 0600))
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, target, defaultServiceOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	assert.NotSame(t, active, router.serviceForName("service1").ActiveTarget())
+	assert.Equal(t, []string{"new-key", "old-key"}, router.serviceForName("service1").ActiveTarget().signingKeys)
+}
+
 func TestRouter_ActiveServiceForUnknownHost(t *testing.T) {
 	router := testRouter(t)
 	_, target := testBackend(t, "first", http.StatusOK)
@@ -342,6 +414,23 @@ func TestRouter_WildcardDomainsCannotBeUsedWithAutomaticTLS(t *testing.T) {
 	require.Equal(t, ErrorAutomaticTLSDoesNotSupportWildcards, err)
 }
 
+func TestRouter_ForcingDeploymentOfUnhealthyTarget(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == DefaultHealthCheckPath {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("first"))
+	})
+
+	require.NoError(t, router.ForceServiceTarget("example", []string{"example.com"}, target, defaultServiceOptions, defaultTargetOptions, DefaultDrainTimeout))
+
+	statusCode, body := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+}
+
 func TestRouter_ServiceFailingToBecomeHealthy(t *testing.T) {
 	router := testRouter(t)
 	_, target := testBackend(t, "", http.StatusInternalServerError)
@@ -372,23 +461,208 @@ func TestRouter_EnablingRollout(t *testing.T) {
 
 	checkResponse("first")
 
-	require.NoError(t, router.SetRolloutSplit("service1", 0, []string{"1"}))
+	require.NoError(t, router.SetRolloutSplit("service1", 0, []string{"1"}, RolloutOptions{}))
 	checkResponse("second")
 
-	require.NoError(t, router.SetRolloutSplit("service1", 0, []string{"2"}))
+	require.NoError(t, router.SetRolloutSplit("service1", 0, []string{"2"}, RolloutOptions{}))
 	checkResponse("first")
 
 	require.NoError(t, router.StopRollout("service1"))
 	checkResponse("first")
 }
 
+func TestRouter_StickyRollout(t *testing.T) {
+	router := testRouter(t)
+	_, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetRolloutTarget("service1", second, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetRolloutSplit("service1", 50, nil, RolloutOptions{Sticky: true}))
+
+	groups := map[string]int{}
+	for range 100 {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		require.Equal(t, RolloutCookieName, cookies[0].Name)
+		group := w.Body.String()
+		groups[group]++
+
+		for range 3 {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.AddCookie(cookies[0])
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, group, w.Body.String())
+			assert.Empty(t, w.Result().Cookies())
+		}
+	}
+
+	assert.Positive(t, groups["first"])
+	assert.Positive(t, groups["second"])
+}
+
+func TestRouter_RolloutVariantHeaders(t *testing.T) {
+	router := testRouter(t)
+	variantHandler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + ":" + r.Header.Get(RolloutVariantHeader)))
+		}
+	}
+	_, first := testBackendWithHandler(t, variantHandler("first"))
+	_, second := testBackendWithHandler(t, variantHandler("second"))
+
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	sendWithCookie := func(value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set(RolloutVariantHeader, "forged")
+		req.AddCookie(&http.Cookie{Name: RolloutCookieName, Value: value})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := sendWithCookie("1")
+	assert.Equal(t, "first:", w.Body.String())
+
+	require.NoError(t, router.SetRolloutTarget("service1", second, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetRolloutSplit("service1", 0, []string{"1"}, RolloutOptions{}))
+
+	w = sendWithCookie("1")
+	assert.Equal(t, "second:rollout", w.Body.String())
+	assert.Empty(t, w.Header().Get(RolloutVariantHeader))
+
+	w = sendWithCookie("2")
+	assert.Equal(t, "first:active", w.Body.String())
+
+	require.NoError(t, router.SetRolloutSplit("service1", 0, []string{"1"}, RolloutOptions{ExposeVariant: true}))
+
+	w = sendWithCookie("1")
+	assert.Equal(t, "rollout", w.Header().Get(RolloutVariantHeader))
+
+	w = sendWithCookie("2")
+	assert.Equal(t, "active", w.Header().Get(RolloutVariantHeader))
+}
+
+func TestRouter_CloneService(t *testing.T) {
+	router := testRouter(t)
+	_, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	targetOptions := defaultTargetOptions
+	targetOptions.BufferRequests = true
+	targetOptions.MaxRequestBodySize = 10
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"app.example.com"}, first, defaultServiceOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.CloneService("service1", "preview", []string{"pr-123.example.com"}, second, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	statusCode, body := sendGETRequest(router, "http://app.example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+
+	statusCode, body = sendGETRequest(router, "http://pr-123.example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "second", body)
+
+	statusCode, _ = sendRequest(router, httptest.NewRequest(http.MethodPost, "http://pr-123.example.com", strings.NewReader("Something longer than 10")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, statusCode)
+
+	t.Run("defaults to the existing target", func(t *testing.T) {
+		require.NoError(t, router.CloneService("service1", "preview2", []string{"pr-124.example.com"}, "", DefaultDeployTimeout, DefaultDrainTimeout))
+
+		statusCode, body := sendGETRequest(router, "http://pr-124.example.com/")
+		assert.Equal(t, http.StatusOK, statusCode)
+		assert.Equal(t, "first", body)
+	})
+
+	t.Run("unknown service", func(t *testing.T) {
+		err := router.CloneService("missing", "preview3", []string{"pr-125.example.com"}, second, DefaultDeployTimeout, DefaultDrainTimeout)
+		assert.Equal(t, ErrorServiceNotFound, err)
+	})
+
+	t.Run("existing new service", func(t *testing.T) {
+		err := router.CloneService("service1", "preview", []string{"pr-126.example.com"}, first, DefaultDeployTimeout, DefaultDrainTimeout)
+		assert.Equal(t, ErrorServiceAlreadyExists, err)
+
+		statusCode, body := sendGETRequest(router, "http://pr-123.example.com/")
+		assert.Equal(t, http.StatusOK, statusCode)
+		assert.Equal(t, "second", body)
+	})
+}
+
+func TestRouter_RecordsDeployTimings(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	timings := router.ListActiveServices()["service1"].LastDeploy
+	require.NotNil(t, timings)
+	assert.Positive(t, timings.HealthCheck)
+	assert.Positive(t, timings.SaveState)
+	assert.GreaterOrEqual(t, timings.Total, timings.CreateTarget+timings.HealthCheck+timings.WarmUp+timings.Swap+timings.Drain+timings.SaveState)
+}
+
+func TestRouter_RouteOtherServicesWhileDeployDrains(t *testing.T) {
+	router := testRouter(t)
+
+	uploading := make(chan struct{})
+	var uploadStarted sync.Once
+	_, first := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			uploadStarted.Do(func() { close(uploading) })
+			io.ReadAll(r.Body)
+		}
+	})
+	_, second := testBackend(t, "second", http.StatusOK)
+	_, other := testBackend(t, "other", http.StatusOK)
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"app.example.com"}, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetServiceTarget("other", []string{"other.example.com"}, other, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "http://app.example.com/upload", bodyReader)
+	req.ContentLength = -1
+	go sendRequest(router, req)
+	<-uploading
+
+	targetOptions := defaultTargetOptions
+	targetOptions.UploadDrainTimeout = time.Second * 5
+	go router.SetServiceTarget("service1", []string{"app.example.com"}, second, defaultServiceOptions, targetOptions, DefaultDeployTimeout, time.Millisecond*10)
+	require.Eventually(t, func() bool {
+		_, body := sendGETRequest(router, "http://app.example.com/")
+		return body == "second"
+	}, time.Second, time.Millisecond)
+
+	served := make(chan string)
+	go func() {
+		_, body := sendGETRequest(router, "http://other.example.com/")
+		served <- body
+	}()
+
+	select {
+	case body := <-served:
+		assert.Equal(t, "other", body)
+	case <-time.After(time.Second):
+		t.Fatal("request was held up by another service's drain")
+	}
+}
+
 func TestRouter_RestoreLastSavedState(t *testing.T) {
 	statePath := filepath.Join(t.TempDir(), "state.json")
 
 	_, first := testBackend(t, "first", http.StatusOK)
 	_, second := testBackend(t, "second", http.StatusOK)
 
-	router := NewRouter(statePath)
+	router := NewRouter(NewFileStateStore(statePath))
 	require.NoError(t, router.SetServiceTarget("default", defaultEmptyHosts, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
 	require.NoError(t, router.SetServiceTarget("other", []string{"other.example.com"}, second, ServiceOptions{TLSEnabled: true}, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
 
@@ -399,8 +673,8 @@ func TestRouter_RestoreLastSavedState(t *testing.T) {
 	statusCode, _ = sendGETRequest(router, "http://other.example.com/")
 	assert.Equal(t, http.StatusMovedPermanently, statusCode)
 
-	router = NewRouter(statePath)
-	router.RestoreLastSavedState()
+	router = NewRouter(NewFileStateStore(statePath))
+	router.RestoreLastSavedState(RestoreOptions{})
 
 	statusCode, body = sendGETRequest(router, "http://something.example.com")
 	assert.Equal(t, http.StatusOK, statusCode)
@@ -410,6 +684,369 @@ func TestRouter_RestoreLastSavedState(t *testing.T) {
 	assert.Equal(t, http.StatusMovedPermanently, statusCode)
 }
 
+func TestRouter_RestoreLastSavedStateSkipsServicesThatCannotBeRestored(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	_, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	targetOptions := defaultTargetOptions
+	targetOptions.SigningKeyFile = testSigningKeyFile(t, "key\n")
+
+	router := NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.SetServiceTarget("service1", []string{"first.example.com"}, first, defaultServiceOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetServiceTarget("service2", []string{"second.example.com"}, second, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	require.NoError(t, os.Remove(targetOptions.SigningKeyFile))
+
+	router = NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.RestoreLastSavedState(RestoreOptions{}))
+	assert.Nil(t, router.serviceForName("service1"))
+
+	_, body := sendGETRequest(router, "http://second.example.com/")
+	assert.Equal(t, "second", body)
+
+	// The service that couldn't be restored is kept when the state is saved
+	// again, until it's removed.
+	require.NoError(t, router.SetServiceTarget("service2", []string{"second.example.com"}, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	data, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"name":"service1"`)
+
+	require.NoError(t, router.RemoveService("service1"))
+	data, err = os.ReadFile(statePath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), `"name":"service1"`)
+}
+
+func TestRouter_RestoreLastSavedStateWithUnreachableTarget(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	server, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	router := NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.SetServiceTarget("first", []string{"first.example.com"}, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetServiceTarget("second", []string{"second.example.com"}, second, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	server.Close()
+
+	router = NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.RestoreLastSavedState(RestoreOptions{ProbeTargets: true}))
+	t.Cleanup(router.serviceForName("first").ActiveTarget().StopHealthChecks)
+
+	assert.Equal(t, TargetStateUnhealthy, router.serviceForName("first").ActiveTarget().state)
+	assert.Equal(t, TargetStateHealthy, router.serviceForName("second").ActiveTarget().state)
+
+	statusCode, _ := sendGETRequest(router, "http://first.example.com/")
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+
+	statusCode, body := sendGETRequest(router, "http://second.example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "second", body)
+}
+
+func TestRouter_RecoveryStopsWhenTargetIsReplaced(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	server, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	router := NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.SetServiceTarget("service1", []string{"example.com"}, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	server.Close()
+
+	router = NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.RestoreLastSavedState(RestoreOptions{ProbeTargets: true}))
+
+	recovering := router.serviceForName("service1").ActiveTarget()
+	check := recovering.healthcheck
+	require.NotNil(t, check)
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"example.com"}, second, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	select {
+	case <-check.Done():
+	case <-time.After(time.Second):
+		t.Fatal("recovery health checks still running after the target was replaced")
+	}
+}
+
+func TestRouter_RecoveryStopsWhenServiceIsRemoved(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	activeServer, first := testBackend(t, "first", http.StatusOK)
+	rolloutServer, second := testBackend(t, "second", http.StatusOK)
+
+	router := NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.SetServiceTarget("service1", []string{"example.com"}, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetRolloutTarget("service1", second, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	activeServer.Close()
+	rolloutServer.Close()
+
+	router = NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.RestoreLastSavedState(RestoreOptions{ProbeTargets: true}))
+
+	service := router.serviceForName("service1")
+	checks := []*HealthCheck{service.ActiveTarget().healthcheck, service.RolloutTarget().healthcheck}
+
+	require.NoError(t, router.RemoveService("service1"))
+
+	for _, check := range checks {
+		require.NotNil(t, check)
+		select {
+		case <-check.Done():
+		case <-time.After(time.Second):
+			t.Fatal("recovery health checks still running after the service was removed")
+		}
+	}
+}
+
+func TestRouter_RestoreLastSavedStateWithVerify(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	var healthy atomic.Bool
+	_, target := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == DefaultHealthCheckPath && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("first"))
+	})
+
+	healthy.Store(true)
+	router := NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.SetServiceTarget("service1", []string{"example.com"}, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	healthy.Store(false)
+	router = NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.RestoreLastSavedState(RestoreOptions{VerifyTargets: true}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.Equal(t, "1", w.Result().Header.Get("Retry-After"))
+
+	healthy.Store(true)
+	require.True(t, router.serviceForName("service1").ActiveTarget().WaitUntilHealthy(time.Second*5))
+
+	statusCode, body := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+}
+
+func TestRouter_PlanServiceTarget(t *testing.T) {
+	router := testRouter(t)
+	_, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	plan, err := router.PlanServiceTarget("service1", []string{"example.com"}, first, defaultServiceOptions, defaultTargetOptions, true)
+	require.NoError(t, err)
+	assert.Equal(t, "create", plan.Action)
+	assert.Equal(t, "ok", plan.HealthCheck)
+
+	statusCode, _ := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusNotFound, statusCode, "dry run should not deploy anything")
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"example.com"}, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	plan, err = router.PlanServiceTarget("service1", []string{"example.com"}, second, defaultServiceOptions, defaultTargetOptions, false)
+	require.NoError(t, err)
+	assert.Equal(t, "update", plan.Action)
+	assert.Equal(t, []string{"target: " + first + " -> " + second}, plan.Changes)
+	assert.Empty(t, plan.HealthCheck)
+
+	_, err = router.PlanServiceTarget("service2", []string{"example.com"}, second, defaultServiceOptions, defaultTargetOptions, false)
+	assert.ErrorIs(t, err, ErrorHostInUse)
+
+	plan, err = router.PlanRemoveService("service1")
+	require.NoError(t, err)
+	assert.Equal(t, "remove", plan.Action)
+
+	_, err = router.PlanRemoveService("service2")
+	assert.ErrorIs(t, err, ErrorServiceNotFound)
+
+	statusCode, body := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+}
+
+func TestRouter_PlanServiceTargetWithFailingHealthCheck(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "", http.StatusInternalServerError)
+
+	plan, err := router.PlanServiceTarget("service1", []string{"example.com"}, target, defaultServiceOptions, defaultTargetOptions, true)
+	require.NoError(t, err)
+	assert.Contains(t, plan.HealthCheck, "500")
+}
+
+func TestRouter_PlanServiceTargetDoesNotCreateInternalCA(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	options := ServiceOptions{TLSEnabled: true, TLSInternalCA: true, ACMECachePath: t.TempDir()}
+	_, err := router.PlanServiceTarget("service1", []string{"app.internal"}, target, options, defaultTargetOptions, false)
+	require.NoError(t, err)
+
+	_, err = os.Stat(InternalCADir(options.ACMECachePath))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRouter_PlanServiceTargetChecksInternalCAHosts(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	options := ServiceOptions{TLSEnabled: true, TLSInternalCA: true, ACMECachePath: t.TempDir()}
+	_, err := router.PlanServiceTarget("service1", []string{"app.example.com"}, target, options, defaultTargetOptions, false)
+	assert.ErrorIs(t, err, ErrorHostNotPermittedByInternalCA)
+}
+
+func TestRouter_PlanServiceTargetChecksCertificateHosts(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "example.com")
+
+	options := ServiceOptions{TLSEnabled: true, TLSCertificatePath: certPath, TLSPrivateKeyPath: keyPath}
+	_, err := router.PlanServiceTarget("service1", []string{"other.example.com"}, target, options, defaultTargetOptions, false)
+	assert.ErrorIs(t, err, ErrorCertificateHostMismatch)
+}
+
+func TestRouter_RouteByOperationName(t *testing.T) {
+	router := testRouter(t)
+
+	echo := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Write([]byte(name + ":" + string(body)))
+		}
+	}
+	_, interactive := testBackendWithHandler(t, echo("interactive"))
+	_, reports := testBackendWithHandler(t, echo("reports"))
+
+	targetOptions := TargetOptions{
+		HealthCheckConfig:   defaultHealthCheckConfig,
+		ResponseTimeout:     DefaultTargetTimeout,
+		BufferRequests:      true,
+		MaxMemoryBufferSize: DefaultMaxMemoryBufferSize,
+	}
+
+	serviceOptions := ServiceOptions{OperationRoutes: []OperationRoute{{Operation: "Report*", Service: "reports"}}}
+	require.NoError(t, router.SetServiceTarget("app", []string{"example.com"}, interactive, serviceOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetServiceTarget("reports", []string{"reports.internal"}, reports, defaultServiceOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	sendGraphQL := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/graphql", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	report := `{"operationName":"ReportSales","query":"query ReportSales { sales }"}`
+	user := `{"operationName":"GetUser","query":"query GetUser { user }"}`
+
+	assert.Equal(t, "reports:"+report, sendGraphQL(report))
+	assert.Equal(t, "interactive:"+user, sendGraphQL(user))
+	assert.Equal(t, "interactive:{}", sendGraphQL("{}"))
+}
+
+func TestRouter_RouteByOperationNameAfterServiceChecks(t *testing.T) {
+	router := testRouter(t)
+
+	echo := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}
+	}
+	_, interactive := testBackendWithHandler(t, echo("interactive"))
+	_, reports := testBackendWithHandler(t, echo("reports"))
+
+	targetOptions := TargetOptions{
+		HealthCheckConfig:   defaultHealthCheckConfig,
+		ResponseTimeout:     DefaultTargetTimeout,
+		BufferRequests:      true,
+		MaxMemoryBufferSize: DefaultMaxMemoryBufferSize,
+	}
+
+	// Routes that point back at each other send the request on only once
+	appOptions := ServiceOptions{OperationRoutes: []OperationRoute{{Operation: "Report*", Service: "reports"}}}
+	reportsOptions := ServiceOptions{OperationRoutes: []OperationRoute{{Operation: "*", Service: "app"}}}
+	require.NoError(t, router.SetServiceTarget("app", []string{"example.com"}, interactive, appOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetServiceTarget("reports", []string{"reports.internal"}, reports, reportsOptions, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	body := strings.NewReader(`{"operationName":"ReportSales","query":"query ReportSales { sales }"}`)
+	sendGraphQL := func() (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/graphql", body)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	statusCode, response := sendGraphQL()
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "reports", response)
+
+	// A stopped service answers before its body is looked at
+	body.Seek(0, io.SeekStart)
+	require.NoError(t, router.StopService("app", DefaultDrainTimeout, ""))
+
+	statusCode, _ = sendGraphQL()
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+	assert.Equal(t, body.Size(), int64(body.Len()))
+}
+
+func TestRouter_ACMEChallengesBypassRedirectsAndStoppedServices(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	serviceOptions := ServiceOptions{TLSEnabled: true, ACMECachePath: t.TempDir()}
+	require.NoError(t, router.SetServiceTarget("service1", []string{"example.com"}, target, serviceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.StopService("service1", DefaultDrainTimeout, ""))
+
+	statusCode, _ := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusMovedPermanently, statusCode)
+
+	// The challenge isn't one we've been asked to answer, so autocert refuses
+	// it, but that's an answer from the challenge handler rather than a
+	// redirect or the stopped page.
+	statusCode, _ = sendGETRequest(router, "http://example.com/.well-known/acme-challenge/token")
+	assert.Equal(t, http.StatusNotFound, statusCode)
+	assert.Equal(t, int64(1), router.ACMEChallengesServed())
+}
+
+func TestRouter_MisdirectedRequestsOnCoalescedConnections(t *testing.T) {
+	router := testRouter(t)
+	_, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "s1.example.com", "s2.example.com")
+	serviceOptions := ServiceOptions{TLSEnabled: true, TLSCertificatePath: certPath, TLSPrivateKeyPath: keyPath}
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"s1.example.com"}, first, serviceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetServiceTarget("service2", []string{"s2.example.com"}, second, serviceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	sendTLSRequest := func(serverName, host string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil)
+		req.TLS = &tls.ConnectionState{ServerName: serverName}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result().StatusCode, w.Body.String()
+	}
+
+	statusCode, body := sendTLSRequest("s1.example.com", "s1.example.com")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+
+	statusCode, _ = sendTLSRequest("s1.example.com", "s2.example.com")
+	assert.Equal(t, http.StatusMisdirectedRequest, statusCode)
+
+	statusCode, body = sendTLSRequest("", "s2.example.com")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "second", body)
+}
+
 func TestHostServiceMap_ServiceForHost(t *testing.T) {
 	hsm := HostServiceMap{
 		"example.com":     &Service{name: "1"},
@@ -464,7 +1101,7 @@ func BenchmarkHostServiceMap_WilcardRouting(b *testing.B) {
 
 func testRouter(t *testing.T) *Router {
 	statePath := filepath.Join(t.TempDir(), "state.json")
-	return NewRouter(statePath)
+	return NewRouter(NewFileStateStore(statePath))
 }
 
 func sendGETRequest(router *Router, url string) (int, string) {
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+)
+
+// readSecretFile reads the non-empty lines of a file of secrets, skipping
+// comments. Secrets are read from files on the proxy's host, rather than
+// given to the deploy command, so that they aren't saved with the routing
+// state, or shown in the audit log and deploy history.
+func readSecretFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secrets = append(secrets, line)
+	}
+
+	return secrets, nil
+}
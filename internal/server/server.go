@@ -1,14 +1,17 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/acme"
@@ -29,13 +32,31 @@ type Server struct {
 	httpsListener  net.Listener
 	httpServer     *http.Server
 	httpsServer    *http.Server
+	internalServer *http.Server
+	malformed      *MalformedRequests
+	tunnels        *TunnelRegistry
+	bufferMemory   *BufferMemoryBudget
+	tunnelListener *TunnelListener
 	commandHandler *CommandHandler
+	expiryChecker  *CertExpiryChecker
+	ticketKeys     *SessionTicketKeyManager
+	draining       atomic.Bool
+	stopStats      context.CancelFunc
+
+	healthChecks     atomic.Pointer[map[string]string]
+	stopHealthChecks context.CancelFunc
 }
 
 func NewServer(config *Config, router *Router) *Server {
+	tunnels := NewTunnelRegistry()
+	router.tunnels = tunnels
+	router.summarizeRequests = config.RequestSummaryInterval > 0
+
 	return &Server{
-		config: config,
-		router: router,
+		config:       config,
+		router:       router,
+		tunnels:      tunnels,
+		bufferMemory: NewBufferMemoryBudget(config.BufferMemoryBudget, config.BufferMemoryBudgetAction),
 	}
 }
 
@@ -45,25 +66,65 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	err = s.startInternalHTTPServer()
+	if err != nil {
+		return err
+	}
+
+	err = s.startTunnelListener()
+	if err != nil {
+		return err
+	}
+
 	err = s.startCommandHandler()
 	if err != nil {
 		return err
 	}
 
-	slog.Info("Server started", "http", s.HttpPort(), "https", s.HttpsPort())
+	s.startCertExpiryChecker()
+	s.startStatsSaving()
+	s.startHealthChecks()
+
+	slog.Info("Server started", "http", s.HttpPort(), "https", s.HttpsPort(), "internal", s.config.InternalHttpPort, "tunnel", s.config.TunnelPort)
 	return nil
 }
 
 func (s *Server) Stop() {
+	s.drain()
+
 	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
+	if s.tunnelListener != nil {
+		_ = s.tunnelListener.Close()
+	}
+	if s.expiryChecker != nil {
+		s.expiryChecker.Close()
+	}
+	if s.ticketKeys != nil {
+		s.ticketKeys.Close()
+	}
+	if s.stopStats != nil {
+		s.stopStats()
+	}
+	if s.stopHealthChecks != nil {
+		s.stopHealthChecks()
+	}
+
 	PerformConcurrently(
 		func() { _ = s.commandHandler.Close() },
 		func() { s.stopHTTPServer(ctx, s.httpServer) },
 		func() { s.stopHTTPServer(ctx, s.httpsServer) },
+		func() {
+			if s.internalServer != nil {
+				s.stopHTTPServer(ctx, s.internalServer)
+			}
+		},
 	)
 
+	// Keep the stats from the requests served since they were last saved.
+	s.router.saveStateSnapshot()
+
 	slog.Info("Server stopped")
 }
 
@@ -81,7 +142,12 @@ func (s *Server) startHTTPServers() error {
 	httpAddr := fmt.Sprintf("%s:%d", s.config.Bind, s.config.HttpPort)
 	httpsAddr := fmt.Sprintf("%s:%d", s.config.Bind, s.config.HttpsPort)
 
-	handler := s.buildHandler()
+	handler := s.buildHandler(s.router, false)
+
+	err := s.createMalformedRequests()
+	if err != nil {
+		return err
+	}
 
 	l, err := net.Listen("tcp", httpAddr)
 	if err != nil {
@@ -89,8 +155,21 @@ func (s *Server) startHTTPServers() error {
 	}
 	s.httpListener = l
 	s.httpServer = &http.Server{
-		Addr:    httpAddr,
-		Handler: handler,
+		Addr:        httpAddr,
+		Handler:     handler,
+		BaseContext: s.baseContext,
+		ConnContext: ConnectionConnContext,
+	}
+
+	tlsConfig := &tls.Config{
+		NextProtos:             []string{"h2", "http/1.1", acme.ALPNProto},
+		GetCertificate:         s.router.GetCertificate,
+		SessionTicketsDisabled: s.config.DisableSessionTickets,
+	}
+
+	err = s.startSessionTicketKeyManager(tlsConfig)
+	if err != nil {
+		return err
 	}
 
 	l, err = net.Listen("tcp", httpsAddr)
@@ -99,40 +178,165 @@ func (s *Server) startHTTPServers() error {
 	}
 	s.httpsListener = l
 	s.httpsServer = &http.Server{
-		Addr:    httpsAddr,
-		Handler: handler,
-		TLSConfig: &tls.Config{
-			NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
-			GetCertificate: s.router.GetCertificate,
-		},
+		Addr:        httpsAddr,
+		Handler:     handler,
+		BaseContext: s.baseContext,
+		ConnContext: httpsConnContext,
+		TLSConfig:   tlsConfig,
+	}
+
+	go s.httpServer.Serve(s.malformed.WrapListener(s.httpListener))
+	go s.httpsServer.ServeTLS(WithClientHelloRecording(s.rateLimitHandshakes(s.httpsListener)), "", "")
+
+	return nil
+}
+
+// drain gives clients a chance to move their connections elsewhere before we
+// shut down. Listeners stay open for the grace period, but every response
+// asks the client to close its connection.
+func (s *Server) drain() {
+	if s.config.ShutdownGracePeriod == 0 {
+		return
+	}
+
+	slog.Info("Draining connections", "grace_period", s.config.ShutdownGracePeriod)
+	s.draining.Store(true)
+	time.Sleep(s.config.ShutdownGracePeriod)
+}
+
+func (s *Server) createMalformedRequests() error {
+	var errorPages fs.FS = pages.DefaultErrorPages
+	if s.config.MalformedRequestPages != "" {
+		errorPages = os.DirFS(s.config.MalformedRequestPages)
+	}
+
+	malformed, err := NewMalformedRequests(errorPages)
+	if err != nil {
+		return err
+	}
+
+	s.malformed = malformed
+	return nil
+}
+
+func (s *Server) startSessionTicketKeyManager(tlsConfig *tls.Config) error {
+	if s.config.DisableSessionTickets || (s.config.SessionTicketKeyFile == "" && s.config.SessionTicketRotation == 0) {
+		return nil // Go rotates its own keys daily by default
+	}
+
+	ticketKeys, err := NewSessionTicketKeyManager(tlsConfig, s.config.SessionTicketKeyFile, s.config.SessionTicketRotation)
+	if err != nil {
+		return err
+	}
+
+	s.ticketKeys = ticketKeys
+	s.ticketKeys.Start()
+	return nil
+}
+
+// startInternalHTTPServer starts the optional listener for traffic from
+// within the host's own networks, such as service-to-service calls between
+// containers, so that it needn't go out through the public interface.
+func (s *Server) startInternalHTTPServer() error {
+	if s.config.InternalHttpPort == 0 {
+		return nil
+	}
+
+	allowed, err := parseInternalAllowedNetworks(s.config.InternalAllowedNetworks)
+	if err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf("%s:%d", cmp.Or(s.config.InternalBind, DefaultInternalBind), s.config.InternalHttpPort)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
 
-	go s.httpServer.Serve(s.httpListener)
-	go s.httpsServer.ServeTLS(s.httpsListener, "", "")
+	s.internalServer = &http.Server{
+		Addr:        addr,
+		Handler:     WithInternalTrafficMiddleware(allowed, s.buildHandler(s.router, true)),
+		BaseContext: s.baseContext,
+		ConnContext: ConnectionConnContext,
+	}
 
+	go s.internalServer.Serve(s.malformed.WrapListener(l))
 	return nil
 }
 
+func (s *Server) startTunnelListener() error {
+	if s.config.TunnelPort == 0 {
+		return nil
+	}
+
+	s.tunnelListener = NewTunnelListener(s.tunnels, s.config.TunnelToken)
+	return s.tunnelListener.Start(fmt.Sprintf("%s:%d", s.config.Bind, s.config.TunnelPort))
+}
+
 func (s *Server) startCommandHandler() error {
-	s.commandHandler = NewCommandHandler(s.router)
+	s.commandHandler = NewCommandHandler(s.router, NewAuditLog(s.config.AuditLogPath()))
+	s.commandHandler.diagnose = s.Diagnose
 	_ = os.Remove(s.config.SocketPath())
 
 	return s.commandHandler.Start(s.config.SocketPath())
 }
 
-func (s *Server) buildHandler() http.Handler {
-	var handler http.Handler
+func (s *Server) startCertExpiryChecker() {
+	if s.config.CertExpiryWarning == 0 {
+		return
+	}
+
+	s.expiryChecker = NewCertExpiryChecker(s.router, s.config.CertExpiryWarning)
+	s.expiryChecker.Start()
+}
 
+// buildHandler wraps the handler for a listener. Only the internal listener
+// shows the details of the proxy's endpoints, since they include service names
+// and hosts.
+func (s *Server) buildHandler(handler http.Handler, internal bool) http.Handler {
 	// Note: handlers are executed in the inverse order.
-	handler = s.router
+	handler = WithMissingHostMiddleware(s.config.MissingHost, handler)
+	handler = WithInternalEndpointsMiddleware(s.config.InternalPathPrefix, s.router, s.HealthStatus, internal, handler)
+	handler = WithDrainingMiddleware(&s.draining, handler)
 	handler, _ = WithErrorPageMiddleware(pages.DefaultErrorPages, true, handler)
 	handler = WithLoggingMiddleware(slog.Default(), s.config.HttpPort, s.config.HttpsPort, handler)
+	handler = WithClientAddressMiddleware(s.config.UnmapIPv4Addresses, handler)
 	handler = WithRequestIDMiddleware(handler)
 	handler = WithRequestStartMiddleware(handler)
 
 	return handler
 }
 
+func (s *Server) startStatsSaving() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopStats = cancel
+
+	go s.router.saveStatsPeriodically(ctx, serviceStatsSaveInterval)
+	go s.router.retryStateSaves(ctx)
+
+	if s.config.RequestSummaryInterval > 0 {
+		go s.router.logRequestSummariesPeriodically(ctx, s.config.RequestSummaryInterval)
+	}
+}
+
+func (s *Server) rateLimitHandshakes(l net.Listener) net.Listener {
+	if s.config.HandshakeRatePerIP == 0 && s.config.HandshakeRate == 0 {
+		return l
+	}
+
+	limiter := NewHandshakeRateLimiter(s.config.HandshakeRatePerIP, s.config.HandshakeRate, s.config.HandshakeBurst)
+	return WithHandshakeRateLimit(l, limiter)
+}
+
+// baseContext gives requests the server's shared resources.
+func (s *Server) baseContext(net.Listener) context.Context {
+	return WithBufferMemoryBudget(context.Background(), s.bufferMemory)
+}
+
+func httpsConnContext(ctx context.Context, c net.Conn) context.Context {
+	return ClientHelloConnContext(ConnectionConnContext(ctx, c), c)
+}
+
 func (s *Server) stopHTTPServer(ctx context.Context, server *http.Server) {
 	err := server.Shutdown(ctx)
 	if err != nil {
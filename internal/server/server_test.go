@@ -1,8 +1,13 @@
 package server
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -19,6 +24,110 @@ func TestServer_Deploying(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
+func TestServer_HealthStatus(t *testing.T) {
+	target := testTarget(t, func(w http.ResponseWriter, r *http.Request) {})
+	server, addr := testServer(t)
+
+	testDeployTarget(t, target, server)
+
+	resp, err := http.Get(addr + "/.kamal/health")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var public ProxyHealth
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&public))
+	assert.True(t, public.Healthy)
+	assert.Empty(t, public.Checks, "details are only shown on the internal listener")
+
+	health := server.HealthStatus()
+	assert.True(t, health.Healthy)
+	assert.Equal(t, "ok", health.Checks["http_listener"])
+	assert.Equal(t, "ok", health.Checks["https_listener"])
+	assert.Equal(t, "ok", health.Checks["state_file"])
+	assert.Equal(t, "ok", health.Checks["state_persistence"])
+	assert.Equal(t, "ok", health.Checks["certificate_cache"])
+	assert.Equal(t, "ok", health.Checks["certificates"])
+	assert.Positive(t, health.Goroutines)
+	assert.Equal(t, target.Target(), health.Services[""].Target)
+}
+
+func TestServer_HealthChecksAreNotRunPerRequest(t *testing.T) {
+	server, addr := testServer(t)
+
+	checks := server.healthChecks.Load()
+	require.NotNil(t, checks)
+
+	for range 3 {
+		resp, err := http.Get(addr + "/.kamal/health")
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Same(t, checks, server.healthChecks.Load())
+}
+
+func TestServer_DrainingBeforeShutdown(t *testing.T) {
+	target := testTarget(t, func(w http.ResponseWriter, r *http.Request) {})
+	server, addr := testServer(t)
+	server.config.ShutdownGracePeriod = 200 * time.Millisecond
+
+	testDeployTarget(t, target, server)
+
+	stopped := make(chan struct{})
+	go func() {
+		server.Stop()
+		close(stopped)
+	}()
+	t.Cleanup(func() { <-stopped })
+
+	require.Eventually(t, func() bool { return server.draining.Load() }, time.Second, 5*time.Millisecond)
+
+	resp, err := http.Get(addr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, resp.Close)
+}
+
+func TestServer_ForwardConnectionInfo(t *testing.T) {
+	target := testTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(ConnectionProtoHeader) + " " + r.Header.Get(ConnectionClientRTTHeader)))
+	})
+	server, addr := testServer(t)
+
+	targetOptions := defaultTargetOptions
+	targetOptions.ForwardConnectionInfo = true
+
+	var result bool
+	err := server.commandHandler.Deploy(DeployArgs{
+		TargetURL:      target.Target(),
+		DeployTimeout:  DefaultDeployTimeout,
+		DrainTimeout:   DefaultDrainTimeout,
+		ServiceOptions: defaultServiceOptions,
+		TargetOptions:  targetOptions,
+	}, &result)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, addr, nil)
+	require.NoError(t, err)
+	req.Header.Set(ConnectionProtoHeader, "forged")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	proto, rtt, _ := strings.Cut(string(body), " ")
+	assert.Equal(t, "http/1.1", proto)
+	if runtime.GOOS == "linux" {
+		assert.Regexp(t, `^\d+\.\d{3}$`, rtt)
+	}
+}
+
 // Helpers
 
 func testDeployTarget(t *testing.T, target *Target, server *Server) {
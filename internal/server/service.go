@@ -1,17 +1,18 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"log/slog"
-	"net"
 	"net/http"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/acme"
@@ -47,6 +48,7 @@ const (
 
 var (
 	ErrorRolloutTargetNotSet                 = errors.New("rollout target not set")
+	ErrorServiceHasNoTarget                  = errors.New("service has no target")
 	ErrorUnableToLoadErrorPages              = errors.New("unable to load error pages")
 	ErrorAutomaticTLSDoesNotSupportWildcards = errors.New("automatic TLS does not support wildcards")
 )
@@ -62,6 +64,18 @@ type HealthCheckConfig struct {
 	Path     string        `json:"path"`
 	Interval time.Duration `json:"interval"`
 	Timeout  time.Duration `json:"timeout"`
+
+	LogChecks bool `json:"log_checks"`
+
+	// Port, when set, is checked instead of the target's own port.
+	Port int `json:"port,omitempty"`
+
+	// Host and Headers, given as "Name: value", are sent with each check, for
+	// targets that route by host and serve checks on a different one.
+	// ServerName is sent as the SNI of checks on HTTPS targets.
+	Host       string   `json:"host,omitempty"`
+	Headers    []string `json:"headers,omitempty"`
+	ServerName string   `json:"server_name,omitempty"`
 }
 
 type ServiceOptions struct {
@@ -69,9 +83,46 @@ type ServiceOptions struct {
 	TLSCertificatePath string `json:"tls_certificate_path"`
 	TLSPrivateKeyPath  string `json:"tls_private_key_path"`
 	TLSDisableRedirect bool   `json:"tls_disable_redirect"`
+	TLSFingerprint     bool   `json:"tls_fingerprint"`
 	ACMEDirectory      string `json:"acme_directory"`
+	ACMEEmail          string `json:"acme_email"`
 	ACMECachePath      string `json:"acme_cache_path"`
+	TLSDNSProvider     string `json:"tls_dns_provider"`
+	TLSInternalCA      bool   `json:"tls_internal_ca"`
 	ErrorPagePath      string `json:"error_page_path"`
+
+	TLSRedirectExceptions []string `json:"tls_redirect_exceptions"`
+
+	StandbyTarget string `json:"standby_target"`
+
+	// StandbyHealthCheckConfig is how the standby target's health is checked,
+	// since it may need different overrides from the main target. When unset,
+	// the main target's config is used.
+	StandbyHealthCheckConfig *HealthCheckConfig `json:"standby_health_check_config,omitempty"`
+
+	OperationRoutes []OperationRoute `json:"operation_routes"`
+	AllowedHosts    []string         `json:"allowed_hosts"`
+	HostGroupLimit  int              `json:"host_group_limit"`
+	AllowedMethods  []string         `json:"allowed_methods"`
+	AnswerOptions   bool             `json:"answer_options"`
+	MethodOverride  bool             `json:"method_override"`
+
+	DisableKeepAlive bool `json:"disable_keepalive"`
+
+	RateLimit       float64 `json:"rate_limit"`
+	RateLimitBurst  int     `json:"rate_limit_burst"`
+	RateLimitHeader string  `json:"rate_limit_header"`
+
+	Schedule         []string `json:"schedule"`
+	ScheduleTimezone string   `json:"schedule_timezone"`
+	ScheduleMessage  string   `json:"schedule_message"`
+
+	FailHealthChecksWhilePaused bool `json:"fail_health_checks_while_paused"`
+
+	AutoStopErrorRate float64       `json:"auto_stop_error_rate"`
+	AutoStopWindow    time.Duration `json:"auto_stop_window"`
+	AutoStopMessage   string        `json:"auto_stop_message"`
+	AutoStopWebhook   string        `json:"auto_stop_webhook"`
 }
 
 func (so ServiceOptions) ScopedCachePath() string {
@@ -82,6 +133,12 @@ func (so ServiceOptions) ScopedCachePath() string {
 
 	hasher := sha256.New()
 	hasher.Write([]byte(so.ACMEDirectory))
+
+	// The account is registered with the email, so a different email needs its
+	// own account. Services without one keep the scope they've always had.
+	if so.ACMEEmail != "" {
+		hasher.Write([]byte("\n" + so.ACMEEmail))
+	}
 	hash := hex.EncodeToString(hasher.Sum(nil))
 
 	return path.Join(so.ACMECachePath, hash)
@@ -89,23 +146,42 @@ func (so ServiceOptions) ScopedCachePath() string {
 
 type Service struct {
 	name    string
-	hosts   []string
-	options ServiceOptions
+	current atomic.Pointer[serviceConfig]
 
 	active     *Target
 	rollout    *Target
+	standby    *standbyFailover
 	targetLock sync.RWMutex
 
 	pauseController   *PauseController
 	rolloutController *RolloutController
-	certManager       CertManager
-	middleware        http.Handler
+	lastDeploy        *DeployTimings
+	counters          *serviceCounters
+	summary           *requestSummary
+	certIssuance      *certIssuanceTracker
+	router            *Router
+}
+
+// serviceConfig is everything a service builds from its hosts and options.
+// Changing them replaces it as a whole, rather than updating it in place, so
+// that a request loads it once and sees a single version of it throughout.
+type serviceConfig struct {
+	hosts       []string
+	options     ServiceOptions
+	certManager CertManager
+	middleware  http.Handler
+	schedule    *ServiceSchedule
+	hostGroups  *hostGroups
+	errorBudget *errorBudget
+	rateLimiter *requestRateLimiter
 }
 
 func NewService(name string, hosts []string, options ServiceOptions) (*Service, error) {
 	service := &Service{
 		name:            name,
 		pauseController: NewPauseController(),
+		counters:        newServiceCounters(),
+		certIssuance:    newCertIssuanceTracker(),
 	}
 
 	err := service.initialize(hosts, options)
@@ -120,6 +196,12 @@ func (s *Service) UpdateOptions(hosts []string, options ServiceOptions) error {
 	return s.initialize(hosts, options)
 }
 
+// config returns the service's current configuration. It's never changed once
+// it's in use, so it can be read without holding any lock.
+func (s *Service) config() *serviceConfig {
+	return s.current.Load()
+}
+
 func (s *Service) ActiveTarget() *Target {
 	s.targetLock.RLock()
 	defer s.targetLock.RUnlock()
@@ -134,43 +216,87 @@ func (s *Service) RolloutTarget() *Target {
 	return s.rollout
 }
 
+// AssignRolloutGroup gives clients that don't yet have a rollout cookie a
+// random one, when a sticky rollout is in progress. The group for a cookie
+// never changes, so they'll stay in the same group for the rest of the
+// rollout.
+func (s *Service) AssignRolloutGroup(w http.ResponseWriter, req *http.Request) {
+	s.targetLock.RLock()
+	defer s.targetLock.RUnlock()
+
+	if s.rollout != nil && s.rolloutController != nil && s.rolloutController.Sticky {
+		s.rolloutController.AssignRolloutCookie(w, req)
+	}
+}
+
 func (s *Service) ClaimTarget(req *http.Request) (*Target, *http.Request, error) {
 	s.targetLock.RLock()
 	defer s.targetLock.RUnlock()
 
+	req.Header.Del(RolloutVariantHeader)
+
 	target := s.active
-	if s.rollout != nil && s.rolloutController != nil && s.rolloutController.RequestUsesRolloutGroup(req) {
-		slog.Debug("Using rollout target for request", "service", s.name, "path", req.URL.Path)
-		target = s.rollout
+	if s.rollout != nil && s.rolloutController != nil {
+		variant := RolloutVariantActive
+		if s.rolloutController.RequestUsesRolloutGroup(req) {
+			slog.Debug("Using rollout target for request", "service", s.name, "path", req.URL.Path)
+			target = s.rollout
+			variant = RolloutVariantRollout
+		}
+
+		req.Header.Set(RolloutVariantHeader, variant)
+	}
+
+	if s.standby != nil {
+		target = s.standby.targetFor(target)
+	}
+
+	if target == nil {
+		return nil, req, ErrorServiceHasNoTarget
 	}
 
 	req, err := target.StartRequest(req)
 	return target, req, err
 }
 
-func (s *Service) SetTarget(slot TargetSlot, target *Target, drainTimeout time.Duration) {
-	s.targetLock.Lock()
-	defer s.targetLock.Unlock()
+// SetTarget places a target in a slot, draining the one it replaces. It
+// returns how long the draining took.
+func (s *Service) SetTarget(slot TargetSlot, target *Target, drainTimeout time.Duration) time.Duration {
+	return s.replaceTarget(slot, target).drain(drainTimeout)
+}
 
-	var replaced *Target
+// replaceTarget places a target in a slot without draining the one it
+// replaces. Draining can take as long as the upload drain timeout, so callers
+// holding the router's lock release it before draining what's returned.
+func (s *Service) replaceTarget(slot TargetSlot, target *Target) replacedTarget {
+	replaced, replacedStandby := s.swapTarget(slot, target)
+
+	// The replacement's options apply, so that a longer upload timeout given
+	// when deploying protects the uploads that are in progress now.
+	var uploadTimeout time.Duration
+	switch {
+	case target != nil:
+		uploadTimeout = target.options.UploadDrainTimeout
+	case replaced != nil:
+		uploadTimeout = replaced.options.UploadDrainTimeout
+	}
 
-	switch slot {
-	case TargetSlotActive:
-		replaced = s.active
-		s.active = target
+	return replacedTarget{target: replaced, standby: replacedStandby, uploadTimeout: uploadTimeout}
+}
 
-	case TargetSlotRollout:
-		replaced = s.rollout
-		s.rollout = target
-	}
+// StandbyStatus reports the service's standby target, if it has one, and
+// whether its traffic has failed over to it.
+func (s *Service) StandbyStatus() (string, bool) {
+	s.targetLock.RLock()
+	defer s.targetLock.RUnlock()
 
-	if replaced != nil {
-		replaced.StopHealthChecks()
-		replaced.Drain(drainTimeout)
+	if s.standby == nil {
+		return "", false
 	}
+	return s.standby.standby.Target(), s.standby.isFailedOver()
 }
 
-func (s *Service) SetRolloutSplit(percentage int, allowlist []string) error {
+func (s *Service) SetRolloutSplit(percentage int, allowlist []string, options RolloutOptions) error {
 	s.targetLock.Lock()
 	defer s.targetLock.Unlock()
 
@@ -179,7 +305,8 @@ func (s *Service) SetRolloutSplit(percentage int, allowlist []string) error {
 	}
 
 	s.rolloutController = NewRolloutController(percentage, allowlist)
-	slog.Info("Set rollout split", "service", s.name, "percentage", percentage, "allowlist", allowlist)
+	s.rolloutController.RolloutOptions = options
+	slog.Info("Set rollout split", "service", s.name, "percentage", percentage, "allowlist", allowlist, "sticky", options.Sticky, "expose_variant", options.ExposeVariant)
 	return nil
 }
 
@@ -192,8 +319,50 @@ func (s *Service) StopRollout() error {
 	return nil
 }
 
+func (s *Service) InflightRequests() []InflightRequestDescription {
+	s.targetLock.RLock()
+	defer s.targetLock.RUnlock()
+
+	result := []InflightRequestDescription{}
+	for _, target := range []*Target{s.active, s.rollout} {
+		if target != nil {
+			result = append(result, target.InflightRequests()...)
+		}
+	}
+
+	return result
+}
+
+func (s *Service) CertificateStatuses() []CertificateStatus {
+	result := []CertificateStatus{}
+	config := s.config()
+	if config.certManager == nil {
+		return result
+	}
+
+	for _, host := range config.hosts {
+		notAfter, ok := certificateExpiry(config.certManager, host)
+		if ok {
+			result = append(result, CertificateStatus{Service: s.name, Host: host, NotAfter: notAfter})
+		}
+	}
+
+	return result
+}
+
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.middleware.ServeHTTP(w, r)
+	started := time.Now()
+	sw := s.counters.countRequestBytes(w, r)
+	defer func() {
+		s.counters.record(sw.statusCode)
+		s.summary.record(sw.statusCode, time.Since(started))
+	}()
+
+	s.config().middleware.ServeHTTP(sw, r)
+}
+
+func (s *Service) Stats() ServiceStats {
+	return s.counters.stats()
 }
 
 type marshalledService struct {
@@ -205,25 +374,32 @@ type marshalledService struct {
 	TargetOptions     TargetOptions      `json:"target_options"`
 	PauseController   *PauseController   `json:"pause_controller"`
 	RolloutController *RolloutController `json:"rollout_controller"`
+	Stats             ServiceStats       `json:"stats"`
 }
 
 func (s *Service) MarshalJSON() ([]byte, error) {
-	activeTarget := s.active.Target()
+	activeTarget := ""
+	var targetOptions TargetOptions
+	if s.active != nil {
+		activeTarget = s.active.Target()
+		targetOptions = s.active.options
+	}
 	rolloutTarget := ""
 	if s.rollout != nil {
 		rolloutTarget = s.rollout.Target()
 	}
-	targetOptions := s.active.options
+	config := s.config()
 
 	return json.Marshal(marshalledService{
 		Name:              s.name,
-		Hosts:             s.hosts,
+		Hosts:             config.hosts,
 		ActiveTarget:      activeTarget,
 		RolloutTarget:     rolloutTarget,
-		Options:           s.options,
+		Options:           config.options,
 		TargetOptions:     targetOptions,
 		PauseController:   s.pauseController,
 		RolloutController: s.rolloutController,
+		Stats:             s.counters.stats(),
 	})
 }
 
@@ -237,10 +413,33 @@ func (s *Service) UnmarshalJSON(data []byte) error {
 	s.name = ms.Name
 	s.pauseController = ms.PauseController
 	s.rolloutController = ms.RolloutController
+	s.counters = newServiceCounters()
+	s.counters.restore(ms.Stats)
+	s.certIssuance = newCertIssuanceTracker()
 
-	s.initialize(ms.Hosts, ms.Options)
-	s.restoreSavedTarget(TargetSlotActive, ms.ActiveTarget, ms.TargetOptions)
-	s.restoreSavedTarget(TargetSlotRollout, ms.RolloutTarget, ms.TargetOptions)
+	// State saved before hosts were normalized may still have them as they
+	// were given, so normalize them on the way back in.
+	hosts, err := normalizeHosts(ms.Hosts)
+	if err != nil {
+		hosts = ms.Hosts
+	}
+
+	// A target that can't be restored, such as one whose signing key file has
+	// gone, fails the whole restore rather than leaving the service without
+	// one.
+	err = s.initialize(hosts, ms.Options)
+	if err != nil {
+		return err
+	}
+	err = s.restoreSavedTarget(TargetSlotActive, ms.ActiveTarget, ms.TargetOptions)
+	if err != nil {
+		return err
+	}
+	err = s.restoreSavedTarget(TargetSlotRollout, ms.RolloutTarget, ms.TargetOptions)
+	if err != nil {
+		return err
+	}
+	s.standby = s.createStandby(s.active)
 
 	return nil
 }
@@ -284,52 +483,221 @@ func (s *Service) Resume() error {
 // Private
 
 func (s *Service) initialize(hosts []string, options ServiceOptions) error {
-	certManager, err := s.createCertManager(hosts, options)
+	setup, err := s.prepare(hosts, options)
 	if err != nil {
 		return err
 	}
 
-	middleware, err := s.createMiddleware(options, certManager)
+	s.apply(setup)
+	return nil
+}
+
+// serviceSetup is what a service builds from its options, before any of it
+// is put into use.
+type serviceSetup struct {
+	config           *serviceConfig
+	startCertManager func()
+}
+
+// checkServiceOptions validates the options for a service, without setting
+// one up or creating a certificate manager, so that nothing is started,
+// issued or written for them.
+func checkServiceOptions(name string, hosts []string, options ServiceOptions) error {
+	s := &Service{name: name}
+	_, err := s.prepareRequestHandling(hosts, options)
 	if err != nil {
 		return err
 	}
 
-	s.hosts = hosts
-	s.options = options
-	s.certManager = certManager
-	s.middleware = middleware
+	return checkCertOptions(hosts, options)
+}
 
-	return nil
+func (s *Service) prepare(hosts []string, options ServiceOptions) (serviceSetup, error) {
+	setup, err := s.prepareRequestHandling(hosts, options)
+	if err != nil {
+		return setup, err
+	}
+
+	setup.config.certManager, setup.startCertManager, err = s.createCertManager(hosts, options)
+	if err != nil {
+		return setup, err
+	}
+
+	return setup, nil
 }
 
-func (s *Service) createCertManager(hosts []string, options ServiceOptions) (CertManager, error) {
+// prepareRequestHandling builds everything in a service's setup apart from
+// its certificate manager.
+func (s *Service) prepareRequestHandling(hosts []string, options ServiceOptions) (serviceSetup, error) {
+	setup := serviceSetup{config: &serviceConfig{hosts: hosts, options: options}}
+	var err error
+
+	if options.StandbyTarget != "" {
+		if _, err := parseTargetURL(options.StandbyTarget); err != nil {
+			return setup, err
+		}
+	}
+
+	setup.config.middleware, err = s.createMiddleware(setup.config)
+	if err != nil {
+		return setup, err
+	}
+
+	if len(options.Schedule) > 0 {
+		setup.config.schedule, err = ParseServiceSchedule(options.Schedule, options.ScheduleTimezone)
+		if err != nil {
+			return setup, err
+		}
+	}
+
+	return setup, nil
+}
+
+func (s *Service) apply(setup serviceSetup) {
+	config := setup.config
+	options := config.options
+	previous := s.config()
+
+	if options.HostGroupLimit > 0 {
+		config.hostGroups = newHostGroups(config.hosts, options.HostGroupLimit)
+	}
+
+	if options.AutoStopErrorRate > 0 {
+		config.errorBudget = newErrorBudget(options.AutoStopErrorRate, options.AutoStopWindow, s.autoStop)
+	}
+
+	// Keep the rate limiter while its settings are unchanged, so that clients
+	// don't get a fresh allowance on every deploy.
+	if options.RateLimit > 0 {
+		if previous != nil && previous.rateLimiter != nil && previous.rateLimiter.sameSettings(options.RateLimit, options.RateLimitBurst, options.RateLimitHeader) {
+			config.rateLimiter = previous.rateLimiter
+		} else {
+			config.rateLimiter = newRequestRateLimiter(options.RateLimit, options.RateLimitBurst, options.RateLimitHeader)
+		}
+	}
+
+	s.current.Store(config)
+
+	if previous != nil {
+		if manager, ok := previous.certManager.(*DNSCertManager); ok && manager != config.certManager {
+			manager.Close()
+		}
+	}
+
+	if setup.startCertManager != nil {
+		setup.startCertManager()
+	}
+}
+
+// createCertManager returns the certificate manager for the service's
+// options, along with anything that has to be done to start it once the
+// options are in use. Nothing is issued before then, so a deploy that fails
+// doesn't leave certificates being requested for it.
+func (s *Service) createCertManager(hosts []string, options ServiceOptions) (CertManager, func(), error) {
 	if !options.TLSEnabled {
-		return nil, nil
+		return nil, nil, nil
+	}
+
+	var existing CertManager
+	if config := s.config(); config != nil {
+		existing = config.certManager
 	}
 
 	if options.TLSCertificatePath != "" && options.TLSPrivateKeyPath != "" {
-		return NewStaticCertManager(options.TLSCertificatePath, options.TLSPrivateKeyPath)
+		// Swap the certificate of a static manager that's already serving,
+		// rather than replacing the manager, so that there's no moment when
+		// connections can't get one. The swap waits until the options are in
+		// use, so a deploy that fails leaves the current certificate serving.
+		cert, err := loadStaticCertificateForHosts(options.TLSCertificatePath, options.TLSPrivateKeyPath, hosts)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if current, ok := existing.(*StaticCertManager); ok {
+			return current, func() { current.replace(cert) }, nil
+		}
+
+		manager := &StaticCertManager{}
+		manager.cert.Store(cert)
+		return manager, nil, nil
 	}
 
-	// Ensure we're not trying to use Let's Encrypt to fetch a wildcard domain,
-	// as that is not supported with the challenge types that we use.
-	for _, host := range hosts {
-		if strings.Contains(host, "*") {
-			return nil, ErrorAutomaticTLSDoesNotSupportWildcards
+	// Internal hosts can't be verified by an ACME server at all, but we can
+	// vouch for them ourselves.
+	if options.TLSInternalCA {
+		manager, err := NewInternalCertManager(hosts, options)
+		return manager, nil, err
+	}
+
+	// Wildcard hosts can only be proven with DNS challenges, which need a
+	// provider to create the records.
+	if options.TLSDNSProvider != "" {
+		if current, ok := existing.(*DNSCertManager); ok && current.usesSettings(options) {
+			return current, func() { current.UpdateHosts(hosts) }, nil
 		}
+
+		provider, err := NewDNSProvider(options.TLSDNSProvider)
+		if err != nil {
+			return nil, nil, err
+		}
+		manager := NewDNSCertManager(hosts, provider, options)
+		return manager, manager.Start, nil
+	}
+
+	err := checkAutomaticTLSHosts(hosts)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	return &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
-		Cache:      autocert.DirCache(options.ScopedCachePath()),
+		Cache:      newCertExpiryCache(autocert.DirCache(options.ScopedCachePath())),
 		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      options.ACMEEmail,
 		Client:     &acme.Client{DirectoryURL: options.ACMEDirectory},
-	}, nil
+	}, nil, nil
 }
 
-func (s *Service) createMiddleware(options ServiceOptions, certManager CertManager) (http.Handler, error) {
+// checkCertOptions validates the options that createCertManager uses,
+// without creating a manager.
+func checkCertOptions(hosts []string, options ServiceOptions) error {
+	switch {
+	case !options.TLSEnabled:
+		return nil
+	case options.TLSInternalCA:
+		return checkInternalCAHosts(hosts)
+	case options.TLSCertificatePath != "" && options.TLSPrivateKeyPath != "":
+		_, err := loadStaticCertificateForHosts(options.TLSCertificatePath, options.TLSPrivateKeyPath, hosts)
+		return err
+	case options.TLSDNSProvider != "":
+		_, err := NewDNSProvider(options.TLSDNSProvider)
+		return err
+	default:
+		return checkAutomaticTLSHosts(hosts)
+	}
+}
+
+// checkAutomaticTLSHosts ensures we're not trying to use Let's Encrypt to
+// fetch a wildcard domain, as that is not supported with the challenge types
+// that we use.
+func checkAutomaticTLSHosts(hosts []string) error {
+	for _, host := range hosts {
+		if strings.Contains(host, "*") {
+			return ErrorAutomaticTLSDoesNotSupportWildcards
+		}
+	}
+	return nil
+}
+
+// createMiddleware builds the handler for requests using a configuration.
+// The configuration is bound to it, so that a request is handled entirely by
+// the version that was current when it arrived.
+func (s *Service) createMiddleware(config *serviceConfig) (http.Handler, error) {
 	var err error
-	var handler http.Handler = http.HandlerFunc(s.serviceRequestWithTarget)
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serviceRequestWithTarget(config, w, r)
+	})
+	options := config.options
 
 	if options.ErrorPagePath != "" {
 		slog.Debug("Using custom error pages", "service", s.name, "path", options.ErrorPagePath)
@@ -341,51 +709,150 @@ func (s *Service) createMiddleware(options ServiceOptions, certManager CertManag
 		}
 	}
 
-	if certManager != nil {
-		slog.Debug("Using ACME handler", "service", s.name)
-		handler = certManager.HTTPHandler(handler)
-	}
-
 	return handler, nil
 }
 
-func (s *Service) serviceRequestWithTarget(w http.ResponseWriter, r *http.Request) {
+func (s *Service) serviceRequestWithTarget(config *serviceConfig, w http.ResponseWriter, r *http.Request) {
 	LoggingRequestContext(r).Service = s.name
+	if config.hostGroups != nil {
+		LoggingRequestContext(r).HostGroup = config.hostGroups.GroupForRequest(r)
+	}
 
-	if s.shouldRedirectToHTTPS(r) {
+	// Only HTTP/1 connections are closed; on HTTP/2, the header would close
+	// the connection for every other request that's sharing it.
+	if config.options.DisableKeepAlive && r.ProtoMajor == 1 {
+		w.Header().Set("Connection", "close")
+	}
+
+	if len(config.options.AllowedHosts) > 0 && !isInternalTraffic(r) && !hostIsAllowed(r, config.options.AllowedHosts) {
+		SetErrorResponse(w, r, http.StatusMisdirectedRequest, nil)
+		return
+	}
+
+	r = s.applyMethodOverride(config, r)
+
+	if s.handleDisallowedMethods(config, w, r) {
+		return
+	}
+
+	if s.shouldRedirectToHTTPS(config, r) {
 		s.redirectToHTTPS(w, r)
 		return
 	}
 
-	if !s.options.TLSEnabled && r.TLS != nil {
+	if !config.options.TLSEnabled && r.TLS != nil {
 		SetErrorResponse(w, r, http.StatusServiceUnavailable, nil)
 		return
 	}
 
-	if s.handlePausedAndStoppedRequests(w, r) {
+	if s.handleOutOfScheduleRequests(config, w, r) {
+		return
+	}
+
+	if s.handleRateLimitedRequests(config, w, r) {
+		return
+	}
+
+	if s.handlePausedAndStoppedRequests(config, w, r) {
+		return
+	}
+
+	routed, release := s.serviceForOperation(config, r)
+	defer release()
+	if routed != nil {
+		routed.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKeyOperationRouted, true)))
 		return
 	}
 
+	if config.options.TLSFingerprint {
+		setTLSFingerprintHeaders(r)
+	}
+
+	s.AssignRolloutGroup(w, r)
+
 	target, req, err := s.ClaimTarget(r)
 	if err != nil {
-		SetErrorResponse(w, req, http.StatusServiceUnavailable, nil)
+		if errors.Is(err, ErrorTargetUnhealthy) {
+			w.Header().Set("Retry-After", target.RetryAfter())
+		}
+		SetErrorResponse(w, r, http.StatusServiceUnavailable, nil)
 		return
 	}
 
+	if s.exposesRolloutVariant() {
+		w.Header().Set(RolloutVariantHeader, req.Header.Get(RolloutVariantHeader))
+	}
+
+	if budget := config.errorBudget; budget != nil {
+		ew := newStatusResponseWriter(w)
+		defer func() { budget.Record(ew.statusCode) }()
+		w = ew
+	}
+
 	target.SendRequest(w, req)
 }
 
-func (s *Service) shouldRedirectToHTTPS(r *http.Request) bool {
-	return s.options.TLSEnabled && !s.options.TLSDisableRedirect && r.TLS == nil
+// serviceForOperation finds the service that a GraphQL request's operation is
+// routed to, if it's routed anywhere other than here. The body is only read as
+// far as the target would buffer it in memory, and release gives back the
+// memory that took.
+func (s *Service) serviceForOperation(config *serviceConfig, r *http.Request) (*Service, func()) {
+	release := func() {}
+	if s.router == nil || r.Context().Value(contextKeyOperationRouted) != nil {
+		return nil, release
+	}
+
+	routes := config.options.OperationRoutes
+	target := s.ActiveTarget()
+	if len(routes) == 0 || target == nil {
+		return nil, release
+	}
+
+	// A body that's too large will be refused by the target, so there's no
+	// need to read any of it.
+	if target.options.MaxRequestBodySize > 0 && r.ContentLength > target.options.MaxRequestBodySize {
+		return nil, release
+	}
+
+	operationName, release := operationNameForRequest(r, min(operationRoutingBodyLimit, target.options.MaxMemoryBufferSize))
+	if operationName == "" {
+		return nil, release
+	}
+
+	for _, route := range routes {
+		if route.Matches(operationName) {
+			routed := s.router.serviceForName(route.Service)
+			if routed == nil || routed == s {
+				return nil, release
+			}
+
+			slog.Debug("Routing operation to service", "operation", operationName, "from", s.name, "to", route.Service)
+			return routed, release
+		}
+	}
+
+	return nil, release
+}
+
+func (s *Service) exposesRolloutVariant() bool {
+	s.targetLock.RLock()
+	defer s.targetLock.RUnlock()
+
+	return s.rollout != nil && s.rolloutController != nil && s.rolloutController.ExposeVariant
+}
+
+func (s *Service) shouldRedirectToHTTPS(config *serviceConfig, r *http.Request) bool {
+	return config.options.TLSEnabled && !config.options.TLSDisableRedirect && r.TLS == nil && !isInternalTraffic(r) &&
+		!isTLSRedirectException(r, config.options.TLSRedirectExceptions)
 }
 
-func (s *Service) handlePausedAndStoppedRequests(w http.ResponseWriter, r *http.Request) bool {
+func (s *Service) handlePausedAndStoppedRequests(config *serviceConfig, w http.ResponseWriter, r *http.Request) bool {
 	if s.pauseController.GetState() != PauseStateRunning && s.ActiveTarget().IsHealthCheckRequest(r) {
 		// When paused or stopped, return success for any health check
 		// requests from downstream services. Otherwise, they might consider
 		// us as unhealthy while in that state, and remove us from their
 		// pool.
-		w.WriteHeader(http.StatusOK)
+		s.answerHealthCheckWhileUnavailable(config, w)
 		return true
 	}
 
@@ -405,6 +872,98 @@ func (s *Service) handlePausedAndStoppedRequests(w http.ResponseWriter, r *http.
 	return false
 }
 
+// answerHealthCheckWhileUnavailable responds to a downstream health check
+// while the service isn't serving requests. Some setups want it to fail,
+// though: a load balancer in front of several proxies can move traffic to
+// another one during maintenance.
+func (s *Service) answerHealthCheckWhileUnavailable(config *serviceConfig, w http.ResponseWriter) {
+	if config.options.FailHealthChecksWhilePaused {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// replacedTarget is what's left to drain after a target has been replaced.
+type replacedTarget struct {
+	target        *Target
+	standby       *standbyFailover
+	uploadTimeout time.Duration
+}
+
+// drain drains the replaced target and its standby, returning how long the
+// target took.
+func (rt replacedTarget) drain(drainTimeout time.Duration) time.Duration {
+	if rt.standby != nil {
+		rt.standby.close(drainTimeout)
+	}
+	if rt.target == nil {
+		return 0
+	}
+
+	started := time.Now()
+	rt.target.StopRecovery()
+	rt.target.StopHealthChecks()
+	rt.target.DrainWithUploadTimeout(drainTimeout, rt.uploadTimeout)
+
+	return time.Since(started)
+}
+
+// swapTarget places a target in a slot, and returns the target and standby
+// it replaced. Draining happens after the lock is released, so that new
+// requests can be claimed by the replacement in the meantime.
+func (s *Service) swapTarget(slot TargetSlot, target *Target) (*Target, *standbyFailover) {
+	s.targetLock.Lock()
+	defer s.targetLock.Unlock()
+
+	var replaced *Target
+	var replacedStandby *standbyFailover
+
+	switch slot {
+	case TargetSlotActive:
+		replaced = s.active
+		s.active = target
+
+		replacedStandby = s.standby
+		s.standby = s.createStandby(target)
+
+	case TargetSlotRollout:
+		replaced = s.rollout
+		s.rollout = target
+	}
+
+	return replaced, replacedStandby
+}
+
+func (s *Service) createStandby(active *Target) *standbyFailover {
+	options := s.config().options
+	if active == nil || options.StandbyTarget == "" {
+		return nil
+	}
+
+	standby, err := newStandbyFailover(s.name, active, options.StandbyTarget, options.StandbyHealthCheckConfig)
+	if err != nil {
+		slog.Error("Unable to create standby target", "service", s.name, "standby", options.StandbyTarget, "error", err)
+		return nil
+	}
+	return standby
+}
+
+// useTunnels gives restored targets the server's tunnel registry, which
+// can't be saved with them.
+func (s *Service) useTunnels(tunnels *TunnelRegistry) {
+	targets := []*Target{s.active, s.rollout}
+	if s.standby != nil {
+		targets = append(targets, s.standby.standby)
+	}
+
+	for _, target := range targets {
+		if target != nil {
+			target.options.tunnels = tunnels
+		}
+	}
+}
+
 func (s *Service) restoreSavedTarget(slot TargetSlot, savedTarget string, options TargetOptions) error {
 	if savedTarget == "" {
 		return nil // Nothing to restore
@@ -433,11 +992,8 @@ func (s *Service) restoreSavedTarget(slot TargetSlot, savedTarget string, option
 func (s *Service) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "close")
 
-	host, _, err := net.SplitHostPort(r.Host)
-	if err != nil {
-		host = r.Host
-	}
+	host, _ := splitHostPort(r.Host)
 
-	url := "https://" + host + r.URL.RequestURI()
+	url := "https://" + joinHost(host) + r.URL.RequestURI()
 	http.Redirect(w, r, url, http.StatusMovedPermanently)
 }
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+var (
+	ErrorServiceNeedsHost      = errors.New("can't remove every host from a service; remove the service instead")
+	ErrorServiceAcceptsAnyHost = errors.New("service accepts any host; deploy it with hosts before adding more")
+)
+
+// AddServiceHosts attaches more hosts to a service, without a deploy. With
+// automatic TLS, a certificate is obtained for each new host when it's first
+// requested; with a static certificate, the certificate must already cover
+// them.
+func (r *Router) AddServiceHosts(name string, hosts []string) error {
+	hosts, err := normalizeHosts(hosts)
+	if err != nil {
+		return err
+	}
+
+	return r.updateServiceHosts(name, func(service *Service) ([]string, error) {
+		config := service.config()
+		if len(config.hosts) == 0 {
+			return nil, ErrorServiceAcceptsAnyHost
+		}
+
+		if manager, ok := config.certManager.(*StaticCertManager); ok {
+			err := verifyCertificateHosts(manager.cert.Load().Leaf, hosts)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		updated := slices.Clone(config.hosts)
+		for _, host := range hosts {
+			if !slices.Contains(updated, host) {
+				updated = append(updated, host)
+			}
+		}
+		return updated, nil
+	})
+}
+
+// RemoveServiceHosts detaches hosts from a service, without a deploy. A
+// service must keep at least one host, so that it doesn't start accepting
+// requests for any host.
+func (r *Router) RemoveServiceHosts(name string, hosts []string) error {
+	hosts, err := normalizeHosts(hosts)
+	if err != nil {
+		return err
+	}
+
+	return r.updateServiceHosts(name, func(service *Service) ([]string, error) {
+		updated := slices.DeleteFunc(slices.Clone(service.config().hosts), func(host string) bool {
+			return slices.Contains(hosts, host)
+		})
+		if len(updated) == 0 {
+			return nil, ErrorServiceNeedsHost
+		}
+		return updated, nil
+	})
+}
+
+// Private
+
+func (r *Router) updateServiceHosts(name string, change func(service *Service) ([]string, error)) error {
+	defer r.saveStateSnapshot()
+
+	return r.withWriteLock(func() error {
+		service := r.services[name]
+		if service == nil {
+			return ErrorServiceNotFound
+		}
+
+		hosts, err := change(service)
+		if err != nil {
+			return err
+		}
+
+		conflict := r.hostServices.CheckHostAvailability(name, hosts)
+		if conflict != nil {
+			return fmt.Errorf("%w (by %s)", ErrorHostInUse, conflict.name)
+		}
+
+		err = service.UpdateOptions(hosts, service.config().options)
+		if err != nil {
+			return err
+		}
+		r.hostServices = r.services.HostServices()
+
+		slog.Info("Updated service hosts", "service", name, "hosts", hosts)
+		return nil
+	})
+}
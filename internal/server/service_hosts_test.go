@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceHosts_AddAndRemove(t *testing.T) {
+	router := testRouter(t)
+	_, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"app.example.com"}, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetServiceTarget("service2", []string{"other.example.com"}, second, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	statusCode, _ := sendGETRequest(router, "http://customer1.com/")
+	assert.Equal(t, http.StatusNotFound, statusCode)
+
+	require.NoError(t, router.AddServiceHosts("service1", []string{"Customer1.com", "customer2.com"}))
+	assert.Equal(t, "app.example.com,customer1.com,customer2.com", router.ListActiveServices()["service1"].Host)
+
+	statusCode, body := sendGETRequest(router, "http://customer1.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+
+	require.NoError(t, router.RemoveServiceHosts("service1", []string{"customer1.com"}))
+
+	statusCode, _ = sendGETRequest(router, "http://customer1.com/")
+	assert.Equal(t, http.StatusNotFound, statusCode)
+	statusCode, _ = sendGETRequest(router, "http://customer2.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+}
+
+func TestServiceHosts_RejectsConflictsAndEmptyServices(t *testing.T) {
+	router := testRouter(t)
+	_, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"app.example.com"}, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.SetServiceTarget("service2", []string{"other.example.com"}, second, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	assert.ErrorIs(t, router.AddServiceHosts("service1", []string{"other.example.com"}), ErrorHostInUse)
+	assert.ErrorIs(t, router.RemoveServiceHosts("service1", []string{"app.example.com"}), ErrorServiceNeedsHost)
+	assert.ErrorIs(t, router.AddServiceHosts("unknown", []string{"customer1.com"}), ErrorServiceNotFound)
+
+	require.NoError(t, router.SetServiceTarget("default", defaultEmptyHosts, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	assert.ErrorIs(t, router.AddServiceHosts("default", []string{"customer1.com"}), ErrorServiceAcceptsAnyHost)
+}
+
+func TestServiceHosts_StaticCertificateMustCoverNewHosts(t *testing.T) {
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "app.example.com", "*.example.com")
+
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	options := ServiceOptions{TLSEnabled: true, TLSCertificatePath: certPath, TLSPrivateKeyPath: keyPath}
+	require.NoError(t, router.SetServiceTarget("service1", []string{"app.example.com"}, target, options, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	assert.NoError(t, router.AddServiceHosts("service1", []string{"www.example.com"}))
+	assert.ErrorIs(t, router.AddServiceHosts("service1", []string{"customer1.com"}), ErrorCertificateHostMismatch)
+}
+
+func TestServiceHosts_KeptInSavedState(t *testing.T) {
+	router := testRouter(t)
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	require.NoError(t, router.SetServiceTarget("service1", []string{"app.example.com"}, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	require.NoError(t, router.AddServiceHosts("service1", []string{"customer1.com"}))
+
+	restored := NewRouter(router.stateStore)
+	require.NoError(t, restored.RestoreLastSavedState(RestoreOptions{}))
+
+	statusCode, body := sendGETRequest(restored, "http://customer1.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata" // The proxy's image doesn't include the time zone database
+)
+
+var (
+	ErrorInvalidSchedule         = errors.New("schedule windows must look like \"Mon-Fri 09:00-17:00\"")
+	ErrorInvalidScheduleTimezone = errors.New("unknown schedule time zone")
+
+	scheduleDayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// ServiceSchedule is the set of times when a service is open. Outside of
+// them, it's served as though it were stopped.
+//
+// Each window covers a range of days and a range of times on those days, such
+// as "Mon-Fri 09:00-17:00". Days can be listed ("Sat,Sun"), or given as "*"
+// for every day. A window that ends earlier than it starts runs past
+// midnight, into the following day.
+type ServiceSchedule struct {
+	windows  []scheduleWindow
+	location *time.Location
+	now      func() time.Time
+}
+
+type scheduleWindow struct {
+	days  [7]bool
+	start int // Minutes after midnight
+	end   int
+}
+
+func ParseServiceSchedule(windows []string, timezone string) (*ServiceSchedule, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrorInvalidScheduleTimezone, timezone)
+	}
+
+	schedule := &ServiceSchedule{location: location, now: time.Now}
+	for _, value := range windows {
+		window, err := parseScheduleWindow(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrorInvalidSchedule, value)
+		}
+		schedule.windows = append(schedule.windows, window)
+	}
+
+	return schedule, nil
+}
+
+func (s *ServiceSchedule) IsOpen() bool {
+	now := s.now().In(s.location)
+	minute := now.Hour()*60 + now.Minute()
+	today := int(now.Weekday())
+	yesterday := (today + 6) % 7
+
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+		} else {
+			if (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleOutOfScheduleRequests serves the stopped page, with the schedule's
+// message, to requests that arrive while the service is closed, returning
+// true if it did.
+func (s *Service) handleOutOfScheduleRequests(config *serviceConfig, w http.ResponseWriter, r *http.Request) bool {
+	if config.schedule == nil || config.schedule.IsOpen() {
+		return false
+	}
+
+	if s.ActiveTarget().IsHealthCheckRequest(r) {
+		s.answerHealthCheckWhileUnavailable(config, w)
+		return true
+	}
+
+	templateArguments := struct{ Message string }{config.options.ScheduleMessage}
+	SetErrorResponse(w, r, http.StatusServiceUnavailable, templateArguments)
+	return true
+}
+
+// Private
+
+func parseScheduleWindow(value string) (scheduleWindow, error) {
+	var window scheduleWindow
+
+	days, times, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok {
+		return window, ErrorInvalidSchedule
+	}
+
+	err := window.parseDays(days)
+	if err != nil {
+		return window, err
+	}
+
+	start, end, ok := strings.Cut(strings.TrimSpace(times), "-")
+	if !ok {
+		return window, ErrorInvalidSchedule
+	}
+
+	window.start, err = parseScheduleTime(start)
+	if err != nil {
+		return window, err
+	}
+	window.end, err = parseScheduleTime(end)
+	if err != nil {
+		return window, err
+	}
+	if window.start == window.end {
+		return window, ErrorInvalidSchedule
+	}
+
+	return window, nil
+}
+
+func (w *scheduleWindow) parseDays(value string) error {
+	if value == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+
+		from := scheduleDay(first)
+		to := scheduleDay(last)
+		if from < 0 || to < 0 {
+			return ErrorInvalidSchedule
+		}
+
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func scheduleDay(name string) int {
+	for i, day := range scheduleDayNames {
+		if strings.EqualFold(name, day) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseScheduleTime reads an HH:MM time as minutes after midnight. The end
+// of the day can be written as 24:00.
+func parseScheduleTime(value string) (int, error) {
+	if value == "24:00" {
+		return 24 * 60, nil
+	}
+
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, ErrorInvalidSchedule
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/basecamp/kamal-proxy/internal/pages"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceSchedule_IsOpen(t *testing.T) {
+	schedule, err := ParseServiceSchedule([]string{"Mon-Fri 09:00-17:00", "Sat 22:00-02:00"}, "Europe/London")
+	require.NoError(t, err)
+
+	london, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+
+	for when, expected := range map[string]bool{
+		"2024-07-01 09:00": true,  // Monday
+		"2024-07-01 08:59": false, // Monday
+		"2024-07-05 16:59": true,  // Friday
+		"2024-07-05 17:00": false, // Friday
+		"2024-07-06 12:00": false, // Saturday
+		"2024-07-06 23:30": true,  // Saturday night
+		"2024-07-07 01:59": true,  // Early Sunday
+		"2024-07-07 02:00": false, // Sunday
+	} {
+		now, err := time.ParseInLocation("2006-01-02 15:04", when, london)
+		require.NoError(t, err)
+
+		schedule.now = func() time.Time { return now.UTC() }
+		assert.Equal(t, expected, schedule.IsOpen(), when)
+	}
+}
+
+func TestServiceSchedule_DayLists(t *testing.T) {
+	schedule, err := ParseServiceSchedule([]string{"sat,sun 00:00-24:00"}, "")
+	require.NoError(t, err)
+
+	schedule.now = func() time.Time { return time.Date(2024, 7, 7, 23, 59, 0, 0, time.UTC) }
+	assert.True(t, schedule.IsOpen())
+
+	schedule.now = func() time.Time { return time.Date(2024, 7, 8, 0, 0, 0, 0, time.UTC) }
+	assert.False(t, schedule.IsOpen())
+}
+
+func TestServiceSchedule_Invalid(t *testing.T) {
+	for _, window := range []string{"Mon-Fri", "Mon-Fri 9-5", "Someday 09:00-17:00", "* 09:00-09:00", "* 09:00-25:00"} {
+		_, err := ParseServiceSchedule([]string{window}, "UTC")
+		assert.ErrorIs(t, err, ErrorInvalidSchedule, window)
+	}
+
+	_, err := ParseServiceSchedule([]string{"* 09:00-17:00"}, "Nowhere/Special")
+	assert.ErrorIs(t, err, ErrorInvalidScheduleTimezone)
+}
+
+func TestService_ServesStoppedPageOutsideSchedule(t *testing.T) {
+	options := ServiceOptions{Schedule: []string{"Mon-Fri 09:00-17:00"}, ScheduleMessage: "Open on weekdays"}
+	service := testCreateService(t, defaultEmptyHosts, options, defaultTargetOptions)
+
+	service.config().schedule.now = func() time.Time { return time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC) }
+
+	handler, err := WithErrorPageMiddleware(pages.DefaultErrorPages, true, service)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	service.config().schedule.now = func() time.Time { return time.Date(2024, 7, 6, 10, 0, 0, 0, time.UTC) }
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "Open on weekdays")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DefaultHealthCheckPath, nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
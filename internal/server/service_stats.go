@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serviceStatsSaveInterval is how often the state is saved while requests are
+// being served, which is as much of the stats as could be lost in a crash.
+// They are also saved whenever the proxy stops.
+const serviceStatsSaveInterval = 5 * time.Minute
+
+// ServiceStats are the cumulative totals of a service's requests. They are
+// saved with the rest of the state, so they survive restarts of the proxy.
+// ClientClosed counts requests that the client gave up on before they were
+// complete, which are not counted as errors. RateLimited counts requests
+// refused for going over the service's rate limit. BytesIn and BytesOut count the
+// request and response bodies, including anything sent either way over
+// upgraded connections such as WebSockets, but not headers.
+type ServiceStats struct {
+	Requests     int64     `json:"requests"`
+	Errors       int64     `json:"errors"`
+	ClientClosed int64     `json:"client_closed"`
+	RateLimited  int64     `json:"rate_limited"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	Since        time.Time `json:"since"`
+}
+
+// Private
+
+// saveStatsPeriodically saves the state every interval in which there have
+// been requests, until the context is cancelled.
+func (r *Router) saveStatsPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSaved := r.totalRequests()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if total := r.totalRequests(); total != lastSaved {
+				r.saveStateSnapshot()
+				lastSaved = total
+			}
+		}
+	}
+}
+
+func (r *Router) totalRequests() int64 {
+	var total int64
+	r.withReadLock(func() error {
+		for _, service := range r.services {
+			total += service.counters.requests.Load()
+		}
+		return nil
+	})
+	return total
+}
+
+type serviceCounters struct {
+	requests     atomic.Int64
+	errors       atomic.Int64
+	clientClosed atomic.Int64
+	rateLimited  atomic.Int64
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	since        time.Time
+}
+
+func newServiceCounters() *serviceCounters {
+	return &serviceCounters{since: time.Now().UTC()}
+}
+
+func (c *serviceCounters) record(statusCode int) {
+	c.requests.Add(1)
+	if statusCode >= 500 && statusCode <= 599 {
+		c.errors.Add(1)
+	}
+	if statusCode == StatusClientClosedRequest {
+		c.clientClosed.Add(1)
+	}
+}
+
+func (c *serviceCounters) stats() ServiceStats {
+	return ServiceStats{
+		Requests:     c.requests.Load(),
+		Errors:       c.errors.Load(),
+		ClientClosed: c.clientClosed.Load(),
+		RateLimited:  c.rateLimited.Load(),
+		BytesIn:      c.bytesIn.Load(),
+		BytesOut:     c.bytesOut.Load(),
+		Since:        c.since,
+	}
+}
+
+func (c *serviceCounters) restore(stats ServiceStats) {
+	c.requests.Store(stats.Requests)
+	c.errors.Store(stats.Errors)
+	c.clientClosed.Store(stats.ClientClosed)
+	c.rateLimited.Store(stats.RateLimited)
+	c.bytesIn.Store(stats.BytesIn)
+	c.bytesOut.Store(stats.BytesOut)
+	if !stats.Since.IsZero() {
+		c.since = stats.Since
+	}
+}
+
+// countRequestBytes counts the request body as it's read, and returns a
+// response writer that counts what's written to it, including on a hijacked
+// connection.
+func (c *serviceCounters) countRequestBytes(w http.ResponseWriter, r *http.Request) *statusResponseWriter {
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingReadCloser{ReadCloser: r.Body, read: &c.bytesIn}
+	}
+
+	sw := newStatusResponseWriter(w)
+	sw.counters = c
+	return sw
+}
+
+// statusResponseWriter records the status of the response written through it,
+// and counts the bytes written when it has counters.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	counters   *serviceCounters
+}
+
+func newStatusResponseWriter(w http.ResponseWriter) *statusResponseWriter {
+	return &statusResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+}
+
+func (r *statusResponseWriter) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusResponseWriter) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	if r.counters != nil {
+		r.counters.bytesOut.Add(int64(n))
+	}
+	return n, err
+}
+
+func (r *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil || r.counters == nil {
+		return conn, rw, err
+	}
+
+	return &countingConn{Conn: conn, read: &r.counters.bytesIn, written: &r.counters.bytesOut}, rw, nil
+}
+
+func (r *statusResponseWriter) Flush() {
+	flusher, ok := r.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// countingConn counts the bytes read from and written to a connection, in
+// whichever of its counters are set.
+type countingConn struct {
+	net.Conn
+	read    *atomic.Int64
+	written *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.read != nil {
+		c.read.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.written != nil {
+		c.written.Add(int64(n))
+	}
+	return n, err
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	read *atomic.Int64
+}
+
+func (r *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.read.Add(int64(n))
+	return n, err
+}
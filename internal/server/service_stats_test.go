@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceStats_CountsRequestsAndErrors(t *testing.T) {
+	counters := newServiceCounters()
+
+	counters.record(http.StatusOK)
+	counters.record(http.StatusNotFound)
+	counters.record(http.StatusBadGateway)
+	counters.record(StatusClientClosedRequest)
+
+	stats := counters.stats()
+	assert.Equal(t, int64(4), stats.Requests)
+	assert.Equal(t, int64(1), stats.Errors)
+	assert.Equal(t, int64(1), stats.ClientClosed)
+	assert.False(t, stats.Since.IsZero())
+}
+
+func TestServiceStats_KeptAcrossRestarts(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	router := NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.SetServiceTarget("default", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	sendGETRequest(router, "http://something.example.com")
+	sendGETRequest(router, "http://something.example.com")
+	before := router.ListActiveServices()["default"].Stats
+	assert.Equal(t, int64(2), before.Requests)
+
+	router.saveStateSnapshot()
+
+	router = NewRouter(NewFileStateStore(statePath))
+	require.NoError(t, router.RestoreLastSavedState(RestoreOptions{}))
+
+	sendGETRequest(router, "http://something.example.com")
+
+	after := router.ListActiveServices()["default"].Stats
+	assert.Equal(t, int64(3), after.Requests)
+	assert.Equal(t, int64(0), after.Errors)
+	assert.True(t, before.Since.Equal(after.Since))
+}
+
+func TestServiceStats_CountsBodyBytes(t *testing.T) {
+	service := testCreateServiceWithHandler(t, defaultEmptyHosts, defaultServiceOptions, defaultTargetOptions,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("goodbye"))
+		}),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("hello"))
+	w := httptest.NewRecorder()
+	service.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	stats := service.Stats()
+	assert.Equal(t, int64(5), stats.BytesIn)
+	assert.Equal(t, int64(7), stats.BytesOut)
+}
+
+func TestServiceStats_CountsWebSocketBytes(t *testing.T) {
+	service := testCreateServiceWithHandler(t, defaultEmptyHosts, defaultServiceOptions, defaultTargetOptions,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := websocket.Accept(w, r, &websocket.AcceptOptions{})
+			require.NoError(t, err)
+			defer c.CloseNow()
+
+			kind, body, err := c.Read(context.Background())
+			require.NoError(t, err)
+			c.Write(context.Background(), kind, body)
+		}),
+	)
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	c, _, err := websocket.Dial(context.Background(), strings.Replace(server.URL, "http:", "ws:", 1), nil)
+	require.NoError(t, err)
+	defer c.CloseNow()
+
+	message := strings.Repeat("x", 1000)
+	require.NoError(t, c.Write(context.Background(), websocket.MessageText, []byte(message)))
+	_, body, err := c.Read(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, message, string(body))
+
+	require.Eventually(t, func() bool {
+		stats := service.Stats()
+		return stats.BytesIn >= 1000 && stats.BytesOut >= 1000
+	}, time.Second, 10*time.Millisecond)
+}
@@ -2,7 +2,11 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -12,6 +16,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func TestService_ServeRequest(t *testing.T) {
@@ -27,7 +32,7 @@ func TestService_ServeRequest(t *testing.T) {
 func TestService_RedirectToHTTPSWhenTLSRequired(t *testing.T) {
 	service := testCreateService(t, []string{"example.com"}, ServiceOptions{TLSEnabled: true}, defaultTargetOptions)
 
-	require.True(t, service.options.TLSEnabled)
+	require.True(t, service.config().options.TLSEnabled)
 
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
 	w := httptest.NewRecorder()
@@ -52,7 +57,7 @@ func TestService_DontRedirectToHTTPSWhenTLSAndPlainHTTPAllowed(t *testing.T) {
 		}),
 	)
 
-	require.True(t, service.options.TLSEnabled)
+	require.True(t, service.config().options.TLSEnabled)
 
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
 	w := httptest.NewRecorder()
@@ -69,8 +74,30 @@ func TestService_DontRedirectToHTTPSWhenTLSAndPlainHTTPAllowed(t *testing.T) {
 	assert.Equal(t, "https", forwardedProto)
 }
 
+func TestService_DontRedirectToHTTPSForExceptions(t *testing.T) {
+	options := ServiceOptions{TLSEnabled: true, TLSRedirectExceptions: []string{"internal.example.com", "/healthz", "/.well-known/*"}}
+	service := testCreateService(t, []string{"example.com", "internal.example.com"}, options, defaultTargetOptions)
+
+	for url, expected := range map[string]int{
+		"http://example.com/":                         http.StatusMovedPermanently,
+		"http://example.com/healthz":                  http.StatusOK,
+		"http://example.com/healthz/more":             http.StatusMovedPermanently,
+		"http://example.com/.well-known/security.txt": http.StatusOK,
+		"http://internal.example.com/anything":        http.StatusOK,
+		"http://INTERNAL.example.com:80/anything":     http.StatusOK,
+		"http://other.internal.example.com/anything":  http.StatusMovedPermanently,
+		"https://example.com/":                        http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		w := httptest.NewRecorder()
+		service.ServeHTTP(w, req)
+
+		assert.Equal(t, expected, w.Result().StatusCode, url)
+	}
+}
+
 func TestService_UseStaticTLSCertificateWhenConfigured(t *testing.T) {
-	certPath, keyPath := prepareTestCertificateFiles(t)
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "example.com")
 
 	service := testCreateService(
 		t,
@@ -83,13 +110,220 @@ func TestService_UseStaticTLSCertificateWhenConfigured(t *testing.T) {
 		defaultTargetOptions,
 	)
 
-	require.IsType(t, &StaticCertManager{}, service.certManager)
+	require.IsType(t, &StaticCertManager{}, service.config().certManager)
+}
+
+func TestService_UseACMESettingsWhenConfigured(t *testing.T) {
+	options := ServiceOptions{
+		TLSEnabled:    true,
+		ACMEDirectory: "https://acme.internal.example.com/directory",
+		ACMEEmail:     "ops@example.com",
+		ACMECachePath: t.TempDir(),
+	}
+	service := testCreateService(t, []string{"example.com"}, options, defaultTargetOptions)
+
+	require.IsType(t, &autocert.Manager{}, service.config().certManager)
+	manager := service.config().certManager.(*autocert.Manager)
+	assert.Equal(t, "ops@example.com", manager.Email)
+	assert.Equal(t, "https://acme.internal.example.com/directory", manager.Client.DirectoryURL)
+}
+
+func TestServiceOptions_ScopedCachePath(t *testing.T) {
+	production := ServiceOptions{ACMECachePath: "/certs"}
+	staging := ServiceOptions{ACMECachePath: "/certs", ACMEDirectory: ACMEStagingDirectoryURL}
+	withEmail := ServiceOptions{ACMECachePath: "/certs", ACMEEmail: "ops@example.com"}
+
+	assert.NotEqual(t, production.ScopedCachePath(), staging.ScopedCachePath())
+	assert.NotEqual(t, production.ScopedCachePath(), withEmail.ScopedCachePath())
+	assert.Equal(t, "/certs/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", production.ScopedCachePath())
+}
+
+func TestService_RejectDisallowedHosts(t *testing.T) {
+	options := ServiceOptions{AllowedHosts: []string{"example.com", "*.example.com", "10.0.0.1", "example.com:8080"}}
+	service := testCreateService(t, defaultEmptyHosts, options, defaultTargetOptions)
+
+	for host, expected := range map[string]int{
+		"example.com":       http.StatusOK,
+		"EXAMPLE.com.":      http.StatusOK,
+		"app.example.com":   http.StatusOK,
+		"10.0.0.1":          http.StatusOK,
+		"example.com:8080":  http.StatusOK,
+		"evil.com":          http.StatusMisdirectedRequest,
+		"example.com.evil":  http.StatusMisdirectedRequest,
+		"192.168.1.1":       http.StatusMisdirectedRequest,
+		"[::1]":             http.StatusMisdirectedRequest,
+		"example.com:9000":  http.StatusMisdirectedRequest,
+		"app.example.com:1": http.StatusMisdirectedRequest,
+		"":                  http.StatusMisdirectedRequest,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		service.ServeHTTP(w, req)
+
+		assert.Equal(t, expected, w.Result().StatusCode, host)
+	}
+}
+
+func TestService_AllowMatchingPortForRequest(t *testing.T) {
+	options := ServiceOptions{AllowedHosts: []string{"example.com"}}
+	service := testCreateService(t, defaultEmptyHosts, options, defaultTargetOptions)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com:8443/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{Port: 8443}))
+	w := httptest.NewRecorder()
+	service.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestService_RejectDisallowedMethods(t *testing.T) {
+	options := ServiceOptions{AllowedMethods: []string{"GET", "POST"}}
+	service := testCreateService(t, defaultEmptyHosts, options, defaultTargetOptions)
+
+	for method, expected := range map[string]int{
+		http.MethodGet:     http.StatusOK,
+		http.MethodHead:    http.StatusOK,
+		http.MethodPost:    http.StatusOK,
+		http.MethodPut:     http.StatusMethodNotAllowed,
+		http.MethodOptions: http.StatusMethodNotAllowed,
+		"PROPFIND":         http.StatusMethodNotAllowed,
+	} {
+		req := httptest.NewRequest(method, "http://example.com/", nil)
+		w := httptest.NewRecorder()
+		service.ServeHTTP(w, req)
+
+		assert.Equal(t, expected, w.Result().StatusCode, method)
+		if expected == http.StatusMethodNotAllowed {
+			assert.Equal(t, "GET, POST, HEAD", w.Result().Header.Get("Allow"), method)
+		}
+	}
+}
+
+func TestService_AnswerOptionsRequests(t *testing.T) {
+	options := ServiceOptions{AllowedMethods: []string{"GET"}, AnswerOptions: true}
+	service := testCreateServiceWithHandler(t, defaultEmptyHosts, options, defaultTargetOptions,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Access-Control-Allow-Origin", "https://other.example.com")
+		}),
+	)
+
+	req := httptest.NewRequest(http.MethodOptions, "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	service.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	assert.Equal(t, "GET, HEAD, OPTIONS", w.Result().Header.Get("Allow"))
+
+	req = httptest.NewRequest(http.MethodOptions, "http://example.com/", nil)
+	req.Header.Set("Origin", "https://other.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w = httptest.NewRecorder()
+	service.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "https://other.example.com", w.Result().Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestService_MethodOverride(t *testing.T) {
+	var method, override string
+	options := ServiceOptions{MethodOverride: true, AllowedMethods: []string{"GET", "POST", "DELETE"}}
+	service := testCreateServiceWithHandler(t, defaultEmptyHosts, options, defaultTargetOptions,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method = r.Method
+			override = r.Header.Get("X-HTTP-Method-Override")
+		}),
+	)
+
+	out := &strings.Builder{}
+	handler := WithLoggingMiddleware(slog.New(slog.NewJSONHandler(out, nil)), 80, 443, service)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	req.Header.Set("X-HTTP-Method-Override", "delete")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, http.MethodDelete, method)
+	assert.Empty(t, override)
+
+	logline := struct {
+		Method         string `json:"method"`
+		MethodOverride string `json:"method_override"`
+	}{}
+	require.NoError(t, json.NewDecoder(strings.NewReader(out.String())).Decode(&logline))
+	assert.Equal(t, http.MethodPost, logline.Method)
+	assert.Equal(t, http.MethodDelete, logline.MethodOverride)
+
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	req.Header.Set("X-HTTP-Method-Override", "PUT")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Result().StatusCode, "allowed methods apply to the override")
+
+	for _, value := range []string{"GET", "TRACE"} {
+		req = httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+		req.Header.Set("X-HTTP-Method-Override", value)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, http.MethodPost, method, value)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-HTTP-Method-Override", "DELETE")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, http.MethodGet, method, "only POST requests are overridden")
+}
+
+func TestService_MethodOverrideNotAppliedByDefault(t *testing.T) {
+	var method string
+	service := testCreateServiceWithHandler(t, defaultEmptyHosts, defaultServiceOptions, defaultTargetOptions,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method = r.Method
+		}),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	req.Header.Set("X-HTTP-Method-Override", "DELETE")
+	service.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, http.MethodPost, method)
+}
+
+func TestService_DisableKeepAlive(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		service := testCreateService(t, defaultEmptyHosts, ServiceOptions{DisableKeepAlive: disabled}, defaultTargetOptions)
+		server := httptest.NewServer(service)
+		t.Cleanup(server.Close)
+
+		resp, err := http.Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, disabled, resp.Close)
+	}
+
+	service := testCreateService(t, defaultEmptyHosts, ServiceOptions{DisableKeepAlive: true}, defaultTargetOptions)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.ProtoMajor, req.ProtoMinor = 2, 0
+	w := httptest.NewRecorder()
+	service.ServeHTTP(w, req)
+
+	assert.Empty(t, w.Result().Header.Get("Connection"))
 }
 
 func TestService_RejectTLSRequestsWhenNotConfigured(t *testing.T) {
 	service := testCreateService(t, defaultEmptyHosts, defaultServiceOptions, defaultTargetOptions)
 
-	require.False(t, service.options.TLSEnabled)
+	require.False(t, service.config().options.TLSEnabled)
 
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
 	w := httptest.NewRecorder()
@@ -130,6 +364,89 @@ func TestService_ReturnSuccessfulHealthCheckWhilePausedOrStopped(t *testing.T) {
 	assert.Equal(t, http.StatusOK, checkRequest("/other"))
 }
 
+func TestService_FailHealthCheckWhilePausedWhenConfigured(t *testing.T) {
+	options := ServiceOptions{FailHealthChecksWhilePaused: true}
+	service := testCreateService(t, defaultEmptyHosts, options, defaultTargetOptions)
+
+	checkRequest := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		service.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	service.Pause(time.Second, time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, checkRequest("/up"))
+
+	service.Stop(time.Second, DefaultStopMessage)
+	assert.Equal(t, http.StatusServiceUnavailable, checkRequest("/up"))
+
+	service.Resume()
+	assert.Equal(t, http.StatusOK, checkRequest("/up"))
+	assert.Equal(t, http.StatusOK, checkRequest("/other"))
+}
+
+func TestService_ServeRequestsWhileReplacedTargetDrains(t *testing.T) {
+	uploading := make(chan struct{})
+	service := testCreateServiceWithHandler(t, defaultEmptyHosts, defaultServiceOptions, defaultTargetOptions,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(uploading)
+			io.ReadAll(r.Body)
+		}),
+	)
+
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", bodyReader)
+	req.ContentLength = -1
+	go service.ServeHTTP(httptest.NewRecorder(), req)
+	<-uploading
+
+	replacementOptions := defaultTargetOptions
+	replacementOptions.UploadDrainTimeout = time.Second * 5
+	replacement := testTargetWithOptions(t, replacementOptions, func(w http.ResponseWriter, r *http.Request) {})
+
+	go service.SetTarget(TargetSlotActive, replacement, time.Millisecond*10)
+	require.Eventually(t, func() bool { return service.ActiveTarget() == replacement }, time.Second, time.Millisecond)
+
+	served := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		service.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		served <- w.Result().StatusCode
+	}()
+
+	select {
+	case status := <-served:
+		assert.Equal(t, http.StatusOK, status)
+	case <-time.After(time.Second):
+		t.Fatal("request was held up by the drain of the replaced target")
+	}
+}
+
+func TestService_UpdateOptionsWhileServingRequests(t *testing.T) {
+	service := testCreateService(t, defaultEmptyHosts, defaultServiceOptions, defaultTargetOptions)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 50 {
+			w := httptest.NewRecorder()
+			service.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		}
+	}()
+
+	for i := range 50 {
+		options := defaultServiceOptions
+		options.RateLimit = float64(1000 + i)
+		options.HostGroupLimit = 1 + i%2
+		require.NoError(t, service.UpdateOptions(defaultEmptyHosts, options))
+	}
+	<-done
+}
+
 func TestService_MarshallingState(t *testing.T) {
 	targetOptions := TargetOptions{
 		HealthCheckConfig:   HealthCheckConfig{Path: "/health", Interval: 1, Timeout: 2},
@@ -140,7 +457,7 @@ func TestService_MarshallingState(t *testing.T) {
 	service := testCreateService(t, defaultEmptyHosts, defaultServiceOptions, targetOptions)
 	require.NoError(t, service.Stop(time.Second, DefaultStopMessage))
 	service.SetTarget(TargetSlotRollout, service.active, time.Millisecond)
-	require.NoError(t, service.SetRolloutSplit(20, []string{"first"}))
+	require.NoError(t, service.SetRolloutSplit(20, []string{"first"}, RolloutOptions{}))
 
 	var buf bytes.Buffer
 	err := json.NewEncoder(&buf).Encode(service)
@@ -161,6 +478,55 @@ func TestService_MarshallingState(t *testing.T) {
 	assert.Equal(t, []string{"first"}, service2.rolloutController.Allowlist)
 }
 
+func TestService_WithoutTarget(t *testing.T) {
+	service, err := NewService("service1", defaultEmptyHosts, defaultServiceOptions)
+	require.NoError(t, err)
+
+	_, err = json.Marshal(service)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	_, _, err = service.ClaimTarget(req)
+	assert.ErrorIs(t, err, ErrorServiceHasNoTarget)
+}
+
+func TestService_StripResponseHeaders(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Puma")
+		w.Header().Set("X-Powered-By", "Rails")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("X-Kept", "yes")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "value")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Write([]byte("hello"))
+	})
+
+	for _, buffered := range []bool{false, true} {
+		targetOptions := TargetOptions{
+			HealthCheckConfig:    defaultHealthCheckConfig,
+			ResponseTimeout:      DefaultTargetTimeout,
+			BufferResponses:      buffered,
+			MaxMemoryBufferSize:  DefaultMaxMemoryBufferSize,
+			StripServerHeaders:   true,
+			StripResponseHeaders: []string{"x-internal"},
+		}
+		service := testCreateServiceWithHandler(t, defaultEmptyHosts, defaultServiceOptions, targetOptions, handler)
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		w := httptest.NewRecorder()
+		service.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, "hello", w.Body.String())
+		assert.Equal(t, "yes", w.Result().Header.Get("X-Kept"))
+
+		for _, header := range []string{"Server", "X-Powered-By", "X-Internal", "Connection", "X-Hop", "Keep-Alive"} {
+			assert.Empty(t, w.Result().Header.Get(header), "%s (buffered: %v)", header, buffered)
+		}
+	}
+}
+
 func testCreateService(t *testing.T, hosts []string, options ServiceOptions, targetOptions TargetOptions) *Service {
 	return testCreateServiceWithHandler(t, hosts, options, targetOptions,
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
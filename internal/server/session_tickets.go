@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sessionTicketKeyFileReloadInterval = time.Minute
+	sessionTicketPreviousKeys          = 2
+)
+
+var (
+	ErrorSessionTicketKeyFileEmpty    = errors.New("session ticket key file contains no keys")
+	ErrorSessionTicketKeyInvalid      = errors.New("session ticket keys must be 32 bytes, hex encoded")
+	ErrorSessionTicketOptionsConflict = errors.New("session ticket rotation can't be used with a session ticket key file")
+	ErrorSessionTicketRotationInvalid = errors.New("session ticket rotation must not be negative")
+)
+
+// SessionTicketKeyManager controls the keys used to encrypt TLS session
+// tickets, which allow returning clients to skip most of the handshake.
+//
+// Keys can be generated locally and replaced at a fixed interval, or read from
+// a file. The file is re-read regularly, so that several proxies behind the
+// same address can share keys that are rotated externally, and resume each
+// other's sessions. The first key in the file is used to issue new tickets;
+// the others are only used to accept existing ones.
+//
+// Servers take a copy of their TLS config when they start, so keys set on the
+// config afterwards would never be used. Instead, each handshake is given a
+// copy of the config that holds the current keys.
+type SessionTicketKeyManager struct {
+	tlsConfig *tls.Config
+	keyed     atomic.Pointer[tls.Config]
+	path      string
+	rotation  time.Duration
+	keys      [][32]byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewSessionTicketKeyManager(tlsConfig *tls.Config, path string, rotation time.Duration) (*SessionTicketKeyManager, error) {
+	if rotation < 0 {
+		return nil, ErrorSessionTicketRotationInvalid
+	}
+	if path != "" && rotation != 0 {
+		return nil, ErrorSessionTicketOptionsConflict
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &SessionTicketKeyManager{
+		tlsConfig: tlsConfig,
+		path:      path,
+		rotation:  rotation,
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	if path != "" {
+		err := m.reload()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	} else {
+		err := m.rotate()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	tlsConfig.GetConfigForClient = m.getConfigForClient
+	return m, nil
+}
+
+func (m *SessionTicketKeyManager) Start() {
+	go m.run()
+}
+
+func (m *SessionTicketKeyManager) Close() {
+	m.cancel()
+}
+
+// Private
+
+func (m *SessionTicketKeyManager) run() {
+	interval := m.rotation
+	if m.path != "" {
+		interval = sessionTicketKeyFileReloadInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			var err error
+			if m.path != "" {
+				err = m.reload()
+			} else {
+				err = m.rotate()
+			}
+			if err != nil {
+				slog.Error("Unable to update session ticket keys", "error", err)
+			}
+		}
+	}
+}
+
+func (m *SessionTicketKeyManager) rotate() error {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	if err != nil {
+		return err
+	}
+
+	keys := append([][32]byte{key}, m.keys...)
+	if len(keys) > sessionTicketPreviousKeys+1 {
+		keys = keys[:sessionTicketPreviousKeys+1]
+	}
+
+	m.setKeys(keys)
+	return nil
+}
+
+func (m *SessionTicketKeyManager) reload() error {
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseSessionTicketKeys(data)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Equal(keys, m.keys) {
+		slog.Info("Loaded session ticket keys", "path", m.path, "keys", len(keys))
+		m.setKeys(keys)
+	}
+	return nil
+}
+
+func (m *SessionTicketKeyManager) setKeys(keys [][32]byte) {
+	keyed := m.tlsConfig.Clone()
+	keyed.GetConfigForClient = nil
+	keyed.SetSessionTicketKeys(keys)
+
+	m.keys = keys
+	m.keyed.Store(keyed)
+}
+
+func (m *SessionTicketKeyManager) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return m.keyed.Load(), nil
+}
+
+func parseSessionTicketKeys(data []byte) ([][32]byte, error) {
+	keys := [][32]byte{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(line)
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("%w (line %d)", ErrorSessionTicketKeyInvalid, lineNumber)
+		}
+
+		var key [32]byte
+		copy(key[:], decoded)
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrorSessionTicketKeyFileEmpty
+	}
+
+	return keys, nil
+}
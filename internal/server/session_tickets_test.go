@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTicketKeyManager_SharedKeysResumeAcrossServers(t *testing.T) {
+	path := testSessionTicketKeyFile(t, strings.Repeat("ab", 32))
+
+	_, first := testSessionTicketServer(t, path, 0)
+	_, second := testSessionTicketServer(t, path, 0)
+
+	resumed := testSessionResumingClient()
+	assert.False(t, resumed(t, first))
+	assert.True(t, resumed(t, second))
+}
+
+func TestSessionTicketKeyManager_RotationReachesRunningServer(t *testing.T) {
+	manager, server := testSessionTicketServer(t, "", time.Hour)
+	resumed := testSessionResumingClient()
+
+	assert.False(t, resumed(t, server))
+	assert.True(t, resumed(t, server))
+
+	// Tickets issued with a previous key are still accepted.
+	require.NoError(t, manager.rotate())
+	assert.True(t, resumed(t, server))
+
+	// Once a ticket's key has been rotated out, it can't be used.
+	for range sessionTicketPreviousKeys + 1 {
+		require.NoError(t, manager.rotate())
+	}
+	assert.False(t, resumed(t, server))
+}
+
+func TestSessionTicketKeyManager_ReloadsKeyFile(t *testing.T) {
+	path := testSessionTicketKeyFile(t, "# current\n"+strings.Repeat("01", 32)+"\n\n"+strings.Repeat("02", 32))
+
+	manager, err := NewSessionTicketKeyManager(&tls.Config{}, path, 0)
+	require.NoError(t, err)
+	require.Len(t, manager.keys, 2)
+	assert.Equal(t, byte(0x01), manager.keys[0][0])
+
+	require.NoError(t, os.WriteFile(path, []byte(strings.Repeat("03", 32)), 0o600))
+	require.NoError(t, manager.reload())
+	require.Len(t, manager.keys, 1)
+	assert.Equal(t, byte(0x03), manager.keys[0][0])
+
+	require.NoError(t, os.WriteFile(path, []byte("not a key"), 0o600))
+	assert.ErrorIs(t, manager.reload(), ErrorSessionTicketKeyInvalid)
+	assert.Equal(t, byte(0x03), manager.keys[0][0])
+}
+
+func TestSessionTicketKeyManager_RotationKeepsPreviousKeys(t *testing.T) {
+	manager, err := NewSessionTicketKeyManager(&tls.Config{}, "", time.Hour)
+	require.NoError(t, err)
+
+	first := manager.keys[0]
+	for range 5 {
+		require.NoError(t, manager.rotate())
+	}
+
+	assert.Len(t, manager.keys, sessionTicketPreviousKeys+1)
+	assert.NotContains(t, manager.keys, first)
+}
+
+func TestSessionTicketKeyManager_InvalidOptions(t *testing.T) {
+	_, err := NewSessionTicketKeyManager(&tls.Config{}, testSessionTicketKeyFile(t, "# nothing yet"), 0)
+	assert.ErrorIs(t, err, ErrorSessionTicketKeyFileEmpty)
+
+	_, err = NewSessionTicketKeyManager(&tls.Config{}, testSessionTicketKeyFile(t, strings.Repeat("ab", 32)), time.Hour)
+	assert.ErrorIs(t, err, ErrorSessionTicketOptionsConflict)
+
+	_, err = NewSessionTicketKeyManager(&tls.Config{}, "", -time.Hour)
+	assert.ErrorIs(t, err, ErrorSessionTicketRotationInvalid)
+}
+
+// Private
+
+func testSessionTicketServer(t *testing.T, path string, rotation time.Duration) (*SessionTicketKeyManager, *httptest.Server) {
+	t.Helper()
+
+	certPath, keyPath := prepareTestCertificateFilesForHosts(t, "example.com")
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	require.NoError(t, err)
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	manager, err := NewSessionTicketKeyManager(tlsConfig, path, rotation)
+	require.NoError(t, err)
+	t.Cleanup(manager.Close)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return manager, server
+}
+
+// testSessionResumingClient returns a function that makes a new connection
+// to a server, reporting whether it resumed the client's previous session.
+func testSessionResumingClient() func(*testing.T, *httptest.Server) bool {
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "example.com",
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+	}}
+
+	return func(t *testing.T, server *httptest.Server) bool {
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.TLS.DidResume
+	}
+}
+
+func testSessionTicketKeyFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "ticket.keys")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// standbyFailoverThreshold is how many health checks in a row must fail
+// before traffic moves to the standby target, and how many must then pass
+// before it moves back, so that a single slow check doesn't cause flapping.
+const standbyFailoverThreshold = 3
+
+// standbyFailover keeps a standby target warm for a service, health checking
+// it alongside the active target, and sends the service's traffic to it
+// while the active target is failing its health checks.
+type standbyFailover struct {
+	service string
+	active  *Target
+	standby *Target
+
+	activeCheck  *HealthCheck
+	standbyCheck *HealthCheck
+
+	lock           sync.Mutex
+	activeFailures int
+	activePasses   int
+	standbyHealthy bool
+	failedOver     bool
+}
+
+func newStandbyFailover(service string, active *Target, address string, healthCheck *HealthCheckConfig) (*standbyFailover, error) {
+	options := active.options
+	if healthCheck != nil {
+		options.HealthCheckConfig = *healthCheck
+	}
+
+	standby, err := NewTarget(address, options)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &standbyFailover{
+		service: service,
+		active:  active,
+		standby: standby,
+	}
+
+	f.activeCheck = f.healthCheck(active, f.activeHealthCheckCompleted)
+	f.standbyCheck = f.healthCheck(standby, f.standbyHealthCheckCompleted)
+
+	slog.Info("Watching target with standby", "service", service, "target", active.Target(), "standby", address)
+	return f, nil
+}
+
+// targetFor returns the target that should serve requests meant for the
+// active target.
+func (f *standbyFailover) targetFor(target *Target) *Target {
+	if target != f.active {
+		return target
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.failedOver {
+		return f.standby
+	}
+	return target
+}
+
+func (f *standbyFailover) isFailedOver() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.failedOver
+}
+
+func (f *standbyFailover) close(drainTimeout time.Duration) {
+	f.activeCheck.Close()
+	f.standbyCheck.Close()
+	f.standby.Drain(drainTimeout)
+}
+
+// Private
+
+func (f *standbyFailover) healthCheck(target *Target, completed func(bool)) *HealthCheck {
+	return NewHealthCheck(healthCheckConsumerFunc(completed),
+		&http.Client{Transport: target.healthChecks},
+		target.healthCheckURL(),
+		target.options.HealthCheckConfig.Interval,
+		target.options.HealthCheckConfig.Timeout,
+		target.options.HealthCheckConfig.LogChecks,
+	)
+}
+
+func (f *standbyFailover) activeHealthCheckCompleted(success bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if success {
+		f.activeFailures = 0
+		f.activePasses++
+	} else {
+		f.activePasses = 0
+		f.activeFailures++
+	}
+
+	switch {
+	case !f.failedOver && f.activeFailures >= standbyFailoverThreshold:
+		if !f.standbyHealthy {
+			slog.Error("Target is failing health checks, but standby is unhealthy too", "service", f.service, "target", f.active.Target(), "standby", f.standby.Target())
+			return
+		}
+		f.failedOver = true
+		slog.Warn("Failed over to standby target", "event", "failover", "service", f.service, "target", f.active.Target(), "standby", f.standby.Target())
+
+	case f.failedOver && f.activePasses >= standbyFailoverThreshold:
+		f.failedOver = false
+		slog.Info("Failed back to active target", "event", "failback", "service", f.service, "target", f.active.Target(), "standby", f.standby.Target())
+	}
+}
+
+func (f *standbyFailover) standbyHealthCheckCompleted(success bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if success != f.standbyHealthy {
+		slog.Info("Standby target health updated", "service", f.service, "standby", f.standby.Target(), "success", success)
+	}
+	f.standbyHealthy = success
+}
+
+type healthCheckConsumerFunc func(success bool)
+
+func (fn healthCheckConsumerFunc) HealthCheckCompleted(success bool) {
+	fn(success)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStandby_FailsOverAndBack(t *testing.T) {
+	var activeHealthy atomic.Bool
+	activeHealthy.Store(true)
+
+	_, active := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == DefaultHealthCheckPath && !activeHealthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("active"))
+	})
+	_, standby := testBackend(t, "standby", http.StatusOK)
+
+	targetOptions := defaultTargetOptions
+	targetOptions.HealthCheckConfig.Interval = 10 * time.Millisecond
+
+	router := testRouter(t)
+	options := ServiceOptions{StandbyTarget: standby}
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, active, options, targetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	t.Cleanup(func() { router.RemoveService("service1") })
+
+	_, body := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, "active", body)
+
+	activeHealthy.Store(false)
+	require.Eventually(t, func() bool {
+		_, body := sendGETRequest(router, "http://example.com/")
+		return body == "standby"
+	}, time.Second, 10*time.Millisecond)
+
+	description := router.ListActiveServices()["service1"]
+	assert.Equal(t, standby, description.Standby)
+	assert.True(t, description.FailedOver)
+
+	activeHealthy.Store(true)
+	require.Eventually(t, func() bool {
+		_, body := sendGETRequest(router, "http://example.com/")
+		return body == "active"
+	}, time.Second, 10*time.Millisecond)
+
+	assert.False(t, router.ListActiveServices()["service1"].FailedOver)
+}
+
+func TestStandby_StaysOnActiveWhenStandbyIsUnhealthy(t *testing.T) {
+	_, active := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == DefaultHealthCheckPath {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("active"))
+	})
+	_, standby := testBackend(t, "standby", http.StatusServiceUnavailable)
+
+	activeTarget, err := NewTarget(active, defaultTargetOptions)
+	require.NoError(t, err)
+
+	failover, err := newStandbyFailover("service1", activeTarget, standby, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { failover.close(DefaultDrainTimeout) })
+
+	for range standbyFailoverThreshold {
+		failover.standbyHealthCheckCompleted(false)
+		failover.activeHealthCheckCompleted(false)
+	}
+	assert.False(t, failover.isFailedOver())
+	assert.Equal(t, activeTarget, failover.targetFor(activeTarget))
+
+	failover.standbyHealthCheckCompleted(true)
+	failover.activeHealthCheckCompleted(false)
+	assert.True(t, failover.isFailedOver())
+	assert.Equal(t, failover.standby, failover.targetFor(activeTarget))
+}
+
+func TestStandby_UsesItsOwnHealthCheckConfig(t *testing.T) {
+	_, active := testBackend(t, "active", http.StatusOK)
+	_, standby := testBackend(t, "standby", http.StatusOK)
+
+	activeOptions := defaultTargetOptions
+	activeOptions.HealthCheckConfig.Path = "/active-health"
+	activeOptions.HealthCheckConfig.Port = 9999
+
+	activeTarget, err := NewTarget(active, activeOptions)
+	require.NoError(t, err)
+
+	standbyHealthCheck := defaultTargetOptions.HealthCheckConfig
+	failover, err := newStandbyFailover("service1", activeTarget, standby, &standbyHealthCheck)
+	require.NoError(t, err)
+	t.Cleanup(func() { failover.close(DefaultDrainTimeout) })
+
+	assert.Equal(t, "http://"+standby+DefaultHealthCheckPath, failover.standby.healthCheckURL().String())
+	assert.Equal(t, "9999", failover.active.healthCheckURL().Port())
+}
+
+func TestStandby_RestoredWithService(t *testing.T) {
+	_, standby := testBackend(t, "standby", http.StatusOK)
+
+	service := testCreateService(t, defaultEmptyHosts, ServiceOptions{StandbyTarget: standby}, defaultTargetOptions)
+
+	data, err := json.Marshal(service)
+	require.NoError(t, err)
+
+	var restored Service
+	require.NoError(t, json.Unmarshal(data, &restored))
+	t.Cleanup(func() { restored.SetTarget(TargetSlotActive, nil, DefaultDrainTimeout) })
+
+	address, failedOver := restored.StandbyStatus()
+	assert.Equal(t, standby, address)
+	assert.False(t, failedOver)
+}
+
+func TestStandby_InvalidAddress(t *testing.T) {
+	_, err := NewService("service1", defaultEmptyHosts, ServiceOptions{StandbyTarget: "not a host"})
+	assert.Error(t, err)
+}
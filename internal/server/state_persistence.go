@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	stateSaveRetryMinDelay = time.Second
+	stateSaveRetryMaxDelay = time.Minute
+)
+
+var (
+	ErrorStateNotPersisted  = errors.New("unable to save state, so deploys are refused until it can be saved")
+	ErrorDeployNotPersisted = errors.New("deployed, but unable to save state, so the deploy will be lost if the proxy restarts")
+)
+
+// statePersistence tracks whether the state is being saved. When a save
+// fails, it's retried in the background, with backoff, until one succeeds.
+// Until then, deploys are refused, since their changes would be lost when the
+// proxy restarts.
+type statePersistence struct {
+	lock     sync.Mutex
+	err      error
+	failedAt time.Time
+	failed   chan struct{}
+}
+
+func newStatePersistence() statePersistence {
+	return statePersistence{failed: make(chan struct{}, 1)}
+}
+
+// StatePersistenceError reports why the state couldn't be saved, or nil if
+// the most recent save succeeded.
+func (r *Router) StatePersistenceError() error {
+	r.persistence.lock.Lock()
+	defer r.persistence.lock.Unlock()
+
+	if r.persistence.err != nil {
+		return fmt.Errorf("%w: %w", ErrorStateNotPersisted, r.persistence.err)
+	}
+	return nil
+}
+
+// Private
+
+func (r *Router) recordStateSaved(err error) {
+	r.persistence.lock.Lock()
+	defer r.persistence.lock.Unlock()
+
+	if err == nil {
+		if r.persistence.err != nil {
+			slog.Info("Saved state after earlier failures", "store", r.stateStore, "failing_for", time.Since(r.persistence.failedAt).Round(time.Second))
+		}
+		r.persistence.err = nil
+		return
+	}
+
+	if r.persistence.err == nil {
+		slog.Warn("Refusing deploys until state can be saved", "store", r.stateStore)
+		r.persistence.failedAt = time.Now()
+	}
+	r.persistence.err = err
+
+	select {
+	case r.persistence.failed <- struct{}{}:
+	default:
+	}
+}
+
+// retryStateSaves saves the state again, with backoff, whenever a save
+// fails, until one succeeds. It runs until the context is cancelled.
+func (r *Router) retryStateSaves(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.persistence.failed:
+		}
+
+		delay := stateSaveRetryMinDelay
+		for r.StatePersistenceError() != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			r.saveStateSnapshot()
+			delay = min(delay*2, stateSaveRetryMaxDelay)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter_RefusesDeploysWhileStateCannotBeSaved(t *testing.T) {
+	store := &failingStateStore{}
+	router := NewRouter(store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go router.retryStateSaves(ctx)
+
+	_, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	assert.NoError(t, router.StatePersistenceError())
+
+	store.failing.Store(true)
+	require.NoError(t, router.StopRollout("service1"))
+
+	err := router.SetServiceTarget("service1", defaultEmptyHosts, second, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout)
+	assert.ErrorIs(t, err, ErrorStateNotPersisted)
+	assert.ErrorContains(t, err, "read-only file system")
+
+	statusCode, body := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body, "existing services carry on serving")
+
+	store.failing.Store(false)
+	require.Eventually(t, func() bool {
+		return router.StatePersistenceError() == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, second, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	statusCode, body = sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "second", body)
+}
+
+func TestRouter_ReportsDeployWhoseStateCannotBeSaved(t *testing.T) {
+	store := &failingStateStore{}
+	router := NewRouter(store)
+
+	_, first := testBackend(t, "first", http.StatusOK)
+	_, second := testBackend(t, "second", http.StatusOK)
+
+	store.failing.Store(true)
+	err := router.SetServiceTarget("service1", defaultEmptyHosts, first, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout)
+	assert.ErrorIs(t, err, ErrorDeployNotPersisted)
+
+	statusCode, body := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body, "the deploy still takes effect")
+
+	store.failing.Store(false)
+	require.NoError(t, router.saveStateSnapshot())
+
+	store.failing.Store(true)
+	err = router.SetRolloutTarget("service1", second, DefaultDeployTimeout, DefaultDrainTimeout)
+	assert.ErrorIs(t, err, ErrorDeployNotPersisted)
+}
+
+func TestRouter_StateSaveRetriesStopWithContext(t *testing.T) {
+	store := &failingStateStore{}
+	store.failing.Store(true)
+	router := NewRouter(store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		router.retryStateSaves(ctx)
+		close(done)
+	}()
+
+	router.saveStateSnapshot()
+	router.saveStateSnapshot()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("retries should stop when the context is cancelled")
+	}
+}
+
+func TestCheckCertificateCache(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.NoError(t, checkCertificateCache(dir+"/not-created-yet"))
+	assert.NoError(t, checkCertificateCache(dir))
+}
+
+type failingStateStore struct {
+	failing atomic.Bool
+}
+
+func (s *failingStateStore) Load() ([]byte, error) {
+	return []byte(`[]`), nil
+}
+
+func (s *failingStateStore) Save(data []byte) error {
+	if s.failing.Load() {
+		return errors.New("read-only file system")
+	}
+	return nil
+}
+
+func (s *failingStateStore) String() string {
+	return "failing"
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	s3StoreTimeout   = 10 * time.Second
+	s3DefaultRegion  = "us-east-1"
+	s3SigningService = "s3"
+
+	sqliteBusyTimeout = 5 * time.Second
+)
+
+var (
+	ErrorUnsupportedStateStore = errors.New("unsupported state store (must be a file path, or an sqlite:// or s3:// URL)")
+	ErrorInvalidStateStore     = errors.New("state store URL must be in the form s3://<bucket>/<key> or sqlite://<path>")
+	ErrorStateStoreFailed      = errors.New("state store request failed")
+)
+
+// StateStore persists the router's state, so that it can be restored when
+// the proxy restarts. Load returns an error matching os.ErrNotExist when
+// nothing has been saved yet.
+type StateStore interface {
+	Load() ([]byte, error)
+	Save(data []byte) error
+	String() string
+}
+
+// NewStateStore returns the store for a location, which is either a path on
+// the local disk, an sqlite:// URL or an s3:// URL. The file at defaultPath is
+// used when the location is empty.
+func NewStateStore(location string, defaultPath string) (StateStore, error) {
+	switch {
+	case location == "":
+		return NewFileStateStore(defaultPath), nil
+	case strings.HasPrefix(location, "s3://"):
+		return NewS3StateStore(location)
+	case strings.HasPrefix(location, "sqlite://"):
+		return NewSQLiteStateStore(location)
+	case strings.Contains(location, "://"):
+		return nil, ErrorUnsupportedStateStore
+	default:
+		return NewFileStateStore(location), nil
+	}
+}
+
+// FileStateStore keeps the state in a JSON file on the local disk.
+type FileStateStore struct {
+	path string
+}
+
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+func (s *FileStateStore) Load() ([]byte, error) {
+	return os.ReadFile(s.path)
+}
+
+// Save replaces the file in a single step, by writing the state to a new file
+// alongside it and renaming that over it. A crash or a full disk part way
+// through leaves the previous state in place, rather than a truncated file
+// that can't be restored.
+func (s *FileStateStore) Save(data []byte) error {
+	dir, name := filepath.Split(s.path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(f.Name(), s.path)
+	if err != nil {
+		return err
+	}
+
+	// Make the rename itself durable. Not every filesystem allows syncing a
+	// directory, and the state is already saved, so failing here isn't an
+	// error.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+func (s *FileStateStore) String() string {
+	return s.path
+}
+
+// S3StateStore keeps the state as an object in an S3-compatible store, so it
+// survives the loss of the host. It is configured with a URL of the form
+// s3://<bucket>/<key>, which may include `region` and `endpoint` query
+// parameters; the latter allows the use of stores other than AWS. Credentials
+// are read from the standard AWS environment variables.
+type S3StateStore struct {
+	endpoint    *url.URL
+	bucket      string
+	key         string
+	region      string
+	credentials awsCredentials
+	client      *http.Client
+}
+
+func NewS3StateStore(location string) (*S3StateStore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, ErrorInvalidStateStore
+	}
+
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, ErrorInvalidStateStore
+	}
+
+	region := u.Query().Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Host == "" {
+		return nil, ErrorInvalidStateStore
+	}
+
+	return &S3StateStore{
+		endpoint:    endpointURL,
+		bucket:      u.Host,
+		key:         key,
+		region:      region,
+		credentials: awsCredentialsFromEnvironment(),
+		client:      &http.Client{Timeout: s3StoreTimeout},
+	}, nil
+}
+
+func (s *S3StateStore) Load() ([]byte, error) {
+	resp, err := s.request(http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w (%d)", ErrorStateStoreFailed, resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3StateStore) Save(data []byte) error {
+	resp, err := s.request(http.MethodPut, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w (%d)", ErrorStateStoreFailed, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *S3StateStore) String() string {
+	return "s3://" + s.bucket + "/" + s.key
+}
+
+func (s *S3StateStore) request(method string, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + s.key
+
+	req, err := http.NewRequestWithContext(context.Background(), method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	s.credentials.sign(req, body, s.region, s3SigningService, time.Now().UTC())
+
+	return s.client.Do(req)
+}
+
+// SQLiteStateStore keeps the state in an SQLite database, for hosts that
+// already back up or replicate their databases. It is configured with a URL
+// of the form sqlite://<path>, and the database is created if it doesn't
+// exist yet. The state is kept as a single row, which each save replaces
+// with an upsert.
+type SQLiteStateStore struct {
+	path string
+	db   *sql.DB
+}
+
+func NewSQLiteStateStore(location string) (*SQLiteStateStore, error) {
+	path := strings.TrimPrefix(location, "sqlite://")
+	if path == "" {
+		return nil, ErrorInvalidStateStore
+	}
+
+	dsn := (&url.URL{
+		Scheme:   "file",
+		Opaque:   path,
+		RawQuery: fmt.Sprintf("_pragma=busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()),
+	}).String()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	return &SQLiteStateStore{path: path, db: db}, nil
+}
+
+func (s *SQLiteStateStore) Load() ([]byte, error) {
+	err := s.createTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	err = s.db.QueryRow(`SELECT data FROM state WHERE id = 1`).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, os.ErrNotExist
+	}
+	return data, err
+}
+
+func (s *SQLiteStateStore) Save(data []byte) error {
+	err := s.createTable()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO state (id, data, saved_at) VALUES (1, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data, saved_at = excluded.saved_at`,
+		data, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (s *SQLiteStateStore) String() string {
+	return "sqlite://" + s.path
+}
+
+// Private
+
+func (s *SQLiteStateStore) createTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS state (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		data BLOB NOT NULL,
+		saved_at TEXT NOT NULL
+	)`)
+	return err
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateStore_SelectedFromLocation(t *testing.T) {
+	store, err := NewStateStore("", "/tmp/default.state")
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/default.state", store.String())
+
+	store, err = NewStateStore("/var/lib/other.state", "/tmp/default.state")
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/other.state", store.String())
+
+	store, err = NewStateStore("s3://bucket/path/to/state.json", "/tmp/default.state")
+	require.NoError(t, err)
+	assert.Equal(t, "s3://bucket/path/to/state.json", store.String())
+
+	store, err = NewStateStore("sqlite:///var/lib/kamal-proxy/state.db", "/tmp/default.state")
+	require.NoError(t, err)
+	assert.Equal(t, "sqlite:///var/lib/kamal-proxy/state.db", store.String())
+
+	_, err = NewStateStore("sqlite://", "/tmp/default.state")
+	assert.Equal(t, ErrorInvalidStateStore, err)
+
+	_, err = NewStateStore("s3://bucket", "/tmp/default.state")
+	assert.Equal(t, ErrorInvalidStateStore, err)
+
+	_, err = NewStateStore("ftp://example.com/state", "/tmp/default.state")
+	assert.Equal(t, ErrorUnsupportedStateStore, err)
+}
+
+func TestFileStateStore_SaveAndLoad(t *testing.T) {
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+
+	_, err := store.Load()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, store.Save([]byte(`[]`)))
+
+	data, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, `[]`, string(data))
+}
+
+func TestFileStateStore_SaveReplacesWithoutLeavingTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStateStore(filepath.Join(dir, "state.json"))
+
+	require.NoError(t, store.Save([]byte(`["first"]`)))
+	require.NoError(t, store.Save([]byte(`["second"]`)))
+
+	data, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, `["second"]`, string(data))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "state.json", entries[0].Name())
+
+	info, err := os.Stat(filepath.Join(dir, "state.json"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestFileStateStore_FailedSaveKeepsPreviousState(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("directory permissions are not enforced for root")
+	}
+
+	dir := t.TempDir()
+	store := NewFileStateStore(filepath.Join(dir, "state.json"))
+	require.NoError(t, store.Save([]byte(`["first"]`)))
+
+	require.NoError(t, os.Chmod(dir, 0o500))
+	defer os.Chmod(dir, 0o700)
+
+	assert.Error(t, store.Save([]byte(`["second"]`)))
+
+	data, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, `["first"]`, string(data))
+}
+
+func TestSQLiteStateStore_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	store, err := NewSQLiteStateStore("sqlite://" + path)
+	require.NoError(t, err)
+
+	_, err = store.Load()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, store.Save([]byte(`["first"]`)))
+	require.NoError(t, store.Save([]byte(`["second"]`)))
+
+	data, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, `["second"]`, string(data))
+
+	reopened, err := NewSQLiteStateStore("sqlite://" + path)
+	require.NoError(t, err)
+
+	data, err = reopened.Load()
+	require.NoError(t, err)
+	assert.Equal(t, `["second"]`, string(data))
+}
+
+func TestS3StateStore_SaveAndLoad(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	var lock sync.Mutex
+	objects := map[string][]byte{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("X-Amz-Date") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	store, err := NewS3StateStore("s3://bucket/kamal-proxy.state?region=eu-west-1&endpoint=" + server.URL)
+	require.NoError(t, err)
+
+	_, err = store.Load()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, store.Save([]byte(`[]`)))
+	assert.Contains(t, objects, "/bucket/kamal-proxy.state")
+
+	data, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, `[]`, string(data))
+}
+
+func TestS3StateStore_ReportsFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	store, err := NewS3StateStore("s3://bucket/kamal-proxy.state?endpoint=" + server.URL)
+	require.NoError(t, err)
+
+	_, err = store.Load()
+	assert.ErrorIs(t, err, ErrorStateStoreFailed)
+
+	err = store.Save([]byte(`[]`))
+	assert.ErrorIs(t, err, ErrorStateStoreFailed)
+}
+
+func TestRouter_RestoreLastSavedStateFromS3(t *testing.T) {
+	var lock sync.Mutex
+	var saved []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if r.Method == http.MethodPut {
+			saved, _ = io.ReadAll(r.Body)
+			return
+		}
+		w.Write(saved)
+	}))
+	defer server.Close()
+
+	store, err := NewS3StateStore("s3://bucket/kamal-proxy.state?endpoint=" + server.URL)
+	require.NoError(t, err)
+
+	_, target := testBackend(t, "first", http.StatusOK)
+
+	router := NewRouter(store)
+	require.NoError(t, router.SetServiceTarget("default", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	router = NewRouter(store)
+	require.NoError(t, router.RestoreLastSavedState(RestoreOptions{}))
+
+	statusCode, body := sendGETRequest(router, "http://something.example.com")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+}
@@ -3,25 +3,38 @@ package server
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
 	StatusClientClosedRequest = 499
+
+	requestDeadlineHeader = "X-Request-Deadline"
 )
 
 var (
 	ErrorInvalidHostPattern = errors.New("invalid host pattern")
 	ErrorDraining           = errors.New("target is draining")
+	ErrorTargetUnhealthy    = errors.New("target is unhealthy")
+	ErrorInvalidSourceAddr  = errors.New("source address must be an IP address or interface name")
 
 	hostRegex = regexp.MustCompile(`^(\w[-_.\w+]+)(:\d+)?$`)
 )
@@ -32,6 +45,7 @@ const (
 	TargetStateAdding TargetState = iota
 	TargetStateDraining
 	TargetStateHealthy
+	TargetStateUnhealthy
 )
 
 func (ts TargetState) String() string {
@@ -42,28 +56,69 @@ func (ts TargetState) String() string {
 		return "draining"
 	case TargetStateHealthy:
 		return "healthy"
+	case TargetStateUnhealthy:
+		return "unhealthy"
 	}
 	return ""
 }
 
 type inflightRequest struct {
 	cancel   context.CancelCauseFunc
-	hijacked bool
+	started  time.Time
+	hijacked atomic.Bool
+	upload   *uploadTrackingBody
 }
 
 type inflightMap map[*http.Request]*inflightRequest
 
+type InflightRequestDescription struct {
+	Method   string        `json:"method"`
+	Host     string        `json:"host"`
+	Path     string        `json:"path"`
+	Target   string        `json:"target"`
+	Elapsed  time.Duration `json:"elapsed"`
+	Hijacked bool          `json:"hijacked"`
+}
+
 type TargetOptions struct {
-	HealthCheckConfig   HealthCheckConfig `json:"health_check_config"`
-	ResponseTimeout     time.Duration     `json:"response_timeout"`
-	BufferRequests      bool              `json:"buffer_requests"`
-	BufferResponses     bool              `json:"buffer_responses"`
-	MaxMemoryBufferSize int64             `json:"max_memory_buffer_size"`
-	MaxRequestBodySize  int64             `json:"max_request_body_size"`
-	MaxResponseBodySize int64             `json:"max_response_body_size"`
-	LogRequestHeaders   []string          `json:"log_request_headers"`
-	LogResponseHeaders  []string          `json:"log_response_headers"`
-	ForwardHeaders      bool              `json:"forward_headers"`
+	HealthCheckConfig          HealthCheckConfig `json:"health_check_config"`
+	ResponseTimeout            time.Duration     `json:"response_timeout"`
+	StreamIdleTimeout          time.Duration     `json:"stream_idle_timeout"`
+	WebSocketHandshakeTimeout  time.Duration     `json:"websocket_handshake_timeout"`
+	WebSocketIdleTimeout       time.Duration     `json:"websocket_idle_timeout"`
+	DecompressResponses        bool              `json:"decompress_responses"`
+	BufferRequests             bool              `json:"buffer_requests"`
+	BufferResponses            bool              `json:"buffer_responses"`
+	MaxMemoryBufferSize        int64             `json:"max_memory_buffer_size"`
+	MaxRequestBodySize         int64             `json:"max_request_body_size"`
+	MaxResponseBodySize        int64             `json:"max_response_body_size"`
+	BufferFlushTimeout         time.Duration     `json:"buffer_flush_timeout"`
+	LogRequestHeaders          []string          `json:"log_request_headers"`
+	LogResponseHeaders         []string          `json:"log_response_headers"`
+	ForwardHeaders             bool              `json:"forward_headers"`
+	ForwardDeadline            bool              `json:"forward_deadline"`
+	ForwardConnectionInfo      bool              `json:"forward_connection_info"`
+	RefusedRetryDelay          time.Duration     `json:"refused_retry_delay"`
+	SourceAddress              string            `json:"source_address"`
+	SigningKeyFile             string            `json:"signing_key_file"`
+	DomainRewrites             []DomainRewrite   `json:"domain_rewrites"`
+	WarmConnections            int               `json:"warm_connections"`
+	UpstreamConnMaxLifetime    time.Duration     `json:"upstream_conn_max_lifetime"`
+	BufferingOverrideTokenFile string            `json:"buffering_override_token_file"`
+	BufferingOverrideNetworks  []string          `json:"buffering_override_networks"`
+	MaxResponseTimeout         time.Duration     `json:"max_response_timeout"`
+	StripServerHeaders         bool              `json:"strip_server_headers"`
+	StripResponseHeaders       []string          `json:"strip_response_headers"`
+	UploadDrainTimeout         time.Duration     `json:"upload_drain_timeout"`
+	ExposeUpstreamErrors       bool              `json:"expose_upstream_errors"`
+	WebSocketDrainCloseCode    int               `json:"websocket_drain_close_code"`
+	TargetTLS                  bool              `json:"target_tls"`
+	TargetTLSCA                string            `json:"target_tls_ca"`
+	TargetTLSInsecure          bool              `json:"target_tls_insecure"`
+
+	// tunnels is where tunnel:// targets find their connections. It belongs
+	// to the server, so it's never saved.
+	tunnels *TunnelRegistry
 }
 
 func (to *TargetOptions) canonicalizeLogHeaders() {
@@ -76,9 +131,19 @@ func (to *TargetOptions) canonicalizeLogHeaders() {
 }
 
 type Target struct {
+	address      string
 	targetURL    *url.URL
+	tunnel       string
+	socket       string
 	options      TargetOptions
+	transport    *http.Transport
+	upgrades     *http.Transport
+	healthChecks http.RoundTripper
 	proxyHandler http.Handler
+	signer       *RequestSigner
+	signingKeys  []string
+
+	bufferingOverrideToken string
 
 	state        TargetState
 	inflight     inflightMap
@@ -86,6 +151,9 @@ type Target struct {
 
 	healthcheck   *HealthCheck
 	becameHealthy chan (bool)
+	recoveryLock  sync.Mutex
+	stopRecovery  context.CancelFunc
+	healthCache   targetHealthCache
 }
 
 func NewTarget(targetURL string, options TargetOptions) (*Target, error) {
@@ -96,7 +164,21 @@ func NewTarget(targetURL string, options TargetOptions) (*Target, error) {
 
 	options.canonicalizeLogHeaders()
 
+	sourceIP, err := resolveSourceAddress(options.SourceAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := targetTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		uri.Scheme = "https"
+	}
+
 	target := &Target{
+		address:   targetURL,
 		targetURL: uri,
 		options:   options,
 
@@ -104,20 +186,60 @@ func NewTarget(targetURL string, options TargetOptions) (*Target, error) {
 		inflight: inflightMap{},
 	}
 
+	if strings.HasPrefix(targetURL, TunnelScheme) {
+		target.tunnel = uri.Host
+	}
+	if path, ok := unixSocketPath(targetURL); ok {
+		target.socket = path
+	}
+
+	target.transport = target.createTransport(sourceIP, tlsConfig)
+	if options.WebSocketHandshakeTimeout > 0 {
+		target.upgrades = target.transport.Clone()
+		target.upgrades.ResponseHeaderTimeout = options.WebSocketHandshakeTimeout
+	}
+	target.healthChecks = target.createHealthCheckTransport()
 	target.proxyHandler = target.createProxyHandler()
 
 	if options.BufferResponses {
-		target.proxyHandler = WithResponseBufferMiddleware(options.MaxMemoryBufferSize, options.MaxResponseBodySize, target.proxyHandler)
+		unbuffered := target.proxyHandler
+		target.proxyHandler = WithResponseBufferMiddleware(options.MaxMemoryBufferSize, options.MaxResponseBodySize, options.BufferFlushTimeout, target.proxyHandler)
+
+		if options.BufferingOverrideTokenFile != "" {
+			target.bufferingOverrideToken, err = readBufferingOverrideToken(options.BufferingOverrideTokenFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if target.bufferingOverrideToken != "" || len(options.BufferingOverrideNetworks) > 0 {
+			target.proxyHandler, err = WithBufferingOverrideMiddleware(target.bufferingOverrideToken, options.BufferingOverrideNetworks, unbuffered, target.proxyHandler)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	if options.BufferRequests {
 		target.proxyHandler = WithRequestBufferMiddleware(options.MaxMemoryBufferSize, options.MaxRequestBodySize, target.proxyHandler)
 	}
+	if options.SigningKeyFile != "" {
+		keys, err := readSecretFile(options.SigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, ErrorSigningKeyFileEmpty
+		}
+
+		target.signingKeys = keys
+		target.signer = NewRequestSigner(keys)
+		target.proxyHandler = WithBodyHashMiddleware(target.proxyHandler)
+	}
 
 	return target, nil
 }
 
 func (t *Target) Target() string {
-	return t.targetURL.Host
+	return t.address
 }
 
 func (t *Target) StartRequest(req *http.Request) (*http.Request, error) {
@@ -127,11 +249,18 @@ func (t *Target) StartRequest(req *http.Request) (*http.Request, error) {
 	if t.state == TargetStateDraining {
 		return nil, ErrorDraining
 	}
+	if t.state == TargetStateUnhealthy {
+		return nil, ErrorTargetUnhealthy
+	}
 
 	ctx, cancel := context.WithCancelCause(req.Context())
 	req = req.WithContext(ctx)
 
-	inflightRequest := &inflightRequest{cancel: cancel}
+	inflightRequest := &inflightRequest{cancel: cancel, started: time.Now()}
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		inflightRequest.upload = &uploadTrackingBody{ReadCloser: req.Body, remaining: req.ContentLength}
+		req.Body = inflightRequest.upload
+	}
 	t.inflight[req] = inflightRequest
 
 	return req, nil
@@ -146,14 +275,45 @@ func (t *Target) SendRequest(w http.ResponseWriter, req *http.Request) {
 	defer t.endInflightRequest(req)
 
 	tw := newTargetResponseWriter(w, inflightRequest)
+	if t.options.WebSocketDrainCloseCode != 0 && isWebSocketUpgrade(req) {
+		tw.drainCloseCode = t.options.WebSocketDrainCloseCode
+		tw.ctx = req.Context()
+	}
 	t.proxyHandler.ServeHTTP(tw, req)
 }
 
+func (t *Target) InflightRequests() []InflightRequestDescription {
+	t.inflightLock.Lock()
+	defer t.inflightLock.Unlock()
+
+	result := []InflightRequestDescription{}
+	for req, inflight := range t.inflight {
+		result = append(result, InflightRequestDescription{
+			Method:   req.Method,
+			Host:     req.Host,
+			Path:     req.URL.Path,
+			Target:   t.Target(),
+			Elapsed:  time.Since(inflight.started),
+			Hijacked: inflight.hijacked.Load(),
+		})
+	}
+
+	return result
+}
+
 func (t *Target) IsHealthCheckRequest(r *http.Request) bool {
 	return r.Method == http.MethodGet && r.URL.Path == t.options.HealthCheckConfig.Path
 }
 
 func (t *Target) Drain(timeout time.Duration) {
+	t.DrainWithUploadTimeout(timeout, t.options.UploadDrainTimeout)
+}
+
+// DrainWithUploadTimeout drains the target like Drain, but allows requests
+// that are still sending their body up to uploadTimeout to finish, so that
+// large uploads aren't lost. It has no effect unless uploadTimeout is longer
+// than timeout.
+func (t *Target) DrainWithUploadTimeout(timeout time.Duration, uploadTimeout time.Duration) {
 	originalState := t.updateState(TargetStateDraining)
 	if originalState == TargetStateDraining {
 		return
@@ -165,17 +325,18 @@ func (t *Target) Drain(timeout time.Duration) {
 
 	// Cancel any hijacked requests immediately, as they may be long-running.
 	for _, inflight := range toCancel {
-		if inflight.hijacked {
+		if inflight.hijacked.Load() {
 			inflight.cancel(ErrorDraining)
 		}
 	}
 
-WAIT_FOR_REQUESTS_TO_COMPLETE:
-	for req := range toCancel {
-		select {
-		case <-req.Context().Done():
-		case <-deadline:
-			break WAIT_FOR_REQUESTS_TO_COMPLETE
+	waitForRequestsToComplete(toCancel, deadline)
+
+	if uploadTimeout > timeout {
+		uploads := inflightUploads(toCancel)
+		if len(uploads) > 0 {
+			slog.Info("Waiting for uploads to complete", "target", t.Target(), "uploads", len(uploads))
+			waitForRequestsToComplete(uploads, time.After(uploadTimeout-timeout))
 		}
 	}
 
@@ -183,14 +344,56 @@ WAIT_FOR_REQUESTS_TO_COMPLETE:
 	for _, inflight := range toCancel {
 		inflight.cancel(ErrorDraining)
 	}
+
+	t.closeIdleConnections()
+}
+
+// secretsChanged is true when the files that the target's secrets were read
+// from now hold different ones, so a deploy needs to read them again.
+func (t *Target) secretsChanged() bool {
+	if t.options.SigningKeyFile != "" {
+		keys, err := readSecretFile(t.options.SigningKeyFile)
+		if err != nil || !slices.Equal(keys, t.signingKeys) {
+			return true
+		}
+	}
+
+	if t.options.BufferResponses && t.options.BufferingOverrideTokenFile != "" {
+		token, err := readBufferingOverrideToken(t.options.BufferingOverrideTokenFile)
+		if err != nil || token != t.bufferingOverrideToken {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *Target) closeIdleConnections() {
+	t.transport.CloseIdleConnections()
+	if t.upgrades != nil {
+		t.upgrades.CloseIdleConnections()
+	}
+
+	// Health checks may have a transport of their own
+	(&http.Client{Transport: t.healthChecks}).CloseIdleConnections()
 }
 
 func (t *Target) BeginHealthChecks() {
 	t.becameHealthy = make(chan bool)
 	t.healthcheck = NewHealthCheck(t,
-		t.targetURL.JoinPath(t.options.HealthCheckConfig.Path),
+		&http.Client{Transport: t.healthChecks},
+		t.healthCheckURL(),
 		t.options.HealthCheckConfig.Interval,
 		t.options.HealthCheckConfig.Timeout,
+		t.options.HealthCheckConfig.LogChecks,
+	)
+}
+
+func (t *Target) ProbeHealth() error {
+	return CheckHealthOnce(
+		&http.Client{Transport: t.healthChecks},
+		t.healthCheckURL(),
+		t.options.HealthCheckConfig.Timeout,
 	)
 }
 
@@ -201,6 +404,81 @@ func (t *Target) StopHealthChecks() {
 	}
 }
 
+// IsReachable makes a quick check that something is listening at the target's
+// address, without waiting for a full health check.
+func (t *Target) IsReachable(timeout time.Duration) bool {
+	if t.tunnel != "" {
+		return true // Tunnel agents connect to us, so there's nothing to dial
+	}
+
+	network, address := "tcp", t.targetURL.Host
+	if t.socket != "" {
+		network, address = "unix", t.socket
+	}
+
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// BeginRecovery takes the target out of service, and runs health checks until
+// it becomes healthy again, or until StopRecovery is called.
+func (t *Target) BeginRecovery() {
+	t.updateState(TargetStateUnhealthy)
+	t.BeginHealthChecks()
+
+	healthcheck := t.healthcheck
+	becameHealthy := t.becameHealthy
+	ctx, cancel := context.WithCancel(context.Background())
+
+	t.recoveryLock.Lock()
+	if t.stopRecovery != nil {
+		t.stopRecovery()
+	}
+	t.stopRecovery = cancel
+	t.recoveryLock.Unlock()
+
+	go func() {
+		defer healthcheck.Close()
+
+		select {
+		case <-becameHealthy:
+		case <-healthcheck.Done():
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// StopRecovery stops the health checks started by BeginRecovery, for a
+// target that's being replaced or removed before it has recovered.
+func (t *Target) StopRecovery() {
+	t.recoveryLock.Lock()
+	defer t.recoveryLock.Unlock()
+
+	if t.stopRecovery != nil {
+		t.stopRecovery()
+		t.stopRecovery = nil
+	}
+}
+
+// RetryAfter suggests how long clients should wait before retrying a request
+// that was refused because the target is unhealthy. We won't know any better
+// until the next health check, so that's what we use.
+func (t *Target) RetryAfter() string {
+	seconds := int(math.Ceil(t.options.HealthCheckConfig.Interval.Seconds()))
+	return strconv.Itoa(max(seconds, 1))
+}
+
+func (t *Target) IsHealthy() bool {
+	t.inflightLock.Lock()
+	defer t.inflightLock.Unlock()
+
+	return t.state == TargetStateHealthy
+}
+
 func (t *Target) WaitUntilHealthy(timeout time.Duration) bool {
 	t.BeginHealthChecks()
 	defer t.StopHealthChecks()
@@ -213,13 +491,65 @@ func (t *Target) WaitUntilHealthy(timeout time.Duration) bool {
 	}
 }
 
+// healthCheckURL is where the target's health is checked: its health check
+// path, on its own port unless another one has been given for checks.
+func (t *Target) healthCheckURL() *url.URL {
+	endpoint := t.targetURL.JoinPath(t.options.HealthCheckConfig.Path)
+	if t.options.HealthCheckConfig.Port != 0 {
+		endpoint.Host = net.JoinHostPort(endpoint.Hostname(), strconv.Itoa(t.options.HealthCheckConfig.Port))
+	}
+	return endpoint
+}
+
+// WarmConnections opens connections to the target ahead of its first
+// requests, so that they don't all have to wait for connections to be set up
+// at once. The connections are made by sending concurrent requests to the
+// health check path, which leaves them idle in the transport's pool.
+func (t *Target) WarmConnections() {
+	count := min(t.options.WarmConnections, MaxIdleConnsPerHost)
+	if count <= 0 {
+		return
+	}
+
+	// Requests go to the serving port, even when health is checked on
+	// another, since those are the connections that requests will reuse.
+	client := &http.Client{Transport: t.transport, Timeout: t.options.HealthCheckConfig.Timeout}
+	endpoint := t.targetURL.JoinPath(t.options.HealthCheckConfig.Path).String()
+
+	var warmed atomic.Int32
+	fns := make([]func(), count)
+	for i := range fns {
+		fns[i] = func() {
+			req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set("User-Agent", healthCheckUserAgent)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			warmed.Add(1)
+		}
+	}
+
+	started := time.Now()
+	PerformConcurrently(fns...)
+
+	slog.Info("Warmed target connections", "target", t.Target(), "connections", warmed.Load(), "duration", time.Since(started))
+}
+
 // HealthCheckConsumer
 
 func (t *Target) HealthCheckCompleted(success bool) {
 	t.inflightLock.Lock()
 	defer t.inflightLock.Unlock()
 
-	if success && t.state == TargetStateAdding {
+	if success && (t.state == TargetStateAdding || t.state == TargetStateUnhealthy) {
 		t.state = TargetStateHealthy
 		close(t.becameHealthy)
 	}
@@ -229,22 +559,266 @@ func (t *Target) HealthCheckCompleted(success bool) {
 
 // Private
 
+func (t *Target) createTransport(sourceIP net.IP, tlsConfig *tls.Config) *http.Transport {
+	transport := &http.Transport{
+		MaxIdleConnsPerHost:   MaxIdleConnsPerHost,
+		ResponseHeaderTimeout: t.options.ResponseTimeout,
+		TLSClientConfig:       tlsConfig,
+	}
+
+	dialer := &net.Dialer{}
+	if sourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: sourceIP}
+	}
+
+	switch {
+	case t.tunnel != "":
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return t.options.tunnels.Dial(ctx, t.tunnel)
+		}
+	case t.socket != "":
+		transport.DialContext = dialUnixSocket(t.socket)
+	case t.options.RefusedRetryDelay > 0:
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return t.dialWithRetry(ctx, dialer, network, addr)
+		}
+	default:
+		transport.DialContext = dialer.DialContext
+	}
+
+	// Targets that can extend the timeout have it enforced as part of the
+	// round trip instead.
+	if t.options.MaxResponseTimeout > 0 {
+		transport.ResponseHeaderTimeout = 0
+	}
+
+	if t.options.UpstreamConnMaxLifetime > 0 {
+		transport.DialContext = withConnMaxLifetime(transport.DialContext, t.options.UpstreamConnMaxLifetime)
+		transport.IdleConnTimeout = t.options.UpstreamConnMaxLifetime
+	}
+
+	return transport
+}
+
+// createHealthCheckTransport sends health checks over the target's own
+// connections, unless they need a different SNI, which needs connections of
+// their own.
+func (t *Target) createHealthCheckTransport() http.RoundTripper {
+	config := t.options.HealthCheckConfig
+
+	var transport http.RoundTripper = t.transport
+	if config.ServerName != "" && t.transport.TLSClientConfig != nil {
+		checks := t.transport.Clone()
+		checks.TLSClientConfig.ServerName = config.ServerName
+		transport = checks
+	}
+
+	if config.Host != "" || len(config.Headers) > 0 {
+		transport = newHealthCheckRequestTransport(transport, config)
+	}
+	return transport
+}
+
+// dialWithRetry gives a target that is restarting in place a brief chance to
+// come back before we give up on the request. Nothing has been sent when a
+// connection is refused, so it's always safe to try again.
+func (t *Target) dialWithRetry(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err == nil || !t.isConnectionRefused(err) {
+		return conn, err
+	}
+
+	select {
+	case <-time.After(t.options.RefusedRetryDelay):
+	case <-ctx.Done():
+		return nil, err
+	}
+
+	slog.Debug("Retrying refused connection", "target", t.Target())
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// resolveSourceAddress finds the local IP that connections to the target should
+// be made from. This can be given either as an IP, or as the name of an
+// interface, in which case we use its first IPv4 address.
+func resolveSourceAddress(source string) (net.IP, error) {
+	if source == "" {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(source)
+	if ip != nil {
+		return ip, nil
+	}
+
+	iface, err := net.InterfaceByName(source)
+	if err != nil {
+		return nil, fmt.Errorf("%w (%s)", ErrorInvalidSourceAddr, source)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("%w (%s has no addresses)", ErrorInvalidSourceAddr, source)
+	}
+
+	ip = interfaceSourceAddress(addrs)
+	if ip == nil {
+		return nil, fmt.Errorf("%w (%s has no addresses)", ErrorInvalidSourceAddr, source)
+	}
+
+	return ip, nil
+}
+
+// interfaceSourceAddress picks the first of an interface's IPv4 addresses, or
+// failing that, its first address of any family.
+func interfaceSourceAddress(addrs []net.Addr) net.IP {
+	var fallback net.IP
+
+	for _, addr := range addrs {
+		var ip net.IP
+		switch addr := addr.(type) {
+		case *net.IPNet:
+			ip = addr.IP
+		case *net.IPAddr:
+			ip = addr.IP
+		default:
+			continue
+		}
+
+		if ip.To4() != nil {
+			return ip
+		}
+		if fallback == nil {
+			fallback = ip
+		}
+	}
+
+	return fallback
+}
+
 func (t *Target) createProxyHandler() http.Handler {
 	bufferPool := NewBufferPool(ProxyBufferSize)
 
-	return &httputil.ReverseProxy{
+	proxy := &httputil.ReverseProxy{
 		BufferPool:   bufferPool,
 		Rewrite:      t.rewrite,
 		ErrorHandler: t.handleProxyError,
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost:   MaxIdleConnsPerHost,
-			ResponseHeaderTimeout: t.options.ResponseTimeout,
-		},
+		Transport:    t.transport,
+	}
+
+	if t.upgrades != nil || t.options.UpstreamConnMaxLifetime > 0 || t.options.MaxResponseTimeout > 0 {
+		proxy.Transport = roundTripperFunc(t.roundTrip)
+	}
+	if t.modifiesResponses() {
+		proxy.ModifyResponse = t.modifyResponse
+	}
+
+	return proxy
+}
+
+func (t *Target) modifiesResponses() bool {
+	return t.options.StreamIdleTimeout > 0 ||
+		t.options.WebSocketIdleTimeout > 0 ||
+		t.options.DecompressResponses ||
+		len(t.options.DomainRewrites) > 0 ||
+		t.options.StripServerHeaders ||
+		len(t.options.StripResponseHeaders) > 0 ||
+		t.streamsUnknownLengthResponses()
+}
+
+// streamsUnknownLengthResponses is true when responses that the target ends
+// by closing the connection should bypass the response buffer. Those are
+// almost always meant to be streamed, often by long-polling endpoints.
+func (t *Target) streamsUnknownLengthResponses() bool {
+	return t.options.BufferResponses && t.options.BufferFlushTimeout > 0
+}
+
+// roundTrip sends WebSocket handshakes through their own transport, so that
+// they can be given a different response timeout to other requests. It also
+// retires connections that have reached their maximum lifetime.
+func (t *Target) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.options.UpstreamConnMaxLifetime > 0 {
+		req = closeExpiredConnections(req)
+	}
+
+	if t.upgrades != nil && isWebSocketUpgrade(req) {
+		return t.upgrades.RoundTrip(req)
 	}
+	if t.options.MaxResponseTimeout > 0 {
+		return t.roundTripWithExtendableTimeout(req, t.transport.RoundTrip)
+	}
+	return t.transport.RoundTrip(req)
+}
+
+func (t *Target) modifyResponse(resp *http.Response) error {
+	t.stripResponseHeaders(resp)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if t.options.WebSocketIdleTimeout > 0 {
+			t.applyWebSocketIdleTimeout(resp)
+		}
+		return nil // Otherwise, upgraded connections are passed through untouched
+	}
+
+	if t.options.StreamIdleTimeout > 0 {
+		t.applyStreamIdleTimeout(resp)
+	}
+	if t.options.DecompressResponses {
+		t.decompressResponse(resp)
+	}
+	if len(t.options.DomainRewrites) > 0 {
+		rewriteResponseDomains(resp, t.options.DomainRewrites)
+	}
+	if t.streamsUnknownLengthResponses() && isCloseDelimited(resp) {
+		BypassResponseBuffer(resp.Request)
+	}
+
+	return nil
+}
+
+// applyStreamIdleTimeout limits how long the response body may go without
+// sending anything. Unlike ResponseTimeout, which only covers waiting for the
+// headers, this lets long-lived streams run for as long as they're active.
+func (t *Target) applyStreamIdleTimeout(resp *http.Response) {
+	path := resp.Request.URL.Path
+	resp.Body = newIdleTimeoutReadCloser(resp.Body, t.options.StreamIdleTimeout, func() {
+		slog.Info("Closing idle response stream", "target", t.Target(), "path", path, "timeout", t.options.StreamIdleTimeout)
+	})
+}
+
+// applyWebSocketIdleTimeout closes upgraded connections that have had no
+// traffic in either direction for a while. Clients and targets that are still
+// there will normally exchange pings, so only dead connections are closed.
+func (t *Target) applyWebSocketIdleTimeout(resp *http.Response) {
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+
+	path := resp.Request.URL.Path
+	resp.Body = newIdleTimeoutReadWriteCloser(conn, t.options.WebSocketIdleTimeout, func() {
+		slog.Info("Closing idle WebSocket", "target", t.Target(), "path", path, "timeout", t.options.WebSocketIdleTimeout)
+	})
+}
+
+// decompressResponse decodes gzipped responses for clients that haven't said
+// they can handle them. Some targets compress regardless of what the client
+// asks for, which leaves simpler clients with bytes they can't read.
+func (t *Target) decompressResponse(resp *http.Response) {
+	if !isGzipEncoded(resp.Header) || acceptsGzip(resp.Request.Header) {
+		return
+	}
+
+	resp.Body = &gzipDecodingReadCloser{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
 }
 
 func (t *Target) rewrite(req *httputil.ProxyRequest) {
 	t.forwardHeaders(req)
+	t.forwardDeadline(req)
+	t.forwardConnectionInfo(req)
 
 	req.SetURL(t.targetURL)
 	req.Out.Host = req.In.Host
@@ -273,6 +847,10 @@ func (t *Target) rewrite(req *httputil.ProxyRequest) {
 	// In our case, we don't make any decisions based on the query params, so it's
 	// safe for us to pass them through verbatim.
 	req.Out.URL.RawQuery = req.In.URL.RawQuery
+
+	if t.signer != nil {
+		t.signer.Sign(req.Out, bodyHashForRequest(req.In), time.Now())
+	}
 }
 
 func (t *Target) forwardHeaders(req *httputil.ProxyRequest) {
@@ -292,6 +870,26 @@ func (t *Target) forwardHeaders(req *httputil.ProxyRequest) {
 	}
 }
 
+func (t *Target) forwardDeadline(req *httputil.ProxyRequest) {
+	// The header is ours to set, so one sent by the client must never reach
+	// the target, where it could be mistaken for the proxy's deadline.
+	req.Out.Header.Del(requestDeadlineHeader)
+
+	if !t.options.ForwardDeadline || t.options.ResponseTimeout <= 0 {
+		return
+	}
+
+	// Let the target know when we will stop waiting for its response, so that
+	// it can abandon work that nobody will see. Like X-Request-Start, this is
+	// expressed as milliseconds since the epoch.
+	//
+	// When the target may extend its timeout, this is the deadline before any
+	// extension. Only the target can ask for more time, so it knows when it
+	// has moved the deadline on.
+	deadline := time.Now().Add(t.options.ResponseTimeout)
+	req.Out.Header.Set(requestDeadlineHeader, strconv.FormatInt(deadline.UnixMilli(), 10))
+}
+
 func (t *Target) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
 	if t.isRequestEntityTooLarge(err) {
 		SetErrorResponse(w, r, http.StatusRequestEntityTooLarge, nil)
@@ -299,6 +897,7 @@ func (t *Target) handleProxyError(w http.ResponseWriter, r *http.Request, err er
 	}
 
 	if t.isGatewayTimeout(err) {
+		t.exposeUpstreamError(w, err)
 		SetErrorResponse(w, r, http.StatusGatewayTimeout, nil)
 		return
 	}
@@ -312,11 +911,23 @@ func (t *Target) handleProxyError(w http.ResponseWriter, r *http.Request, err er
 
 	if t.isDraining(err) {
 		slog.Info("Request cancelled due to draining", "target", t.Target(), "path", r.URL.Path)
+		t.exposeUpstreamError(w, err)
 		SetErrorResponse(w, r, http.StatusGatewayTimeout, nil)
 		return
 	}
 
+	if t.isConnectionRefused(err) {
+		// Most likely the target's container is restarting, so this should be
+		// temporary. Tell the client to come back, rather than that we failed.
+		slog.Warn("Target refused connection", "target", t.Target(), "path", r.URL.Path)
+		w.Header().Set("Retry-After", t.RetryAfter())
+		t.exposeUpstreamError(w, err)
+		SetErrorResponse(w, r, http.StatusServiceUnavailable, nil)
+		return
+	}
+
 	slog.Error("Error while proxying", "target", t.Target(), "path", r.URL.Path, "error", err)
+	t.exposeUpstreamError(w, err)
 	SetErrorResponse(w, r, http.StatusBadGateway, nil)
 }
 
@@ -341,6 +952,10 @@ func (t *Target) isDraining(err error) bool {
 	return errors.Is(err, ErrorDraining)
 }
 
+func (t *Target) isConnectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
 func (t *Target) updateState(state TargetState) TargetState {
 	t.inflightLock.Lock()
 	defer t.inflightLock.Unlock()
@@ -384,22 +999,93 @@ func (t *Target) pendingRequestsToCancel() inflightMap {
 	return result
 }
 
+func waitForRequestsToComplete(requests inflightMap, deadline <-chan time.Time) {
+	for req := range requests {
+		select {
+		case <-req.Context().Done():
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// inflightUploads returns the requests that are still sending their body.
+func inflightUploads(requests inflightMap) inflightMap {
+	result := inflightMap{}
+	for req, inflight := range requests {
+		if req.Context().Err() == nil && inflight.upload != nil && !inflight.upload.complete.Load() {
+			result[req] = inflight
+		}
+	}
+	return result
+}
+
+// uploadTrackingBody notes when a request's body has been read to the end,
+// or as far as its Content-Length, when it has one.
+type uploadTrackingBody struct {
+	io.ReadCloser
+	remaining int64
+	complete  atomic.Bool
+}
+
+func (b *uploadTrackingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.remaining > 0 {
+		b.remaining -= int64(n)
+	}
+	if err != nil || b.remaining == 0 {
+		b.complete.Store(true)
+	}
+	return n, err
+}
+
+func (b *uploadTrackingBody) Close() error {
+	b.complete.Store(true)
+	return b.ReadCloser.Close()
+}
+
 func parseTargetURL(targetURL string) (*url.URL, error) {
-	if !hostRegex.MatchString(targetURL) {
+	if path, ok := unixSocketPath(targetURL); ok {
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("%s :%w", targetURL, ErrorInvalidUnixSocketPath)
+		}
+
+		uri, _ := url.Parse("http://" + unixSocketHost)
+		return uri, nil
+	}
+
+	// Tunnelled targets are addressed by the name their agent registered
+	// with, which we use as the host of the URL.
+	host := strings.TrimPrefix(targetURL, TunnelScheme)
+	if !hostRegex.MatchString(host) {
 		return nil, fmt.Errorf("%s :%w", targetURL, ErrorInvalidHostPattern)
 	}
 
-	uri, _ := url.Parse("http://" + targetURL)
+	uri, _ := url.Parse("http://" + host)
 	return uri, nil
 }
 
+func isWebSocketUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
 type targetResponseWriter struct {
 	http.ResponseWriter
 	inflightRequest *inflightRequest
+
+	// Set for WebSocket requests that are sent a close frame when draining.
+	drainCloseCode int
+	ctx            context.Context
 }
 
 func newTargetResponseWriter(w http.ResponseWriter, inflightRequest *inflightRequest) *targetResponseWriter {
-	return &targetResponseWriter{w, inflightRequest}
+	return &targetResponseWriter{ResponseWriter: w, inflightRequest: inflightRequest}
 }
 
 func (r *targetResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
@@ -408,8 +1094,13 @@ func (r *targetResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
 	}
 
-	r.inflightRequest.hijacked = true
-	return hijacker.Hijack()
+	r.inflightRequest.hijacked.Store(true)
+
+	conn, brw, err := hijacker.Hijack()
+	if err == nil && r.drainCloseCode != 0 {
+		conn = newWebSocketDrainConn(conn, r.ctx, r.drainCloseCode)
+	}
+	return conn, brw, err
 }
 
 func (r *targetResponseWriter) Flush() {
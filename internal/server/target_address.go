@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DockerPortLabel is the container label that a target's port is read
+	// from, when it is deployed by container name alone.
+	DockerPortLabel = "kamal-proxy.port"
+
+	dockerLookupTimeout  = 2 * time.Second
+	targetResolveTimeout = 5 * time.Second
+)
+
+var (
+	ErrorNoPreviousTarget    = errors.New("a port-only target needs a previous deployment to take its host from")
+	ErrorInvalidDockerLabel  = errors.New("container has an invalid " + DockerPortLabel + " label")
+	ErrorTargetNotResolvable = errors.New("target host could not be resolved")
+)
+
+// DockerSocketPath is where the Docker API is found, for looking up the ports
+// of targets deployed by container name.
+var DockerSocketPath = "/var/run/docker.sock"
+
+// resolveTargetAddress fills in the parts of a target address that can be
+// left out when deploying:
+//
+//   - A port on its own (":3000") means the host of the service's current
+//     target, on the new port.
+//   - A host without a port may be a container name, in which case the port
+//     is taken from its kamal-proxy.port label, if the Docker API is
+//     available to ask and lookupContainers is set. Otherwise the address is
+//     used as it is.
+func (r *Router) resolveTargetAddress(name string, targetURL string, lookupContainers bool) (string, error) {
+	if port, ok := strings.CutPrefix(targetURL, ":"); ok {
+		return r.resolvePortOnlyTarget(name, port)
+	}
+
+	if strings.HasPrefix(targetURL, TunnelScheme) || strings.Contains(targetURL, ":") || !lookupContainers {
+		return targetURL, nil
+	}
+
+	port, err := lookupDockerPort(targetURL)
+	if err != nil {
+		return "", err
+	}
+	if port == "" {
+		return targetURL, nil
+	}
+
+	resolved := net.JoinHostPort(targetURL, port)
+	slog.Info("Using port from container label", "service", name, "target", resolved)
+	return resolved, nil
+}
+
+// checkTargetResolves looks up the host of a target address, so that a
+// deployment to a host that doesn't resolve fails straight away, rather than
+// on the first request after traffic has moved to it. Tunnelled targets,
+// sockets and IP addresses have nothing to look up.
+func checkTargetResolves(name string, targetURL string) error {
+	if strings.HasPrefix(targetURL, TunnelScheme) || strings.HasPrefix(targetURL, UnixSocketScheme) {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(targetURL)
+	if err != nil {
+		host = targetURL
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), targetResolveTimeout)
+	defer cancel()
+
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		slog.Error("Unable to resolve target", "service", name, "target", targetURL, "error", err)
+		return fmt.Errorf("%w: %s", ErrorTargetNotResolvable, host)
+	}
+
+	slog.Info("Resolved target", "service", name, "target", targetURL, "addresses", addresses)
+	return nil
+}
+
+// Private
+
+func (r *Router) resolvePortOnlyTarget(name string, port string) (string, error) {
+	var previous *Target
+	if service := r.serviceForName(name); service != nil {
+		previous = service.ActiveTarget()
+	}
+	if previous == nil || previous.tunnel != "" || previous.socket != "" {
+		return "", ErrorNoPreviousTarget
+	}
+
+	return net.JoinHostPort(previous.targetURL.Hostname(), port), nil
+}
+
+// lookupDockerPort returns the port that a container's label says it serves
+// on. It returns an empty port if there is no such container, it has no
+// label, or Docker can't be reached.
+func lookupDockerPort(container string) (string, error) {
+	client := &http.Client{
+		Timeout: dockerLookupTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", DockerSocketPath)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("http://docker/containers/" + url.PathEscape(container) + "/json")
+	if err != nil {
+		slog.Debug("Unable to look up container", "container", container, "error", err)
+		return "", nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+
+	var inspect struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return "", nil
+	}
+
+	label, ok := inspect.Config.Labels[DockerPortLabel]
+	if !ok {
+		return "", nil
+	}
+
+	port, err := strconv.Atoi(label)
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("%w: %q", ErrorInvalidDockerLabel, label)
+	}
+	return label, nil
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetAddress_PortOnlyUsesPreviousHost(t *testing.T) {
+	router := testRouter(t)
+
+	_, err := router.resolveTargetAddress("default", ":3000", true)
+	assert.Equal(t, ErrorNoPreviousTarget, err)
+
+	_, target := testBackend(t, "first", http.StatusOK)
+	require.NoError(t, router.SetServiceTarget("default", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	second, _ := testBackend(t, "second", http.StatusOK)
+	secondURL, _ := url.Parse(second.URL)
+
+	require.NoError(t, router.SetServiceTarget("default", defaultEmptyHosts, ":"+secondURL.Port(), defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+	assert.Equal(t, "127.0.0.1:"+secondURL.Port(), router.serviceForName("default").ActiveTarget().Target())
+
+	statusCode, body := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "second", body)
+}
+
+func TestTargetAddress_PortFromContainerLabel(t *testing.T) {
+	testDockerAPI(t, map[string]string{
+		"web-123": `{"Config":{"Labels":{"kamal-proxy.port":"3000"}}}`,
+		"web-456": `{"Config":{"Labels":{}}}`,
+		"web-789": `{"Config":{"Labels":{"kamal-proxy.port":"http"}}}`,
+	})
+
+	router := testRouter(t)
+
+	address, err := router.resolveTargetAddress("default", "web-123", true)
+	require.NoError(t, err)
+	assert.Equal(t, "web-123:3000", address)
+
+	address, err = router.resolveTargetAddress("default", "web-456", true)
+	require.NoError(t, err)
+	assert.Equal(t, "web-456", address)
+
+	address, err = router.resolveTargetAddress("default", "unknown", true)
+	require.NoError(t, err)
+	assert.Equal(t, "unknown", address)
+
+	address, err = router.resolveTargetAddress("default", "web-123:4000", true)
+	require.NoError(t, err)
+	assert.Equal(t, "web-123:4000", address)
+
+	_, err = router.resolveTargetAddress("default", "web-789", true)
+	assert.ErrorIs(t, err, ErrorInvalidDockerLabel)
+}
+
+func TestTargetAddress_WithoutDocker(t *testing.T) {
+	previous := DockerSocketPath
+	DockerSocketPath = filepath.Join(t.TempDir(), "missing.sock")
+	t.Cleanup(func() { DockerSocketPath = previous })
+
+	address, err := testRouter(t).resolveTargetAddress("default", "web-123", true)
+	require.NoError(t, err)
+	assert.Equal(t, "web-123", address)
+}
+
+func TestTargetAddress_ContainersNotLookedUpWhenPlanning(t *testing.T) {
+	testDockerAPI(t, map[string]string{
+		"web-123": `{"Config":{"Labels":{"kamal-proxy.port":"3000"}}}`,
+	})
+
+	address, err := testRouter(t).resolveTargetAddress("default", "web-123", false)
+	require.NoError(t, err)
+	assert.Equal(t, "web-123", address)
+}
+
+func TestTargetAddress_RolloutPortOnlyUsesActiveHost(t *testing.T) {
+	router := testRouter(t)
+
+	_, target := testBackend(t, "first", http.StatusOK)
+	require.NoError(t, router.SetServiceTarget("default", defaultEmptyHosts, target, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	second, _ := testBackend(t, "second", http.StatusOK)
+	secondURL, _ := url.Parse(second.URL)
+
+	require.NoError(t, router.SetRolloutTarget("default", ":"+secondURL.Port(), DefaultDeployTimeout, DefaultDrainTimeout))
+	assert.Equal(t, "127.0.0.1:"+secondURL.Port(), router.serviceForName("default").rollout.Target())
+}
+
+func TestTargetAddress_CheckTargetResolves(t *testing.T) {
+	assert.NoError(t, checkTargetResolves("default", "127.0.0.1:3000"))
+	assert.NoError(t, checkTargetResolves("default", "[::1]:3000"))
+	assert.NoError(t, checkTargetResolves("default", "localhost:3000"))
+	assert.NoError(t, checkTargetResolves("default", TunnelScheme+"agent-1"))
+
+	err := checkTargetResolves("default", "missing.invalid:3000")
+	assert.ErrorIs(t, err, ErrorTargetNotResolvable)
+	assert.Contains(t, err.Error(), "missing.invalid")
+}
+
+func TestTargetAddress_DeployFailsWhenTargetDoesNotResolve(t *testing.T) {
+	router := testRouter(t)
+
+	err := router.SetServiceTarget("default", defaultEmptyHosts, "missing.invalid:3000", defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout)
+	assert.ErrorIs(t, err, ErrorTargetNotResolvable)
+	assert.Nil(t, router.serviceForName("default"))
+}
+
+func TestTargetAddress_PlanFailsWhenTargetDoesNotResolve(t *testing.T) {
+	router := testRouter(t)
+
+	_, err := router.PlanServiceTarget("default", defaultEmptyHosts, "missing.invalid:3000", defaultServiceOptions, defaultTargetOptions, false)
+	assert.ErrorIs(t, err, ErrorTargetNotResolvable)
+
+	options := defaultServiceOptions
+	options.StandbyTarget = "missing.invalid:3000"
+	_, err = router.PlanServiceTarget("default", defaultEmptyHosts, "localhost:3000", options, defaultTargetOptions, false)
+	assert.ErrorIs(t, err, ErrorTargetNotResolvable)
+}
+
+// Helpers
+
+func testDockerAPI(t *testing.T, containers map[string]string) {
+	t.Helper()
+
+	socketPath := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, body := range containers {
+			if r.URL.Path == "/containers/"+name+"/json" {
+				w.Write([]byte(body))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})}
+	go server.Serve(listener)
+
+	previous := DockerSocketPath
+	DockerSocketPath = socketPath
+	t.Cleanup(func() {
+		DockerSocketPath = previous
+		server.Close()
+	})
+}
@@ -2,10 +2,20 @@ package server
 
 import (
 	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -146,6 +156,72 @@ func TestTarget_ServeWebSocket(t *testing.T) {
 	})
 }
 
+func TestTarget_WebSocketHandshakeTimeout(t *testing.T) {
+	targetOptions := defaultTargetOptions
+	targetOptions.WebSocketHandshakeTimeout = 50 * time.Millisecond
+
+	target := testTargetWithOptions(t, targetOptions, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestTarget_WebSocketIdleTimeout(t *testing.T) {
+	targetOptions := defaultTargetOptions
+	targetOptions.WebSocketIdleTimeout = 200 * time.Millisecond
+
+	target := testTargetWithOptions(t, targetOptions, func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{})
+		require.NoError(t, err)
+
+		go func() {
+			defer c.CloseNow()
+			for {
+				kind, body, err := c.Read(context.Background())
+				if err != nil {
+					return
+				}
+				c.Write(context.Background(), kind, body)
+			}
+		}()
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testServeRequestWithTarget(t, target, w, r)
+	}))
+	defer server.Close()
+
+	c, _, err := websocket.Dial(context.Background(), strings.Replace(server.URL, "http:", "ws:", 1), nil)
+	require.NoError(t, err)
+	defer c.CloseNow()
+
+	// Keeping the connection active lets it outlive the timeout
+	for range 4 {
+		time.Sleep(100 * time.Millisecond)
+		require.NoError(t, c.Write(context.Background(), websocket.MessageText, []byte("ping")))
+		_, body, err := c.Read(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(body))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, _, err = c.Read(ctx)
+	require.Error(t, err)
+	assert.NoError(t, ctx.Err(), "idle connection should be closed before the read times out")
+}
+
 func TestTarget_CancelledRequestsHaveStatus499(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
@@ -274,6 +350,336 @@ func TestTarget_UnparseableQueryParametersArePreserved(t *testing.T) {
 	require.Equal(t, http.StatusOK, w.Result().StatusCode)
 }
 
+func TestTarget_ForwardDeadline(t *testing.T) {
+	var deadline string
+
+	targetOptions := TargetOptions{ResponseTimeout: time.Minute, ForwardDeadline: true}
+	target := testTargetWithOptions(t, targetOptions, func(w http.ResponseWriter, r *http.Request) {
+		deadline = r.Header.Get("X-Request-Deadline")
+	})
+
+	started := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	deadlineMillis, err := strconv.ParseInt(deadline, 10, 64)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, deadlineMillis, started.Add(time.Minute).UnixMilli())
+	assert.LessOrEqual(t, deadlineMillis, time.Now().Add(time.Minute).UnixMilli())
+}
+
+func TestTarget_ForwardDeadlineReplacesClientHeader(t *testing.T) {
+	var deadline string
+
+	targetOptions := TargetOptions{ResponseTimeout: time.Minute, ForwardDeadline: true}
+	target := testTargetWithOptions(t, targetOptions, func(w http.ResponseWriter, r *http.Request) {
+		deadline = r.Header.Get("X-Request-Deadline")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-Deadline", "1")
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.NotEqual(t, "1", deadline)
+	assert.NotEmpty(t, deadline)
+}
+
+func TestTarget_DeadlineNotForwardedByDefault(t *testing.T) {
+	var deadline string
+
+	target := testTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		deadline = r.Header.Get("X-Request-Deadline")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-Deadline", "1")
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Empty(t, deadline)
+}
+
+func TestTarget_InflightRequests(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+
+	target := testTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+	})
+
+	assert.Empty(t, target.InflightRequests())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		req := httptest.NewRequest(http.MethodPost, "http://app.example.com/slow", nil)
+		testServeRequestWithTarget(t, target, httptest.NewRecorder(), req)
+	}()
+
+	<-started
+	inflight := target.InflightRequests()
+	require.Len(t, inflight, 1)
+	assert.Equal(t, http.MethodPost, inflight[0].Method)
+	assert.Equal(t, "app.example.com", inflight[0].Host)
+	assert.Equal(t, "/slow", inflight[0].Path)
+	assert.Equal(t, target.Target(), inflight[0].Target)
+	assert.False(t, inflight[0].Hijacked)
+	assert.Positive(t, inflight[0].Elapsed)
+
+	close(finish)
+	wg.Wait()
+
+	assert.Empty(t, target.InflightRequests())
+}
+
+func TestTarget_RefusedConnectionIsServiceUnavailable(t *testing.T) {
+	addr := testUnusedAddress(t)
+
+	target, err := NewTarget(addr, defaultTargetOptions)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.Equal(t, "1", w.Result().Header.Get("Retry-After"))
+}
+
+func TestTarget_RefusedConnectionIsRetried(t *testing.T) {
+	addr := testUnusedAddress(t)
+
+	target, err := NewTarget(addr, TargetOptions{
+		HealthCheckConfig: defaultHealthCheckConfig,
+		ResponseTimeout:   DefaultTargetTimeout,
+		RefusedRetryDelay: time.Millisecond * 200,
+	})
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})}
+		t.Cleanup(func() { server.Close() })
+		server.Serve(listener)
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "ok", w.Body.String())
+}
+
+func TestTarget_SourceAddress(t *testing.T) {
+	target := testTargetWithOptions(t, TargetOptions{
+		HealthCheckConfig: defaultHealthCheckConfig,
+		ResponseTimeout:   DefaultTargetTimeout,
+		SourceAddress:     "127.0.0.1",
+	}, func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		w.Write([]byte(host))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "127.0.0.1", w.Body.String())
+}
+
+func TestTarget_InvalidSourceAddress(t *testing.T) {
+	_, err := NewTarget("localhost:3000", TargetOptions{SourceAddress: "not-an-interface"})
+	assert.ErrorIs(t, err, ErrorInvalidSourceAddr)
+}
+
+func TestTarget_InterfaceSourceAddress(t *testing.T) {
+	ipv4 := net.ParseIP("192.0.2.1")
+	ipv6 := net.ParseIP("2001:db8::1")
+
+	addrs := []net.Addr{
+		&net.UnixAddr{Name: "/tmp/other", Net: "unix"},
+		&net.IPAddr{IP: ipv6},
+		&net.IPNet{IP: ipv4, Mask: net.CIDRMask(24, 32)},
+	}
+
+	assert.Equal(t, ipv4, interfaceSourceAddress(addrs))
+
+	assert.Equal(t, ipv6, interfaceSourceAddress([]net.Addr{&net.IPAddr{IP: ipv6}}))
+	assert.Nil(t, interfaceSourceAddress([]net.Addr{&net.UnixAddr{Name: "/tmp/other", Net: "unix"}}))
+	assert.Nil(t, interfaceSourceAddress(nil))
+}
+
+func TestTarget_SignRequests(t *testing.T) {
+	var signature string
+	target := testTargetWithOptions(t, TargetOptions{
+		HealthCheckConfig:   defaultHealthCheckConfig,
+		ResponseTimeout:     DefaultTargetTimeout,
+		BufferRequests:      true,
+		MaxMemoryBufferSize: DefaultMaxMemoryBufferSize,
+		SigningKeyFile:      testSigningKeyFile(t, "old-key\nnew-key\n"),
+	}, func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Kamal-Signature")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/orders?page=2", strings.NewReader("hello"))
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	parts := strings.Split(signature, ",")
+	require.Len(t, parts, 4)
+
+	timestamp := strings.TrimPrefix(parts[0], "t=")
+	bodyHash := sha256.Sum256([]byte("hello"))
+	assert.Equal(t, "h="+hex.EncodeToString(bodyHash[:]), parts[1])
+
+	payload := timestamp + "\nPOST\n/orders?page=2\n" + hex.EncodeToString(bodyHash[:])
+	for i, key := range []string{"old-key", "new-key"} {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(payload))
+		assert.Equal(t, "v1="+hex.EncodeToString(mac.Sum(nil)), parts[2+i])
+	}
+}
+
+func TestTarget_SignRequestsWithoutBuffering(t *testing.T) {
+	var signature string
+	target := testTargetWithOptions(t, TargetOptions{
+		HealthCheckConfig: defaultHealthCheckConfig,
+		ResponseTimeout:   DefaultTargetTimeout,
+		SigningKeyFile:    testSigningKeyFile(t, "key\n"),
+	}, func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Kamal-Signature")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+	testServeRequestWithTarget(t, target, httptest.NewRecorder(), req)
+	assert.Contains(t, signature, ",h=UNSIGNED-PAYLOAD,")
+
+	emptyHash := sha256.Sum256(nil)
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Kamal-Signature", "forged")
+	testServeRequestWithTarget(t, target, httptest.NewRecorder(), req)
+	assert.Contains(t, signature, ",h="+hex.EncodeToString(emptyHash[:])+",")
+}
+
+func TestTarget_SigningKeyFileMustContainKeys(t *testing.T) {
+	_, err := NewTarget("localhost:3000", TargetOptions{SigningKeyFile: testSigningKeyFile(t, "# no keys yet\n")})
+	assert.ErrorIs(t, err, ErrorSigningKeyFileEmpty)
+
+	_, err = NewTarget("localhost:3000", TargetOptions{SigningKeyFile: filepath.Join(t.TempDir(), "missing")})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestTarget_SigningKeysNotSaved(t *testing.T) {
+	options := TargetOptions{SigningKeyFile: testSigningKeyFile(t, "secret-key\n")}
+
+	data, err := json.Marshal(options)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret-key")
+}
+
+func TestTarget_StreamIdleTimeoutAllowsActiveStreams(t *testing.T) {
+	target := testTargetWithOptions(t, TargetOptions{
+		HealthCheckConfig: defaultHealthCheckConfig,
+		ResponseTimeout:   DefaultTargetTimeout,
+		StreamIdleTimeout: time.Millisecond * 100,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("data\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond * 40)
+		}
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, strings.Repeat("data\n", 5), w.Body.String())
+}
+
+func TestTarget_StreamIdleTimeoutClosesSilentStreams(t *testing.T) {
+	done := make(chan bool)
+	t.Cleanup(func() { close(done) })
+
+	target := testTargetWithOptions(t, TargetOptions{
+		HealthCheckConfig: defaultHealthCheckConfig,
+		ResponseTimeout:   DefaultTargetTimeout,
+		StreamIdleTimeout: time.Millisecond * 100,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data\n"))
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	})
+
+	started := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Equal(t, "data\n", w.Body.String())
+}
+
+func TestTarget_DecompressResponses(t *testing.T) {
+	target := testTargetWithOptions(t, TargetOptions{
+		HealthCheckConfig:   defaultHealthCheckConfig,
+		ResponseTimeout:     DefaultTargetTimeout,
+		DecompressResponses: true,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("hello"))
+		gz.Close()
+	})
+
+	for acceptEncoding, expectGzip := range map[string]bool{
+		"identity":         false,
+		"deflate, br":      false,
+		"gzip;q=0, br":     false,
+		"gzip, deflate":    true,
+		"br, gzip;q=0.5":   true,
+		"*":                true,
+		"identity, *;q=0.": false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		testServeRequestWithTarget(t, target, w, req)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		if expectGzip {
+			assert.Equal(t, "gzip", w.Result().Header.Get("Content-Encoding"), acceptEncoding)
+			assert.NotEqual(t, "hello", w.Body.String(), acceptEncoding)
+		} else {
+			assert.Empty(t, w.Result().Header.Get("Content-Encoding"), acceptEncoding)
+			assert.Equal(t, "hello", w.Body.String(), acceptEncoding)
+		}
+	}
+}
+
 func TestTarget_IsHealthCheckRequest(t *testing.T) {
 	target := testTarget(t, func(w http.ResponseWriter, r *http.Request) {})
 
@@ -302,6 +708,60 @@ func TestTarget_AddedTargetBecomesHealthy(t *testing.T) {
 	require.Equal(t, "ok", string(w.Body.String()))
 }
 
+func TestTarget_WarmConnections(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	options := defaultTargetOptions
+	options.WarmConnections = 5
+	target, err := NewTarget(strings.TrimPrefix(server.URL, "http://"), options)
+	require.NoError(t, err)
+
+	target.WarmConnections()
+	assert.Equal(t, int32(5), connections.Load())
+
+	for range 5 {
+		testServeRequestWithTarget(t, target, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	assert.Equal(t, int32(5), connections.Load(), "requests should use the warmed connections")
+}
+
+func TestTarget_WarmConnectionsUseServingPortWithSeparateHealthPort(t *testing.T) {
+	var served, checked atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+	}))
+	defer server.Close()
+	healthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checked.Add(1)
+	}))
+	defer healthServer.Close()
+
+	healthURL, err := url.Parse(healthServer.URL)
+	require.NoError(t, err)
+	healthPort, err := strconv.Atoi(healthURL.Port())
+	require.NoError(t, err)
+
+	options := defaultTargetOptions
+	options.WarmConnections = 3
+	options.HealthCheckConfig.Port = healthPort
+	target, err := NewTarget(strings.TrimPrefix(server.URL, "http://"), options)
+	require.NoError(t, err)
+
+	target.WarmConnections()
+	assert.Equal(t, int32(3), served.Load())
+	assert.Equal(t, int32(0), checked.Load())
+}
+
 func TestTarget_DrainWhenEmpty(t *testing.T) {
 	target := testTarget(t, func(w http.ResponseWriter, r *http.Request) {})
 
@@ -366,6 +826,58 @@ func TestTarget_DrainRequestsThatNeedToBeCancelled(t *testing.T) {
 	require.Equal(t, 0, served)
 }
 
+func TestTarget_DrainWaitsLongerForUploads(t *testing.T) {
+	target := testTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	bodyReader, bodyWriter := io.Pipe()
+	req := httptest.NewRequest(http.MethodPost, "/", bodyReader)
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+
+	served := make(chan struct{})
+	go func() {
+		testServeRequestWithTarget(t, target, w, req)
+		close(served)
+	}()
+
+	bodyWriter.Write([]byte("first part,"))
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		bodyWriter.Write([]byte("second part"))
+		bodyWriter.Close()
+	}()
+
+	target.DrainWithUploadTimeout(time.Millisecond*10, time.Second*5)
+	<-served
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "first part,second part", w.Body.String())
+}
+
+func TestTarget_DrainDoesNotWaitLongerForCompletedUploads(t *testing.T) {
+	var started sync.WaitGroup
+	started.Add(1)
+
+	target := testTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		started.Done()
+		<-r.Context().Done()
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	w := httptest.NewRecorder()
+	go testServeRequestWithTarget(t, target, w, req)
+
+	started.Wait()
+
+	startedDraining := time.Now()
+	target.DrainWithUploadTimeout(time.Millisecond*10, time.Second*5)
+	assert.Less(t, time.Since(startedDraining).Seconds(), 1.0)
+}
+
 func TestTarget_DrainHijackedConnectionsImmediately(t *testing.T) {
 	target := testTarget(t, func(w http.ResponseWriter, r *http.Request) {
 		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{})
@@ -394,6 +906,47 @@ func TestTarget_DrainHijackedConnectionsImmediately(t *testing.T) {
 	assert.Less(t, time.Since(startedDraining).Seconds(), 1.0)
 }
 
+func TestTarget_DrainSendsWebSocketCloseCode(t *testing.T) {
+	targetOptions := defaultTargetOptions
+	targetOptions.WebSocketDrainCloseCode = WebSocketCloseServiceRestart
+
+	target := testTargetWithOptions(t, targetOptions, func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{})
+		require.NoError(t, err)
+		defer c.CloseNow()
+
+		c.Read(context.Background())
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, err := target.StartRequest(r)
+		require.NoError(t, err)
+		target.SendRequest(w, r)
+	}))
+	defer server.Close()
+
+	websocketURL := strings.Replace(server.URL, "http:", "ws:", 1)
+
+	c, _, err := websocket.Dial(context.Background(), websocketURL, nil)
+	require.NoError(t, err)
+	defer c.CloseNow()
+
+	target.Drain(time.Second * 5)
+
+	_, _, err = c.Read(context.Background())
+	assert.Equal(t, websocket.StatusServiceRestart, websocket.CloseStatus(err))
+}
+
+func TestIsValidWebSocketDrainCloseCode(t *testing.T) {
+	assert.True(t, IsValidWebSocketDrainCloseCode(1000))
+	assert.True(t, IsValidWebSocketDrainCloseCode(1012))
+	assert.True(t, IsValidWebSocketDrainCloseCode(4000))
+
+	assert.False(t, IsValidWebSocketDrainCloseCode(999))
+	assert.False(t, IsValidWebSocketDrainCloseCode(1006))
+	assert.False(t, IsValidWebSocketDrainCloseCode(5000))
+}
+
 func TestTarget_EnforceMaxBodySizes(t *testing.T) {
 	sendRequest := func(bufferRequests, bufferResponses bool, maxMemorySize, maxBodySize int64, requestBody, responseBody string) *httptest.ResponseRecorder {
 		targetOptions := TargetOptions{
@@ -539,8 +1092,229 @@ func TestTarget_EnforceMaxBodySizes(t *testing.T) {
 	})
 }
 
+func TestTarget_StreamCloseDelimitedResponsesWithFlushTimeout(t *testing.T) {
+	body := strings.Repeat("long poll ", 10)
+
+	sendRequest := func(flushTimeout time.Duration) *httptest.ResponseRecorder {
+		targetOptions := TargetOptions{
+			BufferResponses:     true,
+			MaxMemoryBufferSize: 10,
+			MaxResponseBodySize: 10,
+			BufferFlushTimeout:  flushTimeout,
+			HealthCheckConfig:   defaultHealthCheckConfig,
+			ResponseTimeout:     DefaultTargetTimeout,
+		}
+
+		target := testTargetWithOptions(t, targetOptions, func(w http.ResponseWriter, r *http.Request) {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			defer conn.Close()
+
+			rw.WriteString("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n" + body)
+			rw.Flush()
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		testServeRequestWithTarget(t, target, w, req)
+		return w
+	}
+
+	w := sendRequest(time.Minute)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, body, w.Body.String())
+
+	w = sendRequest(0)
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+}
+
+func TestTarget_UpstreamConnectionsRecycledAfterMaxLifetime(t *testing.T) {
+	run := func(t *testing.T, useTLS bool, method string) {
+		targetOptions := defaultTargetOptions
+		targetOptions.UpstreamConnMaxLifetime = 100 * time.Millisecond
+		targetOptions.TargetTLS = useTLS
+		targetOptions.TargetTLSInsecure = useTLS
+
+		var lock sync.Mutex
+		requests := map[string]int{}
+		closing := map[string]bool{}
+
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			io.ReadAll(r.Body)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			requests[r.RemoteAddr]++
+			if r.Close {
+				closing[r.RemoteAddr] = true
+			}
+		}
+
+		var addr string
+		if useTLS {
+			addr, _ = testTLSBackend(t, handler)
+		} else {
+			_, addr = testBackendWithHandler(t, handler)
+		}
+
+		target, err := NewTarget(addr, targetOptions)
+		require.NoError(t, err)
+
+		// Keep the connection busy enough that it never reaches the idle timeout
+		started := time.Now()
+		for time.Since(started) < 350*time.Millisecond {
+			req := httptest.NewRequest(method, "/", strings.NewReader("body"))
+			w := httptest.NewRecorder()
+			testServeRequestWithTarget(t, target, w, req)
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		assert.GreaterOrEqual(t, len(requests), 3, "connections are replaced as they expire")
+		assert.GreaterOrEqual(t, len(closing), 2, "expired connections are closed after their last request")
+
+		total := 0
+		for _, count := range requests {
+			total += count
+		}
+		assert.Less(t, len(requests), total/2, "connections are reused until they expire")
+	}
+
+	t.Run("GET", func(t *testing.T) { run(t, false, http.MethodGet) })
+	t.Run("POST", func(t *testing.T) { run(t, false, http.MethodPost) })
+	t.Run("TLS", func(t *testing.T) { run(t, true, http.MethodGet) })
+}
+
+func testUnusedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	return addr
+}
+
 func testServeRequestWithTarget(t *testing.T, target *Target, w http.ResponseWriter, r *http.Request) {
 	r, err := target.StartRequest(r)
 	require.NoError(t, err)
 	target.SendRequest(w, r)
 }
+
+func TestTarget_ResponseTimeoutExtendedByInterimResponse(t *testing.T) {
+	run := func(t *testing.T, requested string, wait time.Duration) *http.Response {
+		target := testTargetWithOptions(t, TargetOptions{
+			HealthCheckConfig:  defaultHealthCheckConfig,
+			ResponseTimeout:    50 * time.Millisecond,
+			MaxResponseTimeout: 300 * time.Millisecond,
+		}, func(w http.ResponseWriter, r *http.Request) {
+			if requested != "" {
+				w.Header().Set(ResponseTimeoutHeader, requested)
+				w.WriteHeader(http.StatusProcessing)
+				w.Header().Del(ResponseTimeoutHeader)
+			}
+			time.Sleep(wait)
+			w.Write([]byte("done"))
+		})
+
+		front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			testServeRequestWithTarget(t, target, w, r)
+		}))
+		t.Cleanup(front.Close)
+
+		resp, err := http.Get(front.URL)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("extended", func(t *testing.T) {
+		resp := run(t, "1", 150*time.Millisecond)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "done", string(body))
+	})
+
+	t.Run("not extended", func(t *testing.T) {
+		resp := run(t, "", 200*time.Millisecond)
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	})
+
+	t.Run("limited to the maximum", func(t *testing.T) {
+		resp := run(t, "10", 600*time.Millisecond)
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	})
+}
+
+func TestTarget_ResponseTimeoutStartsAfterRequestIsWritten(t *testing.T) {
+	target := testTargetWithOptions(t, TargetOptions{
+		HealthCheckConfig:  defaultHealthCheckConfig,
+		ResponseTimeout:    50 * time.Millisecond,
+		MaxResponseTimeout: 300 * time.Millisecond,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	bodyReader, bodyWriter := io.Pipe()
+	go func() {
+		bodyWriter.Write([]byte("first part,"))
+		time.Sleep(150 * time.Millisecond)
+		bodyWriter.Write([]byte("second part"))
+		bodyWriter.Close()
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "/", bodyReader)
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "first part,second part", w.Body.String())
+}
+
+func TestTarget_ServeWebSocketWithExtendableResponseTimeout(t *testing.T) {
+	target := testTargetWithOptions(t, TargetOptions{
+		HealthCheckConfig:  defaultHealthCheckConfig,
+		ResponseTimeout:    50 * time.Millisecond,
+		MaxResponseTimeout: 300 * time.Millisecond,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{})
+		require.NoError(t, err)
+		defer c.CloseNow()
+
+		kind, body, err := c.Read(context.Background())
+		if err != nil {
+			return
+		}
+		c.Write(context.Background(), kind, body)
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testServeRequestWithTarget(t, target, w, r)
+	}))
+	defer server.Close()
+
+	c, _, err := websocket.Dial(context.Background(), strings.Replace(server.URL, "http:", "ws:", 1), nil)
+	require.NoError(t, err)
+	defer c.CloseNow()
+
+	// The connection outlives the response timeout once it's upgraded
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, c.Write(context.Background(), websocket.MessageText, []byte("hello")))
+	_, body, err := c.Read(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func testSigningKeyFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "signing-keys")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	return path
+}
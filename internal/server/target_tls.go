@@ -0,0 +1,39 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrorUnableToLoadTargetCA = errors.New("unable to load target CA bundle")
+
+// targetTLSConfig is how we connect to targets that serve HTTPS. They're
+// verified against the system's roots, or against a CA bundle when they use
+// certificates from a private CA. Verification can also be turned off, for
+// targets with self-signed certificates, although then the connection is
+// only protected from passive eavesdropping.
+func targetTLSConfig(options TargetOptions) (*tls.Config, error) {
+	if !options.TargetTLS {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: options.TargetTLSInsecure}
+
+	if options.TargetTLSCA != "" {
+		data, err := os.ReadFile(options.TargetTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrorUnableToLoadTargetCA, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%w: no certificates found in %s", ErrorUnableToLoadTargetCA, options.TargetTLSCA)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
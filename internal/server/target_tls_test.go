@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarget_TLSWithCABundle(t *testing.T) {
+	var scheme string
+	addr, caPath := testTLSBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	})
+
+	targetOptions := defaultTargetOptions
+	targetOptions.TargetTLS = true
+	targetOptions.TargetTLSCA = caPath
+
+	target, err := NewTarget(addr, targetOptions)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "https", scheme)
+	assert.NoError(t, target.ProbeHealth())
+}
+
+func TestTarget_TLSRejectsUntrustedCertificate(t *testing.T) {
+	addr, _ := testTLSBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	targetOptions := defaultTargetOptions
+	targetOptions.TargetTLS = true
+	targetOptions.ExposeUpstreamErrors = true
+
+	target, err := NewTarget(addr, targetOptions)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+	assert.Equal(t, UpstreamErrorTLS, w.Result().Header.Get("X-Kamal-Upstream-Error"))
+	assert.Error(t, target.ProbeHealth())
+}
+
+func TestTarget_TLSInsecure(t *testing.T) {
+	addr, _ := testTLSBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	targetOptions := defaultTargetOptions
+	targetOptions.TargetTLS = true
+	targetOptions.TargetTLSInsecure = true
+
+	target, err := NewTarget(addr, targetOptions)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestTarget_TLSWithMissingCABundle(t *testing.T) {
+	targetOptions := defaultTargetOptions
+	targetOptions.TargetTLS = true
+	targetOptions.TargetTLSCA = filepath.Join(t.TempDir(), "missing.pem")
+
+	_, err := NewTarget("localhost:3000", targetOptions)
+	assert.ErrorIs(t, err, ErrorUnableToLoadTargetCA)
+}
+
+func TestTarget_TLSHealthCheckServerName(t *testing.T) {
+	var serverNames []string
+	addr, _ := testTLSBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		serverNames = append(serverNames, r.TLS.ServerName)
+	})
+
+	targetOptions := defaultTargetOptions
+	targetOptions.TargetTLS = true
+	targetOptions.TargetTLSInsecure = true
+	targetOptions.HealthCheckConfig.ServerName = "health.internal"
+
+	target, err := NewTarget(addr, targetOptions)
+	require.NoError(t, err)
+
+	require.NoError(t, target.ProbeHealth())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	testServeRequestWithTarget(t, target, httptest.NewRecorder(), req)
+
+	assert.Equal(t, []string{"health.internal", ""}, serverNames)
+}
+
+func TestTarget_TLSHealthCheckConnectionsClosedWhenDrained(t *testing.T) {
+	var closed atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	targetOptions := defaultTargetOptions
+	targetOptions.TargetTLS = true
+	targetOptions.TargetTLSInsecure = true
+	targetOptions.HealthCheckConfig.ServerName = "health.internal"
+	targetOptions.HealthCheckConfig.Host = "health.internal"
+
+	target, err := NewTarget(serverURL.Host, targetOptions)
+	require.NoError(t, err)
+
+	require.NoError(t, target.ProbeHealth())
+	assert.Equal(t, int32(0), closed.Load())
+
+	target.Drain(time.Second)
+	assert.Eventually(t, func() bool { return closed.Load() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+// Private
+
+func testTLSBackend(t *testing.T, handler http.HandlerFunc) (string, string) {
+	t.Helper()
+
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caPath, caPEM, 0o600))
+
+	return serverURL.Host, caPath
+}
@@ -65,9 +65,10 @@ func testServer(t testing.TB) (*Server, string) {
 		Bind:               "127.0.0.1",
 		HttpPort:           0,
 		HttpsPort:          0,
+		InternalPathPrefix: DefaultInternalPathPrefix,
 		AlternateConfigDir: t.TempDir(),
 	}
-	router := NewRouter(config.StatePath())
+	router := NewRouter(NewFileStateStore(config.StatePath()))
 	server := NewServer(config, router)
 	err := server.Start()
 	require.NoError(t, err)
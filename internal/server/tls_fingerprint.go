@@ -0,0 +1,437 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	JA3FingerprintHeader = "X-JA3-Fingerprint"
+	JA4FingerprintHeader = "X-JA4-Fingerprint"
+
+	tlsRecordHeaderLength       = 5
+	tlsRecordTypeHandshake      = 0x16
+	tlsHandshakeTypeClientHello = 0x01
+	maxClientHelloLength        = 64 * 1024
+
+	tlsExtensionServerName          = 0x0000
+	tlsExtensionSupportedGroups     = 0x000a
+	tlsExtensionECPointFormats      = 0x000b
+	tlsExtensionSignatureAlgorithms = 0x000d
+	tlsExtensionALPN                = 0x0010
+	tlsExtensionSupportedVersions   = 0x002b
+)
+
+var contextKeyClientHello = contextKey("client-hello")
+
+// ClientHello holds the parts of a TLS ClientHello message that are used to
+// fingerprint the client.
+type ClientHello struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+	ALPNProtocols       []string
+	HasServerName       bool
+}
+
+// ParseClientHello parses a ClientHello handshake message, without its
+// handshake header.
+func ParseClientHello(data []byte) (*ClientHello, bool) {
+	hello := &ClientHello{}
+	s := cryptobyte.String(data)
+
+	var random, sessionID, cipherSuites, compressionMethods cryptobyte.String
+	if !s.ReadUint16(&hello.Version) ||
+		!s.ReadBytes((*[]byte)(&random), 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, false
+	}
+
+	for !cipherSuites.Empty() {
+		var suite uint16
+		if !cipherSuites.ReadUint16(&suite) {
+			return nil, false
+		}
+		hello.CipherSuites = append(hello.CipherSuites, suite)
+	}
+
+	if s.Empty() {
+		return hello, true // No extensions
+	}
+
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, false
+	}
+
+	for !extensions.Empty() {
+		var extension uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil, false
+		}
+		hello.Extensions = append(hello.Extensions, extension)
+
+		if !hello.parseExtension(extension, extData) {
+			return nil, false
+		}
+	}
+
+	return hello, true
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello, as the MD5 hash of its
+// version, cipher suites, extensions, groups and point formats.
+func (h *ClientHello) JA3() string {
+	fields := []string{
+		strconv.Itoa(int(h.Version)),
+		joinDecimal(withoutGREASE(h.CipherSuites)),
+		joinDecimal(withoutGREASE(h.Extensions)),
+		joinDecimal(withoutGREASE(h.SupportedGroups)),
+		joinDecimal(h.PointFormats),
+	}
+
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello.
+func (h *ClientHello) JA4() string {
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	sni := "i"
+	if h.HasServerName {
+		sni = "d"
+	}
+
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s",
+		h.ja4Version(), sni, min(len(ciphers), 99), min(len(extensions), 99), h.ja4ALPN())
+
+	sortedExtensions := slices.DeleteFunc(slices.Clone(extensions), func(ext uint16) bool {
+		return ext == tlsExtensionServerName || ext == tlsExtensionALPN
+	})
+	slices.Sort(sortedExtensions)
+
+	extensionsAndAlgorithms := joinHex(sortedExtensions)
+	if len(h.SignatureAlgorithms) > 0 {
+		extensionsAndAlgorithms += "_" + joinHex(h.SignatureAlgorithms)
+	}
+
+	sortedCiphers := slices.Clone(ciphers)
+	slices.Sort(sortedCiphers)
+
+	return prefix + "_" + ja4Hash(joinHex(sortedCiphers)) + "_" + ja4Hash(extensionsAndAlgorithms)
+}
+
+// WithClientHelloRecording wraps a listener so that the ClientHello sent on
+// each connection is kept, to be fingerprinted later.
+func WithClientHelloRecording(l net.Listener) net.Listener {
+	return &clientHelloListener{Listener: l}
+}
+
+// ClientHelloConnContext makes a connection's recorded ClientHello available
+// to the requests served on it. It is intended to be used as an
+// http.Server's ConnContext.
+func ClientHelloConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+
+	if recorder, ok := c.(*clientHelloConn); ok {
+		return context.WithValue(ctx, contextKeyClientHello, recorder)
+	}
+
+	return ctx
+}
+
+// ClientHelloFromRequest returns the ClientHello of the connection a request
+// arrived on, if it was recorded.
+func ClientHelloFromRequest(r *http.Request) (*ClientHello, bool) {
+	recorder, ok := r.Context().Value(contextKeyClientHello).(*clientHelloConn)
+	if !ok {
+		return nil, false
+	}
+
+	return recorder.ClientHello()
+}
+
+// Private
+
+func (h *ClientHello) parseExtension(extension uint16, data cryptobyte.String) bool {
+	switch extension {
+	case tlsExtensionServerName:
+		h.HasServerName = true
+
+	case tlsExtensionSupportedGroups:
+		var groups cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&groups) {
+			return false
+		}
+		for !groups.Empty() {
+			var group uint16
+			if !groups.ReadUint16(&group) {
+				return false
+			}
+			h.SupportedGroups = append(h.SupportedGroups, group)
+		}
+
+	case tlsExtensionECPointFormats:
+		var formats cryptobyte.String
+		if !data.ReadUint8LengthPrefixed(&formats) {
+			return false
+		}
+		h.PointFormats = append(h.PointFormats, formats...)
+
+	case tlsExtensionSignatureAlgorithms:
+		var algorithms cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&algorithms) {
+			return false
+		}
+		for !algorithms.Empty() {
+			var algorithm uint16
+			if !algorithms.ReadUint16(&algorithm) {
+				return false
+			}
+			h.SignatureAlgorithms = append(h.SignatureAlgorithms, algorithm)
+		}
+
+	case tlsExtensionALPN:
+		var protocols cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&protocols) {
+			return false
+		}
+		for !protocols.Empty() {
+			var protocol cryptobyte.String
+			if !protocols.ReadUint8LengthPrefixed(&protocol) {
+				return false
+			}
+			h.ALPNProtocols = append(h.ALPNProtocols, string(protocol))
+		}
+
+	case tlsExtensionSupportedVersions:
+		var versions cryptobyte.String
+		if !data.ReadUint8LengthPrefixed(&versions) {
+			return false
+		}
+		for !versions.Empty() {
+			var version uint16
+			if !versions.ReadUint16(&version) {
+				return false
+			}
+			h.SupportedVersions = append(h.SupportedVersions, version)
+		}
+	}
+
+	return true
+}
+
+func (h *ClientHello) ja4Version() string {
+	version := h.Version
+	for _, v := range withoutGREASE(h.SupportedVersions) {
+		version = max(version, v)
+	}
+
+	switch version {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case tls.VersionSSL30:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+func (h *ClientHello) ja4ALPN() string {
+	if len(h.ALPNProtocols) == 0 || h.ALPNProtocols[0] == "" {
+		return "00"
+	}
+
+	protocol := h.ALPNProtocols[0]
+	first, last := protocol[0], protocol[len(protocol)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		return hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+	}
+
+	return string(first) + string(last)
+}
+
+type clientHelloListener struct {
+	net.Listener
+}
+
+func (l *clientHelloListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &clientHelloConn{Conn: c}, nil
+}
+
+// clientHelloConn keeps a copy of the data read from the connection until it
+// contains a complete ClientHello.
+type clientHelloConn struct {
+	net.Conn
+
+	lock     sync.Mutex
+	buffer   []byte
+	done     bool
+	hello    *ClientHello
+	helloSet bool
+}
+
+func (c *clientHelloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	c.lock.Lock()
+	if !c.done && n > 0 {
+		c.buffer = append(c.buffer, b[:n]...)
+		c.parse()
+	}
+	c.lock.Unlock()
+
+	return n, err
+}
+
+func (c *clientHelloConn) ClientHello() (*ClientHello, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.hello, c.helloSet
+}
+
+func (c *clientHelloConn) parse() {
+	message, complete, ok := clientHelloMessage(c.buffer)
+	if !ok || (!complete && len(c.buffer) > maxClientHelloLength) {
+		c.finish()
+		return
+	}
+	if !complete {
+		return
+	}
+
+	c.hello, c.helloSet = ParseClientHello(message)
+	c.finish()
+}
+
+func (c *clientHelloConn) finish() {
+	c.done = true
+	c.buffer = nil
+}
+
+// clientHelloMessage extracts the body of the ClientHello from the start of a
+// connection, joining it together from as many handshake records as it spans.
+// It reports whether the message is complete, and whether the data looks like
+// a ClientHello at all.
+func clientHelloMessage(data []byte) (message []byte, complete bool, ok bool) {
+	var handshake []byte
+
+	for len(data) >= tlsRecordHeaderLength {
+		if data[0] != tlsRecordTypeHandshake {
+			return nil, false, false
+		}
+
+		length := int(data[3])<<8 | int(data[4])
+		if len(data) < tlsRecordHeaderLength+length {
+			break
+		}
+
+		handshake = append(handshake, data[tlsRecordHeaderLength:tlsRecordHeaderLength+length]...)
+		data = data[tlsRecordHeaderLength+length:]
+
+		if len(handshake) >= 4 {
+			if handshake[0] != tlsHandshakeTypeClientHello {
+				return nil, false, false
+			}
+
+			length := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= 4+length {
+				return handshake[4 : 4+length], true, true
+			}
+		}
+	}
+
+	return nil, false, true
+}
+
+func setTLSFingerprintHeaders(r *http.Request) {
+	r.Header.Del(JA3FingerprintHeader)
+	r.Header.Del(JA4FingerprintHeader)
+
+	if r.TLS == nil {
+		return
+	}
+
+	hello, ok := ClientHelloFromRequest(r)
+	if !ok {
+		return
+	}
+
+	r.Header.Set(JA3FingerprintHeader, hello.JA3())
+	r.Header.Set(JA4FingerprintHeader, hello.JA4())
+}
+
+// GREASE values (RFC 8701) are random placeholders that clients send to keep
+// servers tolerant of unknown values, so they must be ignored to produce a
+// stable fingerprint.
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), isGREASE)
+}
+
+func joinDecimal[T uint8 | uint16](values []T) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func isAlphanumeric(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func ja4Hash(value string) string {
+	if value == "" {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:12]
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSFingerprint_RecordedFromHandshake(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hello, ok := ClientHelloFromRequest(r)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(hello.JA3() + " " + hello.JA4()))
+	}))
+	server.Listener = WithClientHelloRecording(server.Listener)
+	server.Config.ConnContext = ClientHelloConnContext
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	fingerprint := func() string {
+		client := server.Client()
+		defer client.CloseIdleConnections()
+
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	first := fingerprint()
+	assert.Regexp(t, `^[0-9a-f]{32} t13i\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`, first)
+	assert.Equal(t, first, fingerprint())
+}
+
+func TestTLSFingerprint_JA3(t *testing.T) {
+	hello := &ClientHello{
+		Version:         0x0303,
+		CipherSuites:    []uint16{0x1a1a, 4865, 4866},
+		Extensions:      []uint16{0x2a2a, 0, 10, 11},
+		SupportedGroups: []uint16{0x3a3a, 29, 23},
+		PointFormats:    []uint8{0},
+	}
+
+	sum := md5.Sum([]byte("771,4865-4866,0-10-11,29-23,0"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), hello.JA3())
+}
+
+func TestTLSFingerprint_JA4(t *testing.T) {
+	hello := &ClientHello{
+		Version:             0x0303,
+		CipherSuites:        []uint16{0x1a1a, 0x1302, 0x1301},
+		Extensions:          []uint16{0x2a2a, 0x0000, 0x0010, 0x002b, 0x000d},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804},
+		SupportedVersions:   []uint16{0x3a3a, 0x0304, 0x0303},
+		ALPNProtocols:       []string{"h2", "http/1.1"},
+		HasServerName:       true,
+	}
+
+	expected := "t13d0204h2_" + ja4Hash("1301,1302") + "_" + ja4Hash("000d,002b_0403,0804")
+	assert.Equal(t, expected, hello.JA4())
+
+	hello = &ClientHello{Version: 0x0303, CipherSuites: []uint16{0x1301}}
+	assert.Equal(t, "t12i010000_"+ja4Hash("1301")+"_000000000000", hello.JA4())
+}
+
+func TestTLSFingerprint_ClientHelloMessageSpanningRecords(t *testing.T) {
+	message := []byte{1, 0, 0, 3, 'a', 'b', 'c'}
+
+	data := []byte{0x16, 3, 1, 0, 5}
+	data = append(data, message[:5]...)
+
+	_, complete, ok := clientHelloMessage(data)
+	assert.True(t, ok)
+	assert.False(t, complete)
+
+	data = append(data, 0x16, 3, 1, 0, 2)
+	data = append(data, message[5:]...)
+
+	body, complete, ok := clientHelloMessage(data)
+	assert.True(t, ok)
+	assert.True(t, complete)
+	assert.Equal(t, []byte("abc"), body)
+}
+
+func TestTLSFingerprint_ClientHelloMessageRejectsOtherData(t *testing.T) {
+	_, _, ok := clientHelloMessage([]byte("GET / HTTP/1.1\r\n"))
+	assert.False(t, ok)
+}
+
+func TestTLSFingerprint_ClientHeadersRemovedWithoutTLS(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(JA3FingerprintHeader, "forged")
+	req.Header.Set(JA4FingerprintHeader, "forged")
+
+	setTLSFingerprintHeaders(req)
+
+	assert.Empty(t, req.Header.Get(JA3FingerprintHeader))
+	assert.Empty(t, req.Header.Get(JA4FingerprintHeader))
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var ErrorInvalidTLSRedirectException = errors.New("TLS redirect exception must be a host pattern, or a path starting with /")
+
+// ParseTLSRedirectException checks an exception to the HTTPS redirect, which
+// is either a host pattern (such as internal.example.com or *.internal) or a
+// path (such as /healthz). A path ending in * matches everything that starts
+// with the rest of it, such as /.well-known/*.
+func ParseTLSRedirectException(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.ContainsAny(value, " \t") {
+		return "", ErrorInvalidTLSRedirectException
+	}
+
+	if !strings.HasPrefix(value, "/") {
+		host, err := NormalizeHost(value)
+		if err != nil {
+			return "", ErrorInvalidTLSRedirectException
+		}
+		if _, err := path.Match(host, ""); err != nil {
+			return "", ErrorInvalidTLSRedirectException
+		}
+		return host, nil
+	}
+
+	return value, nil
+}
+
+// Private
+
+func isTLSRedirectException(r *http.Request, exceptions []string) bool {
+	if len(exceptions) == 0 {
+		return false
+	}
+
+	host, _ := splitHostPort(r.Host)
+	host = normalizeRequestHost(host)
+
+	for _, exception := range exceptions {
+		if strings.HasPrefix(exception, "/") {
+			if matchesPathException(r.URL.Path, exception) {
+				return true
+			}
+		} else if matchesAnyHostPattern(host, []string{exception}) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPathException(requestPath string, exception string) bool {
+	if prefix, ok := strings.CutSuffix(exception, "*"); ok {
+		return strings.HasPrefix(requestPath, prefix)
+	}
+	return requestPath == exception
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTLSRedirectException(t *testing.T) {
+	for value, expected := range map[string]string{
+		"/healthz":        "/healthz",
+		"/.well-known/*":  "/.well-known/*",
+		"Internal.Local.": "internal.local",
+		"*.internal":      "*.internal",
+		"bücher.example":  "xn--bcher-kva.example",
+	} {
+		exception, err := ParseTLSRedirectException(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, expected, exception, value)
+	}
+
+	for _, value := range []string{"", "two words", "[internal"} {
+		_, err := ParseTLSRedirectException(value)
+		assert.Equal(t, ErrorInvalidTLSRedirectException, err, value)
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TunnelScheme = "tunnel://"
+
+	tunnelGreeting             = "KAMAL-TUNNEL"
+	tunnelAccepted             = "OK"
+	tunnelRegistrationTimeout  = 10 * time.Second
+	tunnelDialTimeout          = 10 * time.Second
+	tunnelMaxIdleConnsPerAgent = 128
+	tunnelMaxAgents            = 64
+	tunnelMaxLineLength        = 1024
+)
+
+var (
+	ErrorTunnelNotConnected       = errors.New("no tunnel connection available")
+	ErrorTunnelRegistrationFailed = errors.New("tunnel registration failed")
+	ErrorTunnelTokenRequired      = errors.New("a tunnel token is required to accept tunnel connections")
+	ErrorTunnelTooManyAgents      = errors.New("too many tunnels registered")
+	ErrorTunnelTooManyConnections = errors.New("too many idle connections for tunnel")
+)
+
+// TunnelRegistry holds the idle connections that tunnel agents have opened to
+// us, so that targets addressed as tunnel://<name> can use them in place of
+// dialing out. The server owns it, and the router hands it to the targets it
+// creates.
+type TunnelRegistry struct {
+	pools map[string]chan net.Conn
+	lock  sync.Mutex
+}
+
+func NewTunnelRegistry() *TunnelRegistry {
+	return &TunnelRegistry{
+		pools: map[string]chan net.Conn{},
+	}
+}
+
+func (r *TunnelRegistry) Add(name string, conn net.Conn) error {
+	pool, err := r.pool(name)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case pool <- conn:
+		return nil
+	default:
+		return ErrorTunnelTooManyConnections
+	}
+}
+
+func (r *TunnelRegistry) Dial(ctx context.Context, name string) (net.Conn, error) {
+	if r == nil {
+		return nil, fmt.Errorf("%w (%s)", ErrorTunnelNotConnected, name)
+	}
+
+	pool, err := r.pool(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w (%s)", err, name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tunnelDialTimeout)
+	defer cancel()
+
+	for {
+		select {
+		case conn := <-pool:
+			if tunnelConnIsAlive(conn) {
+				return conn, nil
+			}
+			conn.Close()
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (%s)", ErrorTunnelNotConnected, name)
+		}
+	}
+}
+
+func (r *TunnelRegistry) pool(name string) (chan net.Conn, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	pool, ok := r.pools[name]
+	if !ok {
+		if len(r.pools) >= tunnelMaxAgents {
+			return nil, ErrorTunnelTooManyAgents
+		}
+		pool = make(chan net.Conn, tunnelMaxIdleConnsPerAgent)
+		r.pools[name] = pool
+	}
+	return pool, nil
+}
+
+// TunnelToken is the token that an agent registering as name must present.
+// It is derived from the proxy's tunnel secret, so each token is only good
+// for one name, and holding it doesn't let an agent register under another
+// name and take over that tunnel's traffic.
+func TunnelToken(secret, name string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// TunnelListener accepts connections from tunnel agents. Each agent
+// connection starts with a registration line naming the tunnel, after which
+// it carries plain HTTP/1.1 traffic from us to the agent.
+type TunnelListener struct {
+	registry *TunnelRegistry
+	secret   string
+	listener net.Listener
+}
+
+func NewTunnelListener(registry *TunnelRegistry, secret string) *TunnelListener {
+	return &TunnelListener{
+		registry: registry,
+		secret:   secret,
+	}
+}
+
+func (l *TunnelListener) Start(addr string) error {
+	// Without a token, anyone who can reach the port could register under a
+	// target's name and take its traffic.
+	if l.secret == "" {
+		return ErrorTunnelTokenRequired
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("Failed to start tunnel listener", "error", err)
+		return err
+	}
+	l.listener = listener
+
+	go func() {
+		for {
+			conn, err := l.listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					slog.Debug("Closing tunnel listener")
+					return
+				}
+				slog.Error("Error accepting tunnel connection", "error", err)
+				continue
+			}
+
+			go l.register(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (l *TunnelListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *TunnelListener) Close() error {
+	return l.listener.Close()
+}
+
+// Private
+
+func (l *TunnelListener) register(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(tunnelRegistrationTimeout))
+
+	name, token, err := readTunnelRegistration(conn)
+	if err != nil {
+		slog.Info("Tunnel: rejecting connection", "remote", conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(TunnelToken(l.secret, name))) != 1 {
+		slog.Info("Tunnel: rejecting connection with invalid token", "tunnel", name, "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+
+	_, err = l.registry.pool(name)
+	if err != nil {
+		slog.Warn("Tunnel: rejecting connection", "tunnel", name, "remote", conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+
+	_, err = fmt.Fprintf(conn, "%s\n", tunnelAccepted)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	slog.Debug("Tunnel: registered connection", "tunnel", name, "remote", conn.RemoteAddr().String())
+
+	err = l.registry.Add(name, conn)
+	if err != nil {
+		slog.Warn("Tunnel: closing connection", "tunnel", name, "error", err)
+		conn.Close()
+	}
+}
+
+func readTunnelRegistration(conn net.Conn) (string, string, error) {
+	line, err := readTunnelLine(conn)
+	if err != nil {
+		return "", "", err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 || fields[0] != tunnelGreeting {
+		return "", "", ErrorTunnelRegistrationFailed
+	}
+
+	name := fields[1]
+	token := ""
+	if len(fields) == 3 {
+		token = fields[2]
+	}
+
+	return name, token, nil
+}
+
+// tunnelConnIsAlive weeds out connections whose agent has gone away while they
+// were sitting idle in the pool. An idle connection has nothing to read, so a
+// read that times out immediately is the healthy case.
+func tunnelConnIsAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now())
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, err := conn.Read(make([]byte, 1))
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// readTunnelLine reads the handshake one byte at a time, rather than through
+// a buffered reader, so that we can't swallow any of the HTTP traffic that
+// follows it on the same connection.
+func readTunnelLine(conn net.Conn) (string, error) {
+	var line strings.Builder
+	b := make([]byte, 1)
+
+	for line.Len() < tunnelMaxLineLength {
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return line.String(), nil
+		}
+		line.WriteByte(b[0])
+	}
+
+	return "", ErrorTunnelRegistrationFailed
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTunnelConnections = 4
+
+	tunnelAgentMinBackoff = time.Second
+	tunnelAgentMaxBackoff = 30 * time.Second
+)
+
+// TunnelAgent runs alongside a target that the proxy can't reach directly. It
+// keeps a number of connections open to the proxy's tunnel listener, and
+// serves the requests that arrive over them by forwarding them to the target.
+type TunnelAgent struct {
+	name      string
+	proxyAddr string
+	token     string
+	server    *http.Server
+	listener  *tunnelAgentListener
+}
+
+func NewTunnelAgent(name, proxyAddr, token, targetURL string, connections int) (*TunnelAgent, error) {
+	uri, err := parseTargetURL(targetURL)
+	if err != nil {
+		return nil, err
+	}
+
+	agent := &TunnelAgent{
+		name:      name,
+		proxyAddr: proxyAddr,
+		token:     token,
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(req *httputil.ProxyRequest) {
+			// The proxy has already set the forwarding headers, so we pass
+			// the request through unchanged.
+			req.SetURL(uri)
+			req.Out.Host = req.In.Host
+			req.Out.URL.RawQuery = req.In.URL.RawQuery
+		},
+	}
+	if path, ok := unixSocketPath(targetURL); ok {
+		proxy.Transport = &http.Transport{DialContext: dialUnixSocket(path)}
+	}
+
+	agent.listener = newTunnelAgentListener(agent, max(connections, 1))
+	agent.server = &http.Server{Handler: proxy}
+
+	return agent, nil
+}
+
+func (a *TunnelAgent) Run() error {
+	slog.Info("Tunnel agent started", "tunnel", a.name, "proxy", a.proxyAddr)
+
+	err := a.server.Serve(a.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (a *TunnelAgent) Close() error {
+	return a.server.Close()
+}
+
+// Private
+
+func (a *TunnelAgent) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", a.proxyAddr, tunnelDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(tunnelRegistrationTimeout))
+
+	_, err = fmt.Fprintf(conn, "%s %s %s\n", tunnelGreeting, a.name, a.token)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply, err := readTunnelLine(conn)
+	if err != nil || strings.TrimSpace(reply) != tunnelAccepted {
+		conn.Close()
+		return nil, ErrorTunnelRegistrationFailed
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+type tunnelAgentListener struct {
+	agent  *TunnelAgent
+	slots  chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newTunnelAgentListener(agent *TunnelAgent, connections int) *tunnelAgentListener {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &tunnelAgentListener{
+		agent:  agent,
+		slots:  make(chan struct{}, connections),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Accept blocks until one of our connections to the proxy has closed, and
+// then dials a replacement, so that we always keep the configured number open.
+func (l *tunnelAgentListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+
+	backoff := tunnelAgentMinBackoff
+	for {
+		conn, err := l.agent.dial()
+		if err == nil {
+			return &tunnelAgentConn{Conn: conn, release: l.release}, nil
+		}
+
+		slog.Warn("Tunnel agent: unable to connect to proxy", "proxy", l.agent.proxyAddr, "error", err, "retry_in", backoff)
+
+		select {
+		case <-time.After(backoff):
+			backoff = min(backoff*2, tunnelAgentMaxBackoff)
+		case <-l.ctx.Done():
+			<-l.slots
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+func (l *tunnelAgentListener) Close() error {
+	l.cancel()
+	return nil
+}
+
+func (l *tunnelAgentListener) Addr() net.Addr {
+	return tunnelAddr(l.agent.name)
+}
+
+func (l *tunnelAgentListener) release() {
+	<-l.slots
+}
+
+type tunnelAgentConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *tunnelAgentConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.release)
+	return err
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
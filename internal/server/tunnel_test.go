@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnel_ServeRequestsThroughAgent(t *testing.T) {
+	_, backend := testBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through the tunnel: " + r.Host))
+	})
+
+	registry := NewTunnelRegistry()
+	listener := testTunnelListener(t, registry, "secret")
+
+	agent, err := NewTunnelAgent("tunnelled-app", listener.Addr().String(), TunnelToken("secret", "tunnelled-app"), backend, 2)
+	require.NoError(t, err)
+	go agent.Run()
+	t.Cleanup(func() { agent.Close() })
+
+	targetOptions := defaultTargetOptions
+	targetOptions.HealthCheckConfig.Interval = time.Millisecond * 10
+	targetOptions.tunnels = registry
+
+	target, err := NewTarget("tunnel://tunnelled-app", targetOptions)
+	require.NoError(t, err)
+	require.Equal(t, "tunnel://tunnelled-app", target.Target())
+	require.True(t, target.WaitUntilHealthy(time.Second))
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "through the tunnel: app.example.com", w.Body.String())
+}
+
+func TestTunnel_RejectInvalidToken(t *testing.T) {
+	listener := testTunnelListener(t, NewTunnelRegistry(), "secret")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "KAMAL-TUNNEL app wrong\n")
+
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.Error(t, err)
+}
+
+func TestTunnel_RejectTokenForAnotherName(t *testing.T) {
+	listener := testTunnelListener(t, NewTunnelRegistry(), "secret")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "KAMAL-TUNNEL app %s\n", TunnelToken("secret", "other-app"))
+
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.Error(t, err)
+}
+
+func TestTunnel_AcceptTokenForName(t *testing.T) {
+	listener := testTunnelListener(t, NewTunnelRegistry(), "secret")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "KAMAL-TUNNEL app %s\n", TunnelToken("secret", "app"))
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "OK\n", reply)
+}
+
+func TestTunnel_LimitNumberOfTunnels(t *testing.T) {
+	registry := NewTunnelRegistry()
+
+	for i := range tunnelMaxAgents {
+		require.NoError(t, registry.Add(fmt.Sprintf("app-%d", i), testTunnelConn(t)))
+	}
+
+	assert.ErrorIs(t, registry.Add("one-too-many", testTunnelConn(t)), ErrorTunnelTooManyAgents)
+	assert.NoError(t, registry.Add("app-0", testTunnelConn(t)))
+}
+
+func TestTunnel_LimitConnectionsPerTunnel(t *testing.T) {
+	registry := NewTunnelRegistry()
+
+	for range tunnelMaxIdleConnsPerAgent {
+		require.NoError(t, registry.Add("app", testTunnelConn(t)))
+	}
+
+	assert.ErrorIs(t, registry.Add("app", testTunnelConn(t)), ErrorTunnelTooManyConnections)
+}
+
+func TestTunnel_RejectMissingToken(t *testing.T) {
+	listener := testTunnelListener(t, NewTunnelRegistry(), "secret")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "KAMAL-TUNNEL app\n")
+
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.Error(t, err)
+}
+
+func TestTunnel_RequireTokenToListen(t *testing.T) {
+	listener := NewTunnelListener(NewTunnelRegistry(), "")
+	assert.ErrorIs(t, listener.Start("127.0.0.1:0"), ErrorTunnelTokenRequired)
+}
+
+func TestTunnel_RejectInvalidRegistration(t *testing.T) {
+	listener := testTunnelListener(t, NewTunnelRegistry(), "secret")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\n")
+
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.Error(t, err)
+}
+
+func testTunnelConn(t *testing.T) net.Conn {
+	t.Helper()
+
+	conn, other := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		other.Close()
+	})
+
+	return conn
+}
+
+func testTunnelListener(t *testing.T, registry *TunnelRegistry, token string) *TunnelListener {
+	t.Helper()
+
+	listener := NewTunnelListener(registry, token)
+	require.NoError(t, listener.Start("127.0.0.1:0"))
+	t.Cleanup(func() { listener.Close() })
+
+	return listener
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	UnixSocketScheme = "unix://"
+
+	// unixSocketHost stands in for the host in the URLs of socket targets,
+	// which only matters to the transport, since the client's Host header is
+	// what's sent.
+	unixSocketHost = "localhost"
+)
+
+var ErrorInvalidUnixSocketPath = errors.New("unix socket targets must have an absolute path, like unix:///var/run/app.sock")
+
+// Private
+
+// unixSocketPath returns the path of a target given as unix://<path>, for
+// targets in co-located containers that listen on a shared socket.
+func unixSocketPath(targetURL string) (string, bool) {
+	return strings.CutPrefix(targetURL, UnixSocketScheme)
+}
+
+func dialUnixSocket(path string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarget_UnixSocket(t *testing.T) {
+	path := testUnixSocketBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	})
+
+	target, err := NewTarget(UnixSocketScheme+path, defaultTargetOptions)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "app.example.com", w.Body.String())
+
+	assert.NoError(t, target.ProbeHealth())
+	assert.True(t, target.IsReachable(time.Second))
+}
+
+func TestTarget_UnixSocketMustBeAbsolute(t *testing.T) {
+	_, err := NewTarget("unix://var/run/app.sock", defaultTargetOptions)
+	assert.ErrorIs(t, err, ErrorInvalidUnixSocketPath)
+}
+
+func TestRouter_DeployToUnixSocket(t *testing.T) {
+	router := testRouter(t)
+	path := testUnixSocketBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+	})
+
+	require.NoError(t, router.SetServiceTarget("service1", defaultEmptyHosts, UnixSocketScheme+path, defaultServiceOptions, defaultTargetOptions, DefaultDeployTimeout, DefaultDrainTimeout))
+
+	statusCode, body := sendGETRequest(router, "http://example.com/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "first", body)
+}
+
+// Private
+
+func testUnixSocketBackend(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+
+	// Socket paths are limited to around 100 bytes, which test directories
+	// can exceed, so we use a shorter one.
+	dir, err := os.MkdirTemp("", "kamal-proxy")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "app.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return path
+}
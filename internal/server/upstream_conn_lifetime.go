@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// expiringConn is a connection to a target that should stop being reused once
+// it is older than its lifetime, so that pooled connections don't keep
+// sending traffic to a host that DNS or a container rotation has moved away
+// from.
+type expiringConn struct {
+	net.Conn
+	expires time.Time
+}
+
+func (c *expiringConn) expired() bool {
+	return time.Now().After(c.expires)
+}
+
+// Private
+
+func withConnMaxLifetime(dial dialContextFunc, lifetime time.Duration) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &expiringConn{Conn: conn, expires: time.Now().Add(lifetime)}, nil
+	}
+}
+
+// closeExpiredConnections arranges for a request to be the last one sent on
+// its connection, if that connection has expired. The transport hands us the
+// connection before writing the request, so it will ask the target to close
+// the connection, and discard it once the response has been read. This way,
+// requests that are already in progress are never interrupted.
+//
+// The transport sends a copy of requests that have a body, which shares their
+// headers but not their Close field, so it's the Connection header that makes
+// sure the target is asked to close.
+func closeExpiredConnections(req *http.Request) *http.Request {
+	var traced *http.Request
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conn, ok := expiringConnFrom(info.Conn); ok && conn.expired() {
+				traced.Close = true
+				traced.Header.Set("Connection", "close")
+			}
+		},
+	}
+
+	traced = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return traced
+}
+
+// expiringConnFrom finds the connection that was dialed for a target, beneath
+// any TLS that the transport has added.
+func expiringConnFrom(conn net.Conn) (*expiringConn, bool) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	expiring, ok := conn.(*expiringConn)
+	return expiring, ok
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+const upstreamErrorHeader = "X-Kamal-Upstream-Error"
+
+const (
+	UpstreamErrorTimeout           = "timeout"
+	UpstreamErrorDraining          = "draining"
+	UpstreamErrorConnectionRefused = "connection_refused"
+	UpstreamErrorConnectionReset   = "connection_reset"
+	UpstreamErrorDNS               = "dns"
+	UpstreamErrorTLS               = "tls"
+	UpstreamErrorOther             = "other"
+)
+
+// upstreamErrorCategory sorts a proxying error into one of a few broad
+// categories. Only the category is ever shown to clients; the error itself
+// can include addresses and other details of the internal network.
+func upstreamErrorCategory(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var recordHeaderErr tls.RecordHeaderError
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+
+	switch {
+	case errors.Is(err, ErrorDraining):
+		return UpstreamErrorDraining
+	case errors.As(err, &dnsErr):
+		return UpstreamErrorDNS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return UpstreamErrorTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return UpstreamErrorConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return UpstreamErrorConnectionReset
+	case errors.As(err, &recordHeaderErr), errors.As(err, &verificationErr), errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr):
+		return UpstreamErrorTLS
+	}
+	return UpstreamErrorOther
+}
+
+// exposeUpstreamError tells the client why the target couldn't be reached,
+// when the target is configured to. This is meant for development and staging
+// environments, where it saves a trip to the proxy's logs.
+func (t *Target) exposeUpstreamError(w http.ResponseWriter, err error) {
+	if t.options.ExposeUpstreamErrors {
+		w.Header().Set(upstreamErrorHeader, upstreamErrorCategory(err))
+	}
+}
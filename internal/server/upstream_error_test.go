@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamErrorCategory(t *testing.T) {
+	dialErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+
+	assert.Equal(t, UpstreamErrorDraining, upstreamErrorCategory(fmt.Errorf("cancelled: %w", ErrorDraining)))
+	assert.Equal(t, UpstreamErrorDNS, upstreamErrorCategory(dialErr(&net.DNSError{Err: "no such host", Name: "web-1", IsNotFound: true})))
+	assert.Equal(t, UpstreamErrorDNS, upstreamErrorCategory(dialErr(&net.DNSError{Err: "timeout", IsTimeout: true})), "DNS errors are reported as DNS, even when they time out")
+	assert.Equal(t, UpstreamErrorConnectionRefused, upstreamErrorCategory(dialErr(syscall.ECONNREFUSED)))
+	assert.Equal(t, UpstreamErrorConnectionReset, upstreamErrorCategory(dialErr(syscall.ECONNRESET)))
+	assert.Equal(t, UpstreamErrorConnectionReset, upstreamErrorCategory(io.ErrUnexpectedEOF))
+	assert.Equal(t, UpstreamErrorOther, upstreamErrorCategory(errors.New("malformed HTTP response \"secret\"")))
+}
+
+func TestTarget_ExposeUpstreamErrors(t *testing.T) {
+	targetOptions := defaultTargetOptions
+	targetOptions.ExposeUpstreamErrors = true
+
+	target, err := NewTarget(testUnusedAddress(t), targetOptions)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.Equal(t, UpstreamErrorConnectionRefused, w.Result().Header.Get("X-Kamal-Upstream-Error"))
+}
+
+func TestTarget_ExposeUpstreamErrorsOnTimeout(t *testing.T) {
+	targetOptions := defaultTargetOptions
+	targetOptions.ResponseTimeout = 50 * time.Millisecond
+	targetOptions.ExposeUpstreamErrors = true
+
+	target := testTargetWithOptions(t, targetOptions, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Result().StatusCode)
+	assert.Equal(t, UpstreamErrorTimeout, w.Result().Header.Get("X-Kamal-Upstream-Error"))
+}
+
+func TestTarget_UpstreamErrorsNotExposedByDefault(t *testing.T) {
+	target, err := NewTarget(testUnusedAddress(t), defaultTargetOptions)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	testServeRequestWithTarget(t, target, w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.Empty(t, w.Result().Header.Get("X-Kamal-Upstream-Error"))
+}
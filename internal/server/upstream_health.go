@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamHealthCacheTTL is how long a successful check is reused for, so
+// that monitors polling the upstreams endpoint don't multiply the load on
+// each target's health check path. Failures are reused for less time, so
+// that recovery is noticed quickly, but long enough that the endpoint can't
+// be used to flood a struggling target with checks.
+const (
+	upstreamHealthCacheTTL  = 5 * time.Second
+	upstreamFailureCacheTTL = 2 * time.Second
+)
+
+type TargetHealth struct {
+	Target    string    `json:"target"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	Since     time.Time `json:"since"`
+}
+
+type UpstreamHealth struct {
+	Healthy  bool                    `json:"healthy"`
+	Services map[string]TargetHealth `json:"services,omitempty"`
+}
+
+// targetHealthCache holds the most recent health check result for a target.
+type targetHealthCache struct {
+	lock   sync.Mutex
+	health TargetHealth
+}
+
+// UpstreamHealth reports the health of each service's active target, reusing
+// recent results.
+func (r *Router) UpstreamHealth() UpstreamHealth {
+	targets := map[string]*Target{}
+	r.withReadLock(func() error {
+		for name, service := range r.services {
+			if target := service.ActiveTarget(); target != nil {
+				targets[name] = target
+			}
+		}
+		return nil
+	})
+
+	var lock sync.Mutex
+	result := UpstreamHealth{Healthy: true, Services: map[string]TargetHealth{}}
+
+	checks := []func(){}
+	for name, target := range targets {
+		checks = append(checks, func() {
+			health := target.CachedHealth(upstreamHealthCacheTTL, upstreamFailureCacheTTL)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			result.Services[name] = health
+			result.Healthy = result.Healthy && health.Healthy
+		})
+	}
+	PerformConcurrently(checks...)
+
+	return result
+}
+
+// LastModified is the most recent time that any target's health changed.
+func (h UpstreamHealth) LastModified() time.Time {
+	var latest time.Time
+	for _, health := range h.Services {
+		if health.Since.After(latest) {
+			latest = health.Since
+		}
+	}
+	return latest
+}
+
+// ETag identifies the reported health, ignoring when it was last checked, so
+// that it only changes when the health of a target does.
+func (h UpstreamHealth) ETag() string {
+	unchecked := UpstreamHealth{Healthy: h.Healthy, Services: map[string]TargetHealth{}}
+	for name, health := range h.Services {
+		health.CheckedAt = time.Time{}
+		unchecked.Services[name] = health
+	}
+
+	data, _ := json.Marshal(unchecked)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// CachedHealth returns the target's last health check result if it's no
+// older than ttl, or failureTTL for a failed check, and otherwise checks it
+// again. The lock is held while checking, so callers that arrive during a
+// check wait for its result rather than starting another.
+func (t *Target) CachedHealth(ttl time.Duration, failureTTL time.Duration) TargetHealth {
+	t.healthCache.lock.Lock()
+	defer t.healthCache.lock.Unlock()
+
+	now := time.Now()
+	last := t.healthCache.health
+	if !last.Healthy {
+		ttl = failureTTL
+	}
+	if !last.CheckedAt.IsZero() && now.Sub(last.CheckedAt) < ttl {
+		return last
+	}
+
+	health := TargetHealth{Target: t.Target(), Healthy: true, CheckedAt: now, Since: last.Since}
+	if err := t.ProbeHealth(); err != nil {
+		health.Healthy = false
+		health.Error = err.Error()
+	}
+
+	if last.CheckedAt.IsZero() || health.Healthy != last.Healthy || health.Error != last.Error {
+		health.Since = now
+	}
+
+	t.healthCache.health = health
+	return health
+}
+
+// Private
+
+// isNotModified reports whether a conditional request already has the
+// current version of a response.
+func isNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	WebSocketCloseServiceRestart = 1012
+
+	webSocketDrainCloseReason  = "draining"
+	webSocketCloseFrameTimeout = time.Second
+)
+
+// IsValidWebSocketDrainCloseCode reports whether a close code can be sent to
+// clients when draining. Codes 1005, 1006 and 1015 are reserved for reporting
+// problems locally, and must never be sent.
+func IsValidWebSocketDrainCloseCode(code int) bool {
+	if code < 1000 || code > 4999 {
+		return false
+	}
+	return code != 1004 && code != 1005 && code != 1006 && code != 1015
+}
+
+// webSocketDrainConn sends the client a WebSocket close frame when its
+// connection is closed because the target is draining. Without one, the
+// connection just drops, which clients treat like a crash and back off
+// before reconnecting. With a code such as 1012 (Service Restart), they know
+// they can reconnect straight away, and will reach the new target.
+//
+// The frame is only sent once the proxy has stopped copying from the target,
+// so it can't interrupt a message.
+type webSocketDrainConn struct {
+	net.Conn
+	ctx  context.Context
+	code int
+}
+
+func newWebSocketDrainConn(conn net.Conn, ctx context.Context, code int) *webSocketDrainConn {
+	return &webSocketDrainConn{Conn: conn, ctx: ctx, code: code}
+}
+
+func (c *webSocketDrainConn) Close() error {
+	if errors.Is(context.Cause(c.ctx), ErrorDraining) {
+		c.Conn.SetWriteDeadline(time.Now().Add(webSocketCloseFrameTimeout))
+		c.Conn.Write(webSocketCloseFrame(c.code, webSocketDrainCloseReason))
+	}
+	return c.Conn.Close()
+}
+
+// Private
+
+// webSocketCloseFrame builds a close frame as sent by a server, which is
+// unmasked. The reason must be short enough to fit in a control frame.
+func webSocketCloseFrame(code int, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+
+	return append([]byte{0x88, byte(len(payload))}, payload...)
+}
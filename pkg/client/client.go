@@ -0,0 +1,216 @@
+// Package client talks to a running kamal-proxy over its command socket.
+//
+// It wraps the proxy's RPC interface with typed methods, so that tools like
+// Kamal can control the proxy without constructing RPC calls by hand.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+type (
+	DeployArgs         = server.DeployArgs
+	RemoveArgs         = server.RemoveArgs
+	PauseArgs          = server.PauseArgs
+	StopArgs           = server.StopArgs
+	ResumeArgs         = server.ResumeArgs
+	HostsArgs          = server.HostsArgs
+	CertsStatusArgs    = server.CertsStatusArgs
+	RolloutDeployArgs  = server.RolloutDeployArgs
+	RolloutSetArgs     = server.RolloutSetArgs
+	RolloutStopArgs    = server.RolloutStopArgs
+	RolloutOptions     = server.RolloutOptions
+	ServiceOptions     = server.ServiceOptions
+	TargetOptions      = server.TargetOptions
+	HealthCheckConfig  = server.HealthCheckConfig
+	ServiceDescription = server.ServiceDescription
+
+	HostCertificateStatus = server.HostCertificateStatus
+)
+
+var (
+	ErrServiceNotFound = server.ErrorServiceNotFound
+	ErrHostInUse       = server.ErrorHostInUse
+	ErrDeployTimeout   = server.ErrorTargetFailedToBecomeHealthy
+
+	ErrStateNotPersisted   = server.ErrorStateNotPersisted
+	ErrTargetNotResolvable = server.ErrorTargetNotResolvable
+	ErrInvalidDeployArgs   = server.ErrorInvalidDeployArgs
+)
+
+// knownErrors are errors that the proxy may return, which we turn back into
+// their original values. Errors only keep their message when sent over RPC.
+var knownErrors = []error{
+	ErrServiceNotFound,
+	ErrHostInUse,
+	ErrDeployTimeout,
+	ErrStateNotPersisted,
+	ErrTargetNotResolvable,
+	ErrInvalidDeployArgs,
+	server.ErrorRolloutTargetNotSet,
+}
+
+type Client struct {
+	rpc *rpc.Client
+}
+
+// DefaultSocketPath is where the proxy listens for commands, unless it has
+// been configured otherwise.
+func DefaultSocketPath() string {
+	return server.Config{}.SocketPath()
+}
+
+// Dial connects to the proxy listening on socketPath.
+func Dial(ctx context.Context, socketPath string) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{rpc: rpc.NewClient(conn)}, nil
+}
+
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+// Deploy sends traffic for a service to a new target, once it is healthy.
+// Timeouts and health check settings left at zero take the same defaults as
+// the deploy command, and options the proxy can't use are rejected with
+// ErrInvalidDeployArgs.
+func (c *Client) Deploy(ctx context.Context, args DeployArgs) error {
+	var reply bool
+	return c.call(ctx, "kamal-proxy.Deploy", args, &reply)
+}
+
+func (c *Client) Remove(ctx context.Context, service string) error {
+	var reply bool
+	return c.call(ctx, "kamal-proxy.Remove", RemoveArgs{Service: service}, &reply)
+}
+
+func (c *Client) Pause(ctx context.Context, args PauseArgs) error {
+	var reply bool
+	return c.call(ctx, "kamal-proxy.Pause", args, &reply)
+}
+
+func (c *Client) Stop(ctx context.Context, args StopArgs) error {
+	var reply bool
+	return c.call(ctx, "kamal-proxy.Stop", args, &reply)
+}
+
+func (c *Client) Resume(ctx context.Context, service string) error {
+	var reply bool
+	return c.call(ctx, "kamal-proxy.Resume", ResumeArgs{Service: service}, &reply)
+}
+
+// AddHosts attaches hosts to a service, without a deploy.
+func (c *Client) AddHosts(ctx context.Context, service string, hosts ...string) error {
+	var reply bool
+	return c.call(ctx, "kamal-proxy.AddHosts", HostsArgs{Service: service, Hosts: hosts}, &reply)
+}
+
+// RemoveHosts detaches hosts from a service, without a deploy.
+func (c *Client) RemoveHosts(ctx context.Context, service string, hosts ...string) error {
+	var reply bool
+	return c.call(ctx, "kamal-proxy.RemoveHosts", HostsArgs{Service: service, Hosts: hosts}, &reply)
+}
+
+func (c *Client) Rollout(ctx context.Context, args RolloutDeployArgs) error {
+	var reply bool
+	return c.call(ctx, "kamal-proxy.RolloutDeploy", args, &reply)
+}
+
+func (c *Client) SetRollout(ctx context.Context, args RolloutSetArgs) error {
+	var reply bool
+	return c.call(ctx, "kamal-proxy.RolloutSet", args, &reply)
+}
+
+func (c *Client) StopRollout(ctx context.Context, service string) error {
+	var reply bool
+	return c.call(ctx, "kamal-proxy.RolloutStop", RolloutStopArgs{Service: service}, &reply)
+}
+
+// List describes each service, keyed by name.
+func (c *Client) List(ctx context.Context) (map[string]ServiceDescription, error) {
+	var reply server.ListResponse
+	err := c.call(ctx, "kamal-proxy.List", true, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Targets, nil
+}
+
+// Status describes a single service.
+func (c *Client) Status(ctx context.Context, service string) (ServiceDescription, error) {
+	services, err := c.List(ctx)
+	if err != nil {
+		return ServiceDescription{}, err
+	}
+
+	description, ok := services[service]
+	if !ok {
+		return ServiceDescription{}, ErrServiceNotFound
+	}
+
+	return description, nil
+}
+
+// CertificateStatuses reports the certificate state of each of a service's
+// hosts.
+func (c *Client) CertificateStatuses(ctx context.Context, service string) ([]HostCertificateStatus, error) {
+	var reply server.CertsStatusResponse
+	err := c.call(ctx, "kamal-proxy.CertsStatus", CertsStatusArgs{Service: service}, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Hosts, nil
+}
+
+// Private
+
+// call makes an RPC call, returning early if the context is done. The proxy
+// carries on with the command regardless, since it can't be told to stop.
+func (c *Client) call(ctx context.Context, method string, args any, reply any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	call := c.rpc.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.Done:
+		return translateError(call.Error)
+	}
+}
+
+func translateError(err error) error {
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+
+	for _, known := range knownErrors {
+		if string(serverErr) == known.Error() {
+			return known
+		}
+
+		// Some errors are wrapped with the details of their cause.
+		if detail, ok := strings.CutPrefix(string(serverErr), known.Error()+": "); ok {
+			return fmt.Errorf("%w: %s", known, detail)
+		}
+	}
+
+	return err
+}
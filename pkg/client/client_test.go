@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/basecamp/kamal-proxy/internal/server"
+)
+
+func TestClient_DeployListAndRemove(t *testing.T) {
+	client := testClient(t)
+	ctx := context.Background()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(backend.Close)
+
+	err := client.Deploy(ctx, DeployArgs{
+		Service:       "app",
+		TargetURL:     strings.TrimPrefix(backend.URL, "http://"),
+		Hosts:         []string{"app.example.com"},
+		DeployTimeout: time.Second,
+		DrainTimeout:  time.Second,
+		TargetOptions: TargetOptions{
+			HealthCheckConfig: HealthCheckConfig{Path: server.DefaultHealthCheckPath, Interval: 50 * time.Millisecond, Timeout: time.Second},
+		},
+	})
+	require.NoError(t, err)
+
+	services, err := client.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "app.example.com", services["app"].Host)
+
+	status, err := client.Status(ctx, "app")
+	require.NoError(t, err)
+	assert.Equal(t, "running", status.State)
+
+	require.NoError(t, client.AddHosts(ctx, "app", "customer1.com"))
+	status, err = client.Status(ctx, "app")
+	require.NoError(t, err)
+	assert.Equal(t, "app.example.com,customer1.com", status.Host)
+
+	require.NoError(t, client.RemoveHosts(ctx, "app", "customer1.com"))
+	status, err = client.Status(ctx, "app")
+	require.NoError(t, err)
+	assert.Equal(t, "app.example.com", status.Host)
+
+	require.NoError(t, client.Remove(ctx, "app"))
+
+	_, err = client.Status(ctx, "app")
+	assert.Equal(t, ErrServiceNotFound, err)
+}
+
+func TestClient_DeployWithDefaultOptions(t *testing.T) {
+	client := testClient(t)
+	ctx := context.Background()
+
+	var healthCheckPath atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthCheckPath.CompareAndSwap(nil, r.URL.Path)
+	}))
+	t.Cleanup(backend.Close)
+
+	err := client.Deploy(ctx, DeployArgs{
+		Service:   "app",
+		TargetURL: strings.TrimPrefix(backend.URL, "http://") + ";health=/healthz",
+	})
+	require.NoError(t, err)
+
+	status, err := client.Status(ctx, "app")
+	require.NoError(t, err)
+	assert.Equal(t, "running", status.State)
+	assert.Equal(t, strings.TrimPrefix(backend.URL, "http://"), status.Target)
+	assert.Equal(t, "/healthz", healthCheckPath.Load())
+}
+
+func TestClient_DeployRejectsInvalidOptions(t *testing.T) {
+	client := testClient(t)
+
+	err := client.Deploy(context.Background(), DeployArgs{
+		Service:   "app",
+		TargetURL: "localhost:3000",
+		TargetOptions: TargetOptions{
+			HealthCheckConfig: HealthCheckConfig{Interval: -time.Second},
+		},
+	})
+	assert.ErrorIs(t, err, ErrInvalidDeployArgs)
+}
+
+func TestClient_ReturnsKnownErrors(t *testing.T) {
+	client := testClient(t)
+
+	err := client.Remove(context.Background(), "missing")
+	assert.Equal(t, ErrServiceNotFound, err)
+}
+
+func TestClient_CallsRespectContext(t *testing.T) {
+	client := testClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := client.List(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// Helpers
+
+func testClient(t *testing.T) *Client {
+	t.Helper()
+
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "kamal-proxy.sock")
+
+	router := server.NewRouter(server.NewFileStateStore(filepath.Join(dir, "state.json")))
+	handler := server.NewCommandHandler(router, server.NewAuditLog(filepath.Join(dir, "audit.log")))
+	require.NoError(t, handler.Start(socketPath))
+	t.Cleanup(func() { handler.Close() })
+
+	client, err := Dial(context.Background(), socketPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestClient_TranslatesWrappedErrors(t *testing.T) {
+	err := translateError(rpc.ServerError(server.ErrorStateNotPersisted.Error() + ": read-only file system"))
+
+	assert.ErrorIs(t, err, ErrStateNotPersisted)
+	assert.Equal(t, server.ErrorStateNotPersisted.Error()+": read-only file system", err.Error())
+
+	err = translateError(rpc.ServerError(server.ErrorServiceNotFound.Error()))
+	assert.Equal(t, ErrServiceNotFound, err)
+}